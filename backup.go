@@ -2,12 +2,15 @@ package block
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"math"
 	"os"
-	"sort"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -21,34 +24,117 @@ const (
 	backupTypeFull         = "full"
 )
 
+// defaultBlockSize is used for full backups when no block size is specified.
+const defaultBlockSize = 4096
+
 type Backup struct {
 	Config         *BackupConfig
 	Record         *BackupRecord
 	lastFullRecord BackupRecord
 	store          *Store
 	vol            *Volume
+	progress       *progressTracker
+	// written is the number of bytes written to the backup file so far.
+	written int64
+	// writeBack reads the backup file back when VerifyWrites is enabled.
+	writeBack io.ReaderAt
+	// wrapTarget optionally wraps the backup file's writer.
+	wrapTarget func(io.Writer) io.Writer
+	// pipelineDepth overrides the number of buffers in flight through runFixed when set.
+	pipelineDepth int
+	// bufferBlocks is the number of blocks runFixed buffered at once, which an adaptive
+	// BlockBufferSize settles on as the backup runs.
+	bufferBlocks int
+	// stats accumulates the counters reported to the Stats callback.
+	stats liveStats
+	// conn is the connection the backup loop's transactions run on when InsertSynchronous is set.
+	conn *sql.Conn
+	// coldStart is set while a backup that started with an empty blocks table tracks the blocks it
+	// inserted in inserted, in place of querying the table for duplicates.
+	coldStart bool
+	inserted  map[string]bool
+	// disableColdStart forces duplicate detection against the blocks table when set.
+	disableColdStart bool
+	// unpositioned holds the hashes of the blocks the last writeBlocks inserted until their
+	// positions are recorded, so Cleanup can remove them if the backup fails in between.
+	unpositioned []string
+	// createdFile is set once the backup has opened its backup file for writing, so Cleanup only
+	// removes files the backup wrote.
+	createdFile bool
+	// hashCache holds the hash at each position of the last full backup when HashCache is enabled
+	// for a differential.
+	hashCache []string
+	// MismatchedBlockSizes lists the block sizes of the store's other backups that differ from
+	// the block size of this full backup. Blocks of a different size never dedup against each
+	// other, so the backup shares no blocks with those backups.
+	MismatchedBlockSizes []int
+	// SourceChanged reports whether DetectChangeDuringBackup found the source changed while it was
+	// being read, with OnSourceChange set to SourceChangeWarn.
+	SourceChanged bool
 }
 
-func NewBackup(cfg *BackupConfig) (*Backup, error) {
-	// Calculate target size in bytes.
-	sizeInBytes, err := GetTargetSizeInBytes(cfg.DevicePath)
+func NewBackup(c *BackupConfig) (*Backup, error) {
+	// Copy the config so defaults resolved for this backup (e.g. the generated file name)
+	// don't leak into subsequent backups created from the same config.
+	cfgCopy := *c
+	cfg := &cfgCopy
+
+	// A zero-block buffer would never advance through the source.
+	if cfg.BlockBufferSize < 1 && cfg.BlockBufferSize != BlockBufferSizeAuto {
+		return nil, fmt.Errorf("block buffer size must be at least 1, got %d", cfg.BlockBufferSize)
+	}
+
+	if cfg.ReadAheadBytes < 0 {
+		return nil, fmt.Errorf("read-ahead must not be negative, got %d", cfg.ReadAheadBytes)
+	}
+
+	if cfg.ReadTimeout < 0 || cfg.ReadRetries < 0 {
+		return nil, fmt.Errorf("read timeout and retries must not be negative, got %s and %d", cfg.ReadTimeout, cfg.ReadRetries)
+	}
+
+	if cfg.FollowSymlinks {
+		resolved, err := filepath.EvalSymlinks(cfg.DevicePath)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving device path %s: %w", cfg.DevicePath, err)
+		}
+		cfg.DevicePath = resolved
+	}
+
+	concurrency, err := resolveConcurrency(cfg.Concurrency, cfg.DevicePath)
 	if err != nil {
 		return nil, err
 	}
+	cfg.Concurrency = concurrency
 
-	if cfg.BlockSize > sizeInBytes {
-		fmt.Fprintf(os.Stderr, "WARNING: block size %d exceeds the size of the backup target %d. This will result in wasted space!", cfg.BlockSize, sizeInBytes)
+	// Calculate target size in bytes.
+	sizeInBytes, err := sourceSizeInBytes(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	// Calculate the total number of blocks for the device.
-	totalBlocks := calculateTotalBlocks(cfg.BlockSize, sizeInBytes)
+	// Find the volume for the device path, or for the filesystem UUID when it's identified by one.
+	uuid, err := sourceUUID(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the filesystem UUID of %s: %w", cfg.DevicePath, err)
+	}
 
-	// Find the volume for the device path.
-	vol, err := resolveVolume(cfg.Store, cfg.DevicePath)
+	var vol *Volume
+	if uuid != "" {
+		vol, err = resolveVolumeByUUID(cfg.Store, cfg.DevicePath, uuid)
+	} else {
+		vol, err = resolveVolume(cfg.Store, cfg.DevicePath)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	// Fill the settings left unset from the volume's defaults.
+	defaults, err := cfg.Store.GetVolumeDefaults(vol.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving volume defaults: %v", err)
+	}
+	defaults.apply(cfg)
+
 	// Find the last full backup record.
 	lastFullRecord, err := cfg.Store.findLastFullBackupRecord(vol.ID)
 	if err != nil && err != sql.ErrNoRows {
@@ -61,30 +147,190 @@ func NewBackup(cfg *BackupConfig) (*Backup, error) {
 		return nil, err
 	}
 
+	// Differentials inherit the block size of their full unless one is specified.
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultBlockSize
+		if backupType == backupTypeDifferential {
+			cfg.BlockSize = lastFullRecord.BlockSize
+			fmt.Fprintf(os.Stderr, "Inheriting block size %d from full backup %d\n", cfg.BlockSize, lastFullRecord.ID)
+		}
+	}
+
+	if cfg.BlockSize > sizeInBytes {
+		fmt.Fprint(os.Stderr, "WARNING: "+oversizedBlockWarning(cfg.BlockSize, sizeInBytes))
+	}
+
+	// Differential positions are layered on those of their full, so they must line up.
+	if backupType == backupTypeDifferential && cfg.BlockSize != lastFullRecord.BlockSize {
+		return nil, fmt.Errorf("block size %d does not match the block size %d of the last full backup %d", cfg.BlockSize, lastFullRecord.BlockSize, lastFullRecord.ID)
+	}
+
+	// Calculate the total number of blocks for the device.
+	totalBlocks := calculateTotalBlocks(cfg.BlockSize, sizeInBytes)
+
+	switch cfg.Chunking {
+	case "":
+		cfg.Chunking = ChunkingFixed
+	case ChunkingFixed, ChunkingContentDefined:
+	default:
+		return nil, fmt.Errorf("chunking %q is not supported", cfg.Chunking)
+	}
+
+	if cfg.BlockBufferSize == BlockBufferSizeAuto && cfg.Chunking != ChunkingFixed {
+		return nil, fmt.Errorf("adaptive block buffer sizing is not supported with %q chunking", cfg.Chunking)
+	}
+
+	if cfg.RequireAlignedSource && cfg.Chunking == ChunkingFixed && sizeInBytes%cfg.BlockSize != 0 {
+		return nil, fmt.Errorf("source size %d is not a multiple of the block size %d, leaving a partial final block of %d bytes", sizeInBytes, cfg.BlockSize, sizeInBytes%cfg.BlockSize)
+	}
+
+	if backupType == backupTypeDifferential && lastFullRecord.Chunking != cfg.Chunking {
+		return nil, fmt.Errorf("chunking %q does not match the %q chunking of the last full backup", cfg.Chunking, lastFullRecord.Chunking)
+	}
+
+	if cfg.HashSample && cfg.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("hash sampling is not supported with %q chunking", cfg.Chunking)
+	}
+
+	if cfg.VerifyWrites && (cfg.OutputFormat != BackupOutputFormatFile || len(cfg.FilterCommand) > 0 || cfg.Chunking == ChunkingContentDefined) {
+		return nil, fmt.Errorf("write verification requires %q output with fixed chunking and no filter command", BackupOutputFormatFile)
+	}
+
+	if cfg.MerkleTree && cfg.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("merkle trees are not supported with %q chunking", cfg.Chunking)
+	}
+
+	switch cfg.InsertSynchronous {
+	case "", SynchronousOff, SynchronousNormal, SynchronousFull, SynchronousExtra:
+	default:
+		return nil, fmt.Errorf("synchronous mode %q is not supported", cfg.InsertSynchronous)
+	}
+
+	switch cfg.OnSourceChange {
+	case "":
+		cfg.OnSourceChange = SourceChangeFail
+	case SourceChangeFail, SourceChangeWarn:
+	default:
+		return nil, fmt.Errorf("source change policy %q is not supported", cfg.OnSourceChange)
+	}
+
+	if cfg.EncodePositionRanges && cfg.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("position range encoding is not supported with %q chunking", cfg.Chunking)
+	}
+
+	if cfg.HashCache && cfg.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("hash caching is not supported with %q chunking", cfg.Chunking)
+	}
+
+	if backupType == backupTypeDifferential && lastFullRecord.HashSample != cfg.HashSample {
+		return nil, fmt.Errorf("hash sampling (%t) does not match the hash sampling (%t) of the last full backup", cfg.HashSample, lastFullRecord.HashSample)
+	}
+
+	// Differentials inherit the hash algorithm of their full unless one is specified.
+	switch cfg.HashAlgorithm {
+	case "":
+		cfg.HashAlgorithm = HashAlgorithmXXHash64
+		if backupType == backupTypeDifferential {
+			cfg.HashAlgorithm = lastFullRecord.HashAlgorithm
+		}
+	case HashAlgorithmXXHash64, HashAlgorithmSHA256:
+	default:
+		return nil, fmt.Errorf("hash algorithm %q is not supported", cfg.HashAlgorithm)
+	}
+
+	if backupType == backupTypeDifferential && lastFullRecord.HashAlgorithm != cfg.HashAlgorithm {
+		return nil, fmt.Errorf("hash algorithm %q does not match the %q hash algorithm of the last full backup", cfg.HashAlgorithm, lastFullRecord.HashAlgorithm)
+	}
+
+	if cfg.HashSample && cfg.HashAlgorithm != HashAlgorithmXXHash64 {
+		return nil, fmt.Errorf("hash sampling is not supported with the %q hash algorithm", cfg.HashAlgorithm)
+	}
+
+	// Refuse to build a differential on top of a full backup that can't be restored.
+	if backupType == backupTypeDifferential {
+		if err := verifyParentChain(cfg.Store, lastFullRecord); err != nil {
+			return nil, err
+		}
+	}
+
 	// Trim the last slash from the output directory.
 	if cfg.OutputDirectory != "" {
 		cfg.OutputDirectory = strings.TrimRight(cfg.OutputDirectory, "/")
 	}
 
+	onExisting := cfg.OnExisting
 	if cfg.OutputFileName == "" {
 		cfg.OutputFileName = generateBackupName(vol, backupType)
+
+		// Generated names only collide when backups start within the same millisecond.
+		onExisting = ExistingFileRename
 	}
 
 	fullPath := fmt.Sprintf("%s/%s", cfg.OutputDirectory, cfg.OutputFileName)
 
+	if cfg.OutputFormat == BackupOutputFormatFile {
+		fullPath, err = resolveOutputPath(fullPath, onExisting)
+		if err != nil {
+			return nil, err
+		}
+		cfg.OutputFileName = filepath.Base(fullPath)
+	}
+
 	// TODO - Consider storing a checksum of the target volume, so we can verify at restore time.
-	br, err := cfg.Store.insertBackupRecord(vol.ID, cfg.OutputFileName, fullPath, string(cfg.OutputFormat), backupType, totalBlocks, cfg.BlockSize, sizeInBytes)
+	br, err := cfg.Store.insertBackupRecord(vol.ID, cfg.OutputFileName, fullPath, string(cfg.OutputFormat), backupType, totalBlocks, cfg.BlockSize, sizeInBytes, cfg.Chunking)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Backup{
+	// Record where the backup came from, as the volume's device path may change over time.
+	br.SourcePath, br.SourceInode = sourceIdentity(cfg.DevicePath)
+	if err := cfg.Store.updateBackupSource(br.ID, br.SourcePath, br.SourceInode); err != nil {
+		return nil, err
+	}
+
+	if cfg.AppVersion != "" {
+		br.AppVersion = cfg.AppVersion
+		if err := cfg.Store.updateBackupAppVersion(br.ID, cfg.AppVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	br.HashAlgorithm = cfg.HashAlgorithm
+	if cfg.HashAlgorithm != HashAlgorithmXXHash64 {
+		if err := cfg.Store.updateBackupHashAlgorithm(br.ID, cfg.HashAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.HashSample {
+		fmt.Fprintln(os.Stderr, "WARNING: hash sampling is enabled. Changes outside the sampled regions of a block will not be detected!")
+		br.HashSample = true
+		if err := cfg.Store.updateBackupHashSample(br.ID, true); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &Backup{
 		Record:         &br,
 		Config:         cfg,
 		vol:            vol,
 		store:          cfg.Store,
 		lastFullRecord: lastFullRecord,
-	}, nil
+	}
+
+	// A full taken at a new block size shares the blocks table without deduplicating against it.
+	if backupType == backupTypeFull && cfg.Chunking == ChunkingFixed {
+		b.MismatchedBlockSizes, err = cfg.Store.mismatchedBlockSizes(br)
+		if err != nil {
+			return nil, fmt.Errorf("error checking the block sizes of other backups: %v", err)
+		}
+
+		if len(b.MismatchedBlockSizes) > 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: block size %d differs from the block sizes %v of other backups in the store. Their blocks will not be deduplicated against this backup!\n", cfg.BlockSize, b.MismatchedBlockSizes)
+		}
+	}
+
+	return b, nil
 }
 
 func (b *Backup) TotalBlocks() int {
@@ -111,75 +357,446 @@ func (b *Backup) SizeInBytes() int {
 	return b.Record.SizeInBytes
 }
 
+// Run performs the backup. The PreHook runs before the source is opened, and the backup is
+// aborted if it fails. Once the PreHook succeeds, the PostHook runs after the source is closed,
+// even if the backup fails. A failed backup is recorded with its error (see Store.LastError). A
+// PostHook error is still returned once the backup completed, but the backup stays completed.
 func (b *Backup) Run() error {
+	err := b.runWithHooks()
+	if err != nil && b.Record.Status != backupStatusCompleted {
+		// Record the failure, so it can be investigated after the error is gone.
+		if markErr := b.store.markBackupFailed(b.Record.ID, err); markErr != nil {
+			return fmt.Errorf("%w (recording the failure also failed: %v)", err, markErr)
+		}
+		b.Record.Status = backupStatusFailed
+		b.Record.ErrorMessage = err.Error()
+	}
+
+	return err
+}
+
+func (b *Backup) runWithHooks() error {
+	if b.Config.PreHook != nil {
+		if err := b.Config.PreHook(); err != nil {
+			return fmt.Errorf("pre-hook failed, aborting backup: %w", err)
+		}
+	}
+
+	err := b.run()
+
+	if b.Config.PostHook != nil {
+		if hookErr := b.Config.PostHook(); hookErr != nil {
+			if err != nil {
+				return fmt.Errorf("%w (post-hook also failed: %v)", err, hookErr)
+			}
+			return fmt.Errorf("post-hook failed: %w", hookErr)
+		}
+	}
+
+	return err
+}
+
+func (b *Backup) run() error {
+	startTime := time.Now()
+
 	// Open the device for reading.
-	sourceFile, err := os.Open(b.vol.DevicePath)
+	source, closeSource, err := b.openSource()
 	if err != nil {
 		return err
 	}
-	defer func() { _ = sourceFile.Close() }()
+	defer closeSource()
 
 	// Open the backup file for writing.
 	var targetFile *os.File
 	switch b.Config.OutputFormat {
 	case BackupOutputFormatFile:
-		targetFile, err = os.OpenFile(b.FullPath(), os.O_CREATE|os.O_WRONLY, 0644)
+		targetFile, err = openOutputFile(b.FullPath(), b.Config.OnExisting)
 		if err != nil {
 			return fmt.Errorf("error opening restore file: %v", err)
 		}
+		b.createdFile = true
 	case BackupOutputFormatSTDOUT:
 		targetFile = os.Stdout
 	}
 
 	defer func() { _ = targetFile.Close() }()
 
-	// Create a buffer to store the block hashes.
-	// The number of hashes we buffer before writing to the database.
-	bufSize := b.Config.BlockBufferSize * b.Config.BlockSize
+	// Read the backup file through its own handle, so written blocks can be verified.
+	if b.Config.VerifyWrites {
+		writeBack, err := os.Open(b.FullPath())
+		if err != nil {
+			return fmt.Errorf("error opening backup file for verification: %v", err)
+		}
+		defer func() { _ = writeBack.Close() }()
+		b.writeBack = writeBack
+	}
+
+	// Pipe the backup stream through the filter command if one is configured.
+	var target io.Writer = targetFile
+	var filter *filterWriter
+	if len(b.Config.FilterCommand) > 0 {
+		filter, err = newFilterWriter(b.Config.FilterCommand, targetFile)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = filter.Close() }()
+		target = filter
+	}
 
-	// The number of individual blocks we can store in the buffer.
-	bufCapacity := bufSize / b.Config.BlockSize
+	// Count the bytes of the stream before they're filtered, for the backup's logical size.
+	logical := &countingWriter{Writer: target}
+	target = logical
 
-	// The current iteration we are on.
-	iteration := 0
+	if b.wrapTarget != nil {
+		target = b.wrapTarget(target)
+	}
 
-	// Seek to the beginning of the file.
-	_, err = sourceFile.Seek(0, io.SeekStart)
-	if err != nil {
+	// Track the number of blocks hashed across the hashing workers.
+	b.progress = newProgressTracker(b.Config.Progress, b.TotalBlocks())
+
+	stopStats := b.startStats(startTime)
+	defer stopStats()
+
+	var snapshot sourceSnapshot
+	if b.Config.DetectChangeDuringBackup {
+		snapshot, err = b.snapshotSource(source)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.Config.HashCache && b.BackupType() == backupTypeDifferential {
+		if err := b.loadHashCache(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.runLoop(source, target); err != nil {
 		return err
 	}
 
+	if b.Config.DetectChangeDuringBackup {
+		if err := b.checkSourceChange(source, snapshot); err != nil {
+			return err
+		}
+	}
+
+	if b.Config.EncodePositionRanges {
+		if err := b.store.encodePositionRanges(b.Record.ID); err != nil {
+			return err
+		}
+	}
+
+	// Confirm a position was recorded for every block, catching reads that silently stopped short.
+	if b.BackupType() == backupTypeFull {
+		if err := b.verifyPositionCount(); err != nil {
+			return err
+		}
+	}
+
+	// Append the footer that lets the backup file be recovered without the store. Filtered
+	// files are skipped, as the filter must be reversed before the data can be read.
+	if b.Config.OutputFormat == BackupOutputFormatFile && filter == nil {
+		dataLength, err := targetFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("error getting backup data length: %v", err)
+		}
+
+		if err := b.writeFooter(target, dataLength); err != nil {
+			return err
+		}
+	}
+
+	// Wait for the filter to flush its output before sizing the backup.
+	if filter != nil {
+		if err := filter.Close(); err != nil {
+			return err
+		}
+	}
+
+	s, err := GetTargetSizeInBytes(b.FullPath())
+	if err != nil {
+		return fmt.Errorf("error getting backup size: %v", err)
+	}
+
+	b.Record.SizeInBytes = s
+
+	b.Record.LogicalSizeInBytes = int(logical.n)
+	b.Record.PhysicalSizeInBytes = s
+	if err := b.store.updateBackupSizes(b.Record.ID, b.Record.LogicalSizeInBytes, b.Record.PhysicalSizeInBytes); err != nil {
+		return fmt.Errorf("error recording backup size: %v", err)
+	}
+
+	// Record how long the backup took so future backups can be estimated.
+	b.Record.Duration = time.Since(startTime)
+	if err := b.store.updateBackupDuration(b.Record.ID, b.Record.Duration); err != nil {
+		return fmt.Errorf("error recording backup duration: %v", err)
+	}
+
+	if b.Config.MerkleTree {
+		root, err := b.store.computeMerkleRoot(*b.Record)
+		if err != nil {
+			return fmt.Errorf("error building merkle tree: %v", err)
+		}
+		b.Record.MerkleRoot = root
+	}
+
+	if b.Config.HashCache && b.BackupType() == backupTypeFull {
+		if _, err := b.store.updateHashCache(b.vol.ID, *b.Record); err != nil {
+			return err
+		}
+	}
+
+	if err := b.store.updateBackupStatus(b.Record.ID, backupStatusCompleted); err != nil {
+		return fmt.Errorf("error recording backup status: %v", err)
+	}
+	b.Record.Status = backupStatusCompleted
+
+	if err := b.store.TouchVolume(b.vol.ID); err != nil {
+		return fmt.Errorf("error recording volume backup time: %v", err)
+	}
+
+	b.progress.finish()
+
+	return nil
+}
+
+// runLoop reads, hashes and records the source's blocks according to the backup's chunking, with
+// InsertSynchronous applied to the transactions inserting them.
+func (b *Backup) runLoop(source io.ReaderAt, target io.Writer) (err error) {
+	// Checked before a connection is reserved, as the check runs outside the loop's transactions.
+	if b.Record.Chunking == ChunkingFixed {
+		if err := b.startColdStart(); err != nil {
+			return err
+		}
+		defer b.endColdStart()
+	}
+
+	if b.Config.InsertSynchronous != "" {
+		conn, restore, err := b.store.synchronousConn(b.Config.InsertSynchronous)
+		if err != nil {
+			return fmt.Errorf("error setting synchronous mode %s: %v", b.Config.InsertSynchronous, err)
+		}
+		b.conn = conn
+
+		defer func() {
+			b.conn = nil
+			if restoreErr := restore(); restoreErr != nil && err == nil {
+				err = fmt.Errorf("error restoring synchronous mode: %v", restoreErr)
+			}
+		}()
+	}
+
+	switch b.Record.Chunking {
+	case ChunkingContentDefined:
+		return b.runContentDefined(source, target)
+	default:
+		return b.runFixed(source, target)
+	}
+}
+
+// begin starts a transaction of the backup loop.
+func (b *Backup) begin() (*sql.Tx, error) {
+	if b.conn != nil {
+		return b.conn.BeginTx(context.Background(), nil)
+	}
+
+	return b.store.Begin()
+}
+
+// verifyParentChain confirms the full backup a differential is layered on is still present and
+// intact. Only completed full backups are considered parents. The files of backups cataloged on
+// remote storage aren't checked.
+func verifyParentChain(store *Store, parent BackupRecord) error {
+	if parent.OutputFormat == string(BackupOutputFormatFile) && parent.RemoteKey == "" {
+		if _, err := os.Stat(parent.FullPath); err != nil {
+			return fmt.Errorf("backup chain is broken: full backup %d file is missing: %v", parent.ID, err)
+		}
+	}
+
+	positions, err := store.countPositions(parent.ID)
+	if err != nil {
+		return fmt.Errorf("error counting block positions: %v", err)
+	}
+
+	if positions != parent.TotalBlocks {
+		return fmt.Errorf("backup chain is broken: full backup %d recorded %d of %d block positions", parent.ID, positions, parent.TotalBlocks)
+	}
+
+	return nil
+}
+
+// verifyPositionCount confirms the number of distinct positions recorded matches TotalBlocks.
+func (b *Backup) verifyPositionCount() error {
+	positions, err := b.store.countPositions(b.Record.ID)
+	if err != nil {
+		return fmt.Errorf("error counting block positions: %v", err)
+	}
+
+	if positions != b.TotalBlocks() {
+		return fmt.Errorf("full backup recorded %d of %d block positions", positions, b.TotalBlocks())
+	}
+
+	return nil
+}
+
+// maxPipelineBuffers caps the number of buffers in flight through the backup pipeline, so large
+// BlockBufferSize values don't multiply memory use.
+const maxPipelineBuffers = 4
+
+// pipelineBuffers returns the number of buffers runFixed has in flight at once.
+func pipelineBuffers(blockBufferSize, concurrency int) int {
+	maxDepth := blockBufferSize
+	if blockBufferSize == BlockBufferSizeAuto {
+		maxDepth = maxPipelineBuffers
+	}
+
+	if concurrency > 0 {
+		return min(maxDepth, concurrency)
+	}
+
+	return min(maxDepth, maxPipelineBuffers)
+}
+
+// bufferedRead is a buffer read from the source, passed through the stages of the backup pipeline.
+type bufferedRead struct {
+	// start is the position of the buffer's first block.
+	start      int
+	bufEntries int
+	data       []byte
+	// hashes holds the hash of each block in the buffer, indexed by its offset in the buffer.
+	hashes []string
+	err    error
+}
+
+// runFixed reads the source in fixed-size blocks, writing new blocks to the target.
+// Reading, hashing and writing run as a pipeline, so the next buffer is read while the
+// current one is hashed and written. Buffers are written in the order they were read.
+func (b *Backup) runFixed(source io.ReaderAt, target io.Writer) error {
+	// The number of individual blocks we buffer before writing to the database.
+	sizer := newBufferSizer(b.Config.BlockBufferSize, b.Config.BlockSize)
+
+	// The number of buffers that may be read, hashed or written at once.
+	depth := pipelineBuffers(b.Config.BlockBufferSize, b.Config.Concurrency)
+	if b.pipelineDepth > 0 {
+		depth = b.pipelineDepth
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Each buffer holds a slot from reading until its positions are recorded.
+	slots := make(chan struct{}, depth)
+	reads := make(chan bufferedRead)
+	hashed := make(chan bufferedRead)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(reads)
+		b.readBuffers(source, sizer, slots, reads, done)
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer close(hashed)
+		for buf := range reads {
+			if buf.err == nil {
+				buf.hashes = b.hashBufferedData(buf.bufEntries, buf.data)
+			}
+
+			select {
+			case hashed <- buf:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for buf := range hashed {
+		if buf.err != nil {
+			return buf.err
+		}
+
+		// Insert the new blocks into the database and write them to the backup file.
+		if err := b.writeBlocks(target, buf.start, buf.data, buf.hashes); err != nil {
+			return err
+		}
+
+		// Insert the block positions into the database.
+		if err := b.insertBlockPositionsTransaction(buf.start, buf.hashes); err != nil {
+			return err
+		}
+		b.unpositioned = nil
+
+		<-slots
+	}
+
+	return nil
+}
+
+// readBuffers reads the source sequentially into buffers of the sizer's size, sending each to
+// reads. A slot is acquired for each buffer before it's read. Read errors are sent as the final
+// buffer.
+func (b *Backup) readBuffers(source io.ReaderAt, sizer *bufferSizer, slots chan struct{}, reads chan<- bufferedRead, done <-chan struct{}) {
+	send := func(buf bufferedRead) bool {
+		select {
+		case reads <- buf:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
 	endOfFile := int64(b.SizeInBytes())
 
-	// Create a buffered reader to read the source file.
-	reader := bufio.NewReaderSize(sourceFile, bufSize)
+	// Create a buffered reader to read the source file. The read-ahead defaults to one buffer.
+	readAhead := sizer.blocks * b.Config.BlockSize
+	if b.Config.ReadAheadBytes > 0 {
+		readAhead = b.Config.ReadAheadBytes
+	}
+	reader := bufio.NewReaderSize(io.NewSectionReader(source, 0, endOfFile), readAhead)
 
 	// Read chunks until we have enough to fill the buffer.
-	for iteration*bufCapacity < b.TotalBlocks() {
+	for start := 0; start < b.TotalBlocks(); {
+		select {
+		case slots <- struct{}{}:
+		case <-done:
+			return
+		}
+
+		capacity := sizer.blocks
+		b.bufferBlocks = capacity
+		bufSize := capacity * b.Config.BlockSize
 		blockBuf := make([]byte, bufSize)
 
-		offset := int64(iteration * bufCapacity * b.Config.BlockSize)
+		offset := int64(start * b.Config.BlockSize)
 		endRange := offset + int64(bufSize)
 
 		if endRange > endOfFile {
 			endRange = endOfFile
 			trimmedBufSize := endRange - offset
 			if trimmedBufSize <= 0 {
-				break
+				return
 			}
 			blockBuf = make([]byte, trimmedBufSize)
 		}
 
-		n, err := reader.Read(blockBuf)
+		readStarted := time.Now()
+		n, err := io.ReadFull(reader, blockBuf)
 		switch {
 		case err == io.EOF || err == io.ErrUnexpectedEOF:
 			// If we hit EOF before filling the buffer, that's expected behavior; we just trim the buffer.
 			blockBuf = blockBuf[:n]
 			if len(blockBuf) == 0 {
-				break
+				return
 			}
 		case err != nil:
-			return fmt.Errorf("error reading block data: %w", err)
+			send(bufferedRead{err: fmt.Errorf("error reading block data: %w", err)})
+			return
 		}
 
 		// If the buffer is not full, we need to trim it.
@@ -189,127 +806,171 @@ func (b *Backup) Run() error {
 			blockBuf = tmpBuf
 		}
 
-		// The number of individual blocks in the buffer.
-		bufEntries := len(blockBuf) / b.Config.BlockSize
+		// Re-read the range and confirm the source returned the same data.
+		if b.Config.VerifySource {
+			if err := b.verifySourceRead(source, offset, blockBuf); err != nil {
+				send(bufferedRead{err: err})
+				return
+			}
+		}
 
-		// Insert the block positions into the database and write the blocks to the backup file.
-		hashMap, err := b.writeBlocks(targetFile, iteration, bufEntries, bufCapacity, blockBuf)
-		if err != nil {
-			return err
+		// The number of individual blocks in the buffer. When the source isn't block-aligned,
+		// the final block is shorter than BlockSize and is stored at its true length.
+		bufEntries := (len(blockBuf) + b.Config.BlockSize - 1) / b.Config.BlockSize
+		b.stats.bytesRead.Add(int64(len(blockBuf)))
+
+		if !send(bufferedRead{start: start, bufEntries: bufEntries, data: blockBuf}) {
+			return
 		}
 
-		// Insert the block positions into the database.
-		if err := b.insertBlockPositionsTransaction(iteration, bufEntries, bufCapacity, hashMap); err != nil {
-			return err
+		// Size the next buffer from how quickly this one was read. The final, short buffer says
+		// nothing about the source's throughput.
+		if len(blockBuf) == bufSize {
+			sizer.observe(len(blockBuf), time.Since(readStarted))
 		}
+		start += capacity
+	}
+}
 
-		iteration++
+// openSource opens the backup target for reading, bounding its reads by ReadTimeout when set.
+func (b *Backup) openSource() (io.ReaderAt, func(), error) {
+	source, closeSource := b.Config.Source, func() {}
+	if source == nil {
+		file, closer, err := openForRead(b.vol.DevicePath, b.Config.DirectIO)
+		if err != nil {
+			return nil, nil, err
+		}
+		source, closeSource = file, func() { _ = closer.Close() }
 	}
 
-	s, err := GetTargetSizeInBytes(b.FullPath())
-	if err != nil {
-		return fmt.Errorf("error getting backup size: %v", err)
+	if b.Config.ReadTimeout > 0 {
+		source = &timeoutReaderAt{source: source, timeout: b.Config.ReadTimeout, retries: b.Config.ReadRetries}
 	}
 
-	b.Record.SizeInBytes = s
+	return source, closeSource, nil
+}
+
+// verifySourceRead reads the range starting at offset a second time and returns an error
+// identifying the first block whose contents differ from the original read.
+func (b *Backup) verifySourceRead(source io.ReaderAt, offset int64, blockBuf []byte) error {
+	verifyBuf := make([]byte, len(blockBuf))
+	n, err := source.ReadAt(verifyBuf, offset)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error re-reading block data: %w", err)
+	}
+	verifyBuf = verifyBuf[:n]
+
+	startPos := int(offset) / b.Config.BlockSize
+	for i := 0; i*b.Config.BlockSize < len(blockBuf); i++ {
+		start := i * b.Config.BlockSize
+		end := start + b.Config.BlockSize
+		if end > len(blockBuf) {
+			end = len(blockBuf)
+		}
+
+		if end > len(verifyBuf) || !bytes.Equal(blockBuf[start:end], verifyBuf[start:end]) {
+			return fmt.Errorf("source verification failed: block at position %d returned different data on re-read", startPos+i)
+		}
+	}
 
 	return nil
 }
 
-func (b *Backup) insertBlockPositionsTransaction(iteration int, bufEntries int, bufCapacity int, hashMap map[int]string) error {
-	if len(hashMap) == 0 {
+// insertBlockPositionsTransaction records the positions of the buffer of blocks starting at
+// position start, whose hashes are indexed by their offset in the buffer.
+func (b *Backup) insertBlockPositionsTransaction(start int, hashes []string) error {
+	if len(hashes) == 0 {
 		return nil
 	}
 
-	posStartRange := iteration * bufCapacity
-	posEndRange := posStartRange + bufCapacity
+	bufEntries := len(hashes)
+
+	// Perform the dup detection and the insert within a single transaction so the
+	// differential is computed against a consistent view of the last full backup.
+	tx, err := b.begin()
+	if err != nil {
+		return err
+	}
 
 	placeholders := strings.Trim(strings.Repeat("?,", bufEntries), ",")
-	blockQueryStr := "SELECT id, hash FROM blocks WHERE hash IN (" + placeholders + ")"
-	blockQueryValues := []interface{}{}
+	blockQueryStr := "SELECT id, hash FROM blocks WHERE algorithm = ? AND hash IN (" + placeholders + ")"
+	blockQueryValues := make([]interface{}, 0, bufEntries+1)
+	blockQueryValues = append(blockQueryValues, b.Record.HashAlgorithm)
 
-	for i := 0; i < bufEntries; i++ {
-		blockQueryValues = append(blockQueryValues, hashMap[posStartRange+i])
+	for _, hash := range hashes {
+		blockQueryValues = append(blockQueryValues, hash)
 	}
 
-	rows, err := b.store.Query(blockQueryStr, blockQueryValues...)
+	rows, err := tx.Query(blockQueryStr, blockQueryValues...)
 	if err != nil {
+		handleRollback(tx)
 		return err
 	}
 
 	// Create a map of the block hashes to their IDs.
-	blockIDMap := make(map[string]int)
+	blockIDMap := make(map[string]int, bufEntries)
 
 	for rows.Next() {
 		var id int
 		var hash string
 		if err := rows.Scan(&id, &hash); err != nil {
-			switch {
-			case err == sql.ErrNoRows:
-				break
-			default:
-				return err
-			}
+			rows.Close()
+			handleRollback(tx)
+			return err
 		}
 
 		blockIDMap[hash] = id
 	}
+	rows.Close()
 
-	dupMap := make(map[int]string, bufEntries)
+	// The hash the last full backup recorded at each offset of the buffer, if any.
+	var fullHashes []string
 
 	// Query the positions range against the last full backup.
-	if b.BackupType() == backupTypeDifferential {
+	if b.hashCache != nil {
+		fullHashes = b.cachedHashes(start, bufEntries)
+	} else if b.BackupType() == backupTypeDifferential {
+		fullHashes = make([]string, bufEntries)
+
 		// Query hashes associated with the position range.
-		rows, err := b.store.Query("SELECT b.id, bp.position, hash FROM blocks b JOIN block_positions bp ON bp.block_id = b.id WHERE bp.backup_id = ? AND bp.position >= ? AND bp.position < ?", b.lastFullRecord.ID, posStartRange, posEndRange)
+		posEndRange := start + bufEntries
+		rows, err := tx.Query("SELECT "+blockPosition+" AS pos, hash FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND bp.position < ? AND bp.position + bp.run_length > ? AND "+blockPosition+" >= ? AND "+blockPosition+" < ?", b.lastFullRecord.ID, posEndRange, start, start, posEndRange)
 		if err != nil {
+			handleRollback(tx)
 			return err
 		}
 
 		for rows.Next() {
-			var id int
 			var hash string
 			var position int
-			if err := rows.Scan(&id, &position, &hash); err != nil {
-				switch {
-				case err == sql.ErrNoRows:
-					break
-				default:
-					return err
-				}
+			if err := rows.Scan(&position, &hash); err != nil {
+				rows.Close()
+				handleRollback(tx)
+				return err
 			}
-			dupMap[position] = hash
+			fullHashes[position-start] = hash
 		}
 		rows.Close()
 	}
 
 	// Prepare for bulk insert.
 	baseStmt := "INSERT INTO block_positions (backup_id, block_id, position) VALUES "
-	var valueStrings []string
-	var valueArgs []interface{}
-
-	for i := 0; i < bufEntries; i++ {
-		pos := posStartRange + i
+	valueStrings := make([]string, 0, bufEntries)
+	valueArgs := make([]interface{}, 0, 3*bufEntries)
 
-		if b.BackupType() == backupTypeDifferential {
-			// Skip if the hash is the same as the last full backup.
-			if _, ok := dupMap[pos]; ok && dupMap[pos] == hashMap[pos] {
-				continue
-			}
+	for i, hash := range hashes {
+		// Skip if the hash is the same as the last full backup.
+		if fullHashes != nil && fullHashes[i] == hash {
+			continue
 		}
-		blockID := blockIDMap[hashMap[pos]]
+
 		valueStrings = append(valueStrings, "(?, ?, ?)")
-		valueArgs = append(valueArgs, b.Record.ID, blockID, pos)
+		valueArgs = append(valueArgs, b.Record.ID, blockIDMap[hash], start+i)
 	}
 
 	// If there are no inserts, we can abort the transaction.
 	if len(valueStrings) == 0 {
-		return nil
-	}
-
-	// Start a transaction to insert the block positions into the database
-	tx, err := b.store.Begin()
-	if err != nil {
-		return err
+		return tx.Commit()
 	}
 
 	// Append the value strings to the base statement.
@@ -333,172 +994,348 @@ func (b *Backup) insertBlockPositionsTransaction(iteration int, bufEntries int,
 	return tx.Commit()
 }
 
-func (b *Backup) writeBlocks(target *os.File, iteration int, bufEntries int, bufCapacity int, blockBuf []byte) (map[int]string, error) {
-	// Calculate the hash for each block in the buffer.
-	hashMap := b.hashBufferedData(iteration, bufEntries, bufCapacity, blockBuf)
-
-	reverseMap := make(map[string]int)
-	for k, v := range hashMap {
-		reverseMap[v] = k
-	}
-
-	duplicateHashes, err := b.identifyDuplicateBlocks(reverseMap)
+// writeBlocks inserts the buffer's new hashes and writes their blocks to the target. The buffer
+// starts at position start, and its hashes are indexed by their offset in the buffer.
+//
+// Buffers are written in the order they were read, so the backup file holds a single slot per
+// new block, ordered by the first position it appears at, and block IDs follow the same order.
+// Restores rely on this to read the file sequentially. Blocks repeated within the source, or
+// already stored by an earlier backup, aren't written again, so a block's offset in the file
+// can't be derived from its position. Laying the file out with a slot per position would make
+// it a plain image, but would give up deduplication within the file.
+func (b *Backup) writeBlocks(target io.Writer, start int, blockBuf []byte, hashes []string) error {
+	// The offset of the first block in the buffer with each hash, in position order.
+	firsts := firstOccurrences(hashes)
+
+	// Identify and insert the new hashes within a single transaction, so concurrent
+	// backups agree on which backup file holds each new block.
+	tx, err := b.begin()
 	if err != nil {
-		return nil, fmt.Errorf("error identifying duplicate blocks: %v", err)
+		return err
 	}
 
-	querySlice := []string{}
-	queryValues := []interface{}{}
-
-	// Use a map to force unique hashes.
-	insertablePositions := map[string]int{}
-
-	// Exclude hashes that already exist in the database from the insert.
-	for hash, pos := range reverseMap {
-		found := false
-		for _, dup := range duplicateHashes {
-			if hash == dup {
-				found = true
-				break
-			}
+	var duplicates map[string]bool
+	if b.coldStart {
+		// Every block in the table was inserted by this backup.
+		duplicates = b.inserted
+	} else {
+		duplicates, err = identifyDuplicateBlocks(tx, b.Record.HashAlgorithm, hashes, firsts)
+		if err != nil {
+			handleRollback(tx)
+			return fmt.Errorf("error identifying duplicate blocks: %v", err)
 		}
+	}
 
-		if found {
-			continue
+	// Exclude hashes that already exist in the database from the insert, keeping the blocks in
+	// position order, so their IDs follow the layout of the source.
+	insertable := make([]int, 0, len(firsts))
+	for _, i := range firsts {
+		if !duplicates[hashes[i]] {
+			insertable = append(insertable, i)
 		}
-
-		insertablePositions[hash] = pos
-		querySlice = append(querySlice, "(?)")
 	}
 
 	// If there are no insertable positions, we can return early.
-	if len(insertablePositions) == 0 {
-		return hashMap, nil
+	if len(insertable) == 0 {
+		return tx.Commit()
 	}
 
-	// Convert the insertable positions to a slice.
-	insertableSlice := []int{}
-	for _, pos := range insertablePositions {
-		insertableSlice = append(insertableSlice, pos)
-		queryValues = append(queryValues, hashMap[pos])
-	}
-
-	tx, err := b.store.Begin()
-	if err != nil {
-		return nil, err
+	querySlice := make([]string, 0, len(insertable))
+	queryValues := make([]interface{}, 0, 2*len(insertable))
+	for _, i := range insertable {
+		querySlice = append(querySlice, "(?, ?)")
+		queryValues = append(queryValues, hashes[i], b.Record.HashAlgorithm)
 	}
 
 	// TODO - There may be a limit to the number of placeholders we can use in a query.
-	q := "INSERT INTO blocks (hash) VALUES " + strings.Join(querySlice, ",")
+	q := "INSERT INTO blocks (hash, algorithm) VALUES " + strings.Join(querySlice, ",")
 	insertBlockQuery, err := tx.Prepare(q)
 	if err != nil {
 		handleRollback(tx)
-		return nil, err
+		return err
 	}
 
 	_, err = insertBlockQuery.Exec(queryValues...)
 	if err != nil {
-		return nil, fmt.Errorf("error inserting block hash into database: %v", err)
+		handleRollback(tx)
+
+		// Another backup inserted blocks since the cold start was detected, so dedup against them.
+		if b.coldStart {
+			b.endColdStart()
+			return b.writeBlocks(target, start, blockBuf, hashes)
+		}
+
+		return fmt.Errorf("error inserting block hash into database: %v", err)
 	}
 
 	if err := tx.Commit(); err != nil {
 		handleRollback(tx)
-		return nil, err
+		return err
+	}
+
+	b.unpositioned = b.unpositioned[:0]
+	for _, i := range insertable {
+		b.unpositioned = append(b.unpositioned, hashes[i])
 	}
 
-	sort.Ints(insertableSlice)
+	if b.coldStart {
+		for _, i := range insertable {
+			b.inserted[hashes[i]] = true
+		}
 
-	buf := make([]byte, b.Config.BlockSize*len(insertableSlice))
-	var idx int
+		if len(b.inserted) > maxColdStartBlocks {
+			b.endColdStart()
+		}
+	}
 
-	for _, pos := range insertableSlice {
-		startingPos := (pos - (iteration * bufCapacity)) * b.Config.BlockSize
-		copy(buf[idx:], blockBuf[startingPos:startingPos+b.Config.BlockSize])
-		// Move the index for the next block
-		idx += b.Config.BlockSize
+	buf := make([]byte, 0, b.Config.BlockSize*len(insertable))
+	written := make([]int, 0, len(insertable))
+
+	for _, i := range insertable {
+		// Constant blocks are reconstructed from their descriptor, so they aren't written.
+		if isFillBlock(hashes[i]) {
+			continue
+		}
+
+		startingPos := i * b.Config.BlockSize
+		endingPos := min(startingPos+b.Config.BlockSize, len(blockBuf))
+		buf = append(buf, blockBuf[startingPos:endingPos]...)
+		written = append(written, i)
 	}
 
 	_, err = target.Write(buf)
 	if err != nil {
-		return nil, fmt.Errorf("error writing block to backup file: %v", err)
+		return fmt.Errorf("error writing block to backup file: %v", err)
+	}
+
+	if b.writeBack != nil {
+		if err := b.verifyWrittenBlocks(target, start, written, len(buf), hashes); err != nil {
+			return err
+		}
+	}
+	b.written += int64(len(buf))
+	b.stats.blocksWritten.Add(int64(len(written)))
+	b.stats.bytesWritten.Add(int64(len(buf)))
+
+	return nil
+}
+
+// firstOccurrences returns the index of the first occurrence of each distinct hash, in order.
+func firstOccurrences(hashes []string) []int {
+	seen := make(map[string]struct{}, len(hashes))
+	firsts := make([]int, 0, len(hashes))
+	for i, hash := range hashes {
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+		seen[hash] = struct{}{}
+		firsts = append(firsts, i)
+	}
+
+	return firsts
+}
+
+// verifyWrittenBlocks reads back the blocks most recently written to the backup file and confirms
+// each matches its hash, so corruption is caught before the block positions are recorded.
+// Only the last of the blocks may be short.
+func (b *Backup) verifyWrittenBlocks(target io.Writer, start int, offsets []int, size int, hashes []string) error {
+	// Flush the blocks to storage so they're read back from it.
+	if syncer, ok := target.(interface{ Sync() error }); ok {
+		if err := syncer.Sync(); err != nil {
+			return fmt.Errorf("error syncing backup file: %v", err)
+		}
+	}
+
+	data := make([]byte, size)
+	if _, err := b.writeBack.ReadAt(data, b.written); err != nil {
+		return fmt.Errorf("write verification failed: error reading back blocks at offset %d: %v", b.written, err)
 	}
 
-	return hashMap, nil
+	for n, i := range offsets {
+		blockStart := n * b.Config.BlockSize
+		blockEnd := min(blockStart+b.Config.BlockSize, size)
+		offset := b.written + int64(blockStart)
+
+		if !blockMatchesHash(data[blockStart:blockEnd], hashes[i], b.Record.HashAlgorithm) {
+			return fmt.Errorf("write verification failed: block at position %d was corrupted when written to the backup file at offset %d", start+i, offset)
+		}
+	}
+
+	return nil
 }
 
-func (b *Backup) identifyDuplicateBlocks(reverseMap map[string]int) ([]string, error) {
-	qValues := []interface{}{}
-	for hash := range reverseMap {
-		qValues = append(qValues, hash)
+// maxColdStartBlocks bounds the number of hashes a cold start tracks in memory, after which
+// duplicates are identified by querying the blocks table.
+const maxColdStartBlocks = 1 << 20
+
+// startColdStart skips duplicate detection queries when the blocks table holds no blocks hashed
+// with the backup's algorithm, which is the case for the first backup of a store. The blocks
+// inserted by the backup are tracked instead.
+func (b *Backup) startColdStart() error {
+	if b.disableColdStart {
+		return nil
 	}
 
-	placeholders := strings.Trim(strings.Repeat("?,", len(qValues)), ",")
-	query := "SELECT DISTINCT hash FROM blocks WHERE hash IN (" + placeholders + ")"
-	rows, err := b.store.Query(query, qValues...)
+	var empty bool
+	if err := b.store.QueryRow("SELECT NOT EXISTS (SELECT 1 FROM blocks WHERE algorithm = ?)", b.Record.HashAlgorithm).Scan(&empty); err != nil {
+		return fmt.Errorf("error checking for existing blocks: %v", err)
+	}
+
+	b.coldStart = empty
+	b.inserted = map[string]bool{}
+
+	return nil
+}
+
+// endColdStart falls back to querying the blocks table for duplicates.
+func (b *Backup) endColdStart() {
+	b.coldStart = false
+	b.inserted = nil
+}
+
+// identifyDuplicateBlocks returns the set of the hashes at the firsts offsets that are already
+// stored in the blocks table under the algorithm.
+func identifyDuplicateBlocks(tx *sql.Tx, algorithm HashAlgorithm, hashes []string, firsts []int) (map[string]bool, error) {
+	qValues := make([]interface{}, 0, len(firsts)+1)
+	qValues = append(qValues, algorithm)
+	for _, i := range firsts {
+		qValues = append(qValues, hashes[i])
+	}
+
+	placeholders := strings.Trim(strings.Repeat("?,", len(firsts)), ",")
+	query := "SELECT DISTINCT hash FROM blocks WHERE algorithm = ? AND hash IN (" + placeholders + ")"
+	rows, err := tx.Query(query, qValues...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	duplicateHashes := []string{}
-
+	duplicates := map[string]bool{}
 	for rows.Next() {
 		var hash string
 		if err := rows.Scan(&hash); err != nil {
-			switch {
-			case err == sql.ErrNoRows:
-				break
-			case err != nil:
-				return nil, err
-			}
+			return nil, err
 		}
-		duplicateHashes = append(duplicateHashes, hash)
+		duplicates[hash] = true
 	}
-	defer rows.Close()
+
 	if rows.Err() != nil {
 		return nil, rows.Err()
 	}
 
-	return duplicateHashes, nil
+	return duplicates, nil
 }
 
-func (b *Backup) hashBufferedData(iteration int, bufEntries int, bufCapacity int, buf []byte) map[int]string {
-	var wg sync.WaitGroup
-	var mu sync.Mutex
+// hashBufferedData returns the hash of each of the buffer's blocks, indexed by its offset in the buffer.
+func (b *Backup) hashBufferedData(bufEntries int, buf []byte) []string {
+	if bufEntries == 0 {
+		return nil
+	}
 
-	hashMap := make(map[int]string)
+	// Split the buffer into contiguous chunks, one per worker, so each goroutine hashes
+	// many neighbouring blocks rather than paying scheduling costs per block.
 
-	// Calculate the hash for each block in the buffer.
-	for i := 0; i < bufEntries; i++ {
-		wg.Add(1)
+	workers := runtime.GOMAXPROCS(0)
+	if b.Config.Concurrency > 0 {
+		workers = b.Config.Concurrency
+	}
+	if workers > bufEntries {
+		workers = bufEntries
+	}
 
-		go func(i int) {
-			defer wg.Done()
-			startingPos := b.Config.BlockSize * i
-			endingPos := (startingPos + b.Config.BlockSize)
+	// Each worker writes to its own range of the slice, so no locking is required.
+	hashes := make([]string, bufEntries)
 
-			// Read byte range for the block.
-			blockData := buf[startingPos:endingPos]
+	var wg sync.WaitGroup
+	chunkSize := (bufEntries + workers - 1) / workers
+	for start := 0; start < bufEntries; start += chunkSize {
+		end := start + chunkSize
+		if end > bufEntries {
+			end = bufEntries
+		}
 
-			// Calculate the hash for the block.
-			hash := calculateBlockHash(blockData)
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				startingPos := b.Config.BlockSize * i
+				endingPos := min(startingPos+b.Config.BlockSize, len(buf))
 
-			// Determine the position of the chunk.
-			pos := iteration*bufCapacity + i
+				// Calculate the hash for the block.
+				hashes[i] = b.hashBlock(buf[startingPos:endingPos])
+			}
 
-			mu.Lock()
-			hashMap[pos] = hash
-			mu.Unlock()
-		}(i)
+			b.progress.add(end - start)
+		}(start, end)
 	}
 
 	wg.Wait()
 
-	return hashMap
+	return hashes
 }
 
-func resolveVolume(store *Store, devicePath string) (*Volume, error) {
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Sync flushes the underlying writer when it supports it, so written blocks can still be verified.
+func (c *countingWriter) Sync() error {
+	if syncer, ok := c.Writer.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+
+	return nil
+}
+
+// sizer is implemented by in-memory readers such as bytes.Reader and io.SectionReader.
+type sizer interface {
+	Size() int64
+}
+
+func sourceSizeInBytes(cfg *BackupConfig) (int, error) {
+	if cfg.Source == nil {
+		return GetTargetSizeInBytes(cfg.DevicePath)
+	}
+
+	s, ok := cfg.Source.(sizer)
+	if !ok {
+		return 0, fmt.Errorf("backup source must implement Size() int64")
+	}
+
+	return int(s.Size()), nil
+}
+
+// sourceIdentity returns the absolute path and inode of the source.
+// The inode is 0 when the source can't be stat'd, such as when reading from Config.Source.
+func sourceIdentity(devicePath string) (string, uint64) {
+	sourcePath, err := filepath.Abs(devicePath)
+	if err != nil {
+		sourcePath = devicePath
+	}
+
+	fi, err := os.Stat(devicePath)
+	if err != nil {
+		return sourcePath, 0
+	}
+
+	return sourcePath, fileInode(fi)
+}
+
+func volumeName(devicePath string) string {
 	pathSlice := strings.Split(devicePath, "/")
-	volName := pathSlice[len(pathSlice)-1]
+	return pathSlice[len(pathSlice)-1]
+}
+
+func resolveVolume(store *Store, devicePath string) (*Volume, error) {
+	volName := volumeName(devicePath)
 	vol, err := store.FindVolume(volName)
 	switch {
 	case err == sql.ErrNoRows:
@@ -527,8 +1364,7 @@ func generateBackupName(vol *Volume, backupType string) string {
 }
 
 func calculateBlockHash(blockData []byte) string {
-	hash := xxhash.Sum64(blockData)
-	return fmt.Sprint(hash)
+	return formatSum64(xxhash.Sum64(blockData))
 }
 
 func calculateTotalBlocks(blockSize int, sizeInBytes int) int {
@@ -538,6 +1374,6 @@ func calculateTotalBlocks(blockSize int, sizeInBytes int) int {
 
 func handleRollback(tx *sql.Tx) {
 	if err := tx.Rollback(); err != nil {
-		fmt.Printf("error rolling back transaction: %v", err)
+		fmt.Fprintf(os.Stderr, "error rolling back transaction: %v\n", err)
 	}
 }
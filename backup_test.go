@@ -1,8 +1,18 @@
 package block
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -19,7 +29,7 @@ func setup(s *Store) {
 	}
 }
 
-func cleanup(t *testing.T) {
+func cleanup(t testing.TB) {
 	if err := os.RemoveAll("backups/"); err != nil {
 		t.Log(err)
 	}
@@ -232,6 +242,233 @@ func TestDifferentialBackupWithChanges(t *testing.T) {
 	}
 }
 
+// flakyReaderAt returns the underlying data on the first read and corrupted data on every read after.
+type flakyReaderAt struct {
+	data  []byte
+	reads int
+}
+
+func (f *flakyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	n := copy(p, f.data[off:])
+	if f.reads > 1 && n > 0 {
+		p[0] ^= 0xFF
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *flakyReaderAt) Size() int64 {
+	return int64(len(f.data))
+}
+
+func TestBackupVerifySource(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	data, err := os.ReadFile("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		Source:          &flakyReaderAt{data: data},
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 16,
+		VerifySource:    true,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Run()
+	if err == nil {
+		t.Fatal("expected source verification to fail")
+	}
+
+	if !strings.Contains(err.Error(), "block at position 0") {
+		t.Fatalf("expected mismatch to be reported at position 0, got %v", err)
+	}
+
+	// A stable source passes verification.
+	cfg.Source = nil
+	cfg.OutputFileName = ""
+	b, err = NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentDifferentialBackups(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 4
+	var wg sync.WaitGroup
+	backups := make([]*Backup, workers)
+	errs := make([]error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			workerCfg := *cfg
+			workerCfg.OutputFileName = fmt.Sprintf("differential-%d", i)
+
+			db, err := NewBackup(&workerCfg)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			// Hack the device path to simulate a change
+			db.vol.DevicePath = "assets/pg_altered.ext4"
+
+			errs[i] = db.Run()
+			backups[i] = db
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < workers; i++ {
+		if errs[i] != nil {
+			t.Fatalf("worker %d failed: %v", i, errs[i])
+		}
+
+		if backups[i].BackupType() != backupTypeDifferential {
+			t.Fatalf("expected worker %d to take a differential, got %s", i, backups[i].BackupType())
+		}
+
+		positions, err := store.findBlockPositionsByBackup(backups[i].Record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(positions) != 1 || positions[0].position != 0 {
+			t.Fatalf("expected worker %d to record only position 0, got %+v", i, positions)
+		}
+	}
+
+	// The new block is only stored once, regardless of how many backups raced to store it.
+	totalBlocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if totalBlocks != 38 {
+		t.Fatalf("expected 38 blocks, got %d", totalBlocks)
+	}
+}
+
+func TestBackupOnExisting(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// A stale file larger than the backup that will be written.
+	stale := make([]byte, 2*1048576)
+	for i := range stale {
+		stale[i] = 0xEE
+	}
+	if err := os.WriteFile("backups/existing", stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		OutputFileName:  "existing",
+		BlockSize:       4096,
+		BlockBufferSize: 16,
+	}
+
+	// The default policy refuses to clobber the existing file.
+	if _, err := NewBackup(cfg); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected an already exists error, got %v", err)
+	}
+
+	// Renaming writes alongside the existing file.
+	cfg.OnExisting = ExistingFileRename
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.FullPath() != "backups/existing.1" {
+		t.Fatalf("expected backup to be renamed to backups/existing.1, got %s", b.FullPath())
+	}
+
+	// Overwriting truncates the existing file so no stale bytes remain.
+	cfg.OnExisting = ExistingFileOverwrite
+	b, err = NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(b.FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != b.SizeInBytes() || len(data) >= len(stale) {
+		t.Fatalf("expected the backup file to be truncated to %d bytes, got %d", b.SizeInBytes(), len(data))
+	}
+}
+
 func compareChecksum(t *testing.T, filePath string, expected string) {
 	actual, err := fileChecksum(filePath)
 	if err != nil {
@@ -272,3 +509,1561 @@ func compareChecksum(t *testing.T, filePath string, expected string) {
 // 	}
 
 // }
+
+// hashBufferedDataPerBlock is the previous implementation of hashBufferedData, which
+// launched a goroutine per block. It is kept as a baseline for comparison.
+func hashBufferedDataPerBlock(b *Backup, iteration int, bufEntries int, bufCapacity int, buf []byte) map[int]string {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	hashMap := make(map[int]string)
+	for i := 0; i < bufEntries; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			startingPos := b.Config.BlockSize * i
+			endingPos := (startingPos + b.Config.BlockSize)
+
+			hash := b.hashBlock(buf[startingPos:endingPos])
+
+			mu.Lock()
+			hashMap[iteration*bufCapacity+i] = hash
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	return hashMap
+}
+
+func hashingWorkload(tb testing.TB, blockSize, bufCapacity int) (*Backup, []byte) {
+	buf := make([]byte, blockSize*bufCapacity)
+	if _, err := rand.Read(buf); err != nil {
+		tb.Fatal(err)
+	}
+
+	return &Backup{Config: &BackupConfig{BlockSize: blockSize}}, buf
+}
+
+func TestHashBufferedData(t *testing.T) {
+	b, buf := hashingWorkload(t, 4096, 4096)
+
+	// Include a partially filled buffer to exercise uneven chunks.
+	for _, entries := range []int{4096, 1000, 3, 1, 0} {
+		expected := hashBufferedDataPerBlock(b, 2, entries, 4096, buf)
+		actual := b.hashBufferedData(entries, buf)
+
+		if len(actual) != len(expected) {
+			t.Fatalf("expected %d hashes, got %d", len(expected), len(actual))
+		}
+
+		for pos, hash := range expected {
+			if actual[pos-2*4096] != hash {
+				t.Fatalf("hash mismatch at position %d with %d entries", pos, entries)
+			}
+		}
+	}
+}
+
+func BenchmarkHashBufferedData(b *testing.B) {
+	backup, buf := hashingWorkload(b, 4096, 4096)
+
+	b.Run("per-block", func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			hashBufferedDataPerBlock(backup, i, 4096, 4096, buf)
+		}
+	})
+
+	b.Run("chunked", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			backup.hashBufferedData(4096, buf)
+		}
+	})
+}
+
+func TestBackupRecordsSource(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath, err := filepath.Abs("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.SourcePath != expectedPath {
+		t.Fatalf("expected source path %s, got %s", expectedPath, record.SourcePath)
+	}
+
+	fi, err := os.Stat("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.SourceInode != fileInode(fi) {
+		t.Fatalf("expected source inode %d, got %d", fileInode(fi), record.SourceInode)
+	}
+}
+
+func TestDifferentialInheritsBlockSize(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.BlockSize = 0
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Record.BlockSize != 1048576 {
+		t.Fatalf("expected the differential to inherit block size 1048576, got %d", db.Record.BlockSize)
+	}
+
+	if db.Record.TotalBlocks != 50 {
+		t.Fatalf("expected 50 total blocks, got %d", db.Record.TotalBlocks)
+	}
+
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	positions, err := store.findBlockPositionsByBackup(db.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 1 {
+		t.Fatalf("expected 1 block position, got %d", len(positions))
+	}
+}
+
+func TestBackupResult(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := b.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(b.FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := BackupResult{
+		BackupID:          b.Record.ID,
+		FilePath:          b.FullPath(),
+		BackupSizeInBytes: int(fi.Size()),
+		SourceSizeInBytes: 50 * 1048576,
+		SpaceSavedInBytes: 50*1048576 - int(fi.Size()),
+		BlocksEvaluated:   50,
+		BlocksWritten:     37,
+		DurationMs:        b.Record.Duration.Milliseconds(),
+		BlockBufferSize:   5,
+	}
+
+	if result != expected {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+}
+
+// shortReaderAt reports a larger size than the data it serves, so reads stop short.
+type shortReaderAt struct {
+	*bytes.Reader
+	size int64
+}
+
+func (s shortReaderAt) Size() int64 {
+	return s.size
+}
+
+func TestFullBackupVerifiesPositionCount(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	data, err := os.ReadFile("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Claim two more blocks than the source holds, so their positions are never recorded.
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		Source:          shortReaderAt{Reader: bytes.NewReader(data), size: int64(len(data)) + 2*4096},
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Run()
+	if err == nil {
+		t.Fatal("expected the backup to fail when positions are missing")
+	}
+
+	expected := fmt.Sprintf("full backup recorded %d of %d block positions", len(data)/4096, len(data)/4096+2)
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err)
+	}
+}
+
+func TestFailedBackupIsRecorded(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	if _, err := store.LastError(); err != sql.ErrNoRows {
+		t.Fatalf("expected no failed backups, got %v", err)
+	}
+
+	data, err := os.ReadFile("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		Source:          shortReaderAt{Reader: bytes.NewReader(data), size: int64(len(data)) + 4096},
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runErr := b.Run()
+	if runErr == nil {
+		t.Fatal("expected the backup to fail when positions are missing")
+	}
+
+	if b.Record.Status != backupStatusFailed || b.Record.ErrorMessage != runErr.Error() {
+		t.Fatalf("expected the record to be marked failed with %q, got status %q and message %q", runErr, b.Record.Status, b.Record.ErrorMessage)
+	}
+
+	failed, err := store.LastError()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed.ID != b.Record.ID {
+		t.Fatalf("expected the last error to be backup %d, got %d", b.Record.ID, failed.ID)
+	}
+
+	if failed.Status != backupStatusFailed {
+		t.Fatalf("expected status %q, got %q", backupStatusFailed, failed.Status)
+	}
+
+	if failed.ErrorMessage != runErr.Error() {
+		t.Fatalf("expected error message %q, got %q", runErr, failed.ErrorMessage)
+	}
+
+	// A failed full isn't one a differential can chain off.
+	if _, err := store.findLastFullBackupRecord(failed.VolumeID); err != sql.ErrNoRows {
+		t.Fatalf("expected no completed full backup, got %v", err)
+	}
+}
+
+func TestBackupZeroBlockBufferSize(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	done := make(chan error, 1)
+	go func() {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      "assets/tiny.ext4",
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       4096,
+			BlockBufferSize: 0,
+		})
+		if err == nil {
+			err = b.Run()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "block buffer size must be at least 1") {
+			t.Fatalf("expected a block buffer size error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backup with a zero block buffer size did not return")
+	}
+}
+
+func TestDifferentialRefusesBrokenChain(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the full backup's file leaves nothing to layer a differential on.
+	if err := os.Remove(fb.FullPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewBackup(cfg)
+	if err == nil || !strings.Contains(err.Error(), "backup chain is broken") {
+		t.Fatalf("expected a broken chain error, got %v", err)
+	}
+
+	// A full backup that never completed isn't used as a parent.
+	if _, err := store.Exec("UPDATE backups SET status = ? WHERE id = ?", backupStatusRunning, fb.Record.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.BackupType() != backupTypeFull {
+		t.Fatalf("expected a full backup, got %s", b.BackupType())
+	}
+}
+
+func TestHashSampleDetectsFewerChanges(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	const blockSize = 65536
+	original := make([]byte, 8*blockSize)
+	if _, err := rand.Read(original); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change one byte within the sampled first KiB of block 1, and one byte of block 3
+	// that falls between the sampled regions.
+	altered := append([]byte{}, original...)
+	altered[1*blockSize+10] ^= 0xFF
+	altered[3*blockSize+10000] ^= 0xFF
+
+	changedPositions := func(devicePath string, hashSample bool) (int, *Backup) {
+		var diff *Backup
+		for _, data := range [][]byte{original, altered} {
+			b, err := NewBackup(&BackupConfig{
+				Store:           store,
+				DevicePath:      devicePath,
+				Source:          bytes.NewReader(data),
+				OutputFormat:    BackupOutputFormatFile,
+				OutputDirectory: "backups/",
+				BlockSize:       blockSize,
+				BlockBufferSize: 4,
+				HashSample:      hashSample,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := b.Run(); err != nil {
+				t.Fatal(err)
+			}
+			diff = b
+		}
+
+		positions, err := store.findBlockPositionsByBackup(diff.Record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(positions), diff
+	}
+
+	full, _ := changedPositions("sources/full.img", false)
+	if full != 2 {
+		t.Fatalf("expected full hashing to detect 2 changed blocks, got %d", full)
+	}
+
+	sampled, diff := changedPositions("sources/sampled.img", true)
+	if sampled != 1 {
+		t.Fatalf("expected hash sampling to detect 1 changed block, got %d", sampled)
+	}
+
+	result, err := diff.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Approximate {
+		t.Fatal("expected a sampled backup to be reported as approximate")
+	}
+
+	// A differential can't switch hashing modes relative to its full.
+	_, err = NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "sources/sampled.img",
+		Source:          bytes.NewReader(altered),
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       blockSize,
+		BlockBufferSize: 4,
+	})
+	if err == nil {
+		t.Fatal("expected a differential without hash sampling to be rejected")
+	}
+}
+
+// corruptingWriter flips a byte of the data passed to its first write.
+type corruptingWriter struct {
+	io.Writer
+	corrupted bool
+}
+
+func (c *corruptingWriter) Write(p []byte) (int, error) {
+	if !c.corrupted && len(p) > 0 {
+		c.corrupted = true
+		corrupt := append([]byte{}, p...)
+		corrupt[len(corrupt)/2] ^= 0xFF
+		return c.Writer.Write(corrupt)
+	}
+	return c.Writer.Write(p)
+}
+
+func TestBackupVerifyWrites(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+		VerifyWrites:    true,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.wrapTarget = func(w io.Writer) io.Writer { return &corruptingWriter{Writer: w} }
+
+	err = b.Run()
+	if err == nil {
+		t.Fatal("expected the backup to fail when a write is corrupted")
+	}
+
+	if !strings.Contains(err.Error(), "write verification failed") {
+		t.Fatalf("expected a write verification error, got %q", err)
+	}
+
+	// No positions are recorded for the corrupted iteration.
+	positions, err := store.findBlockPositionsByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 0 {
+		t.Fatalf("expected no positions to be recorded, got %d", len(positions))
+	}
+
+	// Uncorrupted writes pass verification.
+	b, err = NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupPartialFinalBlock(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	const blockSize = 4096
+	const tail = 1000
+	data := make([]byte, 10*blockSize+tail)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "unaligned.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      sourcePath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       blockSize,
+		BlockBufferSize: 4,
+		VerifyWrites:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.TotalBlocks() != 11 {
+		t.Fatalf("expected 11 blocks, got %d", b.TotalBlocks())
+	}
+
+	// Every block is unique, so the file holds the full blocks followed by the unpadded tail.
+	expected := 10*blockSize + tail
+	if length := backupDataLength(t, b.FullPath()); length != int64(expected) {
+		t.Fatalf("expected the backup file to hold %d bytes of block data, got %d", expected, length)
+	}
+
+	record, err := store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.SizeInBytes != len(data) {
+		t.Fatalf("expected the recorded source size to be %d, got %d", len(data), record.SizeInBytes)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     b.Record.FileName,
+		Validate:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore.disableFastPath = true
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, data) {
+		t.Fatalf("expected the restore to match the %d byte source, got %d bytes", len(data), len(restored))
+	}
+}
+
+func TestBackupRequireAlignedSource(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	const blockSize = 4096
+	data := make([]byte, 10*blockSize+1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "unaligned.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &BackupConfig{
+		Store:                store,
+		DevicePath:           sourcePath,
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            blockSize,
+		BlockBufferSize:      4,
+		RequireAlignedSource: true,
+	}
+
+	if _, err := NewBackup(cfg); err == nil || !strings.Contains(err.Error(), "partial final block of 1000 bytes") {
+		t.Fatalf("expected the unaligned source to be refused, got %v", err)
+	}
+
+	// The partial tail is backed up when it's allowed.
+	cfg.RequireAlignedSource = false
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.TotalBlocks() != 11 {
+		t.Fatalf("expected 11 blocks, got %d", b.TotalBlocks())
+	}
+
+	// Aligned sources are backed up either way.
+	aligned, err := NewBackup(&BackupConfig{
+		Store:                store,
+		DevicePath:           "assets/tiny.ext4",
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            blockSize,
+		BlockBufferSize:      4,
+		RequireAlignedSource: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aligned.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// backupWithDepth backs up the source into a fresh store, running runFixed with the specified
+// pipeline depth, and returns the backup file along with the hash recorded at each position.
+func backupWithDepth(tb testing.TB, sourcePath string, depth int) ([]byte, map[int]string) {
+	dir := tb.TempDir()
+	store, err := OpenStore(filepath.Join(dir, "backups.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.SetupDB(); err != nil {
+		tb.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      sourcePath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: dir,
+		OutputFileName:  "backup",
+		BlockSize:       65536,
+		BlockBufferSize: 8,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b.pipelineDepth = depth
+
+	if err := b.Run(); err != nil {
+		tb.Fatal(err)
+	}
+
+	data, err := os.ReadFile(b.FullPath())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	hashes, err := store.findHashesByBackup(b.Record.ID)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return data, hashes
+}
+
+func TestPipelinedBackupMatchesSerial(t *testing.T) {
+	// Repeat a few random blocks, so the source holds both unique and duplicate blocks.
+	data := make([]byte, 0, 100*65536)
+	random := make([]byte, 7*65536+1234)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	for len(data) < cap(data) {
+		data = append(data, random[:min(len(random), cap(data)-len(data))]...)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "source.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serialFile, serialHashes := backupWithDepth(t, sourcePath, 1)
+	pipelinedFile, pipelinedHashes := backupWithDepth(t, sourcePath, 0)
+
+	if !bytes.Equal(serialFile, pipelinedFile) {
+		t.Fatal("expected the pipelined backup file to match the serial backup file")
+	}
+
+	if len(serialHashes) != len(pipelinedHashes) {
+		t.Fatalf("expected %d positions, got %d", len(serialHashes), len(pipelinedHashes))
+	}
+
+	for pos, hash := range serialHashes {
+		if pipelinedHashes[pos] != hash {
+			t.Fatalf("expected position %d to have hash %s, got %s", pos, hash, pipelinedHashes[pos])
+		}
+	}
+}
+
+func BenchmarkBackupFull(b *testing.B) {
+	data := make([]byte, 32*1048576)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(b.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, depth := range []int{1, 0} {
+		name := "pipelined"
+		if depth == 1 {
+			name = "serial"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				backupWithDepth(b, sourcePath, depth)
+			}
+		})
+	}
+}
+
+func TestBackupFollowSymlinks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	device, err := filepath.Abs("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two aliases for the same device, as found under /dev/disk/by-id and /dev/disk/by-uuid.
+	dir := t.TempDir()
+	aliases := []string{filepath.Join(dir, "by-id-disk"), filepath.Join(dir, "by-uuid-disk")}
+	for _, alias := range aliases {
+		if err := os.Symlink(device, alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var backups []*Backup
+	for _, alias := range aliases {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      alias,
+			FollowSymlinks:  true,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, b)
+	}
+
+	if backups[0].vol.ID != backups[1].vol.ID {
+		t.Fatalf("expected both aliases to resolve to one volume, got %d and %d", backups[0].vol.ID, backups[1].vol.ID)
+	}
+
+	if backups[0].vol.Name != "pg.ext4" {
+		t.Errorf("expected volume to be named after the device, got %s", backups[0].vol.Name)
+	}
+
+	if backups[1].BackupType() != backupTypeDifferential {
+		t.Errorf("expected backup through the second alias to be differential, got %s", backups[1].BackupType())
+	}
+}
+
+func TestBackupHooks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n := len(events); n == 0 || events[n-1] != event {
+			events = append(events, event)
+		}
+	}
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+		Progress:        func(completed, total int) { record("read") },
+		PreHook: func() error {
+			record("pre")
+			return nil
+		},
+		PostHook: func() error {
+			record("post")
+			return nil
+		},
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(events, ",") != "pre,read,post" {
+		t.Fatalf("expected hooks to run around the backup, got %v", events)
+	}
+
+	// A failing pre-hook aborts the backup before the source is read.
+	events = nil
+	cfg.PreHook = func() error {
+		record("pre")
+		return fmt.Errorf("unable to quiesce")
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fb.Run()
+	if err == nil || !strings.Contains(err.Error(), "unable to quiesce") {
+		t.Fatalf("expected pre-hook error, got %v", err)
+	}
+
+	if strings.Join(events, ",") != "pre" {
+		t.Fatalf("expected only the pre-hook to run, got %v", events)
+	}
+
+	if _, err := os.Stat(fb.FullPath()); !os.IsNotExist(err) {
+		t.Fatalf("expected no backup file to be written, got %v", err)
+	}
+}
+
+func TestBackupInsertSynchronous(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// Use a single connection, so the pragma is read from the connection the backup changed.
+	store.SetMaxOpenConns(1)
+
+	var before int
+	if err := store.QueryRow("PRAGMA synchronous;").Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, restore, err := store.synchronousConn(SynchronousOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var during int
+	if err := conn.QueryRowContext(context.Background(), "PRAGMA synchronous;").Scan(&during); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	if during != 0 {
+		t.Fatalf("expected synchronous to be OFF (0) on the reserved connection, got %d", during)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:             store,
+		DevicePath:        "assets/pg.ext4",
+		OutputFormat:      BackupOutputFormatFile,
+		OutputDirectory:   "backups/",
+		BlockSize:         1048576,
+		BlockBufferSize:   5,
+		InsertSynchronous: SynchronousOff,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var after int
+	if err := store.QueryRow("PRAGMA synchronous;").Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+
+	if after != before {
+		t.Fatalf("expected synchronous to be restored to %d, got %d", before, after)
+	}
+
+	if b.Record.Status != backupStatusCompleted {
+		t.Fatalf("expected the backup to complete, got status %s", b.Record.Status)
+	}
+
+	if _, err := NewBackup(&BackupConfig{
+		Store:             store,
+		DevicePath:        "assets/pg.ext4",
+		OutputFormat:      BackupOutputFormatFile,
+		OutputDirectory:   "backups/",
+		BlockBufferSize:   5,
+		InsertSynchronous: "SOMETIMES",
+	}); err == nil {
+		t.Fatal("expected an unsupported synchronous mode to be rejected")
+	}
+}
+
+func BenchmarkBackupInsertSynchronous(b *testing.B) {
+	data := make([]byte, 32*1048576)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(b.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mode := range []SynchronousMode{SynchronousFull, SynchronousOff} {
+		b.Run(string(mode), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				dir := b.TempDir()
+				store, err := OpenStore(filepath.Join(dir, "backups.db"))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := store.SetupDB(); err != nil {
+					b.Fatal(err)
+				}
+
+				// Small blocks make the position inserts dominate.
+				backup, err := NewBackup(&BackupConfig{
+					Store:             store,
+					DevicePath:        sourcePath,
+					OutputFormat:      BackupOutputFormatFile,
+					OutputDirectory:   dir,
+					OutputFileName:    "backup",
+					BlockSize:         4096,
+					BlockBufferSize:   16,
+					InsertSynchronous: mode,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := backup.Run(); err != nil {
+					b.Fatal(err)
+				}
+				_ = store.Close()
+			}
+		})
+	}
+}
+
+func TestBackupColdStartMatchesDedup(t *testing.T) {
+	results := map[bool]map[int]string{}
+	for _, disable := range []bool{false, true} {
+		dir := t.TempDir()
+		store, err := OpenStore(filepath.Join(dir, "backups.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		if err := store.SetupDB(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      "assets/pg.ext4",
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: dir,
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.disableColdStart = disable
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !disable && b.inserted != nil {
+			t.Fatal("expected the cold start to end with the backup")
+		}
+
+		// The sample volume has 37 unique blocks, each of which must be stored once.
+		blocks, err := store.TotalBlocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if blocks != 37 {
+			t.Fatalf("expected 37 blocks, got %d", blocks)
+		}
+
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     b.Record.ID,
+			OutputDirectory:    dir,
+			OutputFileName:     "restored",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+		compareChecksum(t, restore.FullRestorePath(), fullBackupChecksum)
+
+		results[disable], err = store.findHashesByBackup(b.Record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(results[false]) != len(results[true]) {
+		t.Fatalf("expected %d positions, got %d", len(results[true]), len(results[false]))
+	}
+
+	for pos, hash := range results[true] {
+		if results[false][pos] != hash {
+			t.Fatalf("expected position %d to have hash %s, got %s", pos, hash, results[false][pos])
+		}
+	}
+}
+
+func BenchmarkBackupFirstFull(b *testing.B) {
+	data := make([]byte, 32*1048576)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(b.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, disable := range []bool{true, false} {
+		name := "cold-start"
+		if disable {
+			name = "dedup"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				dir := b.TempDir()
+				store, err := OpenStore(filepath.Join(dir, "backups.db"))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := store.SetupDB(); err != nil {
+					b.Fatal(err)
+				}
+
+				backup, err := NewBackup(&BackupConfig{
+					Store:           store,
+					DevicePath:      sourcePath,
+					OutputFormat:    BackupOutputFormatFile,
+					OutputDirectory: dir,
+					OutputFileName:  "backup",
+					BlockSize:       4096,
+					BlockBufferSize: 64,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				backup.disableColdStart = disable
+
+				if err := backup.Run(); err != nil {
+					b.Fatal(err)
+				}
+				_ = store.Close()
+			}
+		})
+	}
+}
+
+func TestBackupReadAhead(t *testing.T) {
+	// Read-aheads smaller than, unaligned with and larger than a buffer restore the same image.
+	for _, readAhead := range []int{4096, 3*1048576 + 17, 64 * 1048576} {
+		dir := t.TempDir()
+		store, err := OpenStore(filepath.Join(dir, "backups.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		if err := store.SetupDB(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      "assets/pg.ext4",
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: dir,
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+			ReadAheadBytes:  readAhead,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatalf("read-ahead %d: %v", readAhead, err)
+		}
+
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     b.Record.ID,
+			OutputDirectory:    dir,
+			OutputFileName:     "restored",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+		compareChecksum(t, restore.FullRestorePath(), fullBackupChecksum)
+	}
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "backups.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.SetupDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockBufferSize: 5,
+		ReadAheadBytes:  -1,
+	}); err == nil {
+		t.Fatal("expected a negative read-ahead to be rejected")
+	}
+}
+
+func TestBackupBlockSizeChange(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	newCfg := func(devicePath string, blockSize int) *BackupConfig {
+		return &BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       blockSize,
+			BlockBufferSize: 5,
+		}
+	}
+
+	fb, err := NewBackup(newCfg("assets/pg.ext4", 1048576))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fb.MismatchedBlockSizes) != 0 {
+		t.Fatalf("expected the first backup to have no mismatched block sizes, got %v", fb.MismatchedBlockSizes)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A differential at another block size would misalign with its full.
+	if _, err := NewBackup(newCfg("assets/pg.ext4", 4096)); err == nil {
+		t.Fatal("expected a differential with a different block size than its full to be rejected")
+	}
+
+	// A full of another volume at another block size is allowed, but flagged.
+	tb, err := NewBackup(newCfg("assets/tiny.ext4", 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tb.MismatchedBlockSizes) != 1 || tb.MismatchedBlockSizes[0] != 1048576 {
+		t.Fatalf("expected mismatched block sizes [1048576], got %v", tb.MismatchedBlockSizes)
+	}
+
+	if err := tb.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkBackupReadAhead(b *testing.B) {
+	data := make([]byte, 32*1048576)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(b.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, readAhead := range []int{0, 1048576, 8 * 1048576, 32 * 1048576} {
+		b.Run(fmt.Sprintf("readAhead=%d", readAhead), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				dir := b.TempDir()
+				store, err := OpenStore(filepath.Join(dir, "backups.db"))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := store.SetupDB(); err != nil {
+					b.Fatal(err)
+				}
+
+				backup, err := NewBackup(&BackupConfig{
+					Store:           store,
+					DevicePath:      sourcePath,
+					OutputFormat:    BackupOutputFormatFile,
+					OutputDirectory: dir,
+					OutputFileName:  "backup",
+					BlockSize:       65536,
+					BlockBufferSize: 4,
+					ReadAheadBytes:  readAhead,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := backup.Run(); err != nil {
+					b.Fatal(err)
+				}
+				_ = store.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkBackupBufferAllocations(b *testing.B) {
+	data := make([]byte, 16*1048576)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(b.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	// Large buffers of small blocks make the per-buffer bookkeeping dominate.
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		dir := b.TempDir()
+		store, err := OpenStore(filepath.Join(dir, "backups.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err := store.SetupDB(); err != nil {
+			b.Fatal(err)
+		}
+
+		backup, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      sourcePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: dir,
+			OutputFileName:  "backup",
+			BlockSize:       4096,
+			BlockBufferSize: 512,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		backup.disableColdStart = true
+
+		if err := backup.Run(); err != nil {
+			b.Fatal(err)
+		}
+		_ = store.Close()
+	}
+}
+
+func TestBackupFileLayout(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	const blockSize = 4096
+	unique := make([][]byte, 6)
+	for i := range unique {
+		unique[i] = make([]byte, blockSize)
+		if _, err := rand.Read(unique[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Blocks repeat within and across buffers of 4 blocks.
+	layout := []int{0, 1, 0, 2, 1, 3, 0, 4, 5, 3, 2, 5}
+	var source []byte
+	for _, i := range layout {
+		source = append(source, unique[i]...)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "source.img")
+	if err := os.WriteFile(sourcePath, source, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      sourcePath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       blockSize,
+		BlockBufferSize: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each block is stored once, in the order of the first position it appears at.
+	data, err := os.ReadFile(b.FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) < len(unique)*blockSize {
+		t.Fatalf("expected at least %d bytes of blocks, got %d", len(unique)*blockSize, len(data))
+	}
+
+	for i, want := range unique {
+		if !bytes.Equal(data[i*blockSize:(i+1)*blockSize], want) {
+			t.Fatalf("expected block %d of the backup file to hold the block first seen at its position", i)
+		}
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "layout.img",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, source) {
+		t.Fatal("restored image doesn't match the source")
+	}
+}
@@ -0,0 +1,46 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// checkBaseImage refuses a BaseImagePath the differential's changes can't be applied to: the
+// base stands in for the full backup, so it must share its size and block size.
+func (r *Restore) checkBaseImage() error {
+	if r.backup.BackupType != backupTypeDifferential || r.backup.Chunking == ChunkingContentDefined {
+		return fmt.Errorf("restoring onto a base image requires a differential backup with %q chunking", ChunkingFixed)
+	}
+
+	full := r.chain[0]
+	if full.BlockSize != r.backup.BlockSize {
+		return fmt.Errorf("differential %d uses %d byte blocks, but its full backup %d uses %d byte blocks", r.backup.ID, r.backup.BlockSize, full.ID, full.BlockSize)
+	}
+
+	info, err := os.Stat(r.config.BaseImagePath)
+	if err != nil {
+		return fmt.Errorf("error inspecting base image: %v", err)
+	}
+
+	if info.Size() != int64(full.SizeInBytes) {
+		return fmt.Errorf("base image %s is %d bytes, but full backup %d the differential was taken against is %d bytes", r.config.BaseImagePath, info.Size(), full.ID, full.SizeInBytes)
+	}
+
+	return nil
+}
+
+// copyBaseImage writes the base image to the start of the target, leaving the base untouched.
+func (r *Restore) copyBaseImage(target restoreTarget) error {
+	base, err := os.Open(r.config.BaseImagePath)
+	if err != nil {
+		return fmt.Errorf("error opening base image: %v", err)
+	}
+	defer func() { _ = base.Close() }()
+
+	if _, err := io.Copy(io.NewOffsetWriter(target, 0), base); err != nil {
+		return fmt.Errorf("error copying base image: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreOntoBaseImage(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basePath := filepath.Join(t.TempDir(), "base.img")
+	if err := os.WriteFile(basePath, source, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base stands in for the full, so its backup file isn't needed.
+	if err := os.Remove(fb.FullPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreConfig := RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "overlay.img",
+		BaseImagePath:      basePath,
+		Validate:           true,
+	}
+
+	restore, err := NewRestore(restoreConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	compareChecksum(t, restore.FullRestorePath(), diffWithChangesChecksum)
+	compareChecksum(t, basePath, fullBackupChecksum)
+
+	// A base of a different size can't take the differential's changes.
+	restoreConfig.BaseImagePath = "assets/tiny.ext4"
+	restoreConfig.OutputFileName = "mismatched.img"
+	if _, err := NewRestore(restoreConfig); err == nil {
+		t.Fatal("expected a base image of a different size to be rejected")
+	}
+
+	// A full backup has no changes to apply.
+	restoreConfig.BaseImagePath = basePath
+	restoreConfig.SourceBackupID = fb.Record.ID
+	if _, err := NewRestore(restoreConfig); err == nil {
+		t.Fatal("expected restoring a full backup onto a base image to be rejected")
+	}
+}
@@ -0,0 +1,122 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// RunBackups runs the backups described by configs, at most maxParallel at a time. Backups of the
+// same volume run one after another in the order they're listed, so each is layered on the ones
+// before it, while backups of different volumes run in parallel. The result of each backup is
+// returned at the index of its config, or nil if it failed, along with the errors of every backup
+// that failed. Failed backups are removed with Cleanup.
+func RunBackups(configs []*BackupConfig, maxParallel int) ([]*BackupResult, error) {
+	if maxParallel < 1 {
+		return nil, fmt.Errorf("max parallel backups must be at least 1, got %d", maxParallel)
+	}
+
+	// Group the configs by the volume they back up, keeping the order they were listed in.
+	type volumeKey struct {
+		store *Store
+		name  string
+	}
+
+	var groups [][]int
+	grouped := map[volumeKey]int{}
+	for i, cfg := range configs {
+		key := volumeKey{store: cfg.Store, name: batchVolumeKey(cfg)}
+		g, ok := grouped[key]
+		if !ok {
+			g = len(groups)
+			grouped[key] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+
+	// A cold start assumes no other backup inserts blocks while it runs, which doesn't hold once
+	// backups into the same store run in parallel.
+	parallel := maxParallel > 1 && len(groups) > 1
+
+	results := make([]*BackupResult, len(configs))
+	errs := make([]error, len(configs))
+	slots := make(chan struct{}, maxParallel)
+
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			for _, i := range group {
+				slots <- struct{}{}
+				results[i], errs[i] = runBatchedBackup(configs[i], parallel)
+				<-slots
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("backup of %s failed: %w", configs[i].DevicePath, err))
+		}
+	}
+
+	return results, errors.Join(failed...)
+}
+
+// runBatchedBackup runs a single backup of RunBackups and summarizes it.
+func runBatchedBackup(cfg *BackupConfig, parallel bool) (*BackupResult, error) {
+	b, err := NewBackup(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating backup: %w", err)
+	}
+	b.disableColdStart = parallel
+
+	if err := b.Run(); err != nil {
+		if cleanupErr := b.Cleanup(); cleanupErr != nil {
+			return nil, fmt.Errorf("error performing backup: %w (cleaning up also failed: %v)", err, cleanupErr)
+		}
+		return nil, fmt.Errorf("error performing backup: %w", err)
+	}
+
+	result, err := b.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// batchDevicePath returns the device path NewBackup identifies the config's volume by. Paths that
+// can't be resolved are left as they are, and fail once the backup is created.
+func batchDevicePath(cfg *BackupConfig) string {
+	if !cfg.FollowSymlinks {
+		return cfg.DevicePath
+	}
+
+	resolved, err := filepath.EvalSymlinks(cfg.DevicePath)
+	if err != nil {
+		return cfg.DevicePath
+	}
+
+	return resolved
+}
+
+// batchVolumeKey returns what NewBackup identifies the config's volume by: its filesystem UUID when
+// IdentifyByUUID is set and the source has one, otherwise the basename of its device path.
+func batchVolumeKey(cfg *BackupConfig) string {
+	devicePath := batchDevicePath(cfg)
+	if cfg.IdentifyByUUID {
+		resolved := *cfg
+		resolved.DevicePath = devicePath
+		if uuid, err := sourceUUID(&resolved); err == nil && uuid != "" {
+			return "uuid:" + uuid
+		}
+	}
+
+	return volumeName(devicePath)
+}
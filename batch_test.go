@@ -0,0 +1,126 @@
+package block
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRunBackups(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// Track the number of backups in flight through their hooks.
+	var mu sync.Mutex
+	var running, peak int
+	preHook := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		running++
+		peak = max(peak, running)
+		return nil
+	}
+	postHook := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		running--
+		return nil
+	}
+
+	// Random images share no blocks, so each backup file holds all of its volume's blocks.
+	dir := t.TempDir()
+	var configs []*BackupConfig
+	for _, name := range []string{"vol_a.img", "vol_b.img", "vol_c.img"} {
+		data := make([]byte, 4*1048576)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		configs = append(configs, &BackupConfig{
+			Store:           store,
+			DevicePath:      path,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+			PreHook:         preHook,
+			PostHook:        postHook,
+		})
+	}
+
+	// A second backup of the first volume runs after its full, as a differential.
+	configs = append(configs, configs[0])
+
+	results, err := RunBackups(configs, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peak > 2 {
+		t.Fatalf("expected at most 2 backups to run at once, got %d", peak)
+	}
+
+	for i, result := range results {
+		if result == nil {
+			t.Fatalf("expected backup %d to succeed", i)
+		}
+
+		record, err := store.FindBackup(result.BackupID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := backupTypeFull
+		if i == 3 {
+			expected = backupTypeDifferential
+		}
+
+		if record.BackupType != expected {
+			t.Fatalf("expected backup %d to be a %s backup, got %s", i, expected, record.BackupType)
+		}
+
+		if record.Status != backupStatusCompleted {
+			t.Fatalf("expected backup %d to be completed, got %s", i, record.Status)
+		}
+	}
+
+	for i, result := range results[:3] {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     result.BackupID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     filepath.Base(configs[i].DevicePath),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		checksum, err := fileChecksum(configs[i].DevicePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareChecksum(t, restore.FullRestorePath(), checksum)
+	}
+
+	if _, err := RunBackups(configs, 0); err == nil {
+		t.Fatal("expected a max parallel of 0 to be rejected")
+	}
+}
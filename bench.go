@@ -0,0 +1,95 @@
+package block
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BenchResult reports the performance of a backup using a specific block configuration.
+type BenchResult struct {
+	BlockSize       int
+	BlockBufferSize int
+	Duration        time.Duration
+	// Throughput is the number of source bytes processed per second.
+	Throughput float64
+	// DedupRatio is the size of the source divided by the size of the backup file.
+	DedupRatio float64
+}
+
+// Bench performs a full backup of the device for every combination of block size and
+// block buffer size, reporting throughput and dedup ratio for each. Every run uses its
+// own temporary store and output directory, which are removed on return, so results
+// are never persisted to the catalog.
+func Bench(devicePath string, blockSizes, blockBufferSizes []int) ([]BenchResult, error) {
+	tmpDir, err := os.MkdirTemp("", "bd-bench-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	var results []BenchResult
+	for _, blockSize := range blockSizes {
+		for _, blockBufferSize := range blockBufferSizes {
+			result, err := benchOne(tmpDir, devicePath, blockSize, blockBufferSize)
+			if err != nil {
+				return results, fmt.Errorf("error benchmarking block size %d with buffer size %d: %v", blockSize, blockBufferSize, err)
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+func benchOne(tmpDir, devicePath string, blockSize, blockBufferSize int) (BenchResult, error) {
+	runDir, err := os.MkdirTemp(tmpDir, "run-")
+	if err != nil {
+		return BenchResult{}, err
+	}
+	defer func() { _ = os.RemoveAll(runDir) }()
+
+	store, err := OpenStore(filepath.Join(runDir, "bench.db"))
+	if err != nil {
+		return BenchResult{}, err
+	}
+	defer func() { _ = store.Close() }()
+
+	if err := store.SetupDB(); err != nil {
+		return BenchResult{}, err
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      devicePath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: runDir,
+		BlockSize:       blockSize,
+		BlockBufferSize: blockBufferSize,
+	})
+	if err != nil {
+		return BenchResult{}, err
+	}
+
+	sourceSize := b.SizeInBytes()
+
+	start := time.Now()
+	if err := b.Run(); err != nil {
+		return BenchResult{}, err
+	}
+	duration := time.Since(start)
+
+	result := BenchResult{
+		BlockSize:       blockSize,
+		BlockBufferSize: blockBufferSize,
+		Duration:        duration,
+		Throughput:      float64(sourceSize) / duration.Seconds(),
+	}
+
+	if b.SizeInBytes() > 0 {
+		result.DedupRatio = float64(sourceSize) / float64(b.SizeInBytes())
+	}
+
+	return result, nil
+}
@@ -0,0 +1,39 @@
+package block
+
+import (
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	blockSizes := []int{65536, 1048576}
+	blockBufferSizes := []int{1, 8}
+
+	results, err := Bench("assets/pg.ext4", blockSizes, blockBufferSizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(blockSizes)*len(blockBufferSizes) {
+		t.Fatalf("expected %d results, got %d", len(blockSizes)*len(blockBufferSizes), len(results))
+	}
+
+	i := 0
+	for _, blockSize := range blockSizes {
+		for _, blockBufferSize := range blockBufferSizes {
+			result := results[i]
+			if result.BlockSize != blockSize || result.BlockBufferSize != blockBufferSize {
+				t.Fatalf("expected result %d to be for %d/%d, got %d/%d", i, blockSize, blockBufferSize, result.BlockSize, result.BlockBufferSize)
+			}
+
+			if result.Throughput <= 0 {
+				t.Fatalf("expected a positive throughput, got %f", result.Throughput)
+			}
+
+			// The sample asset contains duplicate blocks, so the backup is smaller than the source.
+			if result.DedupRatio <= 1 {
+				t.Fatalf("expected a dedup ratio greater than 1, got %f", result.DedupRatio)
+			}
+			i++
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package block
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// blkGetSize64 is the BLKGETSIZE64 ioctl request, which reports a block device's size in bytes.
+const blkGetSize64 = 0x80081272
+
+// ioctlBlockDeviceSize asks the kernel for the size of the block device at devicePath. Unlike
+// stat, this reports the true size of partitions and loop devices.
+func ioctlBlockDeviceSize(devicePath string) (int64, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+
+	return int64(size), nil
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package block
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attachLoopDevice attaches image to a loop device with partition scanning, skipping the test
+// when loop devices aren't available.
+func attachLoopDevice(t *testing.T, image string) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices require root")
+	}
+
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup is not installed")
+	}
+
+	out, err := exec.Command("losetup", "--find", "--show", "--partscan", image).Output()
+	if err != nil {
+		t.Skipf("unable to attach a loop device: %v", err)
+	}
+
+	device := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if err := exec.Command("losetup", "--detach", device).Run(); err != nil {
+			t.Logf("error detaching %s: %v", device, err)
+		}
+	})
+
+	return device
+}
+
+func TestLoopDeviceSize(t *testing.T) {
+	const (
+		imageSize      = 3 * 1048576
+		partitionStart = 2048 // sectors
+		partitionSize  = 2048 // sectors
+	)
+
+	// An image holding an MBR partition table with a single 1MiB partition.
+	image := make([]byte, imageSize)
+	entry := image[446:462]
+	entry[4] = 0x83
+	binary.LittleEndian.PutUint32(entry[8:], partitionStart)
+	binary.LittleEndian.PutUint32(entry[12:], partitionSize)
+	image[510], image[511] = 0x55, 0xAA
+
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(imagePath, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	device := attachLoopDevice(t, imagePath)
+
+	size, err := GetTargetSizeInBytes(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != imageSize {
+		t.Fatalf("expected loop device %s to be %d bytes, got %d", device, imageSize, size)
+	}
+
+	// The partition's node is created asynchronously, and not at all where partitions of loop
+	// devices aren't supported.
+	partition := device + "p1"
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(partition); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Skipf("partition %s was not created", partition)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	size, err = GetTargetSizeInBytes(partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != partitionSize*512 {
+		t.Fatalf("expected partition %s to be %d bytes, got %d", partition, partitionSize*512, size)
+	}
+}
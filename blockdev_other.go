@@ -0,0 +1,9 @@
+//go:build !linux
+
+package block
+
+import "errors"
+
+func ioctlBlockDeviceSize(devicePath string) (int64, error) {
+	return 0, errors.New("BLKGETSIZE64 is only supported on Linux")
+}
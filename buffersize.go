@@ -0,0 +1,96 @@
+package block
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// BlockBufferSizeAuto sizes a backup's buffer adaptively: it starts at a single block and doubles
+// while the source keeps being read faster, up to maxAdaptiveBufferBytes, then holds the size
+// that read fastest for the rest of the backup.
+const BlockBufferSizeAuto = -1
+
+const (
+	// maxAdaptiveBufferBytes caps the size of an adaptive buffer. Up to maxPipelineBuffers buffers
+	// are in flight at once.
+	maxAdaptiveBufferBytes = 16 << 20
+	// adaptiveSampleBuffers is the number of buffers read at each size before it's compared
+	// against the last, smoothing out the noise of individual reads.
+	adaptiveSampleBuffers = 4
+	// adaptiveMinSpeedup is how much faster a doubled buffer must read for the buffer to keep
+	// growing.
+	adaptiveMinSpeedup = 1.05
+)
+
+// ParseBlockBufferSize parses a block buffer size setting, either a positive number of blocks or
+// "auto" for BlockBufferSizeAuto.
+func ParseBlockBufferSize(value string) (int, error) {
+	if value == "auto" {
+		return BlockBufferSizeAuto, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("block buffer size must be a positive number or \"auto\", got %q", value)
+	}
+
+	return n, nil
+}
+
+// bufferSizer chooses the number of blocks each buffer of a backup holds. A fixed size never
+// changes, while an adaptive one grows as long as reads keep getting faster.
+type bufferSizer struct {
+	blocks    int
+	maxBlocks int
+	// stable is set once the adaptive size has settled.
+	stable bool
+	// The bytes read and time taken by the buffers sampled at the current size.
+	sampled   int
+	sampledIn time.Duration
+	buffers   int
+	// The fastest throughput seen, in bytes per second, and the size it was read at.
+	best       float64
+	bestBlocks int
+}
+
+func newBufferSizer(blockBufferSize, blockSize int) *bufferSizer {
+	if blockBufferSize != BlockBufferSizeAuto {
+		return &bufferSizer{blocks: blockBufferSize, maxBlocks: blockBufferSize, stable: true}
+	}
+
+	maxBlocks := max(maxAdaptiveBufferBytes/blockSize, 1)
+	return &bufferSizer{blocks: 1, maxBlocks: maxBlocks, stable: maxBlocks == 1, bestBlocks: 1}
+}
+
+// observe records that a full buffer of n bytes was read in elapsed, resizing the buffers that
+// follow once enough buffers have been sampled at the current size.
+func (s *bufferSizer) observe(n int, elapsed time.Duration) {
+	if s.stable {
+		return
+	}
+
+	s.sampled += n
+	s.sampledIn += elapsed
+	s.buffers++
+	if s.buffers < adaptiveSampleBuffers {
+		return
+	}
+
+	throughput := float64(s.sampled) / max(s.sampledIn, time.Nanosecond).Seconds()
+	s.sampled, s.sampledIn, s.buffers = 0, 0, 0
+
+	if throughput < s.best*adaptiveMinSpeedup {
+		// Growing stopped paying off, so settle on the fastest size.
+		s.blocks = s.bestBlocks
+		s.stable = true
+		return
+	}
+
+	s.best, s.bestBlocks = throughput, s.blocks
+	if s.blocks == s.maxBlocks {
+		s.stable = true
+		return
+	}
+	s.blocks = min(s.blocks*2, s.maxBlocks)
+}
@@ -0,0 +1,103 @@
+package block
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBufferSizerConverges(t *testing.T) {
+	const blockSize = 4096
+
+	// run simulates a source whose throughput grows with the buffer up to limit blocks.
+	run := func(limit int) *bufferSizer {
+		sizer := newBufferSizer(BlockBufferSizeAuto, blockSize)
+		for i := 0; i < 1000 && !sizer.stable; i++ {
+			n := sizer.blocks * blockSize
+			perSecond := float64(min(sizer.blocks, limit)) * (10 << 20)
+			sizer.observe(n, time.Duration(float64(n)/perSecond*float64(time.Second)))
+		}
+		return sizer
+	}
+
+	if sizer := run(64); !sizer.stable || sizer.blocks != 64 {
+		t.Fatalf("expected the buffer to settle on 64 blocks, got %d (stable: %v)", sizer.blocks, sizer.stable)
+	}
+
+	// A source that keeps speeding up grows the buffer to the memory cap.
+	if sizer := run(1 << 30); !sizer.stable || sizer.blocks != maxAdaptiveBufferBytes/blockSize {
+		t.Fatalf("expected the buffer to grow to %d blocks, got %d (stable: %v)", maxAdaptiveBufferBytes/blockSize, sizer.blocks, sizer.stable)
+	}
+
+	// Blocks larger than the cap are buffered one at a time.
+	if sizer := newBufferSizer(BlockBufferSizeAuto, 2*maxAdaptiveBufferBytes); !sizer.stable || sizer.blocks != 1 {
+		t.Fatalf("expected a single block buffer, got %d", sizer.blocks)
+	}
+
+	fixed := newBufferSizer(5, blockSize)
+	fixed.observe(5*blockSize, time.Millisecond)
+	if fixed.blocks != 5 {
+		t.Fatalf("expected a fixed buffer to stay at 5 blocks, got %d", fixed.blocks)
+	}
+}
+
+func TestAdaptiveBlockBufferSize(t *testing.T) {
+	backup := func(blockBufferSize int) (BackupResult, string) {
+		dir := t.TempDir()
+		store, err := OpenStore(filepath.Join(dir, "backups.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		if err := store.SetupDB(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      "assets/pg.ext4",
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: dir,
+			OutputFileName:  "backup",
+			BlockSize:       65536,
+			BlockBufferSize: blockBufferSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := b.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return result, b.FullPath()
+	}
+
+	fixed, fixedPath := backup(5)
+	adaptive, adaptivePath := backup(BlockBufferSizeAuto)
+
+	if fixed.BlockBufferSize != 5 {
+		t.Fatalf("expected a fixed buffer of 5 blocks, got %d", fixed.BlockBufferSize)
+	}
+
+	if adaptive.BlockBufferSize < 1 || adaptive.BlockBufferSize > maxAdaptiveBufferBytes/65536 {
+		t.Fatalf("expected the adaptive buffer to settle within 1 and %d blocks, got %d", maxAdaptiveBufferBytes/65536, adaptive.BlockBufferSize)
+	}
+
+	// Buffer sizes don't change what's backed up.
+	checksum, err := fileSHA256(fixedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, adaptivePath, checksum)
+
+	if adaptive.BlocksWritten != fixed.BlocksWritten || adaptive.BackupSizeInBytes != fixed.BackupSizeInBytes {
+		t.Fatalf("expected the adaptive backup to match the fixed one, got %+v and %+v", adaptive, fixed)
+	}
+}
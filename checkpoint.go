@@ -0,0 +1,90 @@
+package block
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errSimulatedCrash is returned when a restore is aborted by crashAfter.
+var errSimulatedCrash = errors.New("simulated crash")
+
+// restoreCheckpoint records how far a restore progressed. The blocks of a backup file are
+// restored in the order they're stored, so the progress through the file is all that's needed
+// to resume.
+type restoreCheckpoint struct {
+	backupID   int
+	outputPath string
+	// layerBackupID is the backup whose file was being restored.
+	layerBackupID int
+	// blocksRestored is the number of blocks of the layer's file that were restored.
+	blocksRestored int
+}
+
+// saveCheckpoint syncs the restored blocks to storage, then records that the first blocks of
+// the layer's file have been restored.
+func (r *Restore) saveCheckpoint(target restoreTarget, layer BackupRecord, blocks int) error {
+	if err := target.Sync(); err != nil {
+		return fmt.Errorf("error syncing restore file: %v", err)
+	}
+
+	cp := restoreCheckpoint{
+		backupID:       r.backup.ID,
+		outputPath:     r.FullRestorePath(),
+		layerBackupID:  layer.ID,
+		blocksRestored: blocks,
+	}
+	if err := r.store.saveRestoreCheckpoint(cp); err != nil {
+		return fmt.Errorf("error recording restore checkpoint: %v", err)
+	}
+
+	return nil
+}
+
+func (s Store) saveRestoreCheckpoint(cp restoreCheckpoint) error {
+	_, err := s.Exec(`INSERT INTO restore_checkpoints (backup_id, output_path, layer_backup_id, blocks_restored) VALUES (?, ?, ?, ?)
+		ON CONFLICT(backup_id, output_path) DO UPDATE SET layer_backup_id = excluded.layer_backup_id, blocks_restored = excluded.blocks_restored, updated_at = CURRENT_TIMESTAMP`,
+		cp.backupID, cp.outputPath, cp.layerBackupID, cp.blocksRestored)
+	return err
+}
+
+// findRestoreCheckpoint returns the checkpoint of an interrupted restore, or nil if there is none.
+func (s Store) findRestoreCheckpoint(backupID int, outputPath string) (*restoreCheckpoint, error) {
+	cp := restoreCheckpoint{backupID: backupID, outputPath: outputPath}
+	row := s.QueryRow("SELECT layer_backup_id, blocks_restored FROM restore_checkpoints WHERE backup_id = ? AND output_path = ?", backupID, outputPath)
+	err := row.Scan(&cp.layerBackupID, &cp.blocksRestored)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &cp, nil
+}
+
+func (s Store) deleteRestoreCheckpoint(backupID int, outputPath string) error {
+	_, err := s.Exec("DELETE FROM restore_checkpoints WHERE backup_id = ? AND output_path = ?", backupID, outputPath)
+	return err
+}
+
+// openResumeFile opens the target of a resumed restore, keeping its existing contents.
+func openResumeFile(path string, _ ExistingFilePolicy) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// skipBytes advances the backup stream past n bytes, seeking when the stream supports it.
+func skipBytes(reader io.Reader, n int) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(int64(n), io.SeekCurrent)
+		return err
+	}
+
+	if _, err := io.CopyN(io.Discard, reader, int64(n)); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
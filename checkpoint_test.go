@@ -0,0 +1,109 @@
+package block
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRestoreResumeFromCheckpoint(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreCfg := RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     db.Record.FileName,
+		CheckpointInterval: 10,
+	}
+
+	restore, err := NewRestore(restoreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash part way through the full backup's blocks.
+	restore.crashAfter = 25
+	if err := restore.Run(); !errors.Is(err, errSimulatedCrash) {
+		t.Fatalf("expected the simulated crash, got %v", err)
+	}
+
+	cp, err := store.findRestoreCheckpoint(db.Record.ID, restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cp == nil || cp.layerBackupID != fb.Record.ID || cp.blocksRestored != 20 {
+		t.Fatalf("expected a checkpoint at block 20 of backup %d, got %+v", fb.Record.ID, cp)
+	}
+
+	restoreCfg.Resume = true
+	resumed, err := NewRestore(restoreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resumed.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the blocks after the checkpoint are restored again.
+	if expected := 37 - 20 + 1; resumed.blocksRestored != expected {
+		t.Fatalf("expected %d blocks to be restored on resume, got %d", expected, resumed.blocksRestored)
+	}
+
+	targetChecksum, err := fileChecksum(resumed.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffWithChangesChecksum != targetChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", diffWithChangesChecksum, targetChecksum)
+	}
+
+	cp, err = store.findRestoreCheckpoint(db.Record.ID, resumed.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cp != nil {
+		t.Fatalf("expected the checkpoint to be removed after the restore completed, got %+v", cp)
+	}
+}
@@ -0,0 +1,338 @@
+package block
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+)
+
+// chunkWindowSize is the number of trailing bytes the rolling hash is computed over.
+const chunkWindowSize = 64
+
+// buzhashTable maps each byte value to a pseudo-random value used by the rolling hash.
+// The table is generated from a fixed seed so chunk boundaries are stable across runs.
+var buzhashTable = func() [256]uint32 {
+	var table [256]uint32
+	seed := uint64(0x9E3779B97F4A7C15)
+	for i := range table {
+		// splitmix64
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = uint32(z ^ (z >> 31))
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks using a buzhash rolling hash.
+// A boundary is declared when the low bits of the hash are zero, so the chunk sizes
+// average the target size and boundaries move with the data rather than its offset.
+type chunker struct {
+	reader  *bufio.Reader
+	minSize int
+	maxSize int
+	mask    uint32
+}
+
+func newChunker(r io.Reader, avgSize int) *chunker {
+	// Round the average size down to a power of two to derive the boundary mask.
+	avg := 1 << (bits.Len(uint(avgSize)) - 1)
+
+	minSize := avg / 4
+	if minSize < chunkWindowSize {
+		minSize = chunkWindowSize
+	}
+
+	return &chunker{
+		reader:  bufio.NewReaderSize(r, avg*4),
+		minSize: minSize,
+		maxSize: avg * 4,
+		mask:    uint32(avg - 1),
+	}
+}
+
+// next returns the next chunk, or io.EOF once the stream has been consumed.
+func (c *chunker) next() ([]byte, error) {
+	chunk := make([]byte, 0, c.maxSize)
+	var hash uint32
+
+	for len(chunk) < c.maxSize {
+		in, err := c.reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, in)
+		hash = bits.RotateLeft32(hash, 1) ^ buzhashTable[in]
+		if len(chunk) > chunkWindowSize {
+			out := chunk[len(chunk)-chunkWindowSize-1]
+			hash ^= bits.RotateLeft32(buzhashTable[out], chunkWindowSize)
+		}
+
+		if len(chunk) >= c.minSize && hash&c.mask == 0 {
+			break
+		}
+	}
+
+	if len(chunk) == 0 {
+		return nil, io.EOF
+	}
+
+	return chunk, nil
+}
+
+// contentChunk is a single content-defined chunk waiting to be recorded.
+type contentChunk struct {
+	position int
+	offset   int64
+	length   int
+	hash     string
+	stored   bool
+}
+
+// runContentDefined splits the source into content-defined chunks. Every backup records the
+// complete chunk layout, but only chunks not already held by the parent full backup are
+// written to the backup file, keeping dedup intact when data shifts.
+func (b *Backup) runContentDefined(source io.ReaderAt, target io.Writer) error {
+	// Hashes available from the parent full backup's file.
+	parentHashes := map[string]bool{}
+	if b.BackupType() == backupTypeDifferential {
+		hashes, err := b.store.findHashesByBackup(b.lastFullRecord.ID)
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			parentHashes[hash] = true
+		}
+	}
+
+	reader := io.NewSectionReader(source, 0, int64(b.SizeInBytes()))
+	c := newChunker(reader, b.Config.BlockSize)
+
+	stored := map[string]bool{}
+	var pending []contentChunk
+	var offset int64
+	position := 0
+
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading block data: %w", err)
+		}
+
+		b.stats.bytesRead.Add(int64(len(data)))
+		b.progress.add(1)
+
+		chunk := contentChunk{
+			position: position,
+			offset:   offset,
+			length:   len(data),
+			hash:     b.hashBlock(data),
+		}
+
+		if !isFillBlock(chunk.hash) && !parentHashes[chunk.hash] && !stored[chunk.hash] {
+			if _, err := target.Write(data); err != nil {
+				return fmt.Errorf("error writing block to backup file: %v", err)
+			}
+			stored[chunk.hash] = true
+			chunk.stored = true
+			b.stats.blocksWritten.Add(1)
+			b.stats.bytesWritten.Add(int64(len(data)))
+		}
+
+		pending = append(pending, chunk)
+		if len(pending) >= b.Config.BlockBufferSize {
+			if err := b.insertContentChunks(pending); err != nil {
+				return err
+			}
+			pending = pending[:0]
+		}
+
+		offset += int64(len(data))
+		position++
+	}
+
+	if err := b.insertContentChunks(pending); err != nil {
+		return err
+	}
+
+	// The number of chunks is only known once the source has been read.
+	b.Record.TotalBlocks = position
+	return b.store.updateBackupTotalBlocks(b.Record.ID, position)
+}
+
+func (b *Backup) insertContentChunks(chunks []contentChunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	tx, err := b.begin()
+	if err != nil {
+		return err
+	}
+
+	hashValues := []interface{}{}
+	insertValues := []interface{}{}
+	for _, chunk := range chunks {
+		hashValues = append(hashValues, chunk.hash)
+		insertValues = append(insertValues, chunk.hash, b.Record.HashAlgorithm)
+	}
+	placeholders := strings.Trim(strings.Repeat("?,", len(hashValues)), ",")
+
+	// Register any hashes we haven't seen before.
+	valueStrings := strings.Trim(strings.Repeat("(?, ?),", len(hashValues)), ",")
+	if _, err := tx.Exec("INSERT OR IGNORE INTO blocks (hash, algorithm) VALUES "+valueStrings, insertValues...); err != nil {
+		handleRollback(tx)
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, hash FROM blocks WHERE algorithm = ? AND hash IN ("+placeholders+")", append([]interface{}{b.Record.HashAlgorithm}, hashValues...)...)
+	if err != nil {
+		handleRollback(tx)
+		return err
+	}
+
+	blockIDMap := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			handleRollback(tx)
+			return err
+		}
+		blockIDMap[hash] = id
+	}
+	rows.Close()
+
+	var positionStrings []string
+	var positionArgs []interface{}
+	for _, chunk := range chunks {
+		positionStrings = append(positionStrings, "(?, ?, ?, ?, ?, ?)")
+		positionArgs = append(positionArgs, b.Record.ID, blockIDMap[chunk.hash], chunk.position, chunk.offset, chunk.length, chunk.stored)
+	}
+
+	stmt := "INSERT INTO block_positions (backup_id, block_id, position, offset, length, stored) VALUES " + strings.Join(positionStrings, ",")
+	if _, err := tx.Exec(stmt, positionArgs...); err != nil {
+		handleRollback(tx)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// restoreContentDefined restores a content-defined backup. The chunks making up the target
+// are stored across the parent full's file (if any) and the backup's own file.
+func (r *Restore) restoreContentDefined(target restoreTarget) error {
+	// Resolve the offsets each chunk must be written to.
+	offsets := map[string][]int64{}
+	rows, err := r.store.Query("SELECT b.hash, bp.offset FROM block_positions bp JOIN blocks b ON bp.block_id = b.id WHERE bp.backup_id = ?", r.backup.ID)
+	if err != nil {
+		return fmt.Errorf("error querying block positions: %w", err)
+	}
+	for rows.Next() {
+		var hash string
+		var offset int64
+		if err := rows.Scan(&hash, &offset); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+		offsets[hash] = append(offsets[hash], offset)
+	}
+	rows.Close()
+
+	for _, layer := range r.chain {
+		if err := r.restoreContentDefinedLayer(target, layer, offsets); err != nil {
+			return err
+		}
+	}
+
+	// Constant chunks aren't stored in any file, so reconstruct them from their descriptor.
+	for hash, chunkOffsets := range offsets {
+		if !isFillBlock(hash) {
+			continue
+		}
+
+		data, ok := parseFillDescriptor(hash)
+		if !ok {
+			return fmt.Errorf("invalid fill block descriptor %q", hash)
+		}
+
+		for _, offset := range chunkOffsets {
+			if err := r.writeAt(target, data, offset); err != nil {
+				return err
+			}
+			r.progress.add(1)
+		}
+	}
+
+	return nil
+}
+
+func (r *Restore) restoreContentDefinedLayer(target restoreTarget, layer BackupRecord, offsets map[string][]int64) error {
+	reader, closeSource, err := r.openBackupData(layer)
+	if err != nil {
+		return fmt.Errorf("error opening restore source file: %v", err)
+	}
+	defer closeSource()
+
+	if len(r.config.FilterCommand) > 0 {
+		filter, err := newFilterReader(r.config.FilterCommand, reader)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = filter.Close() }()
+		reader = filter
+	}
+
+	// The chunks stored in the layer's file, in the order they were written.
+	rows, err := r.store.Query("SELECT b.hash, bp.length FROM block_positions bp JOIN blocks b ON bp.block_id = b.id WHERE bp.backup_id = ? AND bp.stored = 1 ORDER BY bp.position ASC", layer.ID)
+	if err != nil {
+		return fmt.Errorf("error querying stored blocks: %w", err)
+	}
+	defer rows.Close()
+
+	var expected int
+	row := r.store.QueryRow("SELECT COUNT(*) FROM block_positions WHERE backup_id = ? AND stored = 1", layer.ID)
+	if err := row.Scan(&expected); err != nil {
+		return fmt.Errorf("error counting stored blocks: %w", err)
+	}
+
+	for blockNum := 0; rows.Next(); blockNum++ {
+		var hash string
+		var length int
+		if err := rows.Scan(&hash, &length); err != nil {
+			return fmt.Errorf("failed to scan stored block: %w", err)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return &TruncatedBackupError{Path: layer.FullPath, Expected: expected, Actual: blockNum}
+			}
+			return fmt.Errorf("error reading block %s: %w", hash, err)
+		}
+
+		if layer.HashAlgorithm.sum(data) != hash {
+			return fmt.Errorf("block %s in %s is corrupt", hash, layer.FullPath)
+		}
+
+		for _, offset := range offsets[hash] {
+			if err := r.writeAt(target, data, offset); err != nil {
+				return err
+			}
+			r.progress.add(1)
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,148 @@
+package block
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestChunkerBoundariesFollowContent(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := func(data []byte) []string {
+		var hashes []string
+		c := newChunker(bytes.NewReader(data), 8192)
+		for {
+			chunk, err := c.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunk) > c.maxSize {
+				t.Fatalf("chunk of %d bytes exceeds the max size of %d", len(chunk), c.maxSize)
+			}
+			hashes = append(hashes, calculateBlockHash(chunk))
+		}
+		return hashes
+	}
+
+	original := chunks(data)
+
+	// Insert a few bytes in the middle of the data.
+	inserted := append(append(append([]byte{}, data[:len(data)/2]...), []byte("inserted")...), data[len(data)/2:]...)
+	shifted := chunks(inserted)
+
+	known := map[string]bool{}
+	for _, hash := range original {
+		known[hash] = true
+	}
+
+	changed := 0
+	for _, hash := range shifted {
+		if !known[hash] {
+			changed++
+		}
+	}
+
+	if changed > 3 {
+		t.Fatalf("expected an insertion to only affect nearby chunks, %d of %d chunks changed", changed, len(shifted))
+	}
+}
+
+func TestContentDefinedChunkingDedup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	original := make([]byte, 2<<20)
+	rand.New(rand.NewSource(42)).Read(original)
+
+	// Insert data into the middle of the original, shifting everything that follows.
+	inserted := append(append(append([]byte{}, original[:len(original)/2]...), bytes.Repeat([]byte{0xAB}, 100)...), original[len(original)/2:]...)
+
+	differentialAfterInsert := func(name string, chunking Chunking) *Backup {
+		devicePath := "backups/" + name
+		if err := os.WriteFile(devicePath, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       16384,
+			BlockBufferSize: 16,
+			Chunking:        chunking,
+		}
+
+		b, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(devicePath, inserted, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.OutputFileName = ""
+		db, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		if db.BackupType() != backupTypeDifferential {
+			t.Fatalf("expected a differential backup, got %s", db.BackupType())
+		}
+
+		return db
+	}
+
+	fixed := differentialAfterInsert("fixed.img", ChunkingFixed)
+	content := differentialAfterInsert("content.img", ChunkingContentDefined)
+
+	// Fixed-size blocks after the insertion all shift, so roughly half the data is rewritten.
+	if content.SizeInBytes()*4 > fixed.SizeInBytes() {
+		t.Fatalf("expected content-defined differential (%d bytes) to be far smaller than fixed (%d bytes)", content.SizeInBytes(), fixed.SizeInBytes())
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     content.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     content.Record.FileName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, inserted) {
+		t.Fatal("expected the restored content-defined backup to match the source")
+	}
+}
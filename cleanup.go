@@ -0,0 +1,265 @@
+package block
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cleanup removes what a failed or interrupted backup left behind: its partial backup file, its
+// block positions, the blocks no other backup references, including those it inserted before
+// failing to record their positions, any restore checkpoints and the hash cache built from it.
+// The record itself is kept, marked failed, so the failure can still be investigated. Cleanup
+// does nothing once the backup has completed, even if Run returned a PostHook error, so it's safe
+// to call whenever Run returns, and calling it again has no further effect.
+func (b *Backup) Cleanup() error {
+	if b.Record == nil {
+		return nil
+	}
+
+	tx, err := b.store.Begin()
+	if err != nil {
+		return err
+	}
+
+	// The stored status is the one that counts, as the record may be stale.
+	var status string
+	if err := tx.QueryRow("SELECT status FROM backups WHERE id = ?", b.Record.ID).Scan(&status); err != nil {
+		handleRollback(tx)
+		return fmt.Errorf("error checking the status of backup %d: %w", b.Record.ID, err)
+	}
+
+	if status == backupStatusCompleted {
+		handleRollback(tx)
+		b.Record.Status = status
+		return nil
+	}
+
+	if err := removeBackupData(tx, b.Record.ID); err != nil {
+		handleRollback(tx)
+		return err
+	}
+
+	// The blocks it inserted without recording their positions, which no backup references yet.
+	unpositioned := strings.TrimSuffix(strings.Repeat("?,", len(b.unpositioned)), ",")
+	unpositionedArgs := []interface{}{b.Record.HashAlgorithm}
+	for _, hash := range b.unpositioned {
+		unpositionedArgs = append(unpositionedArgs, hash)
+	}
+	unpositionedArgs = append(unpositionedArgs, b.Record.ID)
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM blocks WHERE algorithm = ? AND hash IN (" + unpositioned + ") AND NOT " + referencedByOtherBackups, unpositionedArgs},
+		{"UPDATE backups SET status = ? WHERE id = ?", []interface{}{backupStatusFailed, b.Record.ID}},
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			handleRollback(tx)
+			return fmt.Errorf("error cleaning up backup %d: %w", b.Record.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.Record.Status = backupStatusFailed
+	b.unpositioned = nil
+
+	// Files can't be removed transactionally, so the file goes once the records are gone.
+	if b.createdFile {
+		if err := os.Remove(b.FullPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("backup %d was cleaned up, but its backup file couldn't be removed: %v", b.Record.ID, err)
+		}
+		b.createdFile = false
+	}
+
+	return nil
+}
+
+// referencedByOtherBackups matches the blocks referenced by the positions of any backup other than
+// the one passed as its argument.
+const referencedByOtherBackups = "EXISTS (SELECT 1 FROM block_positions op WHERE op.backup_id != ? AND blocks.id BETWEEN op.block_id AND op.block_id + op.run_length - 1)"
+
+// backupBlocks selects the ids of the blocks referenced by the positions of the backup passed as
+// its argument.
+const backupBlocks = "SELECT b.id FROM block_positions bp JOIN blocks b ON " + positionRange + " WHERE bp.backup_id = ?"
+
+// removeBackupData deletes the backup's block positions, the blocks no other backup references,
+// its restore checkpoints and the hash cache built from it, leaving its record in place.
+func removeBackupData(tx *sql.Tx, backupID int) error {
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM blocks WHERE id IN (" + backupBlocks + ") AND NOT " + referencedByOtherBackups, []interface{}{backupID, backupID}},
+		{"DELETE FROM block_positions WHERE backup_id = ?", []interface{}{backupID}},
+		{"DELETE FROM restore_checkpoints WHERE backup_id = ? OR layer_backup_id = ?", []interface{}{backupID, backupID}},
+		{"DELETE FROM hash_cache WHERE backup_id = ?", []interface{}{backupID}},
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("error removing the data of backup %d: %w", backupID, err)
+		}
+	}
+
+	return nil
+}
+
+// PruneResult describes what PruneIncompleteBackups removed.
+type PruneResult struct {
+	// Backups are the records of the pruned backups.
+	Backups []BackupRecord
+	// Shared are the records of the backups kept because other backups reference blocks stored
+	// in their backup files.
+	Shared []BackupRecord
+	// OrphanedBlocks is the number of blocks removed that no backup referenced, such as those
+	// inserted by a backup that crashed before recording their positions.
+	OrphanedBlocks int
+}
+
+// PruneIncompleteBackups deletes the backups that failed, along with their backup files and the
+// data Cleanup removes. Backups still running are assumed to be in progress unless they started
+// more than runningOlderThan ago, such as those interrupted by a crash. Completed backups, and the
+// blocks and backup files they use, are never removed, so every restorable chain is kept intact:
+// a failed backup whose blocks other backups reference is kept, along with its backup file, and
+// reported in Shared. Once no backup is running, the blocks no backup references are removed too.
+func (s Store) PruneIncompleteBackups(runningOlderThan time.Duration) (PruneResult, error) {
+	backups, err := s.ListBackups()
+	if err != nil {
+		return PruneResult{}, err
+	}
+
+	// Files written over by a later backup belong to it.
+	completedPaths := map[string]bool{}
+	for _, backup := range backups {
+		if backup.Status == backupStatusCompleted {
+			completedPaths[backup.FullPath] = true
+		}
+	}
+
+	var result PruneResult
+	cutoff := time.Now().Add(-runningOlderThan)
+	for _, backup := range backups {
+		if backup.Status != backupStatusFailed && (backup.Status != backupStatusRunning || !backup.CreatedAt.Before(cutoff)) {
+			continue
+		}
+
+		pruned, shared, err := s.pruneBackup(backup)
+		if err != nil {
+			return result, err
+		}
+
+		// Its backup file holds the only copy of blocks other backups read.
+		if shared {
+			result.Shared = append(result.Shared, backup)
+			continue
+		}
+
+		// The backup completed since it was listed.
+		if !pruned {
+			continue
+		}
+		result.Backups = append(result.Backups, backup)
+
+		// Files can't be removed transactionally, so they go once the records are gone.
+		if backup.OutputFormat == string(BackupOutputFormatFile) && backup.RemoteKey == "" && !completedPaths[backup.FullPath] {
+			if err := os.Remove(backup.FullPath); err != nil && !os.IsNotExist(err) {
+				return result, fmt.Errorf("backup %d was pruned, but its backup file couldn't be removed: %v", backup.ID, err)
+			}
+		}
+	}
+
+	result.OrphanedBlocks, err = s.removeOrphanedBlocks()
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// pruneBackup deletes the backup and its data, unless it's no longer in the status it was listed
+// with, or other backups reference the blocks it stored. It reports whether the backup was
+// deleted, and whether it was kept because its blocks are shared.
+func (s Store) pruneBackup(backup BackupRecord) (bool, bool, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return false, false, err
+	}
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM backups WHERE id = ?", backup.ID).Scan(&status); err != nil {
+		handleRollback(tx)
+		return false, false, fmt.Errorf("error checking the status of backup %d: %w", backup.ID, err)
+	}
+
+	if status != backup.Status {
+		handleRollback(tx)
+		return false, false, nil
+	}
+
+	var shared int
+	row := tx.QueryRow("SELECT COUNT(*) FROM blocks WHERE id IN ("+backupBlocks+") AND hash NOT LIKE ? AND "+referencedByOtherBackups, backup.ID, fillBlockPrefix+"%", backup.ID)
+	if err := row.Scan(&shared); err != nil {
+		handleRollback(tx)
+		return false, false, fmt.Errorf("error checking for shared blocks: %w", err)
+	}
+
+	if shared > 0 {
+		handleRollback(tx)
+		return false, true, nil
+	}
+
+	if err := removeBackupData(tx, backup.ID); err != nil {
+		handleRollback(tx)
+		return false, false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM backups WHERE id = ?", backup.ID); err != nil {
+		handleRollback(tx)
+		return false, false, fmt.Errorf("error deleting backup %d: %w", backup.ID, err)
+	}
+
+	return true, false, tx.Commit()
+}
+
+// removeOrphanedBlocks deletes the blocks no backup's positions reference, returning the number
+// removed. A running backup's newest blocks don't have positions yet, so nothing is removed while
+// any backup is running.
+func (s Store) removeOrphanedBlocks() (int, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var running int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM backups WHERE status = ?", backupStatusRunning).Scan(&running); err != nil {
+		handleRollback(tx)
+		return 0, fmt.Errorf("error counting running backups: %w", err)
+	}
+
+	if running > 0 {
+		handleRollback(tx)
+		return 0, nil
+	}
+
+	res, err := tx.Exec("DELETE FROM blocks WHERE id NOT IN (SELECT b.id FROM block_positions bp JOIN blocks b ON " + positionRange + ")")
+	if err != nil {
+		handleRollback(tx)
+		return 0, fmt.Errorf("error removing orphaned blocks: %w", err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		handleRollback(tx)
+		return 0, err
+	}
+
+	return int(removed), tx.Commit()
+}
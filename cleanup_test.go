@@ -0,0 +1,394 @@
+package block
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingWriter fails every write once limit bytes have been written.
+type failingWriter struct {
+	io.Writer
+	limit int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		return 0, errors.New("simulated write failure")
+	}
+	f.limit -= len(p)
+	return f.Writer.Write(p)
+}
+
+func TestBackupCleanup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	// Fail the backup partway, once some of its iterations have been recorded.
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.wrapTarget = func(w io.Writer) io.Writer { return &failingWriter{Writer: w, limit: 20 * 1048576} }
+
+	if err := b.Run(); err == nil {
+		t.Fatal("expected the backup to fail")
+	}
+
+	positions, err := store.findBlockPositionsByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) == 0 {
+		t.Fatal("expected the failed backup to have recorded positions")
+	}
+
+	// Cleanup can be called repeatedly.
+	for i := 0; i < 2; i++ {
+		if err := b.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(b.FullPath()); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial backup file to be removed, got %v", err)
+	}
+
+	positions, err = store.findBlockPositionsByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 0 {
+		t.Fatalf("expected no positions to remain, got %d", len(positions))
+	}
+
+	var blocks int
+	if err := store.QueryRow("SELECT COUNT(*) FROM blocks").Scan(&blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	if blocks != 0 {
+		t.Fatalf("expected no blocks to remain, got %d", blocks)
+	}
+
+	record, err := store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Status != backupStatusFailed {
+		t.Fatalf("expected the backup to be marked failed, got %s", record.Status)
+	}
+
+	// No complete full was left behind, so the next backup is a full that restores cleanly.
+	b, err = NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.BackupType() != backupTypeFull {
+		t.Fatalf("expected a full backup, got %s", b.BackupType())
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleanup leaves a completed backup alone.
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "pg.ext4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, restore.FullRestorePath(), fullBackupChecksum)
+}
+
+func TestBackupCleanupAfterPostHookFailure(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+		PostHook:        func() error { return errors.New("unable to thaw") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err == nil {
+		t.Fatal("expected the post-hook error to be returned")
+	}
+
+	// The backup itself completed, so the cleanup made on any Run error leaves it alone.
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.Status != backupStatusCompleted {
+		t.Fatalf("expected the backup to stay completed, got %s", record.Status)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "pg.ext4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, restore.FullRestorePath(), fullBackupChecksum)
+}
+
+func TestPruneIncompleteBackups(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	// A completed chain of a full and a differential.
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A backup that failed on its first write, leaving a partial file and a block without positions.
+	data := make([]byte, 4*1048576)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	randomPath := filepath.Join(t.TempDir(), "random.img")
+	if err := os.WriteFile(randomPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	failedCfg := *cfg
+	failedCfg.DevicePath = randomPath
+	failed, err := NewBackup(&failedCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.wrapTarget = func(w io.Writer) io.Writer { return &failingWriter{Writer: w} }
+
+	if err := failed.Run(); err == nil {
+		t.Fatal("expected the backup to fail")
+	}
+
+	// A backup that's still running.
+	runningCfg := *cfg
+	runningCfg.DevicePath = "assets/tiny.ext4"
+	running, err := NewBackup(&runningCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recently started backups are assumed to be in progress, and block orphans while they run.
+	result, err := store.PruneIncompleteBackups(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Backups) != 1 || result.Backups[0].ID != failed.Record.ID || result.OrphanedBlocks != 0 {
+		t.Fatalf("expected only the failed backup to be pruned, got %+v", result)
+	}
+
+	if _, err := os.Stat(failed.FullPath()); !os.IsNotExist(err) {
+		t.Fatalf("expected the failed backup's file to be removed, got %v", err)
+	}
+
+	result, err = store.PruneIncompleteBackups(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed backup's first buffer of blocks was inserted before its write failed.
+	if len(result.Backups) != 1 || result.Backups[0].ID != running.Record.ID || result.OrphanedBlocks != 4 {
+		t.Fatalf("expected the running backup and 4 orphaned blocks to be pruned, got %+v", result)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 2 || backups[0].ID != fb.Record.ID || backups[1].ID != db.Record.ID {
+		t.Fatalf("expected only the completed backups to remain, got %+v", backups)
+	}
+
+	// The chain still restores.
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "pg_altered.ext4",
+		Validate:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, restore.FullRestorePath(), diffWithChangesChecksum)
+}
+
+func TestPruneIncompleteBackupsKeepsSharedBlocks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	// A full that fails partway, leaving its blocks and positions behind.
+	failed, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.wrapTarget = func(w io.Writer) io.Writer { return &failingWriter{Writer: w, limit: 20 * 1048576} }
+
+	if err := failed.Run(); err == nil {
+		t.Fatal("expected the backup to fail")
+	}
+
+	// The next full dedups against the blocks the failed backup stored.
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := store.PruneIncompleteBackups(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Backups) != 0 || len(result.Shared) != 1 || result.Shared[0].ID != failed.Record.ID {
+		t.Fatalf("expected the failed backup to be kept for its shared blocks, got %+v", result)
+	}
+
+	if _, err := os.Stat(failed.FullPath()); err != nil {
+		t.Fatalf("expected the failed backup's file to be kept, got %v", err)
+	}
+
+	// The blocks the completed full dedupped against are still stored in the failed backup's file.
+	var shared int
+	row := store.QueryRow("SELECT COUNT(*) FROM blocks WHERE id IN ("+backupBlocks+") AND "+referencedByOtherBackups, failed.Record.ID, failed.Record.ID)
+	if err := row.Scan(&shared); err != nil {
+		t.Fatal(err)
+	}
+
+	if shared == 0 {
+		t.Fatal("expected the completed full to reference blocks stored by the failed backup")
+	}
+
+	positions, err := store.findBlockPositionsByBackup(failed.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) == 0 {
+		t.Fatal("expected the failed backup's positions to be kept")
+	}
+}
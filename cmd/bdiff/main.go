@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +22,10 @@ import (
 	_ "net/http/pprof"
 )
 
+// version is the release of the binary, set at build time with
+// -ldflags "-X main.version=<version>". Falls back to the module version when unset.
+var version = ""
+
 // main is the entry point for the application.
 func main() {
 	var rootCmd = &cobra.Command{Use: "bd"}
@@ -24,7 +33,40 @@ func main() {
 	rootCmd.AddCommand(backupCmd)
 	backupCmd.AddCommand(createCmd)
 	backupCmd.AddCommand(listCmd)
+	backupCmd.AddCommand(infoCmd)
+	backupCmd.AddCommand(latestCmd)
+	backupCmd.AddCommand(streamCmd)
 	backupCmd.AddCommand(restoreCmd)
+	backupCmd.AddCommand(diffLiveCmd)
+	backupCmd.AddCommand(estimateCmd)
+	backupCmd.AddCommand(precheckCmd)
+	backupCmd.AddCommand(recoverCmd)
+	backupCmd.AddCommand(syncCmd)
+	backupCmd.AddCommand(histogramCmd)
+	backupCmd.AddCommand(noteCmd)
+	backupCmd.AddCommand(manifestCmd)
+	backupCmd.AddCommand(cleanCmd)
+	rootCmd.AddCommand(selftestCmd)
+	rootCmd.AddCommand(benchCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(devicesCmd)
+
+	var blockCmd = &cobra.Command{Use: "block"}
+	rootCmd.AddCommand(blockCmd)
+	blockCmd.AddCommand(blockFindCmd)
+
+	var volumeCmd = &cobra.Command{Use: "volume"}
+	rootCmd.AddCommand(volumeCmd)
+	volumeCmd.AddCommand(volumeRenameCmd)
+	volumeCmd.AddCommand(volumeListCmd)
+	volumeCmd.AddCommand(volumeStaleCmd)
+	volumeCmd.AddCommand(volumeDefaultsCmd)
+	volumeCmd.AddCommand(volumeDeleteCmd)
+
+	var dbCmd = &cobra.Command{Use: "db"}
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbMergeCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -38,12 +80,97 @@ func init() {
 	createCmd.Flags().StringP("output-dir", "o", "", "Output file path. This is ignored if stdout is specified. (default is current directory)")
 	createCmd.Flags().StringP("output-filename", "f", "", "Output file name.")
 	createCmd.Flags().StringP("output-format", "", "file", "Output format. (file [default], stdout)")
-	createCmd.Flags().IntP("block-size", "b", 4096, "The number of bytes to read at a time")
-	createCmd.Flags().IntP("block-buffer-size", "", 5, "The number of blocks to buffer before writing to disk")
+	createCmd.Flags().StringP("on-existing", "", "fail", "What to do if the output file already exists. (fail [default], overwrite, rename)")
+	createCmd.Flags().IntP("block-size", "b", 4096, "The number of bytes to read at a time. Differentials default to the block size of their full backup.")
+	createCmd.Flags().StringP("block-buffer-size", "", "5", "The number of blocks to buffer before writing to disk, or auto to grow the buffer while the device reads faster.")
+	createCmd.Flags().IntP("read-ahead", "", 0, "The number of bytes the device is read ahead, independent of the hashing buffer. (default is block-size * block-buffer-size)")
+	createCmd.Flags().StringP("chunking", "", "fixed", "How the source is split into blocks. (fixed [default], content)")
+	createCmd.Flags().BoolP("compact-constant-blocks", "", false, "Store blocks consisting of a single repeated byte as a descriptor instead of writing them.")
+	createCmd.Flags().BoolP("verify-source", "", false, "Read each block twice and abort if the reads differ. Halves read throughput.")
+	createCmd.Flags().BoolP("identify-by-uuid", "", false, "Identify the volume by the UUID of the ext4 filesystem on the device rather than the device's name, so backups chain whichever path the device is reached through.")
+	createCmd.Flags().BoolP("include-partial", "", true, "Back up the final partial block of a device whose size isn't a multiple of the block size. When false, such devices are refused.")
+	createCmd.Flags().DurationP("read-timeout", "", 0, "Fail a read of the device that doesn't complete within this duration (e.g. 30s). (0 disables)")
+	createCmd.Flags().IntP("read-retries", "", 0, "The number of times a timed out read is retried.")
+	createCmd.Flags().BoolP("detect-source-change", "", false, "Check the device's size, modification time and first blocks again once it's read, to detect a torn image.")
+	createCmd.Flags().StringP("on-source-change", "", "fail", "What to do if the device changed during the backup. (fail [default], warn)")
+	createCmd.Flags().BoolP("follow-symlinks", "", false, "Resolve the device path to its canonical device before identifying the volume, so symlink aliases share a backup chain.")
+	createCmd.Flags().StringP("concurrency", "", "", "The number of hashing workers, or auto to choose from the device type (fewer for rotational disks). (default is GOMAXPROCS)")
+	createCmd.Flags().BoolP("direct-io", "", false, "Read the source with O_DIRECT to bypass the page cache. (Linux only)")
+	createCmd.Flags().BoolP("verify-writes", "", false, "Read back each batch of written blocks and abort if they don't match. Roughly doubles write I/O.")
+	createCmd.Flags().StringP("hash-algorithm", "", "", "The digest blocks are identified by. (xxhash64, sha256) (default is xxhash64, or the algorithm of the full backup)")
+	createCmd.Flags().BoolP("hash-sample", "", false, "UNSAFE: Hash only the first, middle and last KiB of each block. Faster, but changes elsewhere in a block are missed.")
+	createCmd.Flags().BoolP("encode-position-ranges", "", false, "Store runs of consecutive block positions as a single row to shrink the database.")
+	createCmd.Flags().BoolP("hash-cache", "", false, "Cache the block hashes of the volume's last full, so differentials compare against it without querying its block positions.")
+	createCmd.Flags().StringP("insert-synchronous", "", "", "SQLite synchronous mode while blocks are inserted. (OFF, NORMAL, FULL, EXTRA) UNSAFE: OFF is faster, but a host crash during the backup may corrupt the database.")
+	createCmd.Flags().BoolP("merkle-tree", "", false, "Record the root of a Merkle tree over the backup's blocks, so blocks can be proven to belong to it.")
+	createCmd.Flags().StringP("filter-command", "", "", "External command the backup stream is piped through before writing. (e.g. \"gzip -c\")")
+	createCmd.Flags().DurationP("live-stats", "", 0, "Print throughput, dedup ratio and blocks written to stderr at this interval (e.g. 5s). (0 disables)")
+	createCmd.Flags().StringP("pre-hook", "", "", "Shell command run before the device is opened (e.g. to quiesce an application). The backup is aborted if it fails.")
+	createCmd.Flags().StringP("post-hook", "", "", "Shell command run after the device is closed, even if the backup fails.")
+	createCmd.Flags().StringP("app-version", "", "", "Application version (e.g. a git commit) to record on the backup.")
+	createCmd.Flags().StringP("output", "", "text", "How the backup summary is printed. (text [default], json)")
+	createCmd.Flags().StringP("batch", "", "", "File listing a device path per line to back up with the same flags, in place of <path-to-device>.")
+	createCmd.Flags().IntP("parallel-backups", "", 2, "The number of --batch backups run at once. Backups of the same volume always run one at a time.")
+
+	// Define flags for the precheckCmd
+	precheckCmd.Flags().IntP("block-size", "b", 4096, "The block size the backup will use")
+	precheckCmd.Flags().StringP("block-buffer-size", "", "5", "The number of blocks the backup will buffer, or auto")
+	precheckCmd.Flags().StringP("output-dir", "o", ".", "The directory the backup file will be written to")
+	precheckCmd.Flags().Int64P("memory-budget", "", 0, "The most bytes of memory the backup's buffers may use. (default 1GiB)")
+
+	// Define flags for the selftestCmd
+	selftestCmd.Flags().IntP("block-size", "b", 4096, "The number of bytes to read at a time")
+	selftestCmd.Flags().IntP("block-buffer-size", "", 5, "The number of blocks to buffer before writing to disk")
+
+	// Define flags for the volumeRenameCmd
+	volumeRenameCmd.Flags().StringP("device-path", "", "", "The volume's new device path. (e.g. /dev/sdc)")
+
+	// Define flags for the manifestCmd
+	manifestCmd.Flags().StringP("format", "", "csv", "The format the manifest is written in. (csv [default])")
+
+	// Define flags for the cleanCmd
+	cleanCmd.Flags().DurationP("running-older-than", "", 24*time.Hour, "Also remove backups still marked running that started longer ago than this, e.g. before a crash.")
+
+	// Define flags for the volumeStaleCmd
+	volumeStaleCmd.Flags().DurationP("older-than", "", 24*time.Hour, "Report volumes whose last backup is older than this duration.")
+
+	// Define flags for the volumeDeleteCmd
+	volumeDeleteCmd.Flags().BoolP("force", "f", false, "Delete the volume even if it has backups, removing their files.")
+
+	// Define flags for the volumeDefaultsCmd
+	volumeDefaultsCmd.Flags().IntP("block-size", "b", 0, "The default block size of the volume's backups. (0 to unset)")
+	volumeDefaultsCmd.Flags().StringP("chunking", "", "", "The default chunking of the volume's backups. (fixed, content)")
+	volumeDefaultsCmd.Flags().StringP("filter-command", "", "", "The default filter command of the volume's backups. (e.g. \"gzip -c\")")
+
+	// Define flags for the benchCmd
+	benchCmd.Flags().IntSliceP("block-sizes", "", []int{4096, 65536, 1048576}, "The block sizes to benchmark")
+	benchCmd.Flags().IntSliceP("block-buffer-sizes", "", []int{5, 50}, "The block buffer sizes to benchmark")
+
+	// Define flags for the syncCmd
+	syncCmd.Flags().StringP("output-dir", "o", "", "Where the remote writes the reconstructed backup file. (default is the remote database's directory)")
 
 	// Define flags for the restoreCmd
 	restoreCmd.Flags().BoolP("enable-pprof", "p", false, "Enable pprof")
 	restoreCmd.Flags().StringP("output-dir", "o", "", "Output file path. This is ignored if stdout is specified. (default is current directory)")
+	restoreCmd.Flags().StringP("on-existing", "", "fail", "What to do if the output file already exists. (fail [default], overwrite, rename)")
+	restoreCmd.Flags().BoolP("direct-io", "", false, "Read backup files with O_DIRECT to bypass the page cache. (Linux only)")
+	restoreCmd.Flags().BoolP("pipeline", "", false, "Read blocks from the backup file while previously read blocks are written.")
+	restoreCmd.Flags().StringP("concurrency", "", "", "The number of blocks the pipeline reads ahead, or auto to choose from the target's device type. (default 8)")
+	restoreCmd.Flags().StringP("filter-command", "", "", "External command that reverses the backup's filter. (e.g. \"gunzip -c\")")
+	restoreCmd.Flags().StringP("stream", "", "", "Restore from a backup stream written by 'backup stream' instead of the backup files. Use - for stdin.")
+	restoreCmd.Flags().BoolP("to-stdout", "", false, "Write the restored data to stdout. All other output is written to stderr.")
+	restoreCmd.Flags().IntP("limit-positions", "", 0, "Restore only the first N positions, truncating the output. Useful for inspecting the start of a large image. (0 restores everything)")
+	restoreCmd.Flags().Int64P("max-output-file-size", "", 0, "Split the restored image across numbered files (name.000, name.001, ...) of at most this many bytes. (0 writes a single file)")
+	restoreCmd.Flags().StringP("image-format", "", "raw", "The format of the restored image. (raw [default], raw-sparse)")
+	restoreCmd.Flags().StringP("only-diff", "", "", "Update this existing image in place, writing only the blocks that differ from the backup (e.g. to refresh a staging copy)")
+	restoreCmd.Flags().StringP("base-image", "", "", "Apply a differential's changes onto this image instead of its full backup, writing a new image (e.g. a template plus a volume's changes)")
+	restoreCmd.Flags().StringP("compare", "", "", "Byte-compare the restored output with this reference image (e.g. the original device) and report the first differing offset")
+	restoreCmd.Flags().BoolP("validate", "", false, "Read back the restored file and confirm every block matches its recorded hash")
+	restoreCmd.Flags().IntP("checkpoint-interval", "", 0, "Record the restore's progress every N blocks so it can be resumed. (0 disables checkpoints)")
+	restoreCmd.Flags().IntP("max-chain-depth", "", 0, "Refuse to restore backups whose chain applies more than this many backups. (0 uses the store policy)")
+	restoreCmd.Flags().BoolP("discard", "", false, "Read and look up every block without writing the image, to check the backup is intact. Combine with --validate to confirm every position is restored.")
+	restoreCmd.Flags().BoolP("resume", "", false, "Resume an interrupted restore to the same output file from its last checkpoint")
+	restoreCmd.Flags().StringP("progress", "", "", "Report the restore's progress and estimated time remaining on stderr. (bar, json) (default is no progress)")
 }
 
 var listCmd = &cobra.Command{
@@ -58,42 +185,44 @@ var listCmd = &cobra.Command{
 }
 
 func listBackups() error {
-	store, err := block.NewStore()
+	store, err := block.NewReadOnlyStore()
 	if err != nil {
 		return fmt.Errorf("error creating store: %v", err)
 	}
 
-	backups, err := store.ListBackups()
+	count, err := store.CountBackups()
 	if err != nil {
-		return fmt.Errorf("error getting backups: %v", err)
+		return fmt.Errorf("error counting backups: %v", err)
 	}
 
-	if len(backups) == 0 {
+	if count == 0 {
 		fmt.Println("No backups found")
 		return nil
 	}
 
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"ID", "Type", "Block size", "Total Blocks", "Size", "Created At"})
+	backups, err := store.ListBackups()
+	if err != nil {
+		return fmt.Errorf("error getting backups: %v", err)
+	}
 
-	// Set table alignment, borders, padding, etc. as needed
-	table.SetAlignment(tablewriter.ALIGN_LEFT)
-	table.SetBorder(true) // Set to false to hide borders
-	table.SetCenterSeparator("|")
-	table.SetColumnSeparator("|")
-	table.SetRowSeparator("-")
-	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
-	table.SetHeaderLine(true) // Enable header line
-	table.SetAutoWrapText(false)
+	table := newTable([]string{"ID", "Type", "Status", "Block size", "Total Blocks", "Size", "Ratio", "App Version", "Created At"})
 
 	for _, b := range backups {
+		location := b.FullPath
+		if b.RemoteKey != "" {
+			location = "remote:" + b.RemoteKey
+		}
+
 		table.Append([]string{
 			strconv.Itoa(b.ID),
 			strings.ToUpper(b.BackupType),
+			b.Status,
 			fmt.Sprint(b.BlockSize),
 			fmt.Sprint(b.TotalBlocks),
 			fmt.Sprint(formatFileSize(float64(b.SizeInBytes))),
-			b.FullPath,
+			formatCompressionRatio(b),
+			b.AppVersion,
+			location,
 			b.CreatedAt.String(),
 		})
 	}
@@ -103,145 +232,180 @@ func listBackups() error {
 	return nil
 }
 
-var restoreCmd = &cobra.Command{
-	Use:   "restore <backup-id> -output-dir <path-to-dir> -enable-pprof",
-	Short: "Restores from a specified backup",
-	Long:  `Restores from a specified backup.`,
-	Args:  cobra.ExactArgs(1), // This ensures exactly one argument is passed
+var infoCmd = &cobra.Command{
+	Use:   "info <backup-id>",
+	Short: "Shows the details of a backup",
+	Long:  `Shows the details of a backup, including the path and inode of the source it was taken from.`,
+	Args:  cobra.ExactArgs(1),
 
 	Run: func(cmd *cobra.Command, args []string) {
-		backupIDStr := args[0]
-		// Convert the backupID to an int
-		backupID, err := strconv.ParseInt(backupIDStr, 10, 64)
+		backupID, err := strconv.Atoi(args[0])
 		if err != nil {
 			fmt.Println("Invalid backup ID")
 			return
 		}
 
-		// Extract the output flag value
-		outputDirPath, err := cmd.Flags().GetString("output-dir")
-		if err != nil || outputDirPath == "" {
-			fmt.Println("No output directory specified. Saving backup file to current directory.")
-			outputDirPath = "."
+		if err := backupInfo(backupID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
+	},
+}
 
-		enablePprof, err := cmd.Flags().GetBool("enable-pprof")
-		if err != nil {
-			fmt.Println("Error getting pprof flag")
-		}
+func backupInfo(backupID int) error {
+	store, err := block.NewReadOnlyStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
 
-		wg := &sync.WaitGroup{}
-		if enablePprof {
-			fmt.Println("Starting pprof server on port 6060")
-			wg.Add(1)
-			go func() {
-				if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-					fmt.Println(err)
-					return
-				}
-			}()
-		}
+	b, err := store.FindBackup(backupID)
+	if err != nil {
+		return fmt.Errorf("error finding backup: %v", err)
+	}
+
+	printBackupInfo(b)
+
+	return nil
+}
+
+var histogramCmd = &cobra.Command{
+	Use:   "histogram <backup-id>",
+	Short: "Shows how often the blocks of a backup are reused",
+	Long:  `Shows how many of a backup's unique blocks are referenced by each number of positions, which reveals highly repeated blocks such as zeroed ones.`,
+	Args:  cobra.ExactArgs(1),
 
-		if err := performRestore(int(backupID), outputDirPath); err != nil {
-			fmt.Println(err)
+	Run: func(cmd *cobra.Command, args []string) {
+		backupID, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid backup ID")
+			return
 		}
 
-		if enablePprof {
-			fmt.Println("Backup completed. Pprof server is still running on port 6060. Ctrl+C to stop")
-			wg.Wait()
+		if err := blockHistogram(backupID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
 	},
 }
 
-func performRestore(backupID int, outputPath string) error {
-	store, err := block.NewStore()
+func blockHistogram(backupID int) error {
+	store, err := block.NewReadOnlyStore()
 	if err != nil {
 		return fmt.Errorf("error creating store: %v", err)
 	}
 
-	restoreConfig := block.RestoreConfig{
-		Store:              store,
-		RestoreInputFormat: block.RestoreInputFormatFile,
-		SourceBackupID:     backupID,
-		OutputDirectory:    outputPath,
-		OutputFileName:     "restored.backup",
-	}
-
-	restore, err := block.NewRestore(restoreConfig)
+	histogram, err := store.BlockHistogram(backupID)
 	if err != nil {
-		return fmt.Errorf("error creating restore: %v", err)
+		return fmt.Errorf("error building histogram: %v", err)
 	}
 
-	// Perform full restore
-	if err := restore.Run(); err != nil {
-		return fmt.Errorf("error performing restore: %v", err)
+	table := newTable([]string{"References", "Blocks", "Positions"})
+	for _, bucket := range histogram {
+		table.Append([]string{
+			strconv.Itoa(bucket.References),
+			strconv.Itoa(bucket.Blocks),
+			strconv.Itoa(bucket.References * bucket.Blocks),
+		})
 	}
+	table.Render()
 
 	return nil
 }
 
-var createCmd = &cobra.Command{
-	Use:   "create <path-to-device>",
-	Short: "Performs a backup operation",
-	Long:  `Performs a backup operation on the specified device.`,
-	Args:  cobra.ExactArgs(1), // This ensures exactly one argument is passed
+var manifestCmd = &cobra.Command{
+	Use:   "manifest <backup-id>",
+	Short: "Exports the block positions of a backup",
+	Long:  `Writes a row for each position the backup recorded, with the ID and hash of the block stored there, for analysis in a spreadsheet or other tools. A differential only lists the positions it recorded.`,
+	Args:  cobra.ExactArgs(1),
 
 	Run: func(cmd *cobra.Command, args []string) {
-		devicePath := args[0]
-		stderr := os.Stderr
-
-		// Extract the output flag value
-		outputDirPath, err := cmd.Flags().GetString("output-dir")
-		if err != nil || outputDirPath == "" {
-			fmt.Fprintln(stderr, "No output directory specified. Saving backup file to current directory.")
-			outputDirPath = "."
-		}
-
-		outputFormat, err := cmd.Flags().GetString("output-format")
+		backupID, err := strconv.Atoi(args[0])
 		if err != nil {
-			fmt.Fprintln(stderr, "Error getting output-format flag")
+			fmt.Fprintln(os.Stderr, "Invalid backup ID")
+			return
 		}
 
-		blockSize, err := cmd.Flags().GetInt("block-size")
+		format, err := cmd.Flags().GetString("format")
 		if err != nil {
-			fmt.Fprintln(stderr, "Error getting block-size flag")
+			fmt.Fprintln(os.Stderr, "Error getting format flag")
 		}
 
-		blockBufferSize, err := cmd.Flags().GetInt("block-buffer-size")
-		if err != nil {
-			fmt.Fprintln(stderr, "Error getting block-buffer-size flag")
+		if err := writeManifest(backupID, format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
+	},
+}
 
-		enablePprof, err := cmd.Flags().GetBool("enable-pprof")
+func writeManifest(backupID int, format string) error {
+	if format != "csv" {
+		return fmt.Errorf("manifest format %q is not supported", format)
+	}
+
+	store, err := block.NewReadOnlyStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.WriteManifestCSV(backupID, os.Stdout); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+
+	return nil
+}
+
+var noteCmd = &cobra.Command{
+	Use:   "note <backup-id> <text>",
+	Short: "Attaches notes to a backup",
+	Long:  `Replaces the notes attached to a backup, e.g. "pre-upgrade snapshot, verified restore on 2024-01-02". The notes are shown by 'backup info'. Pass an empty string to clear them.`,
+	Args:  cobra.ExactArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		backupID, err := strconv.Atoi(args[0])
 		if err != nil {
-			fmt.Fprintln(stderr, "Error getting pprof flag")
+			fmt.Fprintln(os.Stderr, "Invalid backup ID")
+			return
 		}
 
-		wg := &sync.WaitGroup{}
-		if enablePprof {
-			fmt.Fprintln(stderr, "Starting pprof server on port 6060")
-			wg.Add(1)
-			go func() {
-				if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-					fmt.Fprintln(stderr, err)
-					return
-				}
-			}()
+		if err := setBackupNotes(backupID, args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
+	},
+}
 
-		if err := performBackup(devicePath, outputDirPath, outputFormat, blockSize, blockBufferSize); err != nil {
-			fmt.Fprintln(stderr, err)
+func setBackupNotes(backupID int, notes string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	if err := store.SetBackupNotes(backupID, notes); err != nil {
+		return fmt.Errorf("error setting notes: %v", err)
+	}
+
+	return nil
+}
+
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Removes failed and incomplete backups",
+	Long:  `Removes the backups that failed, and those still marked running that started longer ago than --running-older-than, along with their partial backup files and the blocks no other backup references. Completed backups are never touched, and a backup whose blocks other backups reference is kept along with its backup file.`,
+	Args:  cobra.NoArgs,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		runningOlderThan, err := cmd.Flags().GetDuration("running-older-than")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting running-older-than flag")
 		}
 
-		if enablePprof {
-			fmt.Fprintf(stderr, "Backup completed. Pprof server is still running on port 6060. Ctrl+C to stop")
-			wg.Wait()
+		if err := cleanBackups(runningOlderThan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
 	},
 }
 
-// performBackup is a placeholder for your backup logic.
-func performBackup(devicePath, outputDir, outputFormat string, blockSize int, bufferBlockSize int) error {
+func cleanBackups(runningOlderThan time.Duration) error {
 	store, err := block.NewStore()
 	if err != nil {
 		return fmt.Errorf("error creating store: %v", err)
@@ -251,52 +415,1711 @@ func performBackup(devicePath, outputDir, outputFormat string, blockSize int, bu
 		return fmt.Errorf("error setting up database: %v", err)
 	}
 
-	cfg := &block.BackupConfig{
-		Store:           store,
-		DevicePath:      devicePath,
-		OutputFormat:    block.BackupOutputFormat(outputFormat),
-		OutputDirectory: outputDir,
-		BlockSize:       blockSize,
-		BlockBufferSize: bufferBlockSize,
+	result, err := store.PruneIncompleteBackups(runningOlderThan)
+	if err != nil {
+		return fmt.Errorf("error cleaning backups: %v", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Performing backup of %s to %s\n", devicePath, outputDir)
+	for _, b := range result.Shared {
+		fmt.Fprintf(os.Stderr, "Kept backup %d: other backups reference blocks stored in %s\n", b.ID, b.FullPath)
+	}
 
-	b, err := block.NewBackup(cfg)
+	if len(result.Backups) == 0 && result.OrphanedBlocks == 0 {
+		if len(result.Shared) == 0 {
+			fmt.Println("No failed or incomplete backups found")
+		}
+		return nil
+	}
+
+	if len(result.Backups) > 0 {
+		table := newTable([]string{"ID", "Type", "Status", "File", "Error"})
+		for _, b := range result.Backups {
+			table.Append([]string{
+				strconv.Itoa(b.ID),
+				strings.ToUpper(b.BackupType),
+				b.Status,
+				b.FullPath,
+				b.ErrorMessage,
+			})
+		}
+		table.Render()
+	}
+
+	fmt.Printf("Removed %d backups and %d orphaned blocks\n", len(result.Backups), result.OrphanedBlocks)
+
+	return nil
+}
+
+var latestCmd = &cobra.Command{
+	Use:   "latest <volume>",
+	Short: "Shows the most recent backup of a volume",
+	Long:  `Shows the details of the most recent backup of the specified volume, regardless of its type.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := latestBackup(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func latestBackup(volumeName string) error {
+	store, err := block.NewReadOnlyStore()
 	if err != nil {
-		return fmt.Errorf("error creating backup: %v", err)
+		return fmt.Errorf("error creating store: %v", err)
 	}
 
-	backupStartTime := time.Now()
-	if err := b.Run(); err != nil {
-		return fmt.Errorf("error performing backup: %v", err)
+	vol, err := store.FindVolume(volumeName)
+	if err != nil {
+		return fmt.Errorf("error finding volume %s: %v", volumeName, err)
 	}
-	backupDuration := time.Since(backupStartTime)
 
-	if cfg.OutputFormat == block.BackupOutputFormatFile {
-		uniqueBlocks, err := store.UniqueBlocksInBackup(b.Record.ID)
+	b, err := store.LatestBackup(vol.ID)
+	if err != nil {
+		return fmt.Errorf("error finding latest backup: %v", err)
+	}
+
+	printBackupInfo(b)
+
+	return nil
+}
+
+// printBackupInfo renders the details of a backup as a table.
+func printBackupInfo(b block.BackupRecord) {
+	sourceInode := "unknown"
+	if b.SourceInode != 0 {
+		sourceInode = strconv.FormatUint(b.SourceInode, 10)
+	}
+
+	table := newTable([]string{"Field", "Value"})
+	table.AppendBulk([][]string{
+		{"ID", strconv.Itoa(b.ID)},
+		{"Volume ID", strconv.Itoa(b.VolumeID)},
+		{"Type", strings.ToUpper(b.BackupType)},
+		{"Status", b.Status},
+		{"Error", b.ErrorMessage},
+		{"Chunking", string(b.Chunking)},
+		{"Hash Algorithm", string(b.HashAlgorithm)},
+		{"Hash Sample", strconv.FormatBool(b.HashSample)},
+		{"Block size", fmt.Sprint(b.BlockSize)},
+		{"Total Blocks", fmt.Sprint(b.TotalBlocks)},
+		{"Size", formatFileSize(float64(b.SizeInBytes))},
+		{"Logical Size", formatFileSize(float64(b.LogicalSizeInBytes))},
+		{"Physical Size", formatFileSize(float64(b.PhysicalSizeInBytes))},
+		{"Compression Ratio", formatCompressionRatio(b)},
+		{"File", b.FullPath},
+		{"Remote Key", b.RemoteKey},
+		{"App Version", b.AppVersion},
+		{"Merkle Root", b.MerkleRoot},
+		{"Notes", b.Notes},
+		{"Source Path", b.SourcePath},
+		{"Source Inode", sourceInode},
+		{"Duration", b.Duration.String()},
+		{"Created At", b.CreatedAt.String()},
+	})
+	table.Render()
+}
+
+// formatCompressionRatio renders the backup's compression ratio, or "-" if it wasn't recorded.
+func formatCompressionRatio(b block.BackupRecord) string {
+	ratio := b.CompressionRatio()
+	if ratio == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.2fx", ratio)
+}
+
+// newTable returns a table writer with the standard formatting.
+func newTable(header []string) *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(header)
+
+	// Set table alignment, borders, padding, etc. as needed
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetBorder(true) // Set to false to hide borders
+	table.SetCenterSeparator("|")
+	table.SetColumnSeparator("|")
+	table.SetRowSeparator("-")
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(true) // Enable header line
+	table.SetAutoWrapText(false)
+
+	return table
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <backup-id> -output-dir <path-to-dir> -enable-pprof",
+	Short: "Restores from a specified backup",
+	Long:  `Restores from a specified backup.`,
+	Args:  cobra.ExactArgs(1), // This ensures exactly one argument is passed
+
+	Run: func(cmd *cobra.Command, args []string) {
+		// Diagnostics are written to stderr, so stdout only ever holds restored data.
+		stderr := os.Stderr
+
+		backupIDStr := args[0]
+		// Convert the backupID to an int
+		backupID, err := strconv.ParseInt(backupIDStr, 10, 64)
+		if err != nil {
+			fmt.Fprintln(stderr, "Invalid backup ID")
+			return
+		}
+
+		toStdout, err := cmd.Flags().GetBool("to-stdout")
 		if err != nil {
-			return fmt.Errorf("error getting unique blocks: %v", err)
+			fmt.Fprintln(stderr, "Error getting to-stdout flag")
 		}
 
-		sourceSizeInBytes, err := block.GetTargetSizeInBytes(devicePath)
+		onlyDiff, err := cmd.Flags().GetString("only-diff")
 		if err != nil {
-			return fmt.Errorf("error getting device size: %v", err)
+			fmt.Fprintln(stderr, "Error getting only-diff flag")
 		}
 
-		sizeDiff := int(sourceSizeInBytes - b.Record.SizeInBytes)
+		discard, err := cmd.Flags().GetBool("discard")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting discard flag")
+		}
 
-		fmt.Println("Backup completed successfully!")
-		fmt.Println("=============Info=================")
-		fmt.Printf("Backup Duration: %s\n", backupDuration)
-		fmt.Printf("Backup file: %s/%s\n", outputDir, b.Record.FileName)
-		fmt.Printf("Backup size %s\n", formatFileSize(float64(b.Record.SizeInBytes)))
-		fmt.Printf("Source device size: %s\n", formatFileSize(float64(sourceSizeInBytes)))
-		fmt.Printf("Space saved: %s\n", formatFileSize(float64(sizeDiff)))
-		fmt.Printf("Blocks evaluated: %d\n", b.TotalBlocks())
-		fmt.Printf("Blocks written: %d\n", uniqueBlocks)
-		fmt.Println("==================================")
-	}
+		baseImage, err := cmd.Flags().GetString("base-image")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting base-image flag")
+		}
+
+		// Extract the output flag value
+		outputDirPath, err := cmd.Flags().GetString("output-dir")
+		if (err != nil || outputDirPath == "") && !toStdout && onlyDiff == "" && !discard {
+			fmt.Fprintln(stderr, "No output directory specified. Saving backup file to current directory.")
+			outputDirPath = "."
+		}
+
+		filterCommand, err := cmd.Flags().GetString("filter-command")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting filter-command flag")
+		}
+
+		directIO, err := cmd.Flags().GetBool("direct-io")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting direct-io flag")
+		}
+
+		pipeline, err := cmd.Flags().GetBool("pipeline")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting pipeline flag")
+		}
+
+		concurrency, err := concurrencyFlag(cmd)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return
+		}
+
+		onExisting, err := cmd.Flags().GetString("on-existing")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting on-existing flag")
+		}
+
+		validate, err := cmd.Flags().GetBool("validate")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting validate flag")
+		}
+
+		imageFormat, err := cmd.Flags().GetString("image-format")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting image-format flag")
+		}
+
+		limitPositions, err := cmd.Flags().GetInt("limit-positions")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting limit-positions flag")
+		}
+
+		maxOutputFileSize, err := cmd.Flags().GetInt64("max-output-file-size")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting max-output-file-size flag")
+		}
+
+		checkpointInterval, err := cmd.Flags().GetInt("checkpoint-interval")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting checkpoint-interval flag")
+		}
+
+		resume, err := cmd.Flags().GetBool("resume")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting resume flag")
+		}
+
+		progress, err := cmd.Flags().GetString("progress")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting progress flag")
+		}
+
+		progressReport, err := restoreProgressPrinter(stderr, progress)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return
+		}
+
+		maxChainDepth, err := cmd.Flags().GetInt("max-chain-depth")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting max-chain-depth flag")
+		}
+
+		streamPath, err := cmd.Flags().GetString("stream")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting stream flag")
+		}
+
+		compareTo, err := cmd.Flags().GetString("compare")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting compare flag")
+		}
+
+		enablePprof, err := cmd.Flags().GetBool("enable-pprof")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting pprof flag")
+		}
+
+		wg := &sync.WaitGroup{}
+		if enablePprof {
+			fmt.Fprintln(stderr, "Starting pprof server on port 6060")
+			wg.Add(1)
+			go func() {
+				if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+					fmt.Fprintln(stderr, err)
+					return
+				}
+			}()
+		}
+
+		restoreConfig := block.RestoreConfig{
+			RestoreInputFormat:   block.RestoreInputFormatFile,
+			SourceBackupID:       int(backupID),
+			OutputDirectory:      outputDirPath,
+			OutputFileName:       "restored.backup",
+			OnExisting:           block.ExistingFilePolicy(onExisting),
+			FilterCommand:        strings.Fields(filterCommand),
+			Validate:             validate,
+			CompareTo:            compareTo,
+			OnlyDiff:             onlyDiff,
+			BaseImagePath:        baseImage,
+			Discard:              discard,
+			OutputImageFormat:    block.ImageFormat(imageFormat),
+			LimitPositions:       limitPositions,
+			MaxOutputFileSize:    maxOutputFileSize,
+			DirectIO:             directIO,
+			Pipeline:             pipeline,
+			Concurrency:          concurrency,
+			CheckpointInterval:   checkpointInterval,
+			Resume:               resume,
+			MaxRestoreChainDepth: maxChainDepth,
+			ProgressReport:       progressReport,
+		}
+
+		if toStdout {
+			restoreConfig.Output = os.Stdout
+		}
+
+		switch streamPath {
+		case "":
+		case "-":
+			restoreConfig.Stream = os.Stdin
+		default:
+			f, err := os.Open(streamPath)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return
+			}
+			defer f.Close()
+			restoreConfig.Stream = f
+		}
+
+		if err := performRestore(restoreConfig); err != nil {
+			fmt.Fprintln(stderr, err)
+		} else if compareTo != "" {
+			fmt.Fprintf(stderr, "Restored output matches %s\n", compareTo)
+		}
+
+		if enablePprof {
+			fmt.Fprintln(stderr, "Restore completed. Pprof server is still running on port 6060. Ctrl+C to stop")
+			wg.Wait()
+		}
+	},
+}
+
+func performRestore(restoreConfig block.RestoreConfig) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	restoreConfig.Store = store
+
+	restore, err := block.NewRestore(restoreConfig)
+	if err != nil {
+		return fmt.Errorf("error creating restore: %v", err)
+	}
+
+	// Perform full restore
+	if err := restore.Run(); err != nil {
+		return fmt.Errorf("error performing restore: %v", err)
+	}
+
+	if restoreConfig.OnlyDiff != "" {
+		fmt.Fprintf(os.Stderr, "Updated %d blocks of %s\n", restore.BlocksUpdated(), restoreConfig.OnlyDiff)
+	}
+
+	if restoreConfig.Discard {
+		fmt.Fprintf(os.Stderr, "Restored %s without writing the image\n", formatFileSize(float64(restore.BytesRestored())))
+	}
+
+	return nil
+}
+
+// restoreProgressLine is a progress update printed by --progress json.
+type restoreProgressLine struct {
+	Completed      int     `json:"completed"`
+	Total          int     `json:"total"`
+	BytesRestored  int64   `json:"bytes_restored"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	ETASeconds     float64 `json:"eta_seconds"`
+	Estimating     bool    `json:"estimating"`
+}
+
+// restoreProgressPrinter returns the callback writing restore progress to w in the format, either
+// a progress bar or a JSON object per update. No callback is returned when format is empty.
+func restoreProgressPrinter(w io.Writer, format string) (block.RestoreProgressFunc, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		return func(p block.RestoreProgress) {
+			_ = encoder.Encode(restoreProgressLine{
+				Completed:      p.Completed,
+				Total:          p.Total,
+				BytesRestored:  p.BytesRestored,
+				BytesPerSecond: p.BytesPerSecond,
+				ETASeconds:     p.Remaining.Seconds(),
+				Estimating:     p.Estimating,
+			})
+		}, nil
+	case "bar":
+		return func(p block.RestoreProgress) {
+			fmt.Fprintf(w, "\r%s", formatProgressBar(p))
+			if p.Completed >= p.Total {
+				fmt.Fprintln(w)
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("progress format %q is not supported", format)
+	}
+}
+
+// progressBarWidth is the number of characters the progress bar fills.
+const progressBarWidth = 30
+
+// formatProgressBar renders the restore's progress as a bar followed by its throughput and
+// estimated time remaining, e.g. "[=====>    ] 50% 120.0 MiB/s ETA 12s".
+func formatProgressBar(p block.RestoreProgress) string {
+	fraction := 1.0
+	if p.Total > 0 {
+		fraction = float64(p.Completed) / float64(p.Total)
+	}
+
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	eta := "estimating"
+	if !p.Estimating {
+		eta = p.Remaining.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("[%s] %3.0f%% %s/s ETA %s", bar, fraction*100, formatFileSize(p.BytesPerSecond), eta)
+}
+
+var streamCmd = &cobra.Command{
+	Use:   "stream <backup-id>",
+	Short: "Writes a backup as a self-delimiting stream to stdout",
+	Long:  `Writes a backup as a self-delimiting stream to stdout. The streams of a full backup and its differential can be concatenated and restored using 'backup restore --stream'.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		backupID, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid backup ID")
+			return
+		}
+
+		if err := streamBackup(backupID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func streamBackup(backupID int) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.WriteBackupStream(os.Stdout, backupID); err != nil {
+		return fmt.Errorf("error streaming backup: %v", err)
+	}
+
+	return nil
+}
+
+var diffLiveCmd = &cobra.Command{
+	Use:   "diff-live <path-to-device> <backup-id>",
+	Short: "Lists the blocks that have changed since a backup",
+	Long:  `Compares a live device against the specified backup and lists the block positions that have changed, without creating a new backup.`,
+	Args:  cobra.ExactArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		devicePath := args[0]
+		backupID, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Println("Invalid backup ID")
+			return
+		}
+
+		if err := diffLive(devicePath, backupID); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func diffLive(devicePath string, backupID int) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	positions, err := store.DiffLive(devicePath, backupID)
+	if err != nil {
+		return fmt.Errorf("error diffing device: %v", err)
+	}
+
+	if len(positions) == 0 {
+		fmt.Println("No changes found")
+		return nil
+	}
+
+	for _, pos := range positions {
+		fmt.Println(pos)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d block(s) changed\n", len(positions))
+
+	return nil
+}
+
+var estimateCmd = &cobra.Command{
+	Use:   "estimate <path-to-device>",
+	Short: "Estimates how long a backup will take",
+	Long:  `Estimates how long a backup of the specified device will take based on the volume's historical throughput.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := estimateBackup(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func estimateBackup(devicePath string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	estimate, err := block.EstimateBackup(store, devicePath)
+	if err != nil {
+		return fmt.Errorf("error estimating backup: %v", err)
+	}
+
+	fmt.Printf("Source device size: %s\n", formatFileSize(float64(estimate.SizeInBytes)))
+	if estimate.Samples == 0 {
+		fmt.Printf("Throughput: %s/s (default, no history)\n", formatFileSize(estimate.Throughput))
+	} else {
+		fmt.Printf("Throughput: %s/s (based on %d backups)\n", formatFileSize(estimate.Throughput), estimate.Samples)
+	}
+	fmt.Printf("Estimated duration: %s\n", estimate.Duration.Round(time.Second))
+
+	return nil
+}
+
+var precheckCmd = &cobra.Command{
+	Use:   "precheck <path-to-device>",
+	Short: "Checks a backup's settings before it's run",
+	Long:  `Checks that the block and buffer sizes fit within the memory budget, that the output directory has room for a full backup of the device and that the device can be read, reporting the warnings the backup would print. Nothing is recorded in the store.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		blockSize, err := cmd.Flags().GetInt("block-size")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-size flag")
+		}
+
+		blockBufferSizeValue, err := cmd.Flags().GetString("block-buffer-size")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-buffer-size flag")
+		}
+
+		blockBufferSize, err := block.ParseBlockBufferSize(blockBufferSizeValue)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+
+		outputDir, err := cmd.Flags().GetString("output-dir")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting output-dir flag")
+		}
+
+		memoryBudget, err := cmd.Flags().GetInt64("memory-budget")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting memory-budget flag")
+		}
+
+		result := block.Precheck(block.PrecheckConfig{
+			DevicePath:      args[0],
+			BlockSize:       blockSize,
+			BlockBufferSize: blockBufferSize,
+			OutputDirectory: outputDir,
+			MemoryBudget:    memoryBudget,
+		})
+		printPrecheckResult(os.Stdout, result)
+	},
+}
+
+// printPrecheckResult writes the outcome of a precheck to w.
+func printPrecheckResult(w io.Writer, result block.PrecheckResult) {
+	freeSpace := "unknown"
+	if result.FreeSpaceInBytes >= 0 {
+		freeSpace = formatFileSize(float64(result.FreeSpaceInBytes))
+	}
+
+	fmt.Fprintf(w, "Source device size: %s\n", formatFileSize(float64(result.SourceSizeInBytes)))
+	fmt.Fprintf(w, "Buffer memory: %s\n", formatFileSize(float64(result.BufferMemoryInBytes)))
+	fmt.Fprintf(w, "Free space: %s\n", freeSpace)
+
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(w, "WARNING: %s\n", warning)
+	}
+
+	for _, problem := range result.Problems {
+		fmt.Fprintf(w, "ERROR: %s\n", problem)
+	}
+
+	if result.Passed() {
+		fmt.Fprintln(w, "Precheck passed")
+	} else {
+		fmt.Fprintf(w, "Precheck failed with %d problems\n", len(result.Problems))
+	}
+}
+
+var recoverCmd = &cobra.Command{
+	Use:   "recover <path-to-backup-file>...",
+	Short: "Recovers backups into the catalog from their backup files",
+	Long:  `Rebuilds the catalog entries of backup files from the footer written at the end of each file, e.g. after the database was lost. Recover a differential's full backup as well so the differential can be restored.`,
+	Args:  cobra.MinimumNArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := recoverBackups(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func recoverBackups(paths []string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	for _, path := range paths {
+		record, err := block.RecoverFromFile(path, store)
+		if err != nil {
+			return fmt.Errorf("error recovering %s: %v", path, err)
+		}
+
+		fmt.Printf("Recovered %s backup %d from %s\n", record.BackupType, record.ID, path)
+	}
+
+	return nil
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <backup-id> <remote.db>",
+	Short: "Transfers a backup to another backup database",
+	Long:  `Transfers a backup to another backup database, such as one kept by another machine, sending only the blocks it doesn't already hold. The remote reconstructs the backup as a full backup file and catalogs it.`,
+	Args:  cobra.ExactArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		backupID, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid backup ID")
+			return
+		}
+
+		outputDir, err := cmd.Flags().GetString("output-dir")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting output-dir flag")
+		}
+
+		if err := syncBackup(backupID, args[1], outputDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func syncBackup(backupID int, remotePath, outputDir string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	remote, err := block.OpenStore(remotePath)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", remotePath, err)
+	}
+	defer func() { _ = remote.Close() }()
+
+	if err := remote.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up %s: %v", remotePath, err)
+	}
+
+	if outputDir == "" {
+		outputDir = filepath.Dir(remotePath)
+	}
+
+	result, err := store.Sync(backupID, block.StoreRemote{Store: remote, OutputDirectory: outputDir})
+	if err != nil {
+		return fmt.Errorf("error syncing backup %d: %v", backupID, err)
+	}
+
+	fmt.Printf("Sent %d blocks (%s), %d already held by the remote\n", result.BlocksSent, formatFileSize(float64(result.BytesSent)), result.BlocksHeld)
+
+	return nil
+}
+
+var blockFindCmd = &cobra.Command{
+	Use:   "find <hash>",
+	Short: "Lists the backups referencing a block",
+	Long:  `Lists every backup and position that references the block with the specified hash.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := findBlock(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func findBlock(hash string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	refs, err := store.BackupsReferencingHash(hash)
+	if err != nil {
+		return fmt.Errorf("error finding block references: %v", err)
+	}
+
+	if len(refs) == 0 {
+		fmt.Println("No references found")
+		return nil
+	}
+
+	table := newTable([]string{"Backup ID", "Volume ID", "Type", "File", "Position"})
+	for _, ref := range refs {
+		table.Append([]string{
+			strconv.Itoa(ref.BackupID),
+			strconv.Itoa(ref.VolumeID),
+			strings.ToUpper(ref.BackupType),
+			ref.FileName,
+			strconv.Itoa(ref.Position),
+		})
+	}
+	table.Render()
+
+	return nil
+}
+
+var volumeRenameCmd = &cobra.Command{
+	Use:   "rename <old-name> <new-name>",
+	Short: "Renames a volume",
+	Long:  `Renames a volume, keeping its backups attached. Use this when a device path changes (e.g. /dev/sdb becomes /dev/sdc) so differential backups continue to chain off the prior full.`,
+	Args:  cobra.ExactArgs(2),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		devicePath, err := cmd.Flags().GetString("device-path")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting device-path flag")
+		}
+
+		if err := renameVolume(args[0], args[1], devicePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func renameVolume(oldName, newName, devicePath string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.RenameVolume(oldName, newName); err != nil {
+		return fmt.Errorf("error renaming volume: %v", err)
+	}
+
+	if devicePath != "" {
+		vol, err := store.FindVolume(newName)
+		if err != nil {
+			return fmt.Errorf("error finding volume: %v", err)
+		}
+
+		if err := store.UpdateVolumeDevicePath(vol.ID, devicePath); err != nil {
+			return fmt.Errorf("error updating device path: %v", err)
+		}
+	}
+
+	fmt.Printf("Volume %s renamed to %s\n", oldName, newName)
+
+	return nil
+}
+
+var volumeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists volumes",
+	Long:  `Lists volumes along with when they were last successfully backed up.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := listVolumes(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func listVolumes() error {
+	store, err := block.NewReadOnlyStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	volumes, err := store.ListVolumes()
+	if err != nil {
+		return fmt.Errorf("error listing volumes: %v", err)
+	}
+
+	if len(volumes) == 0 {
+		fmt.Println("No volumes found")
+		return nil
+	}
+
+	printVolumes(volumes)
+
+	return nil
+}
+
+var volumeStaleCmd = &cobra.Command{
+	Use:   "stale",
+	Short: "Lists volumes that haven't been backed up recently",
+	Long:  `Lists volumes whose last successful backup is older than --older-than, including volumes that have never been backed up.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		olderThan, err := cmd.Flags().GetDuration("older-than")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting older-than flag")
+		}
+
+		if err := listStaleVolumes(olderThan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func listStaleVolumes(olderThan time.Duration) error {
+	store, err := block.NewReadOnlyStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	volumes, err := store.StaleVolumes(olderThan)
+	if err != nil {
+		return fmt.Errorf("error finding stale volumes: %v", err)
+	}
+
+	if len(volumes) == 0 {
+		fmt.Printf("No volumes older than %s found\n", olderThan)
+		return nil
+	}
+
+	printVolumes(volumes)
+
+	return nil
+}
+
+var volumeDeleteCmd = &cobra.Command{
+	Use:   "delete <volume>",
+	Short: "Deletes a volume and all of its backups",
+	Long:  `Deletes a volume along with its backups, their backup files and the blocks no other volume references. Requires --force if the volume has backups.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting force flag")
+		}
+
+		if err := deleteVolume(args[0], force); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func deleteVolume(name string, force bool) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	vol, err := store.FindVolume(name)
+	if err != nil {
+		return fmt.Errorf("error finding volume: %v", err)
+	}
+
+	count, err := store.CountBackupsByVolume(vol.ID)
+	if err != nil {
+		return fmt.Errorf("error counting backups: %v", err)
+	}
+
+	if count > 0 && !force {
+		return fmt.Errorf("volume %s has %d backups, use --force to delete them", name, count)
+	}
+
+	if err := store.DeleteVolume(vol.ID); err != nil {
+		return fmt.Errorf("error deleting volume: %v", err)
+	}
+
+	fmt.Printf("Volume %s deleted along with %d backups\n", name, count)
+
+	return nil
+}
+
+var volumeDefaultsCmd = &cobra.Command{
+	Use:   "defaults <volume>",
+	Short: "Shows or sets a volume's default backup settings",
+	Long:  `Shows the default backup settings of a volume, which apply to its backups when the corresponding flag isn't specified. Specifying a flag replaces that default, and an empty value unsets it.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		blockSize, err := cmd.Flags().GetInt("block-size")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-size flag")
+		}
+
+		chunking, err := cmd.Flags().GetString("chunking")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting chunking flag")
+		}
+
+		filterCommand, err := cmd.Flags().GetString("filter-command")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting filter-command flag")
+		}
+
+		update := func(defaults *block.VolumeDefaults) {
+			if cmd.Flags().Changed("block-size") {
+				defaults.BlockSize = blockSize
+			}
+			if cmd.Flags().Changed("chunking") {
+				defaults.Chunking = block.Chunking(chunking)
+			}
+			if cmd.Flags().Changed("filter-command") {
+				defaults.FilterCommand = strings.Fields(filterCommand)
+			}
+		}
+
+		if err := volumeDefaults(args[0], cmd.Flags().NFlag() > 0, update); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func volumeDefaults(name string, set bool, update func(*block.VolumeDefaults)) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	vol, err := store.FindVolume(name)
+	if err != nil {
+		return fmt.Errorf("error finding volume: %v", err)
+	}
+
+	defaults, err := store.GetVolumeDefaults(vol.ID)
+	if err != nil {
+		return fmt.Errorf("error getting volume defaults: %v", err)
+	}
+
+	if set {
+		update(&defaults)
+		if err := store.SetVolumeDefaults(vol.ID, defaults); err != nil {
+			return fmt.Errorf("error setting volume defaults: %v", err)
+		}
+	}
+
+	unset := func(v string) string {
+		if v == "" {
+			return "-"
+		}
+		return v
+	}
+
+	blockSize := ""
+	if defaults.BlockSize > 0 {
+		blockSize = strconv.Itoa(defaults.BlockSize)
+	}
+
+	table := newTable([]string{"Setting", "Default"})
+	table.Append([]string{"Block Size", unset(blockSize)})
+	table.Append([]string{"Chunking", unset(string(defaults.Chunking))})
+	table.Append([]string{"Filter Command", unset(strings.Join(defaults.FilterCommand, " "))})
+	table.Render()
+
+	return nil
+}
+
+// printVolumes renders volumes as a table, with the age of their last backup.
+func printVolumes(volumes []block.Volume) {
+	table := newTable([]string{"ID", "Name", "Device Path", "UUID", "Last Backup", "Age"})
+	for _, vol := range volumes {
+		lastBackup, age := "never", "-"
+		if !vol.LastBackupAt.IsZero() {
+			lastBackup = vol.LastBackupAt.Format(time.RFC3339)
+			age = time.Since(vol.LastBackupAt).Truncate(time.Second).String()
+		}
+
+		table.Append([]string{
+			strconv.Itoa(vol.ID),
+			vol.Name,
+			vol.DevicePath,
+			vol.UUID,
+			lastBackup,
+			age,
+		})
+	}
+
+	table.Render()
+}
+
+var dbMergeCmd = &cobra.Command{
+	Use:   "merge <other.db>",
+	Short: "Merges another backup database into this one",
+	Long:  `Imports the volumes, backups and blocks of another backup database, such as one kept by another machine. Volumes whose name is already taken are imported with a numeric suffix. The other database isn't modified.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := mergeStore(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func mergeStore(otherPath string) error {
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	result, err := store.Merge(otherPath)
+	if err != nil {
+		return fmt.Errorf("error merging %s: %v", otherPath, err)
+	}
+
+	for from, to := range result.RenamedVolumes {
+		fmt.Printf("Volume %s already exists, imported as %s\n", from, to)
+	}
+
+	fmt.Printf("Merged %d volumes, %d backups, %d new blocks and %d block positions\n", result.Volumes, result.Backups, result.Blocks, result.Positions)
+
+	return nil
+}
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "Lists block devices available on the host",
+	Long:  `Lists the block devices and partitions available on the host along with their sizes. Only supported on Linux.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := listDevices(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+func listDevices() error {
+	devices, err := block.ListBlockDevices()
+	if err != nil {
+		return fmt.Errorf("error listing block devices: %v", err)
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("No block devices found")
+		return nil
+	}
+
+	table := newTable([]string{"Name", "Path", "Size", "Parent", "Read Only"})
+	for _, device := range devices {
+		table.Append([]string{
+			device.Name,
+			device.Path,
+			formatFileSize(float64(device.SizeInBytes)),
+			device.Parent,
+			strconv.FormatBool(device.ReadOnly),
+		})
+	}
+
+	table.Render()
+
+	return nil
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Reports storage statistics",
+	Long:  `Reports storage statistics, including the blocks shared between the backups of different volumes.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := printStats(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Reports the binary, SQLite and schema versions",
+	Long:  `Reports the version of the binary, the SQLite library and the schema of the data store. Include this output when filing a bug.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := block.NewStore()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error creating store: %v\n", err)
+			return
+		}
+		defer store.Close()
+
+		if err := printVersion(os.Stdout, store); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	},
+}
+
+// binaryVersion returns the version set at build time, or the module version recorded in the binary.
+func binaryVersion() string {
+	if version != "" {
+		return version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
+
+func printVersion(w io.Writer, store *block.Store) error {
+	sqliteVersion, err := store.SQLiteVersion()
+	if err != nil {
+		return fmt.Errorf("error getting sqlite version: %v", err)
+	}
+
+	schemaVersion, err := store.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("error getting schema version: %v", err)
+	}
+
+	fmt.Fprintf(w, "Version: %s\n", binaryVersion())
+	fmt.Fprintf(w, "SQLite version: %s\n", sqliteVersion)
+	fmt.Fprintf(w, "Schema version: %d (latest %d)\n", schemaVersion, block.LatestSchemaVersion())
+
+	return nil
+}
+
+func printStats() error {
+	store, err := block.NewReadOnlyStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+
+	shared, err := store.CrossVolumeSharedBlocks()
+	if err != nil {
+		return fmt.Errorf("error finding shared blocks: %v", err)
+	}
+
+	fmt.Printf("Volumes: %d\n", stats.Volumes)
+	fmt.Printf("Backups: %d (%d full, %d differential)\n", stats.Backups, stats.FullBackups, stats.DifferentialBackups)
+	fmt.Printf("Unique blocks: %d\n", stats.UniqueBlocks)
+	fmt.Printf("Block positions: %d\n", stats.Positions)
+	fmt.Printf("Physical size: %s\n", formatFileSize(float64(stats.PhysicalSizeInBytes)))
+	fmt.Printf("Blocks shared across volumes: %d\n", len(shared))
+
+	if len(shared) == 0 {
+		return nil
+	}
+
+	table := newTable([]string{"Block ID", "Hash", "Volumes", "References"})
+	for _, stat := range shared {
+		table.Append([]string{
+			strconv.Itoa(stat.BlockID),
+			stat.Hash,
+			strconv.Itoa(stat.Volumes),
+			strconv.Itoa(stat.References),
+		})
+	}
+	table.Render()
+
+	return nil
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench <path-to-device>",
+	Short: "Benchmarks block size and buffer size combinations",
+	Long:  `Performs backups of the specified device at several block sizes and buffer sizes, reporting throughput and dedup ratio for each. Results are not persisted.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		blockSizes, err := cmd.Flags().GetIntSlice("block-sizes")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-sizes flag")
+		}
+
+		blockBufferSizes, err := cmd.Flags().GetIntSlice("block-buffer-sizes")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-buffer-sizes flag")
+		}
+
+		results, err := block.Bench(args[0], blockSizes, blockBufferSizes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+
+		table := newTable([]string{"Block size", "Buffer size", "Duration", "Throughput", "Dedup ratio"})
+		for _, r := range results {
+			table.Append([]string{
+				formatFileSize(float64(r.BlockSize)),
+				strconv.Itoa(r.BlockBufferSize),
+				r.Duration.Round(time.Millisecond).String(),
+				formatFileSize(r.Throughput) + "/s",
+				fmt.Sprintf("%.2f", r.DedupRatio),
+			})
+		}
+		table.Render()
+	},
+}
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest <path-to-device>",
+	Short: "Verifies the backup and restore pipeline end to end",
+	Long:  `Performs a full backup of the specified device, restores it to a temporary location and compares checksums. All temporary files are removed afterwards.`,
+	Args:  cobra.ExactArgs(1),
+
+	Run: func(cmd *cobra.Command, args []string) {
+		blockSize, err := cmd.Flags().GetInt("block-size")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-size flag")
+		}
+
+		blockBufferSize, err := cmd.Flags().GetInt("block-buffer-size")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error getting block-buffer-size flag")
+		}
+
+		result, err := block.SelfTest(args[0], blockSize, blockBufferSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Source checksum:  %s\n", result.SourceChecksum)
+		fmt.Printf("Restore checksum: %s\n", result.RestoreChecksum)
+		if !result.Passed {
+			fmt.Println("FAIL")
+			os.Exit(1)
+		}
+		fmt.Println("PASS")
+	},
+}
+
+var createCmd = &cobra.Command{
+	Use:   "create <path-to-device>",
+	Short: "Performs a backup operation",
+	Long:  `Performs a backup operation on the specified device, or on each device listed in the --batch file.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if batch, _ := cmd.Flags().GetString("batch"); batch != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+
+	Run: func(cmd *cobra.Command, args []string) {
+		var devicePath string
+		if len(args) > 0 {
+			devicePath = args[0]
+		}
+		stderr := os.Stderr
+
+		// Extract the output flag value
+		outputDirPath, err := cmd.Flags().GetString("output-dir")
+		if err != nil || outputDirPath == "" {
+			fmt.Fprintln(stderr, "No output directory specified. Saving backup file to current directory.")
+			outputDirPath = "."
+		}
+
+		outputFormat, err := cmd.Flags().GetString("output-format")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting output-format flag")
+		}
+
+		onExisting, err := cmd.Flags().GetString("on-existing")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting on-existing flag")
+		}
+
+		blockSize, err := cmd.Flags().GetInt("block-size")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting block-size flag")
+		}
+
+		// Leave the block size unset unless specified, so differentials inherit it from their full.
+		if !cmd.Flags().Changed("block-size") {
+			blockSize = 0
+		}
+
+		blockBufferSizeValue, err := cmd.Flags().GetString("block-buffer-size")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting block-buffer-size flag")
+		}
+
+		blockBufferSize, err := block.ParseBlockBufferSize(blockBufferSizeValue)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return
+		}
+
+		readAhead, err := cmd.Flags().GetInt("read-ahead")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting read-ahead flag")
+		}
+
+		chunking, err := cmd.Flags().GetString("chunking")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting chunking flag")
+		}
+
+		// Leave the chunking unset unless specified, so the volume's default applies.
+		if !cmd.Flags().Changed("chunking") {
+			chunking = ""
+		}
+
+		compactConstantBlocks, err := cmd.Flags().GetBool("compact-constant-blocks")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting compact-constant-blocks flag")
+		}
+
+		verifySource, err := cmd.Flags().GetBool("verify-source")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting verify-source flag")
+		}
+
+		identifyByUUID, err := cmd.Flags().GetBool("identify-by-uuid")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting identify-by-uuid flag")
+		}
+
+		includePartial, err := cmd.Flags().GetBool("include-partial")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting include-partial flag")
+		}
+
+		readTimeout, err := cmd.Flags().GetDuration("read-timeout")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting read-timeout flag")
+		}
+
+		readRetries, err := cmd.Flags().GetInt("read-retries")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting read-retries flag")
+		}
+
+		filterCommand, err := cmd.Flags().GetString("filter-command")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting filter-command flag")
+		}
+
+		directIO, err := cmd.Flags().GetBool("direct-io")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting direct-io flag")
+		}
+
+		hashSample, err := cmd.Flags().GetBool("hash-sample")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting hash-sample flag")
+		}
+
+		hashAlgorithm, err := cmd.Flags().GetString("hash-algorithm")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting hash-algorithm flag")
+		}
+
+		verifyWrites, err := cmd.Flags().GetBool("verify-writes")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting verify-writes flag")
+		}
+
+		followSymlinks, err := cmd.Flags().GetBool("follow-symlinks")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting follow-symlinks flag")
+		}
+
+		concurrency, err := concurrencyFlag(cmd)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return
+		}
+
+		encodePositionRanges, err := cmd.Flags().GetBool("encode-position-ranges")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting encode-position-ranges flag")
+		}
+
+		hashCache, err := cmd.Flags().GetBool("hash-cache")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting hash-cache flag")
+		}
+
+		merkleTree, err := cmd.Flags().GetBool("merkle-tree")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting merkle-tree flag")
+		}
+
+		insertSynchronous, err := cmd.Flags().GetString("insert-synchronous")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting insert-synchronous flag")
+		}
+
+		detectSourceChange, err := cmd.Flags().GetBool("detect-source-change")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting detect-source-change flag")
+		}
+
+		onSourceChange, err := cmd.Flags().GetString("on-source-change")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting on-source-change flag")
+		}
+
+		liveStats, err := cmd.Flags().GetDuration("live-stats")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting live-stats flag")
+		}
+
+		appVersion, err := cmd.Flags().GetString("app-version")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting app-version flag")
+		}
+
+		preHook, err := cmd.Flags().GetString("pre-hook")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting pre-hook flag")
+		}
+
+		postHook, err := cmd.Flags().GetString("post-hook")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting post-hook flag")
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting output flag")
+		}
+
+		batch, err := cmd.Flags().GetString("batch")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting batch flag")
+		}
+
+		parallelBackups, err := cmd.Flags().GetInt("parallel-backups")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting parallel-backups flag")
+		}
+
+		enablePprof, err := cmd.Flags().GetBool("enable-pprof")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error getting pprof flag")
+		}
+
+		wg := &sync.WaitGroup{}
+		if enablePprof {
+			fmt.Fprintln(stderr, "Starting pprof server on port 6060")
+			wg.Add(1)
+			go func() {
+				if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+					fmt.Fprintln(stderr, err)
+					return
+				}
+			}()
+		}
+
+		cfg := &block.BackupConfig{
+			DevicePath:               devicePath,
+			OutputFormat:             block.BackupOutputFormat(outputFormat),
+			OutputDirectory:          outputDirPath,
+			OnExisting:               block.ExistingFilePolicy(onExisting),
+			BlockSize:                blockSize,
+			BlockBufferSize:          blockBufferSize,
+			ReadAheadBytes:           readAhead,
+			Chunking:                 block.Chunking(chunking),
+			VerifySource:             verifySource,
+			RequireAlignedSource:     !includePartial,
+			IdentifyByUUID:           identifyByUUID,
+			ReadTimeout:              readTimeout,
+			ReadRetries:              readRetries,
+			CompactConstantBlocks:    compactConstantBlocks,
+			FilterCommand:            strings.Fields(filterCommand),
+			DirectIO:                 directIO,
+			HashSample:               hashSample,
+			HashAlgorithm:            block.HashAlgorithm(strings.ToLower(hashAlgorithm)),
+			EncodePositionRanges:     encodePositionRanges,
+			HashCache:                hashCache,
+			MerkleTree:               merkleTree,
+			DetectChangeDuringBackup: detectSourceChange,
+			InsertSynchronous:        block.SynchronousMode(strings.ToUpper(insertSynchronous)),
+			OnSourceChange:           block.SourceChangePolicy(onSourceChange),
+			FollowSymlinks:           followSymlinks,
+			Concurrency:              concurrency,
+			VerifyWrites:             verifyWrites,
+			AppVersion:               appVersion,
+		}
+
+		if preHook != "" {
+			cfg.PreHook = shellHook(preHook, stderr)
+		}
+
+		if postHook != "" {
+			cfg.PostHook = shellHook(postHook, stderr)
+		}
+
+		if liveStats > 0 {
+			cfg.StatsInterval = liveStats
+			cfg.Stats = func(stats block.BackupStats) {
+				fmt.Fprintf(stderr, "[%s] %d/%d blocks, %d written, %.2f MB/s, %.1f%% deduplicated\n",
+					stats.Elapsed.Truncate(time.Second), stats.BlocksProcessed, stats.TotalBlocks, stats.BlocksWritten, stats.Throughput, stats.DedupRatio*100)
+			}
+		}
+
+		if batch != "" {
+			if err := performBatchBackup(cfg, batch, parallelBackups, output); err != nil {
+				fmt.Fprintln(stderr, err)
+			}
+		} else if err := performBackup(cfg, output); err != nil {
+			fmt.Fprintln(stderr, err)
+		}
+
+		if enablePprof {
+			fmt.Fprintf(stderr, "Backup completed. Pprof server is still running on port 6060. Ctrl+C to stop")
+			wg.Wait()
+		}
+	},
+}
+
+// shellHook returns a backup hook that runs command with sh, sending its output to w.
+func shellHook(command string, w io.Writer) func() error {
+	return func() error {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%q: %w", command, err)
+		}
+		return nil
+	}
+}
+
+// concurrencyFlag parses the command's concurrency flag. Zero is returned when it's unset.
+func concurrencyFlag(cmd *cobra.Command) (int, error) {
+	value, err := cmd.Flags().GetString("concurrency")
+	if err != nil {
+		return 0, fmt.Errorf("error getting concurrency flag: %w", err)
+	}
+
+	if value == "" {
+		return 0, nil
+	}
+
+	return block.ParseConcurrency(value)
+}
+
+// performBackup runs the backup described by cfg and prints a summary in the specified output format.
+func performBackup(cfg *block.BackupConfig, output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("output %q is not supported", output)
+	}
+
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	cfg.Store = store
+	devicePath := cfg.DevicePath
+	outputDir := cfg.OutputDirectory
+
+	fmt.Fprintf(os.Stderr, "Performing backup of %s to %s\n", devicePath, outputDir)
+
+	b, err := block.NewBackup(cfg)
+	if err != nil {
+		return fmt.Errorf("error creating backup: %v", err)
+	}
+
+	if err := b.Run(); err != nil {
+		// Remove the partial backup, so it isn't mistaken for a usable one.
+		if cleanupErr := b.Cleanup(); cleanupErr != nil {
+			return fmt.Errorf("error performing backup: %v (cleaning up also failed: %v)", err, cleanupErr)
+		}
+		return fmt.Errorf("error performing backup: %v", err)
+	}
+
+	if cfg.OutputFormat == block.BackupOutputFormatFile {
+		result, err := b.Result()
+		if err != nil {
+			return err
+		}
+
+		return printBackupResult(os.Stdout, result, output)
+	}
+
+	return nil
+}
+
+// performBatchBackup backs up each device listed in the batch file with the settings of cfg,
+// running up to parallel backups at once, and prints a summary of each completed backup.
+// Blank lines and lines starting with # are ignored.
+func performBatchBackup(cfg *block.BackupConfig, batch string, parallel int, output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("output %q is not supported", output)
+	}
+
+	if cfg.OutputFormat != block.BackupOutputFormatFile {
+		return fmt.Errorf("batch backups require %q output", block.BackupOutputFormatFile)
+	}
+
+	data, err := os.ReadFile(batch)
+	if err != nil {
+		return fmt.Errorf("error reading batch file: %v", err)
+	}
+
+	store, err := block.NewStore()
+	if err != nil {
+		return fmt.Errorf("error creating store: %v", err)
+	}
+
+	if err := store.SetupDB(); err != nil {
+		return fmt.Errorf("error setting up database: %v", err)
+	}
+
+	var configs []*block.BackupConfig
+	for _, line := range strings.Split(string(data), "\n") {
+		devicePath := strings.TrimSpace(line)
+		if devicePath == "" || strings.HasPrefix(devicePath, "#") {
+			continue
+		}
+
+		c := *cfg
+		c.Store = store
+		c.DevicePath = devicePath
+		configs = append(configs, &c)
+	}
+
+	if len(configs) == 0 {
+		return fmt.Errorf("batch file %s lists no devices", batch)
+	}
+
+	fmt.Fprintf(os.Stderr, "Performing %d backups to %s, %d at a time\n", len(configs), cfg.OutputDirectory, parallel)
+
+	results, err := block.RunBackups(configs, parallel)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+
+		if err := printBackupResult(os.Stdout, *result, output); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// printBackupResult writes the backup summary to w as either decorated text or JSON.
+func printBackupResult(w io.Writer, result block.BackupResult, output string) error {
+	if output == "json" {
+		return json.NewEncoder(w).Encode(result)
+	}
+
+	fmt.Fprintln(w, "Backup completed successfully!")
+	fmt.Fprintln(w, "=============Info=================")
+	fmt.Fprintf(w, "Backup Duration: %s\n", time.Duration(result.DurationMs)*time.Millisecond)
+	fmt.Fprintf(w, "Backup file: %s\n", result.FilePath)
+	fmt.Fprintf(w, "Backup size %s\n", formatFileSize(float64(result.BackupSizeInBytes)))
+	fmt.Fprintf(w, "Source device size: %s\n", formatFileSize(float64(result.SourceSizeInBytes)))
+	fmt.Fprintf(w, "Space saved: %s\n", formatFileSize(float64(result.SpaceSavedInBytes)))
+	fmt.Fprintf(w, "Blocks evaluated: %d\n", result.BlocksEvaluated)
+	fmt.Fprintf(w, "Blocks written: %d\n", result.BlocksWritten)
+	fmt.Fprintf(w, "Block buffer size: %d\n", result.BlockBufferSize)
+	fmt.Fprintln(w, "==================================")
 
 	return nil
 }
@@ -1,6 +1,16 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davissp14/block-diff"
+)
 
 func TestFormatFileSize(t *testing.T) {
 	tests := []struct {
@@ -21,3 +31,98 @@ func TestFormatFileSize(t *testing.T) {
 		}
 	}
 }
+
+func TestPrintBackupResultJSON(t *testing.T) {
+	result := block.BackupResult{
+		BackupID:          7,
+		FilePath:          "backups/pg.ext4_full_1",
+		BackupSizeInBytes: 38797312,
+		SourceSizeInBytes: 52428800,
+		SpaceSavedInBytes: 13631488,
+		BlocksEvaluated:   50,
+		BlocksWritten:     37,
+		DurationMs:        1250,
+		BlockBufferSize:   5,
+	}
+
+	var buf bytes.Buffer
+	if err := printBackupResult(&buf, result, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"backup_id":         float64(7),
+		"file_path":         "backups/pg.ext4_full_1",
+		"backup_size_bytes": float64(38797312),
+		"source_size_bytes": float64(52428800),
+		"space_saved_bytes": float64(13631488),
+		"blocks_evaluated":  float64(50),
+		"blocks_written":    float64(37),
+		"duration_ms":       float64(1250),
+		"block_buffer_size": float64(5),
+		"approximate":       false,
+	}
+
+	if len(fields) != len(expected) {
+		t.Fatalf("expected %d fields, got %d: %v", len(expected), len(fields), fields)
+	}
+
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, fields[key])
+		}
+	}
+}
+
+func TestFormatProgressBar(t *testing.T) {
+	tests := []struct {
+		progress block.RestoreProgress
+		expected string
+	}{
+		{block.RestoreProgress{Completed: 0, Total: 10, Estimating: true}, "[>                             ]   0% 0B/s ETA estimating"},
+		{block.RestoreProgress{Completed: 5, Total: 10, BytesPerSecond: 1048576, Remaining: 12 * time.Second}, "[===============>              ]  50% 1.0 MiB/s ETA 12s"},
+		{block.RestoreProgress{Completed: 10, Total: 10, BytesPerSecond: 1048576}, "[==============================] 100% 1.0 MiB/s ETA 0s"},
+	}
+
+	for _, tt := range tests {
+		if got := formatProgressBar(tt.progress); got != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, got)
+		}
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	store, err := block.OpenStore(filepath.Join(t.TempDir(), "version.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.SetupDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := printVersion(&buf, store); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", buf.String())
+	}
+
+	if sqliteVersion := strings.TrimPrefix(lines[1], "SQLite version: "); sqliteVersion == "" || sqliteVersion == lines[1] {
+		t.Fatalf("expected a sqlite version, got %q", lines[1])
+	}
+
+	expected := fmt.Sprintf("Schema version: %d (latest %d)", block.LatestSchemaVersion(), block.LatestSchemaVersion())
+	if lines[2] != expected {
+		t.Fatalf("expected %q, got %q", expected, lines[2])
+	}
+}
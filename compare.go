@@ -0,0 +1,109 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ImageMismatchError is returned when the restored output differs from the reference image.
+type ImageMismatchError struct {
+	Reference string
+	// Offset is the first byte at which the restored output and the reference differ. When one is
+	// a prefix of the other, it's the length of the shorter.
+	Offset int64
+	// Position is the block position holding Offset.
+	Position int
+}
+
+func (e *ImageMismatchError) Error() string {
+	return fmt.Sprintf("restored output differs from reference image %s at offset %d (position %d)", e.Reference, e.Offset, e.Position)
+}
+
+// compareChunkSize is the number of bytes compared at a time.
+const compareChunkSize = 1 << 20
+
+// compareToReference byte-compares the restored output with the CompareTo reference image.
+func (r *Restore) compareToReference(output io.Reader) error {
+	reference, err := os.Open(r.config.CompareTo)
+	if err != nil {
+		return fmt.Errorf("error opening reference image: %v", err)
+	}
+	defer func() { _ = reference.Close() }()
+
+	offset, equal, err := firstDifference(output, reference)
+	if err != nil {
+		return fmt.Errorf("error comparing restored output to reference image: %v", err)
+	}
+
+	if !equal {
+		return &ImageMismatchError{Reference: r.config.CompareTo, Offset: offset, Position: int(offset / int64(r.backup.BlockSize))}
+	}
+
+	return nil
+}
+
+// compareFile compares the restored file at path with the reference image.
+func (r *Restore) compareFile(path string) error {
+	output, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening restored file: %v", err)
+	}
+	defer func() { _ = output.Close() }()
+
+	return r.compareToReference(output)
+}
+
+// firstDifference reads a and b in step, returning the offset of the first byte at which they
+// differ, or whether they're equal.
+func firstDifference(a, b io.Reader) (int64, bool, error) {
+	bufA := make([]byte, compareChunkSize)
+	bufB := make([]byte, compareChunkSize)
+	readerA := bufio.NewReaderSize(a, compareChunkSize)
+	readerB := bufio.NewReaderSize(b, compareChunkSize)
+
+	var offset int64
+	for {
+		nA, errA := io.ReadFull(readerA, bufA)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return 0, false, errA
+		}
+
+		nB, errB := io.ReadFull(readerB, bufB)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return 0, false, errB
+		}
+
+		n := min(nA, nB)
+		if i := mismatchIndex(bufA[:n], bufB[:n]); i >= 0 {
+			return offset + int64(i), false, nil
+		}
+
+		if nA != nB {
+			return offset + int64(n), false, nil
+		}
+
+		// Both readers ended at the same length.
+		if nA < compareChunkSize {
+			return 0, true, nil
+		}
+		offset += int64(n)
+	}
+}
+
+// mismatchIndex returns the index of the first byte at which a and b differ, or -1.
+func mismatchIndex(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,104 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRestoreCompareTo(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	altered, err := os.ReadFile("assets/pg_altered.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstDiff := int64(-1)
+	for i := range source {
+		if source[i] != altered[i] {
+			firstDiff = int64(i)
+			break
+		}
+	}
+	if firstDiff < 0 {
+		t.Fatal("expected the altered image to differ from the source")
+	}
+
+	// A reference holding only the start of the image differs where it ends.
+	truncated := "restores/truncated.ext4"
+	if err := os.WriteFile(truncated, source[:3*1048576+100], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		reference string
+		offset    int64
+	}{
+		{"source", "assets/pg.ext4", -1},
+		{"altered", "assets/pg_altered.ext4", firstDiff},
+		{"truncated", truncated, 3*1048576 + 100},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			restore, err := NewRestore(RestoreConfig{
+				Store:              store,
+				RestoreInputFormat: RestoreInputFormatFile,
+				SourceBackupID:     b.Record.ID,
+				OutputDirectory:    "restores/",
+				OutputFileName:     "compare-" + tc.name,
+				CompareTo:          tc.reference,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = restore.Run()
+			if tc.offset < 0 {
+				if err != nil {
+					t.Fatalf("expected the restore to match %s, got %v", tc.reference, err)
+				}
+				return
+			}
+
+			var mismatch *ImageMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected an image mismatch, got %v", err)
+			}
+
+			if mismatch.Offset != tc.offset || mismatch.Position != int(tc.offset/1048576) {
+				t.Fatalf("expected the first difference at offset %d (position %d), got offset %d (position %d)", tc.offset, tc.offset/1048576, mismatch.Offset, mismatch.Position)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package block
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// ConcurrencyAuto picks the concurrency of a backup or restore from the type of its device.
+// See AutoConcurrency.
+const ConcurrencyAuto = -1
+
+const (
+	// rotationalConcurrency keeps few requests in flight to spinning disks, where concurrent
+	// requests make the heads seek between them rather than reading sequentially.
+	rotationalConcurrency = 2
+	// minSolidStateConcurrency is the least concurrency used for SSDs and NVMe drives, which
+	// serve many requests in parallel.
+	minSolidStateConcurrency = 8
+)
+
+// AutoConcurrency returns the number of workers to use against devicePath. Rotational block devices
+// get a low concurrency to avoid seek thrashing, while solid state devices get a high one. Files,
+// and devices whose type can't be determined, use GOMAXPROCS.
+func AutoConcurrency(devicePath string) int {
+	info, err := os.Stat(devicePath)
+	if err != nil || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+
+	rotational, err := isRotational(devicePath)
+	if err != nil {
+		return runtime.GOMAXPROCS(0)
+	}
+
+	return deviceConcurrency(rotational)
+}
+
+// deviceConcurrency returns the concurrency used for a block device.
+func deviceConcurrency(rotational bool) int {
+	if rotational {
+		return rotationalConcurrency
+	}
+
+	return max(runtime.GOMAXPROCS(0), minSolidStateConcurrency)
+}
+
+// ParseConcurrency parses a concurrency setting, either a positive number of workers or "auto"
+// for ConcurrencyAuto.
+func ParseConcurrency(value string) (int, error) {
+	if value == "auto" {
+		return ConcurrencyAuto, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("concurrency must be a positive number or \"auto\", got %q", value)
+	}
+
+	return n, nil
+}
+
+// resolveConcurrency validates concurrency, resolving ConcurrencyAuto against devicePath.
+func resolveConcurrency(concurrency int, devicePath string) (int, error) {
+	switch {
+	case concurrency == ConcurrencyAuto:
+		return AutoConcurrency(devicePath), nil
+	case concurrency < 0:
+		return 0, fmt.Errorf("concurrency must not be negative, got %d", concurrency)
+	}
+
+	return concurrency, nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package block
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// isRotational reports whether the block device at devicePath is backed by a spinning disk.
+func isRotational(devicePath string) (bool, error) {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return false, err
+	}
+
+	return sysfsRotational("/sys/block", filepath.Base(resolved))
+}
+
+// sysfsRotational reads the queue/rotational attribute of the named device from a /sys/block
+// style layout rooted at sysRoot. Partitions don't have a queue of their own, so they report
+// the attribute of their disk.
+func sysfsRotational(sysRoot, name string) (bool, error) {
+	dir := filepath.Join(sysRoot, name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		disks, err := filepath.Glob(filepath.Join(sysRoot, "*", name, "partition"))
+		if err != nil {
+			return false, err
+		}
+		if len(disks) == 0 {
+			return false, fmt.Errorf("block device %s not found in %s", name, sysRoot)
+		}
+		dir = filepath.Dir(filepath.Dir(disks[0]))
+	}
+
+	rotational, err := readSysfsInt(filepath.Join(dir, "queue", "rotational"))
+	if err != nil {
+		return false, fmt.Errorf("error reading rotational flag of %s: %w", name, err)
+	}
+
+	return rotational == 1, nil
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package block
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSysfsRotational(t *testing.T) {
+	sysRoot := t.TempDir()
+
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "queue", "rotational"), "1")
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "sda1", "partition"), "1")
+	writeSysfsFile(t, filepath.Join(sysRoot, "nvme0n1", "queue", "rotational"), "0")
+	writeSysfsFile(t, filepath.Join(sysRoot, "nvme0n1", "nvme0n1p1", "partition"), "1")
+
+	cases := map[string]bool{
+		"sda":       true,
+		"sda1":      true,
+		"nvme0n1":   false,
+		"nvme0n1p1": false,
+	}
+
+	for name, expected := range cases {
+		rotational, err := sysfsRotational(sysRoot, name)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+
+		if rotational != expected {
+			t.Fatalf("expected %s rotational to be %t, got %t", name, expected, rotational)
+		}
+	}
+
+	if _, err := sysfsRotational(sysRoot, "sdb"); err == nil {
+		t.Fatal("expected an error for a missing device")
+	}
+
+	hdd := deviceConcurrency(true)
+	ssd := deviceConcurrency(false)
+	if hdd >= ssd {
+		t.Fatalf("expected rotational concurrency %d to be lower than solid state concurrency %d", hdd, ssd)
+	}
+
+	if ssd < runtime.GOMAXPROCS(0) {
+		t.Fatalf("expected solid state concurrency %d to be at least GOMAXPROCS", ssd)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package block
+
+import "errors"
+
+// isRotational is only supported on Linux.
+func isRotational(devicePath string) (bool, error) {
+	return false, errors.New("detecting rotational devices is not supported on this platform")
+}
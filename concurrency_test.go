@@ -0,0 +1,69 @@
+package block
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestAutoConcurrencyFile(t *testing.T) {
+	if concurrency := AutoConcurrency("assets/pg.ext4"); concurrency != runtime.GOMAXPROCS(0) {
+		t.Fatalf("expected files to use GOMAXPROCS %d, got %d", runtime.GOMAXPROCS(0), concurrency)
+	}
+
+	for _, value := range []string{"0", "-1", "fast"} {
+		if _, err := ParseConcurrency(value); err == nil {
+			t.Fatalf("expected an error parsing %q", value)
+		}
+	}
+
+	if concurrency, err := ParseConcurrency("auto"); err != nil || concurrency != ConcurrencyAuto {
+		t.Fatalf("expected auto to parse as ConcurrencyAuto, got %d, %v", concurrency, err)
+	}
+}
+
+func TestBackupAutoConcurrency(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+		Concurrency:     ConcurrencyAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Config.Concurrency != runtime.GOMAXPROCS(0) {
+		t.Fatalf("expected auto concurrency to resolve to %d, got %d", runtime.GOMAXPROCS(0), b.Config.Concurrency)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Record.TotalBlocks != 50 {
+		t.Fatalf("expected 50 blocks, got %d", b.Record.TotalBlocks)
+	}
+
+	if _, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockBufferSize: 10,
+		Concurrency:     -2,
+	}); err == nil {
+		t.Fatal("expected an error for a negative concurrency")
+	}
+}
@@ -1,5 +1,10 @@
 package block
 
+import (
+	"io"
+	"time"
+)
+
 // BackupOutputFormat defines the format of the backup output.
 type BackupOutputFormat string
 
@@ -9,12 +14,88 @@ const (
 	BackupOutputFormatFile   BackupOutputFormat = "file"
 )
 
+// ExistingFilePolicy defines what happens when an output file already exists.
+type ExistingFilePolicy string
+
+// Constants for ExistingFilePolicy to specify how output file collisions are handled.
+const (
+	// ExistingFileFail refuses to write over an existing file. This is the default.
+	ExistingFileFail ExistingFilePolicy = "fail"
+	// ExistingFileOverwrite truncates and replaces the existing file.
+	ExistingFileOverwrite ExistingFilePolicy = "overwrite"
+	// ExistingFileRename writes to a new file with a numeric suffix (e.g. name.1).
+	ExistingFileRename ExistingFilePolicy = "rename"
+)
+
+// Chunking defines how the source is split into blocks.
+type Chunking string
+
+// Constants for Chunking to specify how block boundaries are determined.
+const (
+	// ChunkingFixed splits the source into blocks of exactly BlockSize bytes.
+	ChunkingFixed Chunking = "fixed"
+	// ChunkingContentDefined splits the source at boundaries chosen by a rolling hash,
+	// producing variable-length chunks that average BlockSize bytes. Inserting data only
+	// affects the chunks around the insertion, rather than shifting every following block.
+	ChunkingContentDefined Chunking = "content"
+)
+
+// HashAlgorithm identifies the digest blocks are hashed with.
+type HashAlgorithm string
+
+// Constants for HashAlgorithm to specify how blocks are identified.
+const (
+	// HashAlgorithmXXHash64 is a fast, non-cryptographic 64-bit hash. This is the default.
+	HashAlgorithmXXHash64 HashAlgorithm = "xxhash64"
+	// HashAlgorithmSHA256 is a collision resistant 256-bit hash, at a fraction of the
+	// throughput of HashAlgorithmXXHash64.
+	HashAlgorithmSHA256 HashAlgorithm = "sha256"
+)
+
+// SourceChangePolicy defines what happens when the source changes while it's being backed up.
+type SourceChangePolicy string
+
+// Constants for SourceChangePolicy to specify how a source that changed during the backup is handled.
+const (
+	// SourceChangeFail aborts the backup. This is the default.
+	SourceChangeFail SourceChangePolicy = "fail"
+	// SourceChangeWarn completes the backup, printing a warning and setting Backup.SourceChanged.
+	SourceChangeWarn SourceChangePolicy = "warn"
+)
+
+// SynchronousMode is a SQLite synchronous setting, which trades durability for write speed.
+type SynchronousMode string
+
+// Constants for SynchronousMode, from fastest to most durable.
+const (
+	// SynchronousOff hands writes to the OS without syncing them. A crash of the process is safe,
+	// but an OS crash or power loss may corrupt the database.
+	SynchronousOff SynchronousMode = "OFF"
+	// SynchronousNormal syncs less often. In WAL mode, an OS crash or power loss may roll back the
+	// most recent transactions but won't corrupt the database.
+	SynchronousNormal SynchronousMode = "NORMAL"
+	// SynchronousFull syncs every transaction. This is SQLite's default.
+	SynchronousFull  SynchronousMode = "FULL"
+	SynchronousExtra SynchronousMode = "EXTRA"
+)
+
 // BackupConfig is the configuration for a backup operation.
 type BackupConfig struct {
 	// Store is the sqlite data store used to persist the backup metadata.
 	Store *Store
 	// DevicePath is the path to the device/file to backup.
 	DevicePath string
+	// FollowSymlinks resolves DevicePath to its canonical path before the volume is identified, so
+	// backups taken through different aliases of a device (e.g. /dev/disk/by-id/...) share a chain.
+	FollowSymlinks bool
+	// IdentifyByUUID identifies the volume by the UUID of the ext2/3/4 filesystem on the source
+	// rather than by the basename of DevicePath, so backups of the filesystem chain together
+	// whichever path it's reached through. Sources without a filesystem UUID fall back to the
+	// basename.
+	IdentifyByUUID bool
+	// Source is an optional reader used in place of opening DevicePath.
+	// DevicePath is still used to identify the volume. The reader must implement Size() int64.
+	Source io.ReaderAt
 	// Output format for the backup.
 	OutputFormat BackupOutputFormat
 	// OutputDirectory is the directory where the backup will be written.
@@ -23,12 +104,111 @@ type BackupConfig struct {
 	// OutputFileName is the name of the backup file.
 	// If OutputFormat is set to STDOUT, this field is ignored.
 	OutputFileName string
+	// OnExisting determines what happens if the backup file already exists. Defaults to ExistingFileFail.
+	OnExisting ExistingFilePolicy
 	// BlockSize is the number of bytes used to calculate the hash.
-	// WARNING: Changing this value will invalidate all previous backups.
+	// When zero, differentials inherit the block size of their full backup and fulls default to 4096.
+	// Differentials must use the block size of their full. WARNING: Blocks of different sizes never
+	// dedup against each other, so a full at a new block size shares no blocks with earlier backups
+	// (see Backup.MismatchedBlockSizes).
 	BlockSize int
+	// RequireAlignedSource refuses to back up a source whose size isn't a multiple of BlockSize,
+	// which usually means the device or block size is misconfigured, rather than backing up its
+	// final partial block. Content-defined chunking has no fixed block size, so it's unaffected.
+	RequireAlignedSource bool
 	// BlockBufferSize is the number of blocks to buffer before hashing and writing to storage.
-	// This is used to reduce the number of writes to storage and improve performance.
+	// This is used to reduce the number of writes to storage and improve performance. Must be at
+	// least 1, or BlockBufferSizeAuto to tune it to the source as the backup runs, in which case
+	// the size chosen is reported by BackupResult.BlockBufferSize. BlockBufferSizeAuto is not
+	// supported with ChunkingContentDefined.
 	BlockBufferSize int
+	// ReadAheadBytes is the size of the buffer the source is read through, independent of the
+	// BlockBufferSize used for hashing. Larger values can improve throughput on high-latency
+	// storage. Defaults to BlockBufferSize * BlockSize.
+	ReadAheadBytes int
+	// Concurrency is the number of workers hashing each buffer, and bounds the number of buffers in
+	// flight through the pipeline. Zero uses GOMAXPROCS workers. ConcurrencyAuto chooses it from
+	// the source's device type (see AutoConcurrency).
+	Concurrency int
+	// CompactConstantBlocks stores blocks consisting of a single repeated byte (e.g. zeroed or 0xFF
+	// filled regions) as a tiny descriptor rather than writing them to the backup file.
+	CompactConstantBlocks bool
+	// Chunking determines how the source is split into blocks. Defaults to ChunkingFixed.
+	// Differential backups must use the same chunking as their full backup.
+	Chunking Chunking
+	// Progress is an optional callback that reports the number of blocks processed.
+	Progress ProgressFunc
+	// Stats is an optional callback that receives a snapshot of the backup's throughput, dedup ratio
+	// and blocks written every StatsInterval, and once more when the backup finishes.
+	Stats StatsFunc
+	// StatsInterval is how often Stats is invoked. Defaults to 5 seconds.
+	StatsInterval time.Duration
+	// PreHook is an optional function run before the source is opened, e.g. to flush and quiesce
+	// an application so the backup is consistent. The backup is aborted if it returns an error.
+	PreHook func() error
+	// PostHook is an optional function run after the source is closed, e.g. to thaw the application.
+	// It runs whenever PreHook succeeded, even if the backup fails.
+	PostHook func() error
+	// DetectChangeDuringBackup records the source's size, modification time and a hash of its first
+	// blocks when the backup starts, and checks them again once the source has been read. A change
+	// means the image may be torn, as it mixes data from before and after the change. Rehashing the
+	// first blocks catches writes to block devices, whose modification time isn't updated.
+	DetectChangeDuringBackup bool
+	// OnSourceChange determines what happens if DetectChangeDuringBackup detects a change.
+	// Defaults to SourceChangeFail.
+	OnSourceChange SourceChangePolicy
+	// VerifySource re-reads each block and aborts the backup if the two reads differ.
+	// This is useful for detecting flaky hardware, but halves read throughput.
+	VerifySource bool
+	// FilterCommand is an optional external command (e.g. ["gzip", "-c"]) that the backup
+	// stream is piped through before it is written.
+	FilterCommand []string
+	// DirectIO opens the source with O_DIRECT, bypassing the page cache.
+	// Falls back to buffered I/O when O_DIRECT isn't supported.
+	DirectIO bool
+	// ReadTimeout bounds each read of the source, so a hung device fails the backup rather than
+	// stalling it forever. A timed out read is retried up to ReadRetries times before the backup
+	// fails with a ReadTimeoutError. Zero disables the timeout.
+	ReadTimeout time.Duration
+	// ReadRetries is the number of times a timed out read is retried.
+	ReadRetries int
+	// HashSample identifies blocks by hashing only a sample of each block (its first, middle and
+	// last KiB) rather than the whole block. UNSAFE: a change outside the sampled regions goes
+	// undetected, so a differential may silently restore stale data. Differential backups must
+	// use the same setting as their full backup.
+	HashSample bool
+	// HashAlgorithm is the digest blocks are identified by. Fulls default to HashAlgorithmXXHash64,
+	// and differentials default to, and must use, the algorithm of their full backup. Blocks hashed
+	// with different algorithms are never deduplicated against each other.
+	HashAlgorithm HashAlgorithm
+	// EncodePositionRanges stores runs of consecutive positions that reference consecutive blocks
+	// as a single row once the backup completes, rather than one row per position. This greatly
+	// shrinks the database for sequential full backups. Not supported with ChunkingContentDefined.
+	EncodePositionRanges bool
+	// HashCache keeps a per-volume cache of the hash at each position of the last full backup, so
+	// differentials compare their reads against it rather than querying the full's block positions.
+	// Fulls taken with HashCache populate it, and a differential rebuilds it when it was built from
+	// another backup or block size. Not supported with ChunkingContentDefined.
+	HashCache bool
+	// VerifyWrites reads back the blocks written by each iteration and confirms their hashes before
+	// their positions are recorded, catching storage-layer corruption at backup time rather than
+	// restore time. This roughly doubles write I/O. Requires file output with fixed chunking and
+	// no FilterCommand.
+	VerifyWrites bool
+	// InsertSynchronous optionally sets SQLite's synchronous mode while the backup's blocks and
+	// block positions are inserted, restoring the previous mode before the backup's metadata is
+	// recorded. SynchronousOff speeds up backups of huge volumes. The source is still readable if the
+	// backup fails, so losing the backup in progress is harmless, but an OS crash or power loss
+	// during the inserts may corrupt the whole database rather than just the backup in progress.
+	// SynchronousNormal can't corrupt a WAL database, only lose the most recent inserts.
+	InsertSynchronous SynchronousMode
+	// MerkleTree builds a Merkle tree over the backup's blocks once it completes and records its
+	// root, so a block can be proven to belong to the backup (see Store.MerkleProof) without
+	// reading the backup file. Not supported with ChunkingContentDefined.
+	MerkleTree bool
+	// AppVersion optionally records the application version (e.g. a git commit) that created
+	// the backup on its record.
+	AppVersion string
 }
 
 // RestoreInputFormat defines the format of the incoming backup.
@@ -39,6 +219,18 @@ const (
 	RestoreInputFormatFile RestoreInputFormat = "file"
 )
 
+// ImageFormat defines the format of the restored image.
+type ImageFormat string
+
+// Constants for ImageFormat to specify how the restored image is laid out.
+const (
+	// ImageFormatRaw writes every block of the restore to a flat file. This is the default.
+	ImageFormatRaw ImageFormat = "raw"
+	// ImageFormatRawSparse writes a flat file, leaving zeroed blocks as holes that aren't
+	// allocated on disk. Hypervisors and most tools read it as a raw image.
+	ImageFormatRawSparse ImageFormat = "raw-sparse"
+)
+
 // RestoreConfig is the configuration for a restore operation.
 type RestoreConfig struct {
 	// Store is the sqlite data store used to persist the backup metadata.
@@ -51,4 +243,83 @@ type RestoreConfig struct {
 	OutputDirectory string
 	// OutputFileName is the name of the restored file.
 	OutputFileName string
+	// OnExisting determines what happens if the restored file already exists. Defaults to ExistingFileFail.
+	OnExisting ExistingFilePolicy
+	// OutputImageFormat is the format of the restored image. Defaults to ImageFormatRaw.
+	// ImageFormatRawSparse requires restoring to a file.
+	OutputImageFormat ImageFormat
+	// MaxOutputFileSize splits the restored image across numbered files of at most this many bytes,
+	// named OutputFileName.000, OutputFileName.001 and so on (e.g. to fit removable media).
+	// Concatenating the parts in order yields the image. Zero restores to a single file. Requires
+	// ImageFormatRaw, and is not supported with Output or checkpoints.
+	MaxOutputFileSize int64
+	// Output is an optional writer (e.g. os.Stdout) the restored data is streamed to instead of
+	// OutputFileName. The restore is assembled in a temporary file within OutputDirectory,
+	// or the system temp directory if unset, and nothing else is written to Output.
+	Output io.Writer
+	// Sources optionally supplies the data of backups by ID, such as backups held in memory or
+	// fetched from object storage into a buffer. Backups without an entry are read from their files.
+	Sources map[int]io.ReaderAt
+	// Storage is the remote storage that backups cataloged with Store.CatalogRemoteBackups are
+	// streamed from. Sources takes precedence.
+	Storage Storage
+	// Stream is an optional backup stream (see Store.WriteBackupStream) read in place of the
+	// backup files. It holds one frame per backup of the chain, with the full before its differential.
+	Stream io.Reader
+	// Progress is an optional callback that reports the number of positions restored.
+	Progress ProgressFunc
+	// ProgressReport is an optional callback invoked alongside Progress with the restore's
+	// throughput and estimated time remaining.
+	ProgressReport RestoreProgressFunc
+	// FilterCommand is an optional external command (e.g. ["gzip", "-dc"]) that reverses
+	// the backup's FilterCommand. The backup stream is piped through it before being read.
+	FilterCommand []string
+	// Validate reads back the restored output after the restore and confirms every position
+	// matches the hash recorded for its block.
+	Validate bool
+	// CompareTo is an optional reference image (e.g. the original source) that the restored output
+	// is byte-compared with after the restore. An ImageMismatchError reports the first differing
+	// offset.
+	CompareTo string
+	// DirectIO opens the backup files with O_DIRECT, bypassing the page cache.
+	// Falls back to buffered I/O when O_DIRECT isn't supported.
+	DirectIO bool
+	// Pipeline reads blocks from fixed-size backup files in a separate goroutine while the restored
+	// positions are written, overlapping reads of the backup with writes to the restore target.
+	Pipeline bool
+	// Concurrency is the number of blocks the pipelined restore reads ahead of its writes. Zero reads
+	// 8 blocks ahead. ConcurrencyAuto chooses it from the restore target's device type
+	// (see AutoConcurrency).
+	Concurrency int
+	// LimitPositions restores only the first LimitPositions positions of the backup, producing an
+	// output truncated to their length. This is useful to quickly inspect the start of a large
+	// image. Zero restores every position. Not supported with ChunkingContentDefined.
+	LimitPositions int
+	// CheckpointInterval records the restore's progress every CheckpointInterval blocks, syncing
+	// the restored file first, so an interrupted restore can be resumed. Zero disables checkpoints.
+	CheckpointInterval int
+	// MaxRestoreChainDepth refuses to restore a backup whose chain applies more than this many
+	// backups. When zero, the store's policy (see Store.SetMaxRestoreChainDepth) applies.
+	MaxRestoreChainDepth int
+	// OnlyDiff is an existing image (e.g. a staging copy of the volume) updated in place instead of
+	// restoring to OutputFileName. Only the blocks that differ from the backup are written, and the
+	// image is resized to match it. Not supported with ChunkingContentDefined, Output, Stream,
+	// checkpoints, multi-part, sparse or limited restores.
+	OnlyDiff string
+	// BaseImagePath is an existing image the differential's changes are applied to instead of
+	// restoring its full backup, producing a new image at OutputFileName (e.g. a template with a
+	// volume's changes on top). The base is left untouched, and must be the size of the full backup
+	// the differential was taken against. Not supported with full backups, ChunkingContentDefined,
+	// Stream, checkpoints, multi-part, sparse, limited or OnlyDiff restores.
+	BaseImagePath string
+	// Discard restores without writing the image anywhere, to check the backup is intact or measure
+	// restore throughput without using disk space. Every block of the restore chain is still read,
+	// hashed and looked up, and with Validate the restore fails unless every position was restored.
+	// Restoring to io.Discard or the null device (e.g. /dev/null) implies it. Not supported with
+	// checkpoints, multi-part, sparse or OnlyDiff restores, or CompareTo.
+	Discard bool
+	// Resume continues an interrupted restore of the same backup to the same output file from its
+	// last checkpoint, keeping the blocks already restored. Without a checkpoint the restore starts
+	// over, writing into the existing file.
+	Resume bool
 }
@@ -0,0 +1,15 @@
+package block
+
+import "errors"
+
+var errDeviceListingUnsupported = errors.New("listing block devices is not supported on this platform")
+
+// BlockDevice describes a block device available on the host.
+type BlockDevice struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	SizeInBytes int64  `json:"size_bytes"`
+	// Parent is the name of the disk a partition belongs to. It's empty for whole disks.
+	Parent   string `json:"parent,omitempty"`
+	ReadOnly bool   `json:"read_only"`
+}
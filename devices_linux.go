@@ -0,0 +1,109 @@
+//go:build linux
+
+package block
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysfsSectorSize is the unit sysfs reports device sizes in, regardless of the device's
+// logical sector size.
+const sysfsSectorSize = 512
+
+// ListBlockDevices returns the block devices and partitions on the host, as reported by sysfs.
+// Devices without media, such as unattached loop devices, report a size of zero and are omitted.
+func ListBlockDevices() ([]BlockDevice, error) {
+	return listBlockDevices("/sys/block", "/dev")
+}
+
+// listBlockDevices walks a /sys/block style layout rooted at sysRoot. Each entry is a disk,
+// and a subdirectory of a disk holding a "partition" file is one of its partitions.
+func listBlockDevices(sysRoot, devRoot string) ([]BlockDevice, error) {
+	entries, err := os.ReadDir(sysRoot)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", sysRoot, err)
+	}
+
+	var devices []BlockDevice
+	for _, entry := range entries {
+		name := entry.Name()
+		dir := filepath.Join(sysRoot, name)
+
+		disk, err := readBlockDevice(dir, name, devRoot)
+		if err != nil {
+			return nil, err
+		}
+		if disk.SizeInBytes == 0 {
+			continue
+		}
+		devices = append(devices, disk)
+
+		children, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", dir, err)
+		}
+
+		for _, child := range children {
+			partDir := filepath.Join(dir, child.Name())
+			if _, err := os.Stat(filepath.Join(partDir, "partition")); err != nil {
+				continue
+			}
+
+			part, err := readBlockDevice(partDir, child.Name(), devRoot)
+			if err != nil {
+				return nil, err
+			}
+			part.Parent = name
+			devices = append(devices, part)
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+
+	return devices, nil
+}
+
+// readBlockDevice reads the device described by the sysfs directory dir. Devices without a
+// size attribute are sized from their device node instead.
+func readBlockDevice(dir, name, devRoot string) (BlockDevice, error) {
+	device := BlockDevice{
+		Name: name,
+		Path: filepath.Join(devRoot, name),
+	}
+
+	sectors, err := readSysfsInt(filepath.Join(dir, "size"))
+	switch {
+	case err == nil:
+		device.SizeInBytes = sectors * sysfsSectorSize
+	case os.IsNotExist(err):
+		size, err := GetTargetSizeInBytes(device.Path)
+		if err != nil {
+			return BlockDevice{}, fmt.Errorf("error getting size of %s: %w", device.Path, err)
+		}
+		device.SizeInBytes = int64(size)
+	default:
+		return BlockDevice{}, fmt.Errorf("error reading size of %s: %w", name, err)
+	}
+
+	ro, err := readSysfsInt(filepath.Join(dir, "ro"))
+	if err != nil && !os.IsNotExist(err) {
+		return BlockDevice{}, fmt.Errorf("error reading read-only flag of %s: %w", name, err)
+	}
+	device.ReadOnly = ro == 1
+
+	return device, nil
+}
+
+func readSysfsInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
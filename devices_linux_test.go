@@ -0,0 +1,64 @@
+//go:build linux
+
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSysfsFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListBlockDevices(t *testing.T) {
+	sysRoot := t.TempDir()
+	devRoot := t.TempDir()
+
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "size"), "2048")
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "ro"), "0")
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "sda1", "size"), "1024")
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "sda1", "partition"), "1")
+	// Attribute directories without a partition file aren't partitions.
+	writeSysfsFile(t, filepath.Join(sysRoot, "sda", "queue", "size"), "8")
+	writeSysfsFile(t, filepath.Join(sysRoot, "sr0", "size"), "4")
+	writeSysfsFile(t, filepath.Join(sysRoot, "sr0", "ro"), "1")
+	writeSysfsFile(t, filepath.Join(sysRoot, "loop0", "size"), "0")
+
+	// A device without a size attribute is sized from its device node.
+	if err := os.MkdirAll(filepath.Join(sysRoot, "vda"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(devRoot, "vda"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := listBlockDevices(sysRoot, devRoot)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []BlockDevice{
+		{Name: "sda", Path: filepath.Join(devRoot, "sda"), SizeInBytes: 2048 * 512},
+		{Name: "sda1", Path: filepath.Join(devRoot, "sda1"), SizeInBytes: 1024 * 512, Parent: "sda"},
+		{Name: "sr0", Path: filepath.Join(devRoot, "sr0"), SizeInBytes: 4 * 512, ReadOnly: true},
+		{Name: "vda", Path: filepath.Join(devRoot, "vda"), SizeInBytes: 4096},
+	}
+
+	if len(devices) != len(expected) {
+		t.Fatalf("expected %d devices, got %d: %+v", len(expected), len(devices), devices)
+	}
+
+	for i, device := range devices {
+		if device != expected[i] {
+			t.Errorf("expected device %+v, got %+v", expected[i], device)
+		}
+	}
+}
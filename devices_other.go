@@ -0,0 +1,8 @@
+//go:build !linux
+
+package block
+
+// ListBlockDevices is only supported on Linux.
+func ListBlockDevices() ([]BlockDevice, error) {
+	return nil, errDeviceListingUnsupported
+}
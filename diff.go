@@ -0,0 +1,88 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// DiffLive compares the live device against the specified backup and returns the
+// positions whose block contents have changed since the backup was taken.
+// No backup records are created.
+func (s Store) DiffLive(devicePath string, backupID int) ([]int, error) {
+	backup, err := s.findBackup(backupID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving backup record with id %d: %v", backupID, err)
+	}
+
+	if backup.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("live diffs are not supported for content-defined backups")
+	}
+
+	// Resolve the hash recorded for each position at the time of the backup.
+	hashes, err := s.resolveBackupHashes(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := os.Open(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = source.Close() }()
+
+	sizeInBytes, err := GetTargetSizeInBytes(devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	liveBlocks := calculateTotalBlocks(backup.BlockSize, sizeInBytes)
+
+	var changed []int
+	buf := make([]byte, backup.BlockSize)
+	for pos := 0; pos < liveBlocks; pos++ {
+		n, err := source.ReadAt(buf, int64(pos*backup.BlockSize))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading block at position %d: %w", pos, err)
+		}
+
+		if hash, ok := hashes[pos]; !ok || !blockMatchesHash(buf[:n], hash, backup.HashAlgorithm) {
+			changed = append(changed, pos)
+		}
+	}
+
+	// Positions that no longer exist on the live device are considered changed.
+	for pos := liveBlocks; pos < backup.TotalBlocks; pos++ {
+		changed = append(changed, pos)
+	}
+
+	return changed, nil
+}
+
+// resolveBackupHashes returns the position to hash mapping that represents the
+// full state of the volume at the time the backup was taken.
+func (s Store) resolveBackupHashes(backup BackupRecord) (map[int]string, error) {
+	if backup.BackupType != backupTypeDifferential {
+		return s.findHashesByBackup(backup.ID)
+	}
+
+	// Differential backups only record the positions that changed, so layer them on top of the full.
+	chain, err := s.RestoreChain(backup.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving restore chain: %v", err)
+	}
+
+	resolved := map[int]string{}
+	for _, layer := range chain {
+		hashes, err := s.findHashesByBackup(layer.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for pos, hash := range hashes {
+			resolved[pos] = hash
+		}
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,58 @@
+package block
+
+import (
+	"testing"
+)
+
+func TestDiffLive(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No changes against the original device.
+	positions, err := store.DiffLive("assets/pg.ext4", b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 0 {
+		t.Fatalf("expected no changed positions, got %v", positions)
+	}
+
+	// The altered asset differs in the first block.
+	positions, err = store.DiffLive("assets/pg_altered.ext4", b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 1 {
+		t.Fatalf("expected 1 changed position, got %d", len(positions))
+	}
+
+	if positions[0] != 0 {
+		t.Fatalf("expected position 0 to be changed, got %d", positions[0])
+	}
+}
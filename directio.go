@@ -0,0 +1,83 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// directIOAlignment is the alignment used for O_DIRECT buffers, offsets and lengths.
+// 4096 satisfies both 512 byte and 4KiB logical sector devices.
+const directIOAlignment = 4096
+
+var errDirectIOUnsupported = errors.New("direct I/O is not supported on this platform")
+
+// openForRead opens path for reading. When direct is set the file is opened with O_DIRECT to
+// bypass the page cache, falling back to buffered I/O if O_DIRECT isn't supported.
+func openForRead(path string, direct bool) (io.ReaderAt, io.Closer, error) {
+	if direct {
+		f, err := openDirect(path)
+		if err == nil {
+			return newAlignedReader(f, directIOAlignment), f, nil
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: unable to use direct I/O for %s, falling back to buffered I/O: %v\n", path, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, f, nil
+}
+
+// alignedReader translates arbitrary reads into reads whose offset, length and buffer
+// address are all aligned, as required by O_DIRECT.
+type alignedReader struct {
+	r     io.ReaderAt
+	align int64
+}
+
+func newAlignedReader(r io.ReaderAt, align int64) *alignedReader {
+	return &alignedReader{r: r, align: align}
+}
+
+func (a *alignedReader) ReadAt(p []byte, off int64) (int, error) {
+	start := off &^ (a.align - 1)
+	end := off + int64(len(p))
+	if rem := end % a.align; rem != 0 {
+		end += a.align - rem
+	}
+
+	buf := alignedBuffer(int(end-start), int(a.align))
+	n, err := a.r.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	// Discard the leading bytes that were only read to satisfy alignment.
+	skip := int(off - start)
+	if n <= skip {
+		return 0, io.EOF
+	}
+
+	copied := copy(p, buf[skip:n])
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+
+	return copied, nil
+}
+
+// alignedBuffer returns a buffer of the given size whose starting address is a multiple of align.
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1)); rem != 0 {
+		offset = align - rem
+	}
+
+	return buf[offset : offset+size : offset+size]
+}
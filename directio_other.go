@@ -0,0 +1,9 @@
+//go:build !linux
+
+package block
+
+import "os"
+
+func openDirect(path string) (*os.File, error) {
+	return nil, errDirectIOUnsupported
+}
@@ -0,0 +1,101 @@
+package block
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestAlignedReader(t *testing.T) {
+	data, err := os.ReadFile("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	reader := newAlignedReader(f, directIOAlignment)
+
+	tests := []struct {
+		offset int64
+		length int
+	}{
+		{offset: 0, length: 4096},
+		{offset: 1, length: 10},
+		{offset: 4095, length: 2},
+		{offset: 12345, length: 65536},
+		{offset: int64(len(data)) - 100, length: 100},
+	}
+
+	for _, test := range tests {
+		buf := make([]byte, test.length)
+		n, err := reader.ReadAt(buf, test.offset)
+		if err != nil {
+			t.Fatalf("unexpected error reading %d bytes at %d: %v", test.length, test.offset, err)
+		}
+
+		if !bytes.Equal(buf[:n], data[test.offset:test.offset+int64(test.length)]) {
+			t.Fatalf("data mismatch reading %d bytes at %d", test.length, test.offset)
+		}
+	}
+
+	// Reads past the end of the file are short and report EOF.
+	buf := make([]byte, 200)
+	n, err := reader.ReadAt(buf, int64(len(data))-100)
+	if err != io.EOF || n != 100 {
+		t.Fatalf("expected a 100 byte read and EOF, got %d and %v", n, err)
+	}
+}
+
+func TestDirectIOBackupAndRestore(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+		DirectIO:        true,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     b.Record.FileName,
+		DirectIO:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	compareChecksum(t, restore.FullRestorePath(), fullBackupChecksum)
+}
@@ -0,0 +1,96 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// isDiscardTarget reports whether the restore configured by cfg throws its output away, either
+// with Discard or by restoring to io.Discard or the null device.
+func isDiscardTarget(cfg RestoreConfig) bool {
+	if cfg.Discard || cfg.Output == io.Discard {
+		return true
+	}
+
+	return cfg.Output == nil && filepath.Clean(cfg.OutputDirectory+"/"+cfg.OutputFileName) == os.DevNull
+}
+
+// discardTarget is a restore target that drops what's written to it, recording the extent of
+// the restored image and, when tracking is set, the byte ranges written.
+type discardTarget struct {
+	size     int64
+	tracking bool
+	ranges   [][2]int64
+}
+
+func (d *discardTarget) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	d.size = max(d.size, end)
+	if d.tracking && len(p) > 0 {
+		d.ranges = append(d.ranges, [2]int64{off, end})
+	}
+
+	return len(p), nil
+}
+
+func (d *discardTarget) Sync() error {
+	return nil
+}
+
+// firstGap returns the offset of the first byte before size that wasn't written, or size if
+// every byte was.
+func (d *discardTarget) firstGap(size int64) int64 {
+	sort.Slice(d.ranges, func(i, j int) bool { return d.ranges[i][0] < d.ranges[j][0] })
+
+	var covered int64
+	for _, r := range d.ranges {
+		if r[0] > covered {
+			break
+		}
+		covered = max(covered, r[1])
+	}
+
+	return min(covered, size)
+}
+
+// BytesRestored returns the size of the image a discarded restore reconstructed.
+// It must be called after Run.
+func (r *Restore) BytesRestored() int64 {
+	return r.bytesRestored
+}
+
+// runDiscard restores the backup without writing the image, reading and looking up every block
+// of the restore chain. The full is restored block by block, rather than copied from its file,
+// so each of its blocks is hashed too.
+func (r *Restore) runDiscard() error {
+	target := &discardTarget{tracking: r.config.Validate}
+	r.disableFastPath = true
+
+	if err := r.setupProgress(); err != nil {
+		return err
+	}
+
+	if err := r.restoreTo(target); err != nil {
+		return err
+	}
+
+	r.progress.finish()
+
+	size := r.restoredSize()
+	r.bytesRestored = min(target.size, size)
+	if r.bytesRestored < size {
+		return fmt.Errorf("restored %d bytes, but backup %d is %d bytes", r.bytesRestored, r.backup.ID, size)
+	}
+
+	// A block that doesn't match its recorded hash isn't restored to any position.
+	if r.config.Validate {
+		if gap := target.firstGap(size); gap < size {
+			return fmt.Errorf("validation failed: backup %d restored nothing at offset %d", r.backup.ID, gap)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package block
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRestoreDiscard(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	discard := func(restoreCfg RestoreConfig) (int64, error) {
+		restoreCfg.Store = store
+		restoreCfg.RestoreInputFormat = RestoreInputFormatFile
+		restoreCfg.Validate = true
+
+		restore, err := NewRestore(restoreCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = restore.Run()
+		return restore.BytesRestored(), err
+	}
+
+	source, err := os.Stat("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, restoreCfg := range []RestoreConfig{
+		{SourceBackupID: db.Record.ID, Output: io.Discard},
+		{SourceBackupID: fb.Record.ID, OutputDirectory: "/dev", OutputFileName: "null"},
+		{SourceBackupID: fb.Record.ID, Discard: true, LimitPositions: 3},
+	} {
+		restored, err := discard(restoreCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := source.Size()
+		if restoreCfg.LimitPositions > 0 {
+			expected = int64(restoreCfg.LimitPositions * fb.Record.BlockSize)
+		}
+
+		if restored != expected {
+			t.Fatalf("expected %d bytes to be restored, got %d", expected, restored)
+		}
+	}
+
+	// A corrupt block matches no position, leaving a hole in the restored image.
+	f, err := os.OpenFile(fb.FullPath(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if _, err := discard(RestoreConfig{SourceBackupID: fb.Record.ID, Discard: true}); err == nil || !strings.Contains(err.Error(), "validation failed") {
+		t.Fatalf("expected validation to detect the corrupt block, got %v", err)
+	}
+
+	if _, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     fb.Record.ID,
+		Discard:            true,
+		CompareTo:          "assets/pg.ext4",
+	}); err == nil {
+		t.Fatal("expected a discarded restore with a comparison to be rejected")
+	}
+}
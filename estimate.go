@@ -0,0 +1,59 @@
+package block
+
+import (
+	"database/sql"
+	"time"
+)
+
+// defaultThroughput is the conservative read throughput (bytes per second) assumed
+// when no backup history exists for a volume.
+const defaultThroughput = 50 * 1024 * 1024
+
+// BackupEstimate describes how long a backup of a device is expected to take.
+type BackupEstimate struct {
+	// SizeInBytes is the size of the device.
+	SizeInBytes int
+	// Throughput is the read throughput in bytes per second used for the estimate.
+	Throughput float64
+	// Samples is the number of historical backups the throughput was derived from.
+	// Zero indicates the default throughput was used.
+	Samples int
+	// Duration is the estimated duration of the backup.
+	Duration time.Duration
+}
+
+// EstimateBackup predicts how long a backup of the device will take based on its size
+// and the historical throughput of previous backups of the same volume.
+func EstimateBackup(store *Store, devicePath string) (BackupEstimate, error) {
+	sizeInBytes, err := GetTargetSizeInBytes(devicePath)
+	if err != nil {
+		return BackupEstimate{}, err
+	}
+
+	estimate := BackupEstimate{
+		SizeInBytes: sizeInBytes,
+		Throughput:  defaultThroughput,
+	}
+
+	vol, err := store.FindVolume(volumeName(devicePath))
+	switch {
+	case err == sql.ErrNoRows:
+		// No history exists for the volume.
+	case err != nil:
+		return BackupEstimate{}, err
+	default:
+		throughput, samples, err := store.VolumeThroughput(vol.ID)
+		if err != nil {
+			return BackupEstimate{}, err
+		}
+
+		if samples > 0 {
+			estimate.Throughput = throughput
+			estimate.Samples = samples
+		}
+	}
+
+	estimate.Duration = time.Duration(float64(sizeInBytes) / estimate.Throughput * float64(time.Second))
+
+	return estimate, nil
+}
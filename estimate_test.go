@@ -0,0 +1,61 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateBackup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// Without history the default throughput is used.
+	estimate, err := EstimateBackup(store, "assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if estimate.Samples != 0 {
+		t.Fatalf("expected no samples, got %d", estimate.Samples)
+	}
+
+	if estimate.Throughput != defaultThroughput {
+		t.Fatalf("expected default throughput, got %f", estimate.Throughput)
+	}
+
+	// Seed historical metrics: 50MiB in 1s and 50MiB in 2s.
+	vol, err := store.InsertVolume("pg.ext4", "assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		br, err := store.insertBackupRecord(vol.ID, "seed", "backups/seed", string(BackupOutputFormatFile), backupTypeFull, 50, 1048576, 52428800, ChunkingFixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.updateBackupDuration(br.ID, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	estimate, err = EstimateBackup(store, "assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if estimate.Samples != 2 {
+		t.Fatalf("expected 2 samples, got %d", estimate.Samples)
+	}
+
+	if estimate.Duration != 1500*time.Millisecond {
+		t.Fatalf("expected estimate of 1.5s, got %s", estimate.Duration)
+	}
+}
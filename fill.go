@@ -0,0 +1,122 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fillBlockPrefix identifies blocks that consist of a single repeated byte (e.g. zeroed or
+// secure-erased regions). Instead of storing their contents in the backup file, the hash
+// records the byte value and length needed to reconstruct them at restore time.
+const fillBlockPrefix = "fill:"
+
+// fillDescriptor returns the descriptor for data if every byte in it is the same.
+func fillDescriptor(data []byte) (string, bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+
+	for _, c := range data[1:] {
+		if c != data[0] {
+			return "", false
+		}
+	}
+
+	return fmt.Sprintf("%s%02x:%d", fillBlockPrefix, data[0], len(data)), true
+}
+
+// parseFillDescriptor reconstructs the block described by a fill descriptor.
+func parseFillDescriptor(hash string) ([]byte, bool) {
+	parts := strings.Split(strings.TrimPrefix(hash, fillBlockPrefix), ":")
+	if !strings.HasPrefix(hash, fillBlockPrefix) || len(parts) != 2 {
+		return nil, false
+	}
+
+	value, err := strconv.ParseUint(parts[0], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+
+	length, err := strconv.Atoi(parts[1])
+	if err != nil || length <= 0 {
+		return nil, false
+	}
+
+	return bytes.Repeat([]byte{byte(value)}, length), true
+}
+
+func isFillBlock(hash string) bool {
+	return strings.HasPrefix(hash, fillBlockPrefix)
+}
+
+// hashBlock returns the hash used to identify the block. Constant blocks are identified by
+// their fill descriptor when CompactConstantBlocks is enabled.
+func (b *Backup) hashBlock(data []byte) string {
+	if b.Config.CompactConstantBlocks {
+		if descriptor, ok := fillDescriptor(data); ok {
+			return descriptor
+		}
+	}
+
+	if b.Config.HashSample {
+		return sampleBlockHash(data)
+	}
+
+	return b.Config.HashAlgorithm.sum(data)
+}
+
+// blockMatchesHash reports whether data matches the hash recorded with the algorithm, which may
+// be a fill descriptor.
+func blockMatchesHash(data []byte, hash string, algorithm HashAlgorithm) bool {
+	if isFillBlock(hash) {
+		descriptor, ok := fillDescriptor(data)
+		return ok && descriptor == hash
+	}
+
+	if isSampledBlock(hash) {
+		return sampleBlockHash(data) == hash
+	}
+
+	return algorithm.sum(data) == hash
+}
+
+// restoreFillBlocks reconstructs the backup's constant blocks, which aren't stored in the backup file.
+func (r *Restore) restoreFillBlocks(target restoreTarget, backup BackupRecord) error {
+	rows, err := r.store.Query("SELECT b.hash, "+blockPosition+" FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND b.hash LIKE 'fill:%'", backup.ID)
+	if err != nil {
+		return fmt.Errorf("error querying fill blocks: %w", err)
+	}
+	defer rows.Close()
+
+	fills := map[string][]byte{}
+	for rows.Next() {
+		var hash string
+		var pos int
+		if err := rows.Scan(&hash, &pos); err != nil {
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+
+		if r.beyondLimit(pos) {
+			continue
+		}
+
+		data, ok := fills[hash]
+		if !ok {
+			data, ok = parseFillDescriptor(hash)
+			if !ok {
+				return fmt.Errorf("invalid fill block descriptor %q", hash)
+			}
+			fills[hash] = data
+		}
+
+		if err := r.writeAt(target, data, int64(pos*backup.BlockSize)); err != nil {
+			return err
+		}
+
+		r.progress.add(1)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestFillDescriptor(t *testing.T) {
+	data := bytes.Repeat([]byte{0xFF}, 4096)
+	descriptor, ok := fillDescriptor(data)
+	if !ok {
+		t.Fatal("expected a constant block to produce a descriptor")
+	}
+
+	if descriptor != "fill:ff:4096" {
+		t.Fatalf("unexpected descriptor %s", descriptor)
+	}
+
+	restored, ok := parseFillDescriptor(descriptor)
+	if !ok || !bytes.Equal(restored, data) {
+		t.Fatal("expected the descriptor to reconstruct the block")
+	}
+
+	data[100] = 0xFE
+	if _, ok := fillDescriptor(data); ok {
+		t.Fatal("expected a non-constant block to not produce a descriptor")
+	}
+}
+
+func TestCompactConstantBlocks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	const blockSize = 4096
+
+	// 64 blocks of random data with a 0xFF filled region and a zeroed region.
+	data := make([]byte, 64*blockSize)
+	rand.New(rand.NewSource(7)).Read(data)
+	copy(data[10*blockSize:], bytes.Repeat([]byte{0xFF}, 20*blockSize))
+	copy(data[40*blockSize:], make([]byte, 4*blockSize))
+
+	if err := os.WriteFile("backups/erased.img", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:                 store,
+		DevicePath:            "backups/erased.img",
+		OutputFormat:          BackupOutputFormatFile,
+		OutputDirectory:       "backups/",
+		BlockSize:             blockSize,
+		BlockBufferSize:       8,
+		CompactConstantBlocks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the 40 random blocks are written to the backup file.
+	if length := backupDataLength(t, b.FullPath()); length != int64(40*blockSize) {
+		t.Fatalf("expected backup file to hold %d bytes, got %d", 40*blockSize, length)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     b.Record.FileName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, data) {
+		t.Fatal("expected the restored file to match the source")
+	}
+}
@@ -0,0 +1,120 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// filterWriter pipes everything written to it through an external command, writing the
+// command's output to the underlying writer.
+type filterWriter struct {
+	args   []string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	waited bool
+}
+
+func newFilterWriter(args []string, w io.Writer) (*filterWriter, error) {
+	fw := &filterWriter{args: args}
+
+	fw.cmd = exec.Command(args[0], args[1:]...)
+	fw.cmd.Stdout = w
+	fw.cmd.Stderr = &fw.stderr
+
+	stdin, err := fw.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	fw.stdin = stdin
+
+	if err := fw.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting filter command %q: %v", strings.Join(args, " "), err)
+	}
+
+	return fw, nil
+}
+
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	n, err := fw.stdin.Write(p)
+	if err != nil {
+		return n, fw.wait(err)
+	}
+	return n, nil
+}
+
+// Close flushes the remaining input to the filter and waits for it to exit.
+func (fw *filterWriter) Close() error {
+	return fw.wait(fw.stdin.Close())
+}
+
+func (fw *filterWriter) wait(cause error) error {
+	if fw.waited {
+		return cause
+	}
+	fw.waited = true
+
+	_ = fw.stdin.Close()
+	if err := fw.cmd.Wait(); err != nil {
+		return filterError(fw.args, err, fw.stderr.String())
+	}
+	return cause
+}
+
+// filterReader reads the output of an external command that is fed from the underlying reader.
+type filterReader struct {
+	args   []string
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	waited bool
+}
+
+func newFilterReader(args []string, r io.Reader) (*filterReader, error) {
+	fr := &filterReader{args: args}
+
+	fr.cmd = exec.Command(args[0], args[1:]...)
+	fr.cmd.Stdin = r
+	fr.cmd.Stderr = &fr.stderr
+
+	stdout, err := fr.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	fr.stdout = stdout
+
+	if err := fr.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting filter command %q: %v", strings.Join(args, " "), err)
+	}
+
+	return fr, nil
+}
+
+func (fr *filterReader) Read(p []byte) (int, error) {
+	return fr.stdout.Read(p)
+}
+
+// Close drains any unread output and waits for the filter to exit.
+func (fr *filterReader) Close() error {
+	if fr.waited {
+		return nil
+	}
+	fr.waited = true
+
+	_, _ = io.Copy(io.Discard, fr.stdout)
+	if err := fr.cmd.Wait(); err != nil {
+		return filterError(fr.args, err, fr.stderr.String())
+	}
+	return nil
+}
+
+func filterError(args []string, err error, stderr string) error {
+	stderr = strings.TrimSpace(stderr)
+	if stderr == "" {
+		return fmt.Errorf("filter command %q failed: %v", strings.Join(args, " "), err)
+	}
+	return fmt.Errorf("filter command %q failed: %v: %s", strings.Join(args, " "), err, stderr)
+}
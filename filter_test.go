@@ -0,0 +1,176 @@
+package block
+
+import (
+	"crypto/rand"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterCommandRoundTrip(t *testing.T) {
+	tests := []struct {
+		name          string
+		backupFilter  []string
+		restoreFilter []string
+	}{
+		{name: "identity", backupFilter: []string{"cat"}, restoreFilter: []string{"cat"}},
+		{name: "gzip", backupFilter: []string{"gzip", "-c"}, restoreFilter: []string{"gunzip", "-c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := exec.LookPath(test.backupFilter[0]); err != nil {
+				t.Skipf("%s not available", test.backupFilter[0])
+			}
+
+			store, err := NewStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			setup(store)
+			defer cleanup(t)
+
+			cfg := &BackupConfig{
+				Store:           store,
+				DevicePath:      "assets/pg.ext4",
+				OutputFormat:    BackupOutputFormatFile,
+				OutputDirectory: "backups/",
+				BlockSize:       1048576,
+				BlockBufferSize: 5,
+				FilterCommand:   test.backupFilter,
+			}
+
+			b, err := NewBackup(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := b.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			restore, err := NewRestore(RestoreConfig{
+				Store:              store,
+				RestoreInputFormat: RestoreInputFormatFile,
+				SourceBackupID:     b.Record.ID,
+				OutputDirectory:    "restores/",
+				OutputFileName:     b.Record.FileName,
+				FilterCommand:      test.restoreFilter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := restore.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			compareChecksum(t, restore.FullRestorePath(), fullBackupChecksum)
+		})
+	}
+}
+
+func TestFilterCommandFailure(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+		FilterCommand:   []string{"sh", "-c", "cat > /dev/null; echo filter exploded >&2; exit 3"},
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Run()
+	if err == nil {
+		t.Fatal("expected the failing filter to fail the backup")
+	}
+
+	if !strings.Contains(err.Error(), "filter exploded") {
+		t.Fatalf("expected the filter's stderr in the error, got %v", err)
+	}
+}
+
+func TestFilterCompressionRatio(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("gzip not available")
+	}
+
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	data := make([]byte, 4*1048576)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	randomPath := filepath.Join(t.TempDir(), "random.img")
+	if err := os.WriteFile(randomPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		devicePath string
+		filter     []string
+		min, max   float64
+	}{
+		{devicePath: "assets/pg.ext4", filter: []string{"gzip", "-c"}, min: 1.5, max: math.MaxFloat64},
+		{devicePath: randomPath, filter: []string{"gzip", "-c"}, min: 0.95, max: 1.05},
+		{devicePath: "assets/tiny.ext4", min: 1, max: 1},
+	} {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      test.devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+			FilterCommand:   test.filter,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		record, err := store.FindBackup(b.Record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if record.PhysicalSizeInBytes != b.Record.SizeInBytes {
+			t.Fatalf("expected a physical size of %d for %s, got %d", b.Record.SizeInBytes, test.devicePath, record.PhysicalSizeInBytes)
+		}
+
+		if ratio := record.CompressionRatio(); ratio < test.min || ratio > test.max {
+			t.Fatalf("expected the compression ratio of %s to be within [%.2f, %.2f], got %.2f", test.devicePath, test.min, test.max, ratio)
+		}
+	}
+}
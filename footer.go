@@ -0,0 +1,472 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// footerMagic ends every backup file that carries a footer.
+var footerMagic = [8]byte{'B', 'D', 'F', 'O', 'O', 'T', 'E', 'R'}
+
+// footerTrailerSize is the size of the payload length and magic closing the footer.
+const footerTrailerSize = 16
+
+// footerVersion is the version of the footer layout written by this release.
+const footerVersion = 1
+
+// ErrNoFooter is returned when a backup file doesn't end with a footer, e.g. files written
+// before footers were introduced or piped through a filter command.
+var ErrNoFooter = errors.New("backup file has no footer")
+
+// footerMetadata describes the backup a footer belongs to.
+type footerMetadata struct {
+	Version        int           `json:"version"`
+	Volume         string        `json:"volume"`
+	DevicePath     string        `json:"device_path"`
+	BackupType     string        `json:"backup_type"`
+	Chunking       Chunking      `json:"chunking"`
+	BlockSize      int           `json:"block_size"`
+	TotalBlocks    int           `json:"total_blocks"`
+	SizeInBytes    int           `json:"size_in_bytes"`
+	HashAlgorithm  HashAlgorithm `json:"hash_algorithm"`
+	HashSample     bool          `json:"hash_sample"`
+	PositionRanges bool          `json:"position_ranges"`
+	AppVersion     string        `json:"app_version,omitempty"`
+	// DataLength is the number of bytes of block data preceding the footer.
+	DataLength int64 `json:"data_length"`
+}
+
+// footerPosition is a single block position recorded in the footer's index.
+type footerPosition struct {
+	position int
+	hash     string
+	length   int
+	stored   bool
+}
+
+// writeFooter appends the backup's footer to w, which has received dataLength bytes of block data.
+// The footer holds the metadata and position index needed to rebuild the backup's catalog rows
+// (see RecoverFromFile), followed by the payload's length and footerMagic.
+//
+// The payload is the uvarint length prefixed JSON metadata, the uvarint count and length prefixed
+// hashes of the backup's blocks, then the uvarint count of positions, each encoded as the uvarint
+// distance from the previous position, the uvarint index of its hash, its uvarint length and a
+// stored flag byte. The index is streamed from the store, as a large device can have more
+// positions than fit in memory.
+func (b *Backup) writeFooter(w io.Writer, dataLength int64) error {
+	meta := footerMetadata{
+		Version:        footerVersion,
+		Volume:         b.vol.Name,
+		DevicePath:     b.Config.DevicePath,
+		BackupType:     b.BackupType(),
+		Chunking:       b.Record.Chunking,
+		BlockSize:      b.Config.BlockSize,
+		TotalBlocks:    b.TotalBlocks(),
+		SizeInBytes:    b.Record.SizeInBytes,
+		HashAlgorithm:  b.Record.HashAlgorithm,
+		HashSample:     b.Config.HashSample,
+		PositionRanges: b.Config.EncodePositionRanges,
+		AppVersion:     b.Config.AppVersion,
+		DataLength:     dataLength,
+	}
+
+	enc := newFooterEncoder(w)
+	if err := enc.metadata(meta); err != nil {
+		return err
+	}
+
+	// Hashes are indexed in the order of their block IDs.
+	var hashCount, positionCount int
+	row := b.store.QueryRow("SELECT (SELECT COUNT(*) FROM blocks WHERE id IN ("+backupBlocks+")), (SELECT COUNT(*) FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ?)", b.Record.ID, b.Record.ID)
+	if err := row.Scan(&hashCount, &positionCount); err != nil {
+		return fmt.Errorf("error counting block positions: %w", err)
+	}
+
+	enc.uvarint(uint64(hashCount))
+	rows, err := b.store.Query("SELECT hash FROM blocks WHERE id IN ("+backupBlocks+") ORDER BY id ASC", b.Record.ID)
+	if err != nil {
+		return fmt.Errorf("error querying block hashes: %w", err)
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan hash: %w", err)
+		}
+		enc.bytes([]byte(hash))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading block hashes: %w", err)
+	}
+
+	// A position's hash index is the rank of its block ID among the backup's blocks.
+	enc.uvarint(uint64(positionCount))
+	rows, err = b.store.Query("SELECT "+blockPosition+", DENSE_RANK() OVER (ORDER BY b.id) - 1, bp.length, bp.stored FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? ORDER BY 1 ASC", b.Record.ID)
+	if err != nil {
+		return fmt.Errorf("error querying block positions: %w", err)
+	}
+	for rows.Next() {
+		var p footerPosition
+		var hashIndex int
+		if err := rows.Scan(&p.position, &hashIndex, &p.length, &p.stored); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+		enc.position(p, hashIndex)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading block positions: %w", err)
+	}
+
+	return enc.close()
+}
+
+// encodeFooter writes the footer holding meta and positions to w.
+func encodeFooter(w io.Writer, meta footerMetadata, positions []footerPosition) error {
+	enc := newFooterEncoder(w)
+	if err := enc.metadata(meta); err != nil {
+		return err
+	}
+
+	hashIndex := map[string]int{}
+	var hashes []string
+	for _, p := range positions {
+		if _, ok := hashIndex[p.hash]; !ok {
+			hashIndex[p.hash] = len(hashes)
+			hashes = append(hashes, p.hash)
+		}
+	}
+
+	enc.uvarint(uint64(len(hashes)))
+	for _, hash := range hashes {
+		enc.bytes([]byte(hash))
+	}
+
+	enc.uvarint(uint64(len(positions)))
+	for _, p := range positions {
+		enc.position(p, hashIndex[p.hash])
+	}
+
+	return enc.close()
+}
+
+// footerEncoder writes a footer payload through a buffer, counting its bytes for the trailer.
+// Write errors are kept by the buffer and returned by close.
+type footerEncoder struct {
+	w        *bufio.Writer
+	n        int64
+	previous int
+}
+
+func newFooterEncoder(w io.Writer) *footerEncoder {
+	return &footerEncoder{w: bufio.NewWriter(w), previous: -1}
+}
+
+func (e *footerEncoder) write(p []byte) {
+	n, _ := e.w.Write(p)
+	e.n += int64(n)
+}
+
+func (e *footerEncoder) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// bytes writes p prefixed with its uvarint length.
+func (e *footerEncoder) bytes(p []byte) {
+	e.uvarint(uint64(len(p)))
+	e.write(p)
+}
+
+func (e *footerEncoder) metadata(meta footerMetadata) error {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	e.bytes(metaJSON)
+	return nil
+}
+
+// position writes p, whose hash is at hashIndex, relative to the previous position written.
+func (e *footerEncoder) position(p footerPosition, hashIndex int) {
+	e.uvarint(uint64(p.position - e.previous))
+	e.uvarint(uint64(hashIndex))
+	e.uvarint(uint64(p.length))
+	if p.stored {
+		e.write([]byte{1})
+	} else {
+		e.write([]byte{0})
+	}
+	e.previous = p.position
+}
+
+// close writes the trailer holding the payload's length and footerMagic, and flushes the footer.
+func (e *footerEncoder) close() error {
+	var trailer [footerTrailerSize]byte
+	binary.BigEndian.PutUint64(trailer[:8], uint64(e.n))
+	copy(trailer[8:], footerMagic[:])
+	_, _ = e.w.Write(trailer[:])
+
+	if err := e.w.Flush(); err != nil {
+		return fmt.Errorf("error writing backup footer: %w", err)
+	}
+
+	return nil
+}
+
+// readFooter reads the footer at the end of the backup file at path.
+func readFooter(path string) (footerMetadata, []footerPosition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return footerMetadata{}, nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return footerMetadata{}, nil, err
+	}
+
+	if fi.Size() < footerTrailerSize {
+		return footerMetadata{}, nil, ErrNoFooter
+	}
+
+	var trailer [footerTrailerSize]byte
+	if _, err := f.ReadAt(trailer[:], fi.Size()-footerTrailerSize); err != nil {
+		return footerMetadata{}, nil, fmt.Errorf("error reading footer: %w", err)
+	}
+
+	if !bytes.Equal(trailer[8:], footerMagic[:]) {
+		return footerMetadata{}, nil, ErrNoFooter
+	}
+
+	payloadLength := int64(binary.BigEndian.Uint64(trailer[:8]))
+	payloadStart := fi.Size() - footerTrailerSize - payloadLength
+	if payloadLength < 0 || payloadStart < 0 {
+		return footerMetadata{}, nil, fmt.Errorf("invalid footer: payload length %d exceeds the file", payloadLength)
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f, payloadStart, payloadLength))
+	meta, positions, err := decodeFooter(reader, payloadLength)
+	if err != nil {
+		return footerMetadata{}, nil, fmt.Errorf("invalid footer: %w", err)
+	}
+
+	if meta.DataLength != payloadStart {
+		return footerMetadata{}, nil, fmt.Errorf("invalid footer: expected %d bytes of block data, file holds %d", meta.DataLength, payloadStart)
+	}
+
+	return meta, positions, nil
+}
+
+// decodeFooter decodes a footer payload of length bytes. Counts and lengths larger than the payload
+// are rejected before anything is allocated for them.
+func decodeFooter(r *bufio.Reader, length int64) (footerMetadata, []footerPosition, error) {
+	readCount := func() (uint64, error) {
+		n, err := binary.ReadUvarint(r)
+		if err == nil && n > uint64(length) {
+			err = fmt.Errorf("count %d exceeds the footer length %d", n, length)
+		}
+		return n, err
+	}
+
+	readBytes := func() ([]byte, error) {
+		n, err := readCount()
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		return buf, err
+	}
+
+	var meta footerMetadata
+	metaJSON, err := readBytes()
+	if err != nil {
+		return meta, nil, err
+	}
+
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return meta, nil, err
+	}
+
+	if meta.Version != footerVersion {
+		return meta, nil, fmt.Errorf("footer version %d is not supported", meta.Version)
+	}
+
+	if meta.HashAlgorithm != HashAlgorithmXXHash64 && meta.HashAlgorithm != HashAlgorithmSHA256 {
+		return meta, nil, fmt.Errorf("hash algorithm %q is not supported", meta.HashAlgorithm)
+	}
+
+	hashCount, err := readCount()
+	if err != nil {
+		return meta, nil, err
+	}
+
+	var hashes []string
+	for i := uint64(0); i < hashCount; i++ {
+		hash, err := readBytes()
+		if err != nil {
+			return meta, nil, err
+		}
+		hashes = append(hashes, string(hash))
+	}
+
+	positionCount, err := readCount()
+	if err != nil {
+		return meta, nil, err
+	}
+
+	positions := make([]footerPosition, 0, positionCount)
+	previous := -1
+	for i := uint64(0); i < positionCount; i++ {
+		var fields [3]uint64
+		for j := range fields {
+			if fields[j], err = binary.ReadUvarint(r); err != nil {
+				return meta, nil, err
+			}
+		}
+
+		stored, err := r.ReadByte()
+		if err != nil {
+			return meta, nil, err
+		}
+
+		if fields[1] >= uint64(len(hashes)) {
+			return meta, nil, fmt.Errorf("position references hash %d of %d", fields[1], len(hashes))
+		}
+
+		p := footerPosition{
+			position: previous + int(fields[0]),
+			hash:     hashes[fields[1]],
+			length:   int(fields[2]),
+			stored:   stored == 1,
+		}
+		positions = append(positions, p)
+		previous = p.position
+	}
+
+	return meta, positions, nil
+}
+
+// RecoverFromFile rebuilds the catalog rows of the backup file at path from its footer, for
+// example after the store was lost. The backup's volume is created if it doesn't exist. A
+// differential can only be restored once its full backup has been recovered too.
+func RecoverFromFile(path string, store *Store) (BackupRecord, error) {
+	meta, positions, err := readFooter(path)
+	if err != nil {
+		return BackupRecord{}, err
+	}
+
+	var existing int
+	if err := store.QueryRow("SELECT COUNT(*) FROM backups WHERE full_path = ?", path).Scan(&existing); err != nil {
+		return BackupRecord{}, err
+	}
+
+	if existing > 0 {
+		return BackupRecord{}, fmt.Errorf("backup file %s is already cataloged", path)
+	}
+
+	vol, err := store.FindVolume(meta.Volume)
+	if err == sql.ErrNoRows {
+		vol, err = store.InsertVolume(meta.Volume, meta.DevicePath)
+	}
+	if err != nil {
+		return BackupRecord{}, fmt.Errorf("error recovering volume %s: %w", meta.Volume, err)
+	}
+
+	br, err := store.insertBackupRecord(vol.ID, filepath.Base(path), path, string(BackupOutputFormatFile), meta.BackupType, meta.TotalBlocks, meta.BlockSize, meta.SizeInBytes, meta.Chunking)
+	if err != nil {
+		return BackupRecord{}, err
+	}
+
+	br.HashAlgorithm = meta.HashAlgorithm
+	if meta.HashAlgorithm != HashAlgorithmXXHash64 {
+		if err := store.updateBackupHashAlgorithm(br.ID, meta.HashAlgorithm); err != nil {
+			return BackupRecord{}, err
+		}
+	}
+
+	if err := store.insertFooterPositions(br.ID, meta.Chunking, meta.HashAlgorithm, positions); err != nil {
+		return BackupRecord{}, fmt.Errorf("error recovering block positions: %w", err)
+	}
+
+	if meta.PositionRanges {
+		if err := store.encodePositionRanges(br.ID); err != nil {
+			return BackupRecord{}, err
+		}
+	}
+
+	if meta.AppVersion != "" {
+		br.AppVersion = meta.AppVersion
+		if err := store.updateBackupAppVersion(br.ID, meta.AppVersion); err != nil {
+			return BackupRecord{}, err
+		}
+	}
+
+	if meta.HashSample {
+		br.HashSample = true
+		if err := store.updateBackupHashSample(br.ID, true); err != nil {
+			return BackupRecord{}, err
+		}
+	}
+
+	if err := store.updateBackupStatus(br.ID, backupStatusCompleted); err != nil {
+		return BackupRecord{}, err
+	}
+	br.Status = backupStatusCompleted
+
+	return br, nil
+}
+
+// insertFooterPositions registers the hashes of the recovered positions under the algorithm and
+// inserts the positions. Content-defined chunks tile the source, so each chunk's offset follows
+// from the lengths before it.
+func (s Store) insertFooterPositions(backupID int, chunking Chunking, algorithm HashAlgorithm, positions []footerPosition) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+
+	blockIDs := map[string]int64{}
+	var offset int64
+	for _, p := range positions {
+		id, ok := blockIDs[p.hash]
+		if !ok {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO blocks (hash, algorithm) VALUES (?, ?)", p.hash, algorithm); err != nil {
+				handleRollback(tx)
+				return err
+			}
+
+			if err := tx.QueryRow("SELECT id FROM blocks WHERE algorithm = ? AND hash = ?", algorithm, p.hash).Scan(&id); err != nil {
+				handleRollback(tx)
+				return err
+			}
+			blockIDs[p.hash] = id
+		}
+
+		var chunkOffset int64
+		if chunking == ChunkingContentDefined {
+			chunkOffset = offset
+			offset += int64(p.length)
+		}
+
+		if _, err := tx.Exec("INSERT INTO block_positions (backup_id, block_id, position, offset, length, stored) VALUES (?, ?, ?, ?, ?, ?)", backupID, id, p.position, chunkOffset, p.length, p.stored); err != nil {
+			handleRollback(tx)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,158 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// backupDataLength returns the number of bytes of block data preceding the backup file's footer.
+func backupDataLength(t *testing.T, path string) int64 {
+	t.Helper()
+
+	meta, _, err := readFooter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return meta.DataLength
+}
+
+func TestRecoverFromFile(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:                store,
+		DevicePath:           "assets/pg.ext4",
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            1048576,
+		BlockBufferSize:      10,
+		EncodePositionRanges: true,
+		AppVersion:           "v1.2.3",
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the catalog.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"backups.db", "backups.db-shm", "backups.db-wal"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+
+	store, err = NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+
+	full, err := RecoverFromFile(b.FullPath(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := RecoverFromFile(db.FullPath(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if full.BackupType != backupTypeFull || diff.BackupType != backupTypeDifferential {
+		t.Fatalf("expected a full and a differential, got %s and %s", full.BackupType, diff.BackupType)
+	}
+
+	if full.VolumeID != diff.VolumeID {
+		t.Fatalf("expected both backups to be recovered into one volume, got %d and %d", full.VolumeID, diff.VolumeID)
+	}
+
+	record, err := store.FindBackup(full.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.AppVersion != "v1.2.3" || record.BlockSize != 1048576 || record.TotalBlocks != 50 {
+		t.Errorf("expected recovered record to match the backup, got %+v", record)
+	}
+
+	totalBlocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if totalBlocks != 38 {
+		t.Fatalf("expected 38 blocks, got %d", totalBlocks)
+	}
+
+	if _, err := RecoverFromFile(b.FullPath(), store); err == nil {
+		t.Fatal("expected recovering a cataloged backup file to fail")
+	}
+
+	for _, tc := range []struct {
+		backup   BackupRecord
+		checksum string
+	}{
+		{full, fullBackupChecksum},
+		{diff, diffWithChangesChecksum},
+	} {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     tc.backup.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     tc.backup.FileName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), tc.checksum)
+	}
+}
+
+func TestRecoverFromFileWithoutFooter(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	if _, err := RecoverFromFile("assets/tiny.ext4", store); !errors.Is(err, ErrNoFooter) {
+		t.Fatalf("expected no footer error, got %v", err)
+	}
+}
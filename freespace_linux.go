@@ -0,0 +1,16 @@
+//go:build linux
+
+package block
+
+import "syscall"
+
+// filesystemFreeSpace returns the number of bytes available to unprivileged users on the
+// filesystem holding path.
+func filesystemFreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package block
+
+import "errors"
+
+var errFreeSpaceUnsupported = errors.New("checking free space is not supported on this platform")
+
+func filesystemFreeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,114 @@
+package block
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// formatSum64 encodes a 64-bit digest, such as xxhash's, as fixed width lowercase hex. This is
+// more compact than decimal, and is the same encoding longer digests would be stored with.
+func formatSum64(sum uint64) string {
+	return fmt.Sprintf("%016x", sum)
+}
+
+// sum returns the hex encoded digest of data. Records from before algorithms were tracked have
+// no algorithm, and were hashed with xxhash64.
+func (a HashAlgorithm) sum(data []byte) string {
+	if a == HashAlgorithmSHA256 {
+		digest := sha256.Sum256(data)
+		return hex.EncodeToString(digest[:])
+	}
+
+	return calculateBlockHash(data)
+}
+
+// encodeHashesAsHex migrates block hashes stored as decimal xxhash values, including sampled
+// hashes, to hex. Fill descriptors don't hold a digest and are left alone.
+func encodeHashesAsHex(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, hash FROM blocks WHERE hash NOT LIKE ?", fillBlockPrefix+"%")
+	if err != nil {
+		return err
+	}
+
+	converted := map[int]string{}
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+
+		prefix := ""
+		if isSampledBlock(hash) {
+			prefix = sampledBlockPrefix
+		}
+
+		sum, err := strconv.ParseUint(strings.TrimPrefix(hash, prefix), 10, 64)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("block %d has unrecognized hash %q: %w", id, hash, err)
+		}
+		converted[id] = prefix + formatSum64(sum)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// A converted hash could equal another block's unconverted decimal hash, so every hash is
+	// staged under a marker before any marker is removed to keep UNIQUE(hash) satisfied.
+	const staged = "~"
+	for id, hash := range converted {
+		if _, err := tx.Exec("UPDATE blocks SET hash = ? WHERE id = ?", staged+hash, id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE blocks SET hash = substr(hash, ?) WHERE hash LIKE ?", len(staged)+1, staged+"%")
+	return err
+}
+
+// addBlockAlgorithms rebuilds the blocks table with the algorithm each block was hashed with,
+// replacing UNIQUE(hash) with UNIQUE(algorithm, hash) so blocks hashed with different algorithms
+// are never deduplicated against each other. Every existing block was hashed with xxhash64.
+func addBlockAlgorithms(tx *sql.Tx) error {
+	// The rebuilt table must stay in the attached block database of a split store.
+	var schema string
+	if err := tx.QueryRow("SELECT schema FROM pragma_table_list WHERE name = 'blocks' AND schema != 'temp'").Scan(&schema); err != nil {
+		return fmt.Errorf("error locating blocks table: %w", err)
+	}
+
+	// Block ids are referenced by position ranges, so ids freed by pruning must not be reused.
+	var seq int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM " + schema + ".sqlite_sequence WHERE name = 'blocks'").Scan(&seq); err != nil {
+		return err
+	}
+
+	stmts := []string{
+		`CREATE TABLE ` + schema + `.blocks_migrated (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT NOT NULL,
+			algorithm TEXT NOT NULL DEFAULT '` + string(HashAlgorithmXXHash64) + `',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(algorithm, hash)
+		);`,
+		`INSERT INTO ` + schema + `.blocks_migrated (id, hash, created_at) SELECT id, hash, created_at FROM ` + schema + `.blocks;`,
+		`DROP TABLE ` + schema + `.blocks;`,
+		`ALTER TABLE ` + schema + `.blocks_migrated RENAME TO blocks;`,
+		`CREATE INDEX IF NOT EXISTS ` + schema + `.idx_blocks_hash ON blocks(hash);`,
+		`DELETE FROM ` + schema + `.sqlite_sequence WHERE name = 'blocks';`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec("INSERT INTO "+schema+".sqlite_sequence (name, seq) SELECT 'blocks', MAX(?, COALESCE(MAX(id), 0)) FROM "+schema+".blocks", seq)
+	return err
+}
@@ -0,0 +1,240 @@
+package block
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestEncodeHashesAsHexMigration(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the store as it was before hashes were hex encoded.
+	hashes, err := store.findHashesByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range hashes {
+		sum, err := strconv.ParseUint(hash, 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Exec("UPDATE blocks SET hash = ? WHERE hash = ?", fmt.Sprint(sum), hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encodeHashesAsHex(tx); err != nil {
+		handleRollback(tx)
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := store.findHashesByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range migrated {
+		if len(hash) != 16 {
+			t.Fatalf("expected hash %q to be hex encoded", hash)
+		}
+	}
+
+	// A backup taken after the migration dedups against the migrated blocks.
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	totalBlocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totalBlocks != 38 {
+		t.Fatalf("expected 38 blocks, got %d", totalBlocks)
+	}
+
+	for _, tc := range []struct {
+		backup   *Backup
+		checksum string
+	}{
+		{b, fullBackupChecksum},
+		{db, diffWithChangesChecksum},
+	} {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     tc.backup.Record.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     tc.backup.Record.FileName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), tc.checksum)
+	}
+}
+
+func TestMixedHashAlgorithms(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	source, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second copy of the image is backed up as its own volume, hashed with sha256.
+	shaPath := filepath.Join(t.TempDir(), "pg_sha256.ext4")
+	if err := os.WriteFile(shaPath, source, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newCfg := func(devicePath string, algorithm HashAlgorithm) *BackupConfig {
+		return &BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+			HashAlgorithm:   algorithm,
+		}
+	}
+
+	run := func(cfg *BackupConfig, devicePath string) *Backup {
+		b, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Hack the device path to simulate a change
+		b.vol.DevicePath = devicePath
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	}
+
+	xxFull := run(newCfg("assets/pg.ext4", ""), "assets/pg.ext4")
+	if xxFull.Record.HashAlgorithm != HashAlgorithmXXHash64 {
+		t.Fatalf("expected the full to default to %q, got %q", HashAlgorithmXXHash64, xxFull.Record.HashAlgorithm)
+	}
+
+	shaFull := run(newCfg(shaPath, HashAlgorithmSHA256), shaPath)
+
+	// The identical image shares no blocks across algorithms.
+	totalBlocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totalBlocks != 74 {
+		t.Fatalf("expected 74 blocks, got %d", totalBlocks)
+	}
+
+	// The differential inherits sha256 and dedups against its full.
+	shaDiff := run(newCfg(shaPath, ""), "assets/pg_altered.ext4")
+	if shaDiff.Record.HashAlgorithm != HashAlgorithmSHA256 {
+		t.Fatalf("expected the differential to inherit %q, got %q", HashAlgorithmSHA256, shaDiff.Record.HashAlgorithm)
+	}
+
+	totalBlocks, err = store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totalBlocks != 75 {
+		t.Fatalf("expected 75 blocks, got %d", totalBlocks)
+	}
+
+	var sha256Blocks int
+	if err := store.QueryRow("SELECT COUNT(*) FROM blocks WHERE algorithm = ? AND length(hash) = 64", HashAlgorithmSHA256).Scan(&sha256Blocks); err != nil {
+		t.Fatal(err)
+	}
+	if sha256Blocks != 38 {
+		t.Fatalf("expected 38 sha256 blocks, got %d", sha256Blocks)
+	}
+
+	if _, err := NewBackup(newCfg("assets/pg.ext4", HashAlgorithmSHA256)); err == nil {
+		t.Fatal("expected a differential with another hash algorithm than its full to be rejected")
+	}
+
+	for _, tc := range []struct {
+		backup   *Backup
+		checksum string
+	}{
+		{xxFull, fullBackupChecksum},
+		{shaFull, fullBackupChecksum},
+		{shaDiff, diffWithChangesChecksum},
+	} {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     tc.backup.Record.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     tc.backup.Record.FileName,
+			Validate:           true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), tc.checksum)
+	}
+}
@@ -0,0 +1,64 @@
+package block
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// The hash cache holds the hash of every position of a volume's last full backup in a single row,
+// so a differential with BackupConfig.HashCache compares its reads against it without joining
+// the full's block positions. The row records the full it was built from and its block size, and
+// is rebuilt whenever either no longer matches.
+
+// loadHashCache loads the hash at each position of the differential's full backup, rebuilding
+// the volume's cache when it was built from another backup or block size.
+func (b *Backup) loadHashCache() error {
+	var backupID, blockSize int
+	var encoded string
+	row := b.store.QueryRow("SELECT backup_id, block_size, hashes FROM hash_cache WHERE volume_id = ?", b.vol.ID)
+	err := row.Scan(&backupID, &blockSize, &encoded)
+	switch {
+	case err == nil && backupID == b.lastFullRecord.ID && blockSize == b.lastFullRecord.BlockSize:
+		b.hashCache = strings.Split(encoded, "\n")
+		return nil
+	case err != nil && err != sql.ErrNoRows:
+		return fmt.Errorf("error loading hash cache: %w", err)
+	}
+
+	hashes, err := b.store.updateHashCache(b.vol.ID, b.lastFullRecord)
+	if err != nil {
+		return err
+	}
+	b.hashCache = hashes
+
+	return nil
+}
+
+// updateHashCache replaces the volume's hash cache with the hashes of the full backup.
+func (s Store) updateHashCache(volumeID int, full BackupRecord) ([]string, error) {
+	hashes, err := s.positionHashes(full)
+	if err != nil {
+		return nil, fmt.Errorf("error building hash cache: %w", err)
+	}
+
+	_, err = s.Exec(`INSERT INTO hash_cache (volume_id, backup_id, block_size, hashes) VALUES (?, ?, ?, ?)
+		ON CONFLICT(volume_id) DO UPDATE SET backup_id = excluded.backup_id, block_size = excluded.block_size, hashes = excluded.hashes`,
+		volumeID, full.ID, full.BlockSize, strings.Join(hashes, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("error storing hash cache: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// cachedHashes returns the full backup's hashes for the n positions from start, indexed by their
+// offset from start. Positions beyond the full are left empty.
+func (b *Backup) cachedHashes(start, n int) []string {
+	hashes := make([]string, n)
+	if start < len(b.hashCache) {
+		copy(hashes, b.hashCache[start:])
+	}
+
+	return hashes
+}
@@ -0,0 +1,180 @@
+package block
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHashCacheMatchesRescan(t *testing.T) {
+	type result struct {
+		positions []int
+		restored  string
+	}
+
+	run := func(hashCache bool) result {
+		dir := t.TempDir()
+		store, err := OpenStore(filepath.Join(dir, "backups.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		if err := store.SetupDB(); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &BackupConfig{
+			Store:           store,
+			DevicePath:      "assets/pg.ext4",
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: dir,
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+			HashCache:       hashCache,
+		}
+
+		fb, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := fb.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		var cached int
+		if err := store.QueryRow("SELECT COUNT(*) FROM hash_cache WHERE backup_id = ?", fb.Record.ID).Scan(&cached); err != nil {
+			t.Fatal(err)
+		}
+
+		if hashCache != (cached == 1) {
+			t.Fatalf("expected the full to populate the hash cache: %t, got %d rows", hashCache, cached)
+		}
+
+		db, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Hack the device path to simulate a change
+		db.vol.DevicePath = "assets/pg_altered.ext4"
+
+		if err := db.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		if hashCache != (len(db.hashCache) == 50) {
+			t.Fatalf("expected the differential to use the hash cache: %t, got %d hashes", hashCache, len(db.hashCache))
+		}
+
+		positions, err := store.findBlockPositionsByBackup(db.Record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var res result
+		for _, p := range positions {
+			res.positions = append(res.positions, p.position)
+		}
+
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     db.Record.ID,
+			OutputDirectory:    dir,
+			OutputFileName:     "restored",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		res.restored, err = fileChecksum(restore.FullRestorePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	cached, rescanned := run(true), run(false)
+
+	if len(cached.positions) != 1 || cached.positions[0] != 0 {
+		t.Fatalf("expected the cached differential to record position 0 only, got %v", cached.positions)
+	}
+
+	if len(rescanned.positions) != 1 || rescanned.positions[0] != cached.positions[0] {
+		t.Fatalf("expected the cached differential to match the rescan %v, got %v", rescanned.positions, cached.positions)
+	}
+
+	if cached.restored != diffWithChangesChecksum || rescanned.restored != diffWithChangesChecksum {
+		t.Fatalf("expected both differentials to restore %s, got %s and %s", diffWithChangesChecksum, cached.restored, rescanned.restored)
+	}
+}
+
+func TestHashCacheRebuildsWhenStale(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// A full taken without the cache leaves it empty.
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed a cache built from another block size, which must not be trusted.
+	if _, err := store.Exec("INSERT INTO hash_cache (volume_id, backup_id, block_size, hashes) VALUES (?, ?, ?, ?)", fb.vol.ID, fb.Record.ID, 4096, "stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.HashCache = true
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unchanged source yields an empty differential.
+	positions, err := store.findBlockPositionsByBackup(db.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 0 {
+		t.Fatalf("expected no changed positions, got %d", len(positions))
+	}
+
+	var blockSize int
+	if err := store.QueryRow("SELECT block_size FROM hash_cache WHERE volume_id = ?", fb.vol.ID).Scan(&blockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if blockSize != 1048576 {
+		t.Fatalf("expected the cache to be rebuilt with block size 1048576, got %d", blockSize)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package block
+
+import "os"
+
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package block
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file, or 0 if it can't be determined.
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+
+	return 0
+}
@@ -0,0 +1,131 @@
+package block
+
+import "fmt"
+
+// IntegrityError describes a row referencing a row that doesn't exist.
+type IntegrityError struct {
+	// Table and RowID identify the row holding the dangling reference.
+	Table string
+	RowID int
+	// Column is the column holding the reference, and Reference the id it refers to.
+	Column    string
+	Reference int
+	// ReferencedTable is the table the reference should resolve to.
+	ReferencedTable string
+}
+
+func (e IntegrityError) Error() string {
+	return fmt.Sprintf("%s %d references missing %s %d through %s", e.Table, e.RowID, e.ReferencedTable, e.Reference, e.Column)
+}
+
+// integrityChecks query the dangling references of each foreign key as (row id, reference, run length).
+// A block_positions row references every block in its run, so runs are reported by their first missing block.
+var integrityChecks = []struct {
+	table           string
+	column          string
+	referencedTable string
+	query           string
+}{
+	{
+		table:           "block_positions",
+		column:          "block_id",
+		referencedTable: "blocks",
+		query: `SELECT bp.id, bp.block_id, bp.run_length FROM block_positions bp
+			WHERE (SELECT COUNT(*) FROM blocks b WHERE b.id BETWEEN bp.block_id AND bp.block_id + bp.run_length - 1) < bp.run_length
+			ORDER BY bp.id ASC`,
+	},
+	{
+		table:           "block_positions",
+		column:          "backup_id",
+		referencedTable: "backups",
+		query: `SELECT bp.id, bp.backup_id, 1 FROM block_positions bp
+			LEFT JOIN backups bk ON bk.id = bp.backup_id
+			WHERE bk.id IS NULL
+			ORDER BY bp.id ASC`,
+	},
+	{
+		table:           "backups",
+		column:          "volume_id",
+		referencedTable: "volumes",
+		query: `SELECT bk.id, bk.volume_id, 1 FROM backups bk
+			LEFT JOIN volumes v ON v.id = bk.volume_id
+			WHERE v.id IS NULL
+			ORDER BY bk.id ASC`,
+	},
+}
+
+// ValidateReferentialIntegrity checks every foreign key of the schema and returns the references
+// that don't resolve, such as block positions left pointing at renumbered blocks. Dangling
+// references make restores silently produce the wrong data.
+//
+// SQLite's foreign key enforcement isn't enabled, as it can't span the databases of a split store.
+func (s Store) ValidateReferentialIntegrity() ([]IntegrityError, error) {
+	var errs []IntegrityError
+	for _, check := range integrityChecks {
+		rows, err := s.Query(check.query)
+		if err != nil {
+			return nil, fmt.Errorf("error checking %s.%s: %w", check.table, check.column, err)
+		}
+
+		var found []IntegrityError
+		var runLengths []int
+		for rows.Next() {
+			var rowID, reference, runLength int
+			if err := rows.Scan(&rowID, &reference, &runLength); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan dangling reference: %w", err)
+			}
+
+			runLengths = append(runLengths, runLength)
+			found = append(found, IntegrityError{
+				Table:           check.table,
+				RowID:           rowID,
+				Column:          check.column,
+				Reference:       reference,
+				ReferencedTable: check.referencedTable,
+			})
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for i := range found {
+			if runLengths[i] > 1 {
+				missing, err := s.firstMissingBlock(found[i].Reference, runLengths[i])
+				if err != nil {
+					return nil, err
+				}
+				found[i].Reference = missing
+			}
+		}
+		errs = append(errs, found...)
+	}
+
+	return errs, nil
+}
+
+// firstMissingBlock returns the first id of the run of blocks starting at blockID that doesn't exist.
+func (s Store) firstMissingBlock(blockID int, runLength int) (int, error) {
+	rows, err := s.Query("SELECT id FROM blocks WHERE id BETWEEN ? AND ? ORDER BY id ASC", blockID, blockID+runLength-1)
+	if err != nil {
+		return 0, fmt.Errorf("error querying blocks: %w", err)
+	}
+	defer rows.Close()
+
+	expected := blockID
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+
+		if id != expected {
+			break
+		}
+		expected++
+	}
+
+	return expected, rows.Err()
+}
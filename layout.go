@@ -0,0 +1,109 @@
+package block
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// EachHashForBackup calls fn with the hash of the block at each position of the image the backup
+// restores, in position order. The positions a differential left unchanged resolve to the blocks
+// of its full backup, and constant blocks are reported by their fill descriptor. The hashes are
+// streamed from the store, so the layout of a large backup is never held in memory. Iteration
+// stops at the first error fn returns, which is returned.
+func (s Store) EachHashForBackup(backupID int, fn func(position int, hash string) error) error {
+	chain, err := s.RestoreChain(backupID)
+	if err != nil {
+		return err
+	}
+
+	// Content-defined backups record every chunk of the image themselves.
+	backup := chain[len(chain)-1]
+	if backup.Chunking == ChunkingContentDefined {
+		chain = chain[len(chain)-1:]
+	}
+
+	// Merge the position-ordered hashes of each layer, with later layers taking precedence.
+	layers := make([]*sql.Rows, len(chain))
+	defer func() {
+		for _, rows := range layers {
+			if rows != nil {
+				rows.Close()
+			}
+		}
+	}()
+
+	type layerHash struct {
+		position int
+		hash     string
+		ok       bool
+	}
+	heads := make([]layerHash, len(chain))
+
+	advance := func(i int) error {
+		if !layers[i].Next() {
+			heads[i] = layerHash{}
+			return layers[i].Err()
+		}
+
+		heads[i].ok = true
+		return layers[i].Scan(&heads[i].position, &heads[i].hash)
+	}
+
+	for i, layer := range chain {
+		rows, err := s.Query("SELECT "+blockPosition+", b.hash FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND "+blockPosition+" < ? ORDER BY 1 ASC", layer.ID, backup.TotalBlocks)
+		if err != nil {
+			return fmt.Errorf("error querying block hashes of backup %d: %w", layer.ID, err)
+		}
+		layers[i] = rows
+
+		if err := advance(i); err != nil {
+			return fmt.Errorf("error reading block hashes of backup %d: %w", layer.ID, err)
+		}
+	}
+
+	for {
+		next := -1
+		for i, head := range heads {
+			if head.ok && (next < 0 || head.position <= heads[next].position) {
+				next = i
+			}
+		}
+
+		if next < 0 {
+			return nil
+		}
+
+		position, hash := heads[next].position, heads[next].hash
+		if err := fn(position, hash); err != nil {
+			return err
+		}
+
+		// Move every layer past the position.
+		for i := range heads {
+			for heads[i].ok && heads[i].position == position {
+				if err := advance(i); err != nil {
+					return fmt.Errorf("error reading block hashes of backup %d: %w", chain[i].ID, err)
+				}
+			}
+		}
+	}
+}
+
+// AllHashesForBackup returns the hash of the block at each position of the image the backup
+// restores, indexed by position, as reported by EachHashForBackup. Positions without a block are
+// left empty.
+func (s Store) AllHashesForBackup(backupID int) ([]string, error) {
+	var hashes []string
+	err := s.EachHashForBackup(backupID, func(position int, hash string) error {
+		for len(hashes) < position {
+			hashes = append(hashes, "")
+		}
+		hashes = append(hashes, hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
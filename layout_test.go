@@ -0,0 +1,108 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// imageHashes returns the hash of each blockSize block of the image at path.
+func imageHashes(t *testing.T, path string, blockSize int) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []string
+	for start := 0; start < len(data); start += blockSize {
+		hashes = append(hashes, calculateBlockHash(data[start:min(start+blockSize, len(data))]))
+	}
+
+	return hashes
+}
+
+func TestAllHashesForBackup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The differential's unchanged positions resolve to the blocks of the full.
+	for _, tc := range []struct {
+		backupID int
+		image    string
+	}{
+		{fb.Record.ID, "assets/pg.ext4"},
+		{db.Record.ID, "assets/pg_altered.ext4"},
+	} {
+		hashes, err := store.AllHashesForBackup(tc.backupID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := imageHashes(t, tc.image, cfg.BlockSize)
+		if len(hashes) != len(expected) {
+			t.Fatalf("expected %d hashes for backup %d, got %d", len(expected), tc.backupID, len(hashes))
+		}
+
+		unique := map[string]bool{}
+		for i := range expected {
+			if hashes[i] != expected[i] {
+				t.Fatalf("expected hash %s at position %d of backup %d, got %s", expected[i], i, tc.backupID, hashes[i])
+			}
+			unique[hashes[i]] = true
+		}
+
+		if tc.backupID == fb.Record.ID && len(unique) != 37 {
+			t.Fatalf("expected 37 unique blocks in the full backup, got %d", len(unique))
+		}
+	}
+
+	// Iteration stops at the first error.
+	stop := errors.New("stop")
+	var visited int
+	err = store.EachHashForBackup(db.Record.ID, func(position int, hash string) error {
+		visited++
+		if position == 9 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || visited != 10 {
+		t.Fatalf("expected iteration to stop after 10 positions, got %d and %v", visited, err)
+	}
+}
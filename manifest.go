@@ -0,0 +1,46 @@
+package block
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteManifestCSV writes the backup's block positions to w as CSV, with a position,block_id,hash
+// header followed by a row for each position the backup recorded, in position order. A
+// differential only lists the positions it recorded, not those resolved from its full backup.
+func (s Store) WriteManifestCSV(backupID int, w io.Writer) error {
+	if _, err := s.findBackup(backupID); err != nil {
+		return fmt.Errorf("error resolving backup record with id %d: %w", backupID, err)
+	}
+
+	rows, err := s.Query("SELECT "+blockPosition+", b.id, b.hash FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? ORDER BY 1 ASC", backupID)
+	if err != nil {
+		return fmt.Errorf("error querying block positions: %w", err)
+	}
+	defer rows.Close()
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"position", "block_id", "hash"}); err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var position, blockID int
+		var hash string
+		if err := rows.Scan(&position, &blockID, &hash); err != nil {
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+
+		if err := writer.Write([]string{strconv.Itoa(position), strconv.Itoa(blockID), hash}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading block positions: %w", err)
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,78 @@
+package block
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"testing"
+)
+
+func TestWriteManifestCSV(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:                store,
+		DevicePath:           "assets/pg.ext4",
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            1048576,
+		BlockBufferSize:      5,
+		EncodePositionRanges: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := store.WriteManifestCSV(b.Record.ID, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := records[0]; len(got) != 3 || got[0] != "position" || got[1] != "block_id" || got[2] != "hash" {
+		t.Fatalf("unexpected header %v", got)
+	}
+
+	positions, err := store.findBlockPositionsByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := records[1:]
+	if len(rows) != len(positions) {
+		t.Fatalf("expected %d rows, got %d", len(positions), len(rows))
+	}
+
+	for i, pos := range positions {
+		var hash string
+		if err := store.QueryRow("SELECT hash FROM blocks WHERE id = ?", pos.blockID).Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{strconv.Itoa(pos.position), strconv.Itoa(pos.blockID), hash}
+		for j := range want {
+			if rows[i][j] != want[j] {
+				t.Fatalf("row %d: expected %v, got %v", i, want, rows[i])
+			}
+		}
+	}
+
+	if err := store.WriteManifestCSV(b.Record.ID+1, &buf); err == nil {
+		t.Fatal("expected an unknown backup to be rejected")
+	}
+}
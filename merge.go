@@ -0,0 +1,312 @@
+package block
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// MergeResult summarizes the catalog imported by Store.Merge.
+type MergeResult struct {
+	Volumes int
+	Backups int
+	// Blocks is the number of blocks that weren't already held by the store. Blocks with a hash
+	// the store already holds are deduplicated.
+	Blocks    int
+	Positions int
+	// RenamedVolumes maps the names of imported volumes that collided with an existing volume to
+	// the names they were imported as.
+	RenamedVolumes map[string]string
+}
+
+// Merge imports the volumes, backups, blocks and block positions of the data store at otherDBPath,
+// for example one kept by another machine, remapping their IDs to avoid collisions. Blocks are
+// deduplicated by hash. Volumes are never combined, since a differential is restored on top of
+// its volume's latest full backup, so a volume whose name is already taken is imported with a
+// numeric suffix (e.g. name.1). The other store is only read, and must be at the same schema version.
+func (s Store) Merge(otherDBPath string) (MergeResult, error) {
+	other, err := OpenReadOnlyStore(otherDBPath)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	defer other.Close()
+
+	version, err := other.SchemaVersion()
+	if err != nil {
+		return MergeResult{}, fmt.Errorf("error reading schema version of %s: %w", otherDBPath, err)
+	}
+
+	if version != LatestSchemaVersion() {
+		return MergeResult{}, fmt.Errorf("%s is at schema version %d, expected %d", otherDBPath, version, LatestSchemaVersion())
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		return MergeResult{}, err
+	}
+
+	m := &merger{src: other, tx: tx, result: MergeResult{RenamedVolumes: map[string]string{}}}
+	if err := m.merge(); err != nil {
+		handleRollback(tx)
+		return MergeResult{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return MergeResult{}, err
+	}
+
+	// Runs are expanded on import, since the remapped block IDs of a run may not be consecutive.
+	for _, backupID := range m.encoded {
+		if err := s.encodePositionRanges(backupID); err != nil {
+			return MergeResult{}, fmt.Errorf("error encoding position ranges of backup %d: %w", backupID, err)
+		}
+	}
+
+	return m.result, nil
+}
+
+// merger copies the catalog of src into the store within tx.
+type merger struct {
+	src *Store
+	tx  *sql.Tx
+
+	volumeIDs map[int64]int64
+	backupIDs map[int64]int64
+	blockIDs  map[int64]int64
+	// encoded holds the imported backups whose positions were range encoded.
+	encoded []int
+	result  MergeResult
+}
+
+func (m *merger) merge() error {
+	var err error
+
+	m.volumeIDs, err = m.copyRows("volumes", func(row map[string]interface{}) error {
+		name, ok := row["name"].(string)
+		if !ok {
+			return fmt.Errorf("volume %v has no name", row["id"])
+		}
+
+		unique, err := m.uniqueVolumeName(name)
+		if err != nil {
+			return err
+		}
+
+		if unique != name {
+			m.result.RenamedVolumes[name] = unique
+			row["name"] = unique
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error merging volumes: %w", err)
+	}
+	m.result.Volumes = len(m.volumeIDs)
+
+	m.backupIDs, err = m.copyRows("backups", func(row map[string]interface{}) error {
+		return remapID(row, "volume_id", m.volumeIDs)
+	})
+	if err != nil {
+		return fmt.Errorf("error merging backups: %w", err)
+	}
+	m.result.Backups = len(m.backupIDs)
+
+	if err := m.mergeBlocks(); err != nil {
+		return fmt.Errorf("error merging blocks: %w", err)
+	}
+
+	if err := m.mergePositions(); err != nil {
+		return fmt.Errorf("error merging block positions: %w", err)
+	}
+
+	return nil
+}
+
+// copyRows inserts every row of the source table into the same table of the store, without its
+// id so a new one is assigned. remap rewrites a row's values by column name before it's inserted.
+// The new IDs are returned keyed by the source ID.
+func (m *merger) copyRows(table string, remap func(row map[string]interface{}) error) (map[int64]int64, error) {
+	rows, err := m.src.Query("SELECT * FROM " + table + " ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var insertColumns []string
+	for _, column := range columns {
+		if column != "id" {
+			insertColumns = append(insertColumns, column)
+		}
+	}
+	placeholders := strings.Trim(strings.Repeat("?,", len(insertColumns)), ",")
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(insertColumns, ", "), placeholders)
+
+	ids := map[int64]int64{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := map[string]interface{}{}
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+
+		if err := remap(row); err != nil {
+			return nil, err
+		}
+
+		args := make([]interface{}, len(insertColumns))
+		for i, column := range insertColumns {
+			args[i] = row[column]
+		}
+
+		res, err := m.tx.Exec(stmt, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		srcID, ok := row["id"].(int64)
+		if !ok {
+			return nil, fmt.Errorf("%s row has an invalid id %v", table, row["id"])
+		}
+		ids[srcID] = id
+	}
+
+	return ids, rows.Err()
+}
+
+// remapID rewrites the ID held in column using ids.
+func remapID(row map[string]interface{}, column string, ids map[int64]int64) error {
+	srcID, ok := row[column].(int64)
+	if !ok {
+		return fmt.Errorf("%s %v is not an ID", column, row[column])
+	}
+
+	id, ok := ids[srcID]
+	if !ok {
+		return fmt.Errorf("%s %d references a missing row", column, srcID)
+	}
+	row[column] = id
+
+	return nil
+}
+
+// uniqueVolumeName returns name, or name with the lowest numeric suffix not already taken.
+func (m *merger) uniqueVolumeName(name string) (string, error) {
+	candidate := name
+	for i := 1; ; i++ {
+		var count int
+		if err := m.tx.QueryRow("SELECT COUNT(*) FROM volumes WHERE name = ?", candidate).Scan(&count); err != nil {
+			return "", err
+		}
+
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s.%d", name, i)
+	}
+}
+
+// mergeBlocks registers the source's block hashes, reusing the blocks the store already holds
+// under the same algorithm.
+func (m *merger) mergeBlocks() error {
+	rows, err := m.src.Query("SELECT id, hash, algorithm FROM blocks ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	m.blockIDs = map[int64]int64{}
+	for rows.Next() {
+		var srcID int64
+		var hash string
+		var algorithm HashAlgorithm
+		if err := rows.Scan(&srcID, &hash, &algorithm); err != nil {
+			return err
+		}
+
+		res, err := m.tx.Exec("INSERT OR IGNORE INTO blocks (hash, algorithm) VALUES (?, ?)", hash, algorithm)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			m.result.Blocks++
+		}
+
+		var id int64
+		if err := m.tx.QueryRow("SELECT id FROM blocks WHERE algorithm = ? AND hash = ?", algorithm, hash).Scan(&id); err != nil {
+			return err
+		}
+		m.blockIDs[srcID] = id
+	}
+
+	return rows.Err()
+}
+
+// mergePositions copies the source's block positions using the remapped backup and block IDs.
+// Range encoded runs are expanded into a row per position.
+func (m *merger) mergePositions() error {
+	rows, err := m.src.Query("SELECT backup_id, block_id, position, offset, length, stored, run_length FROM block_positions ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	stmt, err := m.tx.Prepare("INSERT INTO block_positions (backup_id, block_id, position, offset, length, stored) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	encoded := map[int64]bool{}
+	for rows.Next() {
+		var backupID, blockID, position, offset, length, runLength int64
+		var stored bool
+		if err := rows.Scan(&backupID, &blockID, &position, &offset, &length, &stored, &runLength); err != nil {
+			return err
+		}
+
+		newBackupID, ok := m.backupIDs[backupID]
+		if !ok {
+			return fmt.Errorf("position %d references missing backup %d", position, backupID)
+		}
+
+		if runLength > 1 && !encoded[newBackupID] {
+			encoded[newBackupID] = true
+			m.encoded = append(m.encoded, int(newBackupID))
+		}
+
+		for i := int64(0); i < runLength; i++ {
+			newBlockID, ok := m.blockIDs[blockID+i]
+			if !ok {
+				return fmt.Errorf("position %d references missing block %d", position+i, blockID+i)
+			}
+
+			if _, err := stmt.Exec(newBackupID, newBlockID, position+i, offset, length, stored); err != nil {
+				return err
+			}
+			m.result.Positions++
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,168 @@
+package block
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeStores(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	local, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := local.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other machine backs up a volume with the same name, with its positions range encoded.
+	otherDir := t.TempDir()
+	otherPath := filepath.Join(otherDir, "other.db")
+	other, err := OpenStore(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.SetupDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	otherCfg := &BackupConfig{
+		Store:                other,
+		DevicePath:           "assets/pg.ext4",
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      otherDir,
+		BlockSize:            1048576,
+		BlockBufferSize:      10,
+		EncodePositionRanges: true,
+	}
+
+	full, err := NewBackup(otherCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := full.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := NewBackup(otherCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := diff.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := store.Merge(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Volumes != 1 || result.Backups != 2 {
+		t.Fatalf("expected 1 volume and 2 backups to be merged, got %+v", result)
+	}
+
+	// Only the altered block is new to the local store.
+	if result.Blocks != 1 {
+		t.Errorf("expected 1 new block, got %d", result.Blocks)
+	}
+
+	// The differential only records the altered position.
+	if result.Positions != 51 {
+		t.Errorf("expected 51 positions, got %d", result.Positions)
+	}
+
+	if renamed := result.RenamedVolumes["pg.ext4"]; renamed != "pg.ext4.1" {
+		t.Errorf("expected colliding volume to be renamed to pg.ext4.1, got %q", renamed)
+	}
+
+	totalBlocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if totalBlocks != 38 {
+		t.Fatalf("expected 38 blocks, got %d", totalBlocks)
+	}
+
+	problems, err := store.ValidateReferentialIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatalf("expected merged store to be consistent, got %v", problems)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 3 {
+		t.Fatalf("expected 3 backups, got %d", len(backups))
+	}
+
+	checksums := map[string]string{
+		local.Record.FullPath: fullBackupChecksum,
+		full.Record.FullPath:  fullBackupChecksum,
+		diff.Record.FullPath:  diffWithChangesChecksum,
+	}
+
+	// Runs are re-encoded once their block IDs have been remapped.
+	var otherRows, mergedRows int
+	if err := other.QueryRow("SELECT COUNT(*) FROM block_positions WHERE backup_id = ?", full.Record.ID).Scan(&otherRows); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.QueryRow("SELECT COUNT(*) FROM block_positions bp JOIN backups b ON bp.backup_id = b.id WHERE b.full_path = ?", full.Record.FullPath).Scan(&mergedRows); err != nil {
+		t.Fatal(err)
+	}
+
+	if otherRows >= 50 || mergedRows != otherRows {
+		t.Errorf("expected the merged full to keep its %d encoded rows, got %d", otherRows, mergedRows)
+	}
+
+	for _, backup := range backups {
+		checksum, ok := checksums[backup.FullPath]
+		if !ok {
+			t.Fatalf("unexpected backup %s", backup.FullPath)
+		}
+
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     backup.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     backup.FileName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatalf("error restoring merged backup %d: %v", backup.ID, err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), checksum)
+	}
+}
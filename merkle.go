@@ -0,0 +1,191 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// Merkle tree nodes are domain separated, so a leaf can't be passed off as an interior node.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof proves that a block is held at a position of a backup, by hashing it up to the
+// backup's Merkle root through the sibling of each node on its path.
+type MerkleProof struct {
+	Position int
+	// Hash is the hash recorded for the block at Position.
+	Hash string
+	// Algorithm is the digest Hash was computed with.
+	Algorithm HashAlgorithm
+	Steps     []MerkleStep
+}
+
+// MerkleStep is the sibling hashed with a node on the path from a leaf to the root.
+type MerkleStep struct {
+	Sibling []byte
+	// Left is set when the sibling is the left hand side of the pair.
+	Left bool
+}
+
+// merkleLeaf hashes the block recorded at a position into its leaf.
+func merkleLeaf(position int, hash string) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	_ = binary.Write(h, binary.BigEndian, uint64(position))
+	h.Write([]byte(hash))
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels builds the levels of the tree over the hashes recorded for positions 0 through
+// len(hashes)-1, from the leaves up to the root. The last node of a level with an odd number of
+// nodes is promoted to the next level unchanged.
+func merkleLevels(hashes []string) [][][]byte {
+	level := make([][]byte, len(hashes))
+	for pos, hash := range hashes {
+		level[pos] = merkleLeaf(pos, hash)
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// backupMerkleLevels builds the Merkle tree over the backup's blocks in position order, returning
+// the hash recorded for each position along with the tree's levels.
+func (s Store) backupMerkleLevels(backup BackupRecord) ([]string, [][][]byte, error) {
+	if backup.Chunking == ChunkingContentDefined {
+		return nil, nil, fmt.Errorf("merkle trees are not supported with %q chunking", backup.Chunking)
+	}
+
+	hashes, err := s.positionHashes(backup)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hashes, merkleLevels(hashes), nil
+}
+
+// positionHashes returns the hash of the block at each position of the backup, in position order.
+// The blocks of a differential are layered on its full backup, so every position of the volume
+// is covered.
+func (s Store) positionHashes(backup BackupRecord) ([]string, error) {
+	resolved, err := s.resolveBackupHashes(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("backup %d has no block positions", backup.ID)
+	}
+
+	hashes := make([]string, len(resolved))
+	for pos := range hashes {
+		hash, ok := resolved[pos]
+		if !ok {
+			return nil, fmt.Errorf("backup %d has no block at position %d", backup.ID, pos)
+		}
+		hashes[pos] = hash
+	}
+
+	return hashes, nil
+}
+
+// computeMerkleRoot builds the backup's Merkle tree and records its root.
+func (s Store) computeMerkleRoot(backup BackupRecord) (string, error) {
+	_, levels, err := s.backupMerkleLevels(backup)
+	if err != nil {
+		return "", err
+	}
+
+	root := hex.EncodeToString(levels[len(levels)-1][0])
+	if _, err := s.Exec("UPDATE backups SET merkle_root = ? WHERE id = ?", root, backup.ID); err != nil {
+		return "", err
+	}
+
+	return root, nil
+}
+
+// MerkleProof returns the proof that the block at position belongs to the backup, which must
+// have been taken with BackupConfig.MerkleTree.
+func (s Store) MerkleProof(backupID, position int) (MerkleProof, error) {
+	backup, err := s.findBackup(backupID)
+	if err != nil {
+		return MerkleProof{}, fmt.Errorf("error resolving backup record with id %d: %w", backupID, err)
+	}
+
+	if backup.MerkleRoot == "" {
+		return MerkleProof{}, fmt.Errorf("backup %d has no merkle root", backupID)
+	}
+
+	hashes, levels, err := s.backupMerkleLevels(backup)
+	if err != nil {
+		return MerkleProof{}, err
+	}
+
+	if position < 0 || position >= len(levels[0]) {
+		return MerkleProof{}, fmt.Errorf("position %d is outside of backup %d", position, backupID)
+	}
+
+	proof := MerkleProof{Position: position, Hash: hashes[position], Algorithm: backup.HashAlgorithm}
+	index := position
+	for _, level := range levels[:len(levels)-1] {
+		switch {
+		case index%2 == 1:
+			proof.Steps = append(proof.Steps, MerkleStep{Sibling: level[index-1], Left: true})
+		case index+1 < len(level):
+			proof.Steps = append(proof.Steps, MerkleStep{Sibling: level[index+1]})
+		}
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// Verify reports whether data is the block the proof was issued for and hashes up to root, the
+// hex encoded Merkle root of the backup.
+func (p MerkleProof) Verify(root string, data []byte) bool {
+	if !blockMatchesHash(data, p.Hash, p.Algorithm) {
+		return false
+	}
+
+	expected, err := hex.DecodeString(root)
+	if err != nil {
+		return false
+	}
+
+	node := merkleLeaf(p.Position, p.Hash)
+	for _, step := range p.Steps {
+		if step.Left {
+			node = merkleNode(step.Sibling, node)
+		} else {
+			node = merkleNode(node, step.Sibling)
+		}
+	}
+
+	return bytes.Equal(node, expected)
+}
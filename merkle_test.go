@@ -0,0 +1,129 @@
+package block
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// readSourceBlock reads the block at position from the source file.
+func readSourceBlock(t *testing.T, path string, position, blockSize int) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := position * blockSize
+	return data[start:min(start+blockSize, len(data))]
+}
+
+func TestMerkleProof(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+		MerkleTree:      true,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.findBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.MerkleRoot == "" || record.MerkleRoot != b.Record.MerkleRoot {
+		t.Fatalf("expected the merkle root to be recorded, got %q", record.MerkleRoot)
+	}
+
+	// Every position of the 50 block source, including those promoted through odd levels.
+	for pos := 0; pos < b.TotalBlocks(); pos++ {
+		proof, err := store.MerkleProof(b.Record.ID, pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := readSourceBlock(t, "assets/pg.ext4", pos, cfg.BlockSize)
+		if !proof.Verify(record.MerkleRoot, data) {
+			t.Fatalf("expected the proof for position %d to verify", pos)
+		}
+	}
+
+	proof, err := store.MerkleProof(b.Record.ID, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := readSourceBlock(t, "assets/pg.ext4", 7, cfg.BlockSize)
+
+	tampered := bytes.Clone(data)
+	tampered[0] ^= 0xFF
+	if proof.Verify(record.MerkleRoot, tampered) {
+		t.Fatal("expected the proof to reject a modified block")
+	}
+
+	moved := proof
+	moved.Position = 8
+	if moved.Verify(record.MerkleRoot, data) {
+		t.Fatal("expected the proof to reject the block at another position")
+	}
+
+	// A differential's tree covers the volume as it was at the time of the differential.
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Record.MerkleRoot == record.MerkleRoot {
+		t.Fatal("expected the differential to have a different merkle root")
+	}
+
+	for _, pos := range []int{0, 7} {
+		proof, err := store.MerkleProof(db.Record.ID, pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !proof.Verify(db.Record.MerkleRoot, readSourceBlock(t, "assets/pg_altered.ext4", pos, cfg.BlockSize)) {
+			t.Fatalf("expected the differential's proof for position %d to verify", pos)
+		}
+	}
+
+	original, err := store.MerkleProof(db.Record.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if original.Verify(db.Record.MerkleRoot, readSourceBlock(t, "assets/pg.ext4", 0, cfg.BlockSize)) {
+		t.Fatal("expected the differential's proof to reject the block it replaced")
+	}
+
+	if _, err := store.MerkleProof(b.Record.ID, b.TotalBlocks()); err == nil {
+		t.Fatal("expected an error for a position outside of the backup")
+	}
+}
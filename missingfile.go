@@ -0,0 +1,124 @@
+package block
+
+import (
+	"fmt"
+	"os"
+)
+
+// backupFileMissing reports whether the backup's data is read from a local backup file that no
+// longer exists.
+func (r *Restore) backupFileMissing(backup BackupRecord) bool {
+	if _, ok := r.config.Sources[backup.ID]; ok || backup.RemoteKey != "" {
+		return false
+	}
+
+	_, err := os.Stat(backup.FullPath)
+	return os.IsNotExist(err)
+}
+
+// restoreFromOtherFiles restores the layer, whose backup file is missing, from the files of the
+// other backups that store its blocks, such as a full of another volume holding the same image.
+// Blocks are matched by hash, so only backups hashed the same way as the layer are read, and the
+// restore fails if any of the layer's blocks isn't stored in an intact file.
+func (r *Restore) restoreFromOtherFiles(target restoreTarget, layer BackupRecord) error {
+	needed := map[string][]int{}
+	rows, err := r.store.Query("SELECT b.hash, "+blockPosition+" FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND b.hash NOT LIKE ?", layer.ID, fillBlockPrefix+"%")
+	if err != nil {
+		return fmt.Errorf("error querying block positions: %w", err)
+	}
+	for rows.Next() {
+		var hash string
+		var pos int
+		if err := rows.Scan(&hash, &pos); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+		needed[hash] = append(needed[hash], pos)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading block positions: %w", err)
+	}
+
+	donors, err := r.store.backupsSharingBlocks(layer.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, donor := range donors {
+		if len(needed) == 0 {
+			break
+		}
+
+		if donor.Status != backupStatusCompleted || donor.Chunking != layer.Chunking || donor.BlockSize != layer.BlockSize ||
+			donor.HashAlgorithm != layer.HashAlgorithm || donor.HashSample != layer.HashSample || r.backupFileMissing(donor) {
+			continue
+		}
+
+		err := r.readStoredBlocks(donor, func(hash string, data []byte) error {
+			positions, ok := needed[hash]
+			if !ok {
+				return nil
+			}
+
+			for _, pos := range positions {
+				if r.beyondLimit(pos) {
+					continue
+				}
+
+				if err := r.writeAt(target, data, int64(pos*layer.BlockSize)); err != nil {
+					return err
+				}
+				r.progress.add(1)
+			}
+			delete(needed, hash)
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error restoring blocks of backup %d from backup %d: %w", layer.ID, donor.ID, err)
+		}
+	}
+
+	if len(needed) > 0 {
+		return fmt.Errorf("backup file %s is missing, and %d of its blocks aren't stored in any other intact backup file", layer.FullPath, len(needed))
+	}
+
+	return r.restoreFillBlocks(target, layer)
+}
+
+// backupsSharingBlocks returns the backups other than backupID whose positions reference any of
+// its blocks, oldest first.
+func (s Store) backupsSharingBlocks(backupID int) ([]BackupRecord, error) {
+	rows, err := s.Query(`SELECT DISTINCT op.backup_id FROM block_positions op JOIN blocks ob ON ob.id BETWEEN op.block_id AND op.block_id + op.run_length - 1
+		WHERE op.backup_id != ? AND ob.id IN (SELECT b.id FROM block_positions bp JOIN blocks b ON `+positionRange+` WHERE bp.backup_id = ?)
+		ORDER BY op.backup_id ASC`, backupID, backupID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying backups sharing blocks with backup %d: %w", backupID, err)
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	backups := make([]BackupRecord, 0, len(ids))
+	for _, id := range ids {
+		backup, err := s.findBackup(id)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving backup record with id %d: %w", id, err)
+		}
+		backups = append(backups, backup)
+	}
+
+	return backups, nil
+}
@@ -0,0 +1,121 @@
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreWithMissingFullFile(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another machine keeps a full of the same image in its own backup file.
+	otherDir := t.TempDir()
+	otherPath := filepath.Join(otherDir, "other.db")
+	other, err := OpenStore(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.SetupDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	sibling, err := NewBackup(&BackupConfig{
+		Store:           other,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: otherDir,
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sibling.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Merge(otherPath); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func(backupID int, name string) error {
+		r, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     backupID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     name,
+			Validate:           true,
+		})
+		if err != nil {
+			return err
+		}
+
+		return r.Run()
+	}
+
+	if err := os.Remove(fb.FullPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The full's blocks are restored from the sibling's file.
+	if err := restore(db.Record.ID, "diff.img"); err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, "restores/diff.img", diffWithChangesChecksum)
+
+	if err := restore(fb.Record.ID, "full.img"); err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, "restores/full.img", fullBackupChecksum)
+
+	// Without the sibling's file the blocks aren't stored anywhere.
+	if err := os.Remove(sibling.FullPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(db.Record.ID, "lost.img"); err == nil {
+		t.Fatal("expected restoring without any file holding the full's blocks to fail")
+	}
+}
@@ -0,0 +1,183 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// partPath returns the path of the nth part of a multi-part restore.
+func partPath(path string, n int) string {
+	return fmt.Sprintf("%s.%03d", path, n)
+}
+
+// resolvePartsPath applies the existing file policy to a multi-part restore, based on whether
+// its first part exists. Renamed restores use a numeric suffix before the part number.
+func resolvePartsPath(path string, policy ExistingFilePolicy) (string, error) {
+	first, err := resolveOutputPath(partPath(path, 0), policy)
+	if err != nil || first == partPath(path, 0) {
+		return path, err
+	}
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(partPath(candidate, 0)); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+}
+
+// partFiles presents the parts of a multi-part restore as a single file, where the nth part holds
+// the maxSize bytes starting at offset n*maxSize. Parts are opened as they're first accessed.
+type partFiles struct {
+	path    string
+	maxSize int64
+	open    func(path string) (*os.File, error)
+	files   []*os.File
+}
+
+func newPartFiles(path string, maxSize int64, open func(path string) (*os.File, error)) *partFiles {
+	return &partFiles{path: path, maxSize: maxSize, open: open}
+}
+
+// part returns the nth part, opening it and any preceding parts that haven't been opened yet, so
+// the parts have no gaps.
+func (p *partFiles) part(n int) (*os.File, error) {
+	for len(p.files) <= n {
+		f, err := p.open(partPath(p.path, len(p.files)))
+		if err != nil {
+			return nil, err
+		}
+		p.files = append(p.files, f)
+	}
+
+	return p.files[n], nil
+}
+
+// span calls fn for each part the len(b) bytes at off fall within, with the slice of b and the
+// offset held by that part.
+func (p *partFiles) span(b []byte, off int64, fn func(f *os.File, b []byte, off int64) (int, error)) (int, error) {
+	var total int
+	for len(b) > 0 {
+		n := int(off / p.maxSize)
+		partOff := off % p.maxSize
+		length := min(int64(len(b)), p.maxSize-partOff)
+
+		f, err := p.part(n)
+		if err != nil {
+			return total, err
+		}
+
+		written, err := fn(f, b[:length], partOff)
+		total += written
+		if err != nil {
+			return total, err
+		}
+
+		b = b[length:]
+		off += length
+	}
+
+	return total, nil
+}
+
+func (p *partFiles) WriteAt(b []byte, off int64) (int, error) {
+	return p.span(b, off, func(f *os.File, b []byte, off int64) (int, error) {
+		return f.WriteAt(b, off)
+	})
+}
+
+// ReadAt reads across the parts, returning io.EOF when a read reaches past the last part.
+func (p *partFiles) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.span(b, off, func(f *os.File, b []byte, off int64) (int, error) {
+		n, err := f.ReadAt(b, off)
+		if err == io.EOF && n == len(b) {
+			err = nil
+		}
+		return n, err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Truncate sizes the parts to hold size bytes, creating any that were never written.
+func (p *partFiles) Truncate(size int64) error {
+	for n := 0; int64(n)*p.maxSize < size; n++ {
+		f, err := p.part(n)
+		if err != nil {
+			return err
+		}
+
+		if err := f.Truncate(min(p.maxSize, size-int64(n)*p.maxSize)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *partFiles) Sync() error {
+	for _, f := range p.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *partFiles) Close() error {
+	var errs []error
+	for _, f := range p.files {
+		errs = append(errs, f.Close())
+	}
+	p.files = nil
+
+	return errors.Join(errs...)
+}
+
+// runToParts restores the backup across numbered files of at most MaxOutputFileSize bytes.
+func (r *Restore) runToParts() error {
+	path := r.FullRestorePath()
+	parts := newPartFiles(path, r.config.MaxOutputFileSize, func(path string) (*os.File, error) {
+		return openOutputFile(path, r.config.OnExisting)
+	})
+	defer func() { _ = parts.Close() }()
+
+	if err := r.setupProgress(); err != nil {
+		return err
+	}
+
+	if err := r.restoreTo(parts); err != nil {
+		return err
+	}
+
+	if err := parts.Truncate(r.restoredSize()); err != nil {
+		return fmt.Errorf("error sizing restore parts: %v", err)
+	}
+
+	r.progress.finish()
+
+	if err := parts.Close(); err != nil {
+		return fmt.Errorf("error closing restore parts: %v", err)
+	}
+
+	if r.config.Validate {
+		if err := r.validateParts(path); err != nil {
+			return err
+		}
+	}
+
+	if r.config.CompareTo != "" {
+		output := newPartFiles(path, r.config.MaxOutputFileSize, os.Open)
+		defer func() { _ = output.Close() }()
+
+		return r.compareToReference(io.NewSectionReader(output, 0, r.restoredSize()))
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package block
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRestoreMultiPart(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Parts that aren't a multiple of the block size split blocks across parts.
+	const maxSize = 20*1048576 + 12345
+	cases := []struct {
+		name     string
+		backupID int
+		checksum string
+	}{
+		{"full", fb.Record.ID, fullBackupChecksum},
+		{"differential", db.Record.ID, diffWithChangesChecksum},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			restore, err := NewRestore(RestoreConfig{
+				Store:              store,
+				RestoreInputFormat: RestoreInputFormatFile,
+				SourceBackupID:     tc.backupID,
+				OutputDirectory:    "restores/",
+				OutputFileName:     "parts-" + tc.name,
+				MaxOutputFileSize:  maxSize,
+				Validate:           true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := restore.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			joinedPath := "restores/joined-" + tc.name
+			joined, err := os.Create(joinedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer joined.Close()
+
+			remaining := int64(fb.Record.TotalBlocks * cfg.BlockSize)
+			for n := 0; remaining > 0; n++ {
+				part, err := os.Open(partPath(restore.FullRestorePath(), n))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				size, err := io.Copy(joined, part)
+				_ = part.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if size != min(maxSize, remaining) {
+					t.Fatalf("expected part %d to hold %d bytes, got %d", n, min(maxSize, remaining), size)
+				}
+				remaining -= size
+			}
+
+			if _, err := os.Stat(partPath(restore.FullRestorePath(), 3)); !os.IsNotExist(err) {
+				t.Fatalf("expected 3 parts, got %v", err)
+			}
+
+			compareChecksum(t, joinedPath, tc.checksum)
+		})
+	}
+
+	// The first part exists, so the restore is refused under the default policy.
+	_, err = NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     fb.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "parts-full",
+		MaxOutputFileSize:  maxSize,
+	})
+	if err == nil {
+		t.Fatal("expected an existing first part to be refused")
+	}
+}
@@ -0,0 +1,108 @@
+package block
+
+import "fmt"
+
+// maxPreloadedBlocks is the number of a layer's blocks whose positions a restore holds in memory
+// at once. Layers with more blocks are loaded in windows of this many blocks.
+const maxPreloadedBlocks = 1 << 18
+
+// blockPositionIndex looks up the positions a layer's blocks are restored to without a query per
+// block. Blocks are stored in the backup file in the order of their IDs, so the index loads the
+// positions of the next window of block IDs as the restore reads through the file. A block the
+// loaded window doesn't hold, which happens if the file's order doesn't follow the IDs, is looked
+// up on its own.
+type blockPositionIndex struct {
+	store    *Store
+	backupID int
+	window   int
+	// loadedThrough is the block number the loaded window ends before, and lastID the highest
+	// block ID it holds.
+	loadedThrough int
+	lastID        int
+	positions     map[string][]int
+}
+
+func newBlockPositionIndex(store *Store, backupID int) *blockPositionIndex {
+	return &blockPositionIndex{store: store, backupID: backupID, window: maxPreloadedBlocks, loadedThrough: -1}
+}
+
+// lookup returns the positions of the block with the hash, which is the blockNum'th block of the
+// backup file. Block numbers must be looked up in ascending order.
+func (x *blockPositionIndex) lookup(blockNum int, hash string) ([]int, error) {
+	if blockNum >= x.loadedThrough {
+		if err := x.load(blockNum); err != nil {
+			return nil, err
+		}
+	}
+
+	if positions, ok := x.positions[hash]; ok {
+		return positions, nil
+	}
+
+	return x.store.blockPositions(x.backupID, hash)
+}
+
+// load replaces the loaded window with the positions of the window starting at blockNum.
+func (x *blockPositionIndex) load(blockNum int) error {
+	// The first window skips the blocks a resumed restore has already restored.
+	args := []any{x.backupID, x.lastID, x.window, 0}
+	if x.loadedThrough < 0 {
+		args[3] = blockNum
+	}
+
+	var firstID, lastID, count int
+	row := x.store.QueryRow(`SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0), COUNT(*) FROM (
+		SELECT DISTINCT b.id FROM block_positions bp JOIN blocks b ON `+positionRange+`
+		WHERE bp.backup_id = ? AND b.id > ? AND b.hash NOT LIKE 'fill:%'
+		ORDER BY b.id LIMIT ? OFFSET ?)`, args...)
+	if err := row.Scan(&firstID, &lastID, &count); err != nil {
+		return fmt.Errorf("error finding the next window of blocks: %w", err)
+	}
+
+	x.positions = make(map[string][]int, count)
+	x.loadedThrough = blockNum + x.window
+	if count == 0 {
+		return nil
+	}
+	x.lastID = lastID
+
+	rows, err := x.store.Query("SELECT b.hash, "+blockPosition+" FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND b.id BETWEEN ? AND ?", x.backupID, firstID, lastID)
+	if err != nil {
+		return fmt.Errorf("error querying block positions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		var pos int
+		if err := rows.Scan(&hash, &pos); err != nil {
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+		x.positions[hash] = append(x.positions[hash], pos)
+	}
+
+	return rows.Err()
+}
+
+// blockPositions returns the positions of the backup's blocks with the hash.
+func (s Store) blockPositions(backupID int, hash string) ([]int, error) {
+	rows, err := s.Query("SELECT "+blockPosition+" from block_positions bp JOIN blocks b ON "+positionRange+" where bp.backup_id = ? AND b.hash = ?", backupID, hash)
+	if err != nil {
+		return nil, fmt.Errorf("error quering block positions for hash %s: %w", hash, err)
+	}
+	defer rows.Close()
+
+	var positions []int
+	for rows.Next() {
+		var pos int
+		if err := rows.Scan(&pos); err != nil {
+			return nil, fmt.Errorf("failed to scan position: %w", err)
+		}
+		positions = append(positions, pos)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading block positions: %w", err)
+	}
+
+	return positions, nil
+}
@@ -0,0 +1,112 @@
+package block
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRestorePositionWindows(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows smaller than the layers load their positions in several passes.
+	for _, window := range []int{1, 3, 36, 37, maxPreloadedBlocks} {
+		for _, pipeline := range []bool{false, true} {
+			restore, err := NewRestore(RestoreConfig{
+				Store:              store,
+				RestoreInputFormat: RestoreInputFormatFile,
+				SourceBackupID:     db.Record.ID,
+				OutputDirectory:    "restores/",
+				OutputFileName:     "windowed.ext4",
+				OnExisting:         ExistingFileOverwrite,
+				Pipeline:           pipeline,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			restore.disableFastPath = true
+			restore.positionWindow = window
+
+			if err := restore.Run(); err != nil {
+				t.Fatalf("window %d: %v", window, err)
+			}
+
+			compareChecksum(t, restore.FullRestorePath(), diffWithChangesChecksum)
+		}
+	}
+}
+
+func BenchmarkRestorePositionWindow(b *testing.B) {
+	store, err := NewStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(b)
+
+	backup, _ := backupRandomSource(b, store, 32*1048576)
+
+	// A window of one block loads each block's positions on its own.
+	for _, window := range []int{1, 64, maxPreloadedBlocks} {
+		b.Run(fmt.Sprintf("window-%d", window), func(b *testing.B) {
+			b.SetBytes(int64(backup.Record.SizeInBytes))
+			for i := 0; i < b.N; i++ {
+				restore, err := NewRestore(RestoreConfig{
+					Store:              store,
+					RestoreInputFormat: RestoreInputFormatFile,
+					SourceBackupID:     backup.Record.ID,
+					OutputDirectory:    "restores/",
+					OutputFileName:     "bench",
+					OnExisting:         ExistingFileOverwrite,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				restore.disableFastPath = true
+				restore.positionWindow = window
+
+				if err := restore.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultPrecheckMemoryBudget is the memory a backup's buffers may use when PrecheckConfig
+// doesn't set a budget.
+const defaultPrecheckMemoryBudget = 1 << 30
+
+// freeSpace returns the bytes available on the filesystem holding a path. Tests replace it to
+// simulate a full disk.
+var freeSpace = filesystemFreeSpace
+
+// PrecheckConfig describes a planned backup checked by Precheck.
+type PrecheckConfig struct {
+	DevicePath string
+	// BlockSize defaults to 4096 when zero.
+	BlockSize int
+	// BlockBufferSize is a number of blocks, or BlockBufferSizeAuto.
+	BlockBufferSize int
+	// Concurrency bounds the number of buffers in flight, as in BackupConfig.
+	Concurrency int
+	// ReadAheadBytes is the size of the buffer the source is read through, as in BackupConfig.
+	ReadAheadBytes int
+	// OutputDirectory is where the backup file will be written. Defaults to the current directory.
+	OutputDirectory string
+	// MemoryBudget is the most memory the backup's buffers may use. Defaults to 1 GiB.
+	MemoryBudget int64
+}
+
+// PrecheckResult is the outcome of Precheck.
+type PrecheckResult struct {
+	// SourceSizeInBytes is the size of the source, or zero if it couldn't be read.
+	SourceSizeInBytes int
+	// BufferMemoryInBytes is the most memory the backup's buffers use at once.
+	BufferMemoryInBytes int64
+	// FreeSpaceInBytes is the space available in the output directory, or -1 if it's unknown.
+	FreeSpaceInBytes int64
+	// Problems would make the backup fail or exhaust resources, while Warnings are worth
+	// reviewing but don't stop it.
+	Problems []string
+	Warnings []string
+}
+
+// Passed reports whether the precheck found no problems.
+func (r PrecheckResult) Passed() bool {
+	return len(r.Problems) == 0
+}
+
+// Precheck validates a planned backup before it's run: that the block and buffer sizes are
+// valid and their buffers fit within the memory budget, that the output directory has room for
+// the backup file and that the source can be read. The warnings a backup would print as it
+// starts, such as a block size larger than the source, are reported up front. Nothing is
+// recorded in the store.
+func Precheck(cfg PrecheckConfig) PrecheckResult {
+	result := PrecheckResult{FreeSpaceInBytes: -1}
+
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultBlockSize
+	}
+	if cfg.OutputDirectory == "" {
+		cfg.OutputDirectory = "."
+	}
+	if cfg.MemoryBudget == 0 {
+		cfg.MemoryBudget = defaultPrecheckMemoryBudget
+	}
+
+	switch {
+	case cfg.BlockSize < 1:
+		result.Problems = append(result.Problems, fmt.Sprintf("block size must be at least 1, got %d", cfg.BlockSize))
+	case cfg.BlockBufferSize < 1 && cfg.BlockBufferSize != BlockBufferSizeAuto:
+		result.Problems = append(result.Problems, fmt.Sprintf("block buffer size must be at least 1, got %d", cfg.BlockBufferSize))
+	default:
+		result.BufferMemoryInBytes = bufferMemory(cfg)
+		if result.BufferMemoryInBytes > cfg.MemoryBudget {
+			result.Problems = append(result.Problems, fmt.Sprintf("the buffers of %d byte blocks use up to %d bytes of memory, exceeding the budget of %d bytes",
+				cfg.BlockSize, result.BufferMemoryInBytes, cfg.MemoryBudget))
+		}
+	}
+
+	size, err := checkSourceReadable(cfg.DevicePath, max(cfg.BlockSize, 1))
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("source %s can't be read: %v", cfg.DevicePath, err))
+	}
+	result.SourceSizeInBytes = size
+
+	if cfg.BlockSize > size && size > 0 {
+		result.Warnings = append(result.Warnings, oversizedBlockWarning(cfg.BlockSize, size))
+	}
+
+	if _, err := os.Stat(cfg.OutputDirectory); err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("output directory does not exist: %v", err))
+		return result
+	}
+
+	free, err := freeSpace(cfg.OutputDirectory)
+	if err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("free space in %s couldn't be checked: %v", cfg.OutputDirectory, err))
+		return result
+	}
+	result.FreeSpaceInBytes = free
+
+	// A full backup of a source without duplicate blocks is as large as the source.
+	if free < int64(size) {
+		result.Problems = append(result.Problems, fmt.Sprintf("%s has %d bytes free, but a full backup of the source may need up to %d bytes", cfg.OutputDirectory, free, size))
+	}
+
+	return result
+}
+
+// oversizedBlockWarning describes a block size larger than the source it's backing up.
+func oversizedBlockWarning(blockSize, sizeInBytes int) string {
+	return fmt.Sprintf("block size %d exceeds the size of the backup target %d. This will result in wasted space!", blockSize, sizeInBytes)
+}
+
+// bufferMemory returns the most memory the buffers of a fixed-size backup with the settings use
+// at once: each buffer in flight through the pipeline, and the read-ahead buffer.
+func bufferMemory(cfg PrecheckConfig) int64 {
+	bufferBytes := int64(cfg.BlockBufferSize) * int64(cfg.BlockSize)
+	readAhead := bufferBytes
+	if cfg.BlockBufferSize == BlockBufferSizeAuto {
+		bufferBytes = int64(max(maxAdaptiveBufferBytes/cfg.BlockSize, 1)) * int64(cfg.BlockSize)
+		readAhead = int64(cfg.BlockSize)
+	}
+	if cfg.ReadAheadBytes > 0 {
+		readAhead = int64(cfg.ReadAheadBytes)
+	}
+
+	return int64(pipelineBuffers(cfg.BlockBufferSize, cfg.Concurrency))*bufferBytes + readAhead
+}
+
+// checkSourceReadable returns the size of the source after reading its first and last blocks.
+func checkSourceReadable(devicePath string, blockSize int) (int, error) {
+	size, err := GetTargetSizeInBytes(devicePath)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	buf := make([]byte, min(blockSize, size))
+	for _, offset := range []int64{0, int64(size - len(buf))} {
+		if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+			return size, fmt.Errorf("error reading %d bytes at offset %d: %w", len(buf), offset, err)
+		}
+	}
+
+	return size, nil
+}
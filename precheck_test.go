@@ -0,0 +1,76 @@
+package block
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrecheck(t *testing.T) {
+	plentiful := func(string) (int64, error) { return 1 << 40, nil }
+	defer func() { freeSpace = filesystemFreeSpace }()
+	freeSpace = plentiful
+
+	result := Precheck(PrecheckConfig{
+		DevicePath:      "assets/pg.ext4",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+		OutputDirectory: t.TempDir(),
+	})
+	if !result.Passed() || len(result.Warnings) != 0 {
+		t.Fatalf("expected the precheck to pass without warnings, got %+v", result)
+	}
+
+	if result.SourceSizeInBytes != 50*1048576 {
+		t.Fatalf("expected a source size of %d, got %d", 50*1048576, result.SourceSizeInBytes)
+	}
+
+	// Each of the 4 buffers in flight and the read-ahead hold 5 blocks.
+	if result.BufferMemoryInBytes != 5*5*1048576 {
+		t.Fatalf("expected %d bytes of buffers, got %d", 5*5*1048576, result.BufferMemoryInBytes)
+	}
+
+	// A block size larger than the source is warned about.
+	result = Precheck(PrecheckConfig{
+		DevicePath:      "assets/pg.ext4",
+		BlockSize:       64 * 1048576,
+		BlockBufferSize: 5,
+		OutputDirectory: t.TempDir(),
+	})
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "exceeds the size of the backup target") {
+		t.Fatalf("expected a warning about the block size, got %+v", result.Warnings)
+	}
+
+	// The same block size exceeds a tighter memory budget.
+	result = Precheck(PrecheckConfig{
+		DevicePath:      "assets/pg.ext4",
+		BlockSize:       64 * 1048576,
+		BlockBufferSize: 5,
+		OutputDirectory: t.TempDir(),
+		MemoryBudget:    256 * 1048576,
+	})
+	if result.Passed() || !strings.Contains(result.Problems[0], "exceeding the budget") {
+		t.Fatalf("expected the memory budget to be exceeded, got %+v", result.Problems)
+	}
+
+	// The output directory can't hold a full backup of the source.
+	freeSpace = func(string) (int64, error) { return 1048576, nil }
+	result = Precheck(PrecheckConfig{
+		DevicePath:      "assets/pg.ext4",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+		OutputDirectory: t.TempDir(),
+	})
+	if result.Passed() || result.FreeSpaceInBytes != 1048576 || !strings.Contains(result.Problems[0], "bytes free") {
+		t.Fatalf("expected insufficient free space to be reported, got %+v", result)
+	}
+	freeSpace = plentiful
+
+	result = Precheck(PrecheckConfig{
+		DevicePath:      "assets/missing.ext4",
+		BlockBufferSize: 5,
+		OutputDirectory: t.TempDir(),
+	})
+	if result.Passed() || !strings.Contains(result.Problems[0], "can't be read") {
+		t.Fatalf("expected an unreadable source to be reported, got %+v", result.Problems)
+	}
+}
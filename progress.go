@@ -0,0 +1,152 @@
+package block
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProgressFunc is invoked as blocks are processed. completed is guaranteed to be
+// monotonically increasing and the final invocation always reports completed == total.
+type ProgressFunc func(completed, total int)
+
+// defaultProgressInterval limits progress updates to at most 10 per second.
+const defaultProgressInterval = 100 * time.Millisecond
+
+// progressTracker aggregates progress across parallel workers and throttles the
+// rate at which the progress callback fires.
+type progressTracker struct {
+	fn       ProgressFunc
+	total    int
+	interval time.Duration
+
+	completed atomic.Int64
+
+	mu           sync.Mutex
+	lastEmit     time.Time
+	lastReported int64
+}
+
+func newProgressTracker(fn ProgressFunc, total int) *progressTracker {
+	return &progressTracker{
+		fn:           fn,
+		total:        total,
+		interval:     defaultProgressInterval,
+		lastReported: -1,
+	}
+}
+
+// add records n completed units of work and emits a progress update if the throttle allows.
+// It is safe to call from multiple goroutines.
+func (p *progressTracker) add(n int) {
+	if p == nil {
+		return
+	}
+
+	p.completed.Add(int64(n))
+
+	if p.fn == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.lastEmit) < p.interval {
+		return
+	}
+
+	// The counter only ever increases, so loading it while holding the lock keeps reports monotonic.
+	completed := p.completed.Load()
+	if completed >= int64(p.total) || completed <= p.lastReported {
+		// The final 100% update is reserved for finish.
+		return
+	}
+
+	p.emit(completed)
+}
+
+// finish reports that all work has been completed.
+func (p *progressTracker) finish() {
+	if p == nil || p.fn == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.emit(int64(p.total))
+}
+
+func (p *progressTracker) emit(completed int64) {
+	p.lastEmit = time.Now()
+	p.lastReported = completed
+	p.fn(int(completed), p.total)
+}
+
+// RestoreProgress is a snapshot of a running restore, reported to RestoreConfig.ProgressReport.
+type RestoreProgress struct {
+	// Completed is the number of positions restored so far, out of Total.
+	Completed int
+	Total     int
+	// BytesRestored is the number of bytes written for the restored positions.
+	BytesRestored int64
+	// BytesPerSecond is the rate positions have been restored at over the last etaWindow.
+	BytesPerSecond float64
+	// Remaining is the estimated time until the restore completes. It's only meaningful once
+	// Estimating is false.
+	Remaining time.Duration
+	// Estimating is set until enough progress has been made to measure the throughput.
+	Estimating bool
+}
+
+// RestoreProgressFunc receives snapshots of a running restore as positions are restored.
+type RestoreProgressFunc func(RestoreProgress)
+
+// etaWindow is how far back the throughput behind a restore's ETA is measured, so the estimate
+// follows changes in speed without jumping with every update.
+const etaWindow = 10 * time.Second
+
+// progressSample is the number of bytes restored at a point in time.
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// etaEstimator estimates the time remaining from the throughput over a sliding window.
+type etaEstimator struct {
+	window  time.Duration
+	samples []progressSample
+}
+
+func newETAEstimator() *etaEstimator {
+	return &etaEstimator{window: etaWindow}
+}
+
+// observe records that bytes of totalBytes were restored at the time, returning the throughput
+// over the window and the estimated time remaining. ok is false until two samples apart in time
+// show progress.
+func (e *etaEstimator) observe(at time.Time, bytes, totalBytes int64) (perSecond float64, remaining time.Duration, ok bool) {
+	e.samples = append(e.samples, progressSample{at: at, bytes: bytes})
+
+	// Keep the newest sample older than the window as its start.
+	drop := 0
+	for drop+1 < len(e.samples) && at.Sub(e.samples[drop+1].at) >= e.window {
+		drop++
+	}
+	e.samples = e.samples[drop:]
+
+	first := e.samples[0]
+	if elapsed := at.Sub(first.at); elapsed > 0 && bytes > first.bytes {
+		perSecond = float64(bytes-first.bytes) / elapsed.Seconds()
+	}
+
+	switch {
+	case bytes >= totalBytes:
+		return perSecond, 0, true
+	case perSecond == 0:
+		return 0, 0, false
+	}
+
+	return perSecond, time.Duration(float64(totalBytes-bytes) / perSecond * float64(time.Second)), true
+}
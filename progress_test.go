@@ -0,0 +1,263 @@
+package block
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressTrackerParallelWorkers(t *testing.T) {
+	const (
+		workers         = 8
+		blocksPerWorker = 1000
+		total           = workers * blocksPerWorker
+	)
+
+	var reported []int
+	tracker := newProgressTracker(func(completed, total int) {
+		reported = append(reported, completed)
+	}, total)
+	// Disable throttling so every update is eligible to fire.
+	tracker.interval = 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < blocksPerWorker; i++ {
+				tracker.add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	tracker.finish()
+
+	if len(reported) == 0 {
+		t.Fatal("expected progress to be reported")
+	}
+
+	for i := 1; i < len(reported); i++ {
+		if reported[i] <= reported[i-1] {
+			t.Fatalf("expected progress to be monotonic, got %d after %d", reported[i], reported[i-1])
+		}
+	}
+
+	if last := reported[len(reported)-1]; last != total {
+		t.Fatalf("expected final progress to be %d, got %d", total, last)
+	}
+}
+
+func TestBackupProgress(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	var completed, total int
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 4,
+		Progress: func(c, t int) {
+			completed = c
+			total = t
+		},
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if total != b.TotalBlocks() {
+		t.Fatalf("expected progress total to be %d, got %d", b.TotalBlocks(), total)
+	}
+
+	if completed != total {
+		t.Fatalf("expected final progress to be %d, got %d", total, completed)
+	}
+}
+
+func TestBackupLiveStats(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	var mu sync.Mutex
+	var snapshots []BackupStats
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+		StatsInterval:   time.Millisecond,
+		Stats: func(stats BackupStats) {
+			mu.Lock()
+			defer mu.Unlock()
+			snapshots = append(snapshots, stats)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(snapshots) == 0 {
+		t.Fatal("expected at least one stats snapshot")
+	}
+
+	for i, stats := range snapshots {
+		if stats.BlocksWritten > stats.BlocksProcessed || stats.BlocksProcessed > stats.TotalBlocks {
+			t.Fatalf("snapshot %d has inconsistent block counts: %+v", i, stats)
+		}
+		if stats.DedupRatio < 0 || stats.DedupRatio > 1 || stats.Throughput < 0 {
+			t.Fatalf("snapshot %d has out of range rates: %+v", i, stats)
+		}
+		if i > 0 && stats.BlocksProcessed < snapshots[i-1].BlocksProcessed {
+			t.Fatalf("expected blocks processed to be monotonic, got %d after %d", stats.BlocksProcessed, snapshots[i-1].BlocksProcessed)
+		}
+	}
+
+	// The final snapshot covers the whole backup: 50 blocks, of which 37 are unique.
+	final := snapshots[len(snapshots)-1]
+	if final.BlocksProcessed != 50 || final.BlocksWritten != 37 || final.BytesRead != 52428800 {
+		t.Fatalf("expected 50 blocks processed, 37 written and 52428800 bytes read, got %+v", final)
+	}
+
+	if final.DedupRatio != 1-37.0/50.0 {
+		t.Fatalf("expected a dedup ratio of %f, got %f", 1-37.0/50.0, final.DedupRatio)
+	}
+
+	if final.Throughput <= 0 {
+		t.Fatalf("expected a positive throughput, got %f", final.Throughput)
+	}
+}
+
+func TestRestoreProgressETA(t *testing.T) {
+	const (
+		total = 100 << 20
+		step  = 1 << 20
+	)
+
+	// Progress arrives every 100ms at a steady 10 MiB/s, with updates briefly stalling midway.
+	eta := newETAEstimator()
+	start := time.Now()
+	_, remaining, ok := eta.observe(start, 0, total)
+	if ok || remaining != 0 {
+		t.Fatalf("expected the first update to still be estimating, got %s", remaining)
+	}
+
+	last := time.Duration(-1)
+	at := start
+	for bytes := int64(step); bytes <= total; bytes += step {
+		at = at.Add(100 * time.Millisecond)
+		if bytes == total/2 {
+			// The same progress reported twice doesn't make the estimate jump.
+			if _, _, ok := eta.observe(at, bytes-step, total); !ok {
+				t.Fatal("expected a throughput to be measured")
+			}
+			at = at.Add(100 * time.Millisecond)
+		}
+
+		perSecond, remaining, ok := eta.observe(at, bytes, total)
+		if !ok {
+			t.Fatalf("expected an estimate after %d bytes", bytes)
+		}
+
+		if perSecond <= 0 {
+			t.Fatalf("expected a positive throughput after %d bytes, got %f", bytes, perSecond)
+		}
+
+		if last >= 0 && remaining > last {
+			t.Fatalf("expected the estimate to decrease, got %s after %s", remaining, last)
+		}
+		last = remaining
+	}
+
+	if last != 0 {
+		t.Fatalf("expected no time remaining once complete, got %s", last)
+	}
+}
+
+func TestRestoreProgressReport(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []RestoreProgress
+	r, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "progress.img",
+		ProgressReport:     func(p RestoreProgress) { reports = append(reports, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reports) == 0 {
+		t.Fatal("expected progress to be reported")
+	}
+
+	final := reports[len(reports)-1]
+	if final.Completed != final.Total || final.Total != b.TotalBlocks() {
+		t.Fatalf("expected the final report to cover all %d positions, got %d of %d", b.TotalBlocks(), final.Completed, final.Total)
+	}
+
+	if final.Estimating || final.Remaining != 0 || final.BytesRestored != int64(final.Total)*1048576 {
+		t.Fatalf("expected the final report to have nothing remaining, got %+v", final)
+	}
+}
@@ -0,0 +1,86 @@
+package block
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Each block_positions row maps the run_length positions starting at position to the same number
+// of consecutive block IDs starting at block_id. Rows are written with a run_length of one, and
+// encodePositionRanges merges them into runs when EncodePositionRanges is enabled.
+
+// positionRange joins the blocks b to the block_positions rows bp whose run covers them.
+const positionRange = "b.id BETWEEN bp.block_id AND bp.block_id + bp.run_length - 1"
+
+// blockPosition is the position of the block b within the run of the row bp it was joined through.
+const blockPosition = "(bp.position + b.id - bp.block_id)"
+
+// positionRun is a single encoded block_positions row.
+type positionRun struct {
+	position int
+	blockID  int
+	length   int
+}
+
+// encodePositionRanges replaces the backup's block positions with one row per run of consecutive
+// positions that reference consecutive block IDs. A sequential full backup of unique blocks
+// collapses into a handful of rows.
+func (s Store) encodePositionRanges(backupID int) error {
+	rows, err := s.Query("SELECT position, block_id, run_length FROM block_positions WHERE backup_id = ? ORDER BY position ASC, block_id ASC", backupID)
+	if err != nil {
+		return fmt.Errorf("error querying block positions: %w", err)
+	}
+
+	var runs []positionRun
+	for rows.Next() {
+		var run positionRun
+		if err := rows.Scan(&run.position, &run.blockID, &run.length); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan position: %w", err)
+		}
+
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			if run.position == last.position+last.length && run.blockID == last.blockID+last.length {
+				last.length += run.length
+				continue
+			}
+		}
+		runs = append(runs, run)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading block positions: %w", err)
+	}
+
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM block_positions WHERE backup_id = ?", backupID); err != nil {
+		handleRollback(tx)
+		return fmt.Errorf("error removing block positions: %w", err)
+	}
+
+	// Insert the runs in batches to stay within SQLite's variable limit.
+	const batchSize = 200
+	for start := 0; start < len(runs); start += batchSize {
+		end := min(start+batchSize, len(runs))
+
+		var valueStrings []string
+		var valueArgs []interface{}
+		for _, run := range runs[start:end] {
+			valueStrings = append(valueStrings, "(?, ?, ?, ?)")
+			valueArgs = append(valueArgs, backupID, run.blockID, run.position, run.length)
+		}
+
+		stmt := "INSERT INTO block_positions (backup_id, block_id, position, run_length) VALUES " + strings.Join(valueStrings, ",")
+		if _, err := tx.Exec(stmt, valueArgs...); err != nil {
+			handleRollback(tx)
+			return fmt.Errorf("error inserting position ranges: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
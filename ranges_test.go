@@ -0,0 +1,168 @@
+package block
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodePositionRanges(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	data := make([]byte, 64*65536)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:                store,
+		DevicePath:           sourcePath,
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            65536,
+		BlockBufferSize:      16,
+		EncodePositionRanges: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows int
+	if err := store.QueryRow("SELECT COUNT(*) FROM block_positions WHERE backup_id = ?", b.Record.ID).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows > b.TotalBlocks()/10 {
+		t.Fatalf("expected far fewer than %d position rows, got %d", b.TotalBlocks(), rows)
+	}
+
+	missing, err := store.MissingPositions(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing positions, got %v", missing)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     b.Record.FileName,
+		Validate:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exercise the position queries rather than copying the file as-is.
+	restore.disableFastPath = true
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sha256.Sum256(restored) != sha256.Sum256(data) {
+		t.Fatal("expected the restore to match the source")
+	}
+}
+
+func TestEncodePositionRangesDifferential(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:                store,
+		DevicePath:           "assets/pg.ext4",
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            1048576,
+		BlockBufferSize:      5,
+		EncodePositionRanges: true,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	positions, err := store.findBlockPositionsByBackup(db.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 1 || positions[0].position != 0 {
+		t.Fatalf("expected the differential to record only position 0, got %v", positions)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     db.Record.FileName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	targetChecksum, err := fileChecksum(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffWithChangesChecksum != targetChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", diffWithChangesChecksum, targetChecksum)
+	}
+}
@@ -0,0 +1,72 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ReadTimeoutError describes a source read that didn't complete within the read timeout on any
+// of its attempts.
+type ReadTimeoutError struct {
+	// Offset and Length identify the range that was being read.
+	Offset int64
+	Length int
+	// Attempts is the number of times the read was tried, and Timeout the deadline of each.
+	Attempts int
+	Timeout  time.Duration
+}
+
+func (e ReadTimeoutError) Error() string {
+	return fmt.Sprintf("read of %d bytes at offset %d timed out after %s (%d attempts)", e.Length, e.Offset, e.Timeout, e.Attempts)
+}
+
+// timeoutReaderAt bounds each read of the source by a deadline, retrying reads that miss it.
+// A read that misses its deadline can't be interrupted, so it's abandoned and left to finish in
+// the background.
+type timeoutReaderAt struct {
+	source  io.ReaderAt
+	timeout time.Duration
+	retries int
+}
+
+func (t *timeoutReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		n, err := t.readWithDeadline(p, off)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return n, err
+		}
+	}
+
+	return 0, ReadTimeoutError{Offset: off, Length: len(p), Attempts: t.retries + 1, Timeout: t.timeout}
+}
+
+// readWithDeadline makes a single attempt at the read, returning context.DeadlineExceeded if it
+// doesn't complete within the timeout.
+func (t *timeoutReaderAt) readWithDeadline(p []byte, off int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	// An abandoned read may still write to its buffer, so each attempt reads into its own.
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+	go func() {
+		n, err := t.source.ReadAt(buf, off)
+		done <- result{n: n, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
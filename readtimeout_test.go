@@ -0,0 +1,122 @@
+package block
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hangingReaderAt blocks the first hangs reads until release is closed, then reads from data.
+type hangingReaderAt struct {
+	data    []byte
+	release chan struct{}
+
+	mu    sync.Mutex
+	hangs int
+}
+
+func (h *hangingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	h.mu.Lock()
+	hang := h.hangs > 0
+	if hang {
+		h.hangs--
+	}
+	h.mu.Unlock()
+
+	if hang {
+		<-h.release
+	}
+
+	n := copy(p, h.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *hangingReaderAt) Size() int64 {
+	return int64(len(h.data))
+}
+
+func TestBackupReadTimeout(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	data, err := os.ReadFile("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+
+	backup := func(hangs int) (*Backup, error) {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      "assets/tiny.ext4",
+			Source:          &hangingReaderAt{data: data, release: release, hangs: hangs},
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       4096,
+			BlockBufferSize: 16,
+			ReadTimeout:     50 * time.Millisecond,
+			ReadRetries:     2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b, b.Run()
+	}
+
+	// A read that hangs once is retried.
+	b, err := backup(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "tiny.ext4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := fileChecksum("assets/tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, restore.FullRestorePath(), checksum)
+
+	// A read that hangs on every attempt times out.
+	_, err = backup(3)
+	var timeoutErr ReadTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a read timeout, got %v", err)
+	}
+
+	if timeoutErr.Attempts != 3 || timeoutErr.Offset != 0 {
+		t.Fatalf("expected 3 attempts at offset 0, got %d at offset %d", timeoutErr.Attempts, timeoutErr.Offset)
+	}
+
+	if _, err := NewBackup(&BackupConfig{Store: store, DevicePath: "assets/tiny.ext4", BlockSize: 4096, BlockBufferSize: 16, ReadTimeout: -time.Second}); err == nil {
+		t.Fatal("expected a negative read timeout to be rejected")
+	}
+}
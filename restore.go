@@ -1,16 +1,44 @@
 package block
 
 import (
+	"database/sql"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 type Restore struct {
-	store          *Store
-	backup         BackupRecord
-	lastFullBackup BackupRecord
-	config         RestoreConfig
+	store  *Store
+	backup BackupRecord
+	// chain holds the backups layered to restore backup, in the order they're applied.
+	chain    []BackupRecord
+	config   RestoreConfig
+	progress *progressTracker
+	// disableFastPath forces full backups through the general restore path.
+	disableFastPath bool
+	// checkpoint is the progress recorded by an interrupted restore when resuming.
+	checkpoint *restoreCheckpoint
+	// crashAfter aborts the restore after the specified number of blocks when set,
+	// simulating a crash.
+	crashAfter int
+	// blocksRestored is the number of backup file blocks restored across the layers.
+	blocksRestored int
+	// blocksUpdated is the number of blocks an OnlyDiff restore wrote to its target.
+	blocksUpdated int
+	// bytesRestored is the size of the image a Discard restore reconstructed.
+	bytesRestored int64
+	// positionWindow overrides the number of blocks whose positions are loaded at once when set.
+	positionWindow int
+}
+
+// restoreTarget is what a restore writes to: the restore file, or the parts of a multi-part restore.
+type restoreTarget interface {
+	io.WriterAt
+	Sync() error
 }
 
 func NewRestore(cfg RestoreConfig) (*Restore, error) {
@@ -21,133 +49,784 @@ func NewRestore(cfg RestoreConfig) (*Restore, error) {
 		}
 	}
 
+	switch cfg.OutputImageFormat {
+	case "":
+		cfg.OutputImageFormat = ImageFormatRaw
+	case ImageFormatRaw, ImageFormatRawSparse:
+	default:
+		return nil, fmt.Errorf("image format %q is not supported", cfg.OutputImageFormat)
+	}
+
+	if cfg.OutputImageFormat == ImageFormatRawSparse && cfg.Output != nil {
+		return nil, fmt.Errorf("%q images must be restored to a file", ImageFormatRawSparse)
+	}
+
+	checkpointing := cfg.CheckpointInterval > 0 || cfg.Resume
+	if checkpointing && (cfg.Output != nil || cfg.Stream != nil) {
+		return nil, fmt.Errorf("restore checkpoints require restoring to a file from backup files")
+	}
+
+	if cfg.MaxOutputFileSize < 0 {
+		return nil, fmt.Errorf("maximum output file size must not be negative, got %d", cfg.MaxOutputFileSize)
+	}
+
+	if cfg.MaxRestoreChainDepth < 0 {
+		return nil, fmt.Errorf("maximum restore chain depth must not be negative, got %d", cfg.MaxRestoreChainDepth)
+	}
+
+	if cfg.MaxOutputFileSize > 0 && (cfg.Output != nil || checkpointing || cfg.OutputImageFormat == ImageFormatRawSparse) {
+		return nil, fmt.Errorf("multi-part restores require %q images without checkpoints or an Output", ImageFormatRaw)
+	}
+
+	if isDiscardTarget(cfg) {
+		if checkpointing || cfg.MaxOutputFileSize > 0 || cfg.OnlyDiff != "" || cfg.CompareTo != "" || cfg.OutputImageFormat == ImageFormatRawSparse {
+			return nil, fmt.Errorf("discarded restores require a %q restore without checkpoints, parts, an existing image or a comparison", ImageFormatRaw)
+		}
+		cfg.Discard = true
+		cfg.Output = nil
+	}
+
+	if cfg.OnlyDiff != "" {
+		if cfg.Output != nil || cfg.Stream != nil || checkpointing || cfg.MaxOutputFileSize > 0 || cfg.LimitPositions != 0 || cfg.OutputImageFormat == ImageFormatRawSparse {
+			return nil, fmt.Errorf("updating an existing image requires a %q restore from backup files without an Output, checkpoints, parts or a position limit", ImageFormatRaw)
+		}
+
+		if _, err := os.Stat(cfg.OnlyDiff); err != nil {
+			return nil, fmt.Errorf("restore target does not exist: %v", err)
+		}
+	}
+
+	if cfg.BaseImagePath != "" {
+		if cfg.Stream != nil || cfg.OnlyDiff != "" || cfg.Discard || checkpointing || cfg.MaxOutputFileSize > 0 || cfg.LimitPositions != 0 || cfg.OutputImageFormat == ImageFormatRawSparse {
+			return nil, fmt.Errorf("restoring onto a base image requires a %q restore from backup files without checkpoints, parts, a position limit or an existing image", ImageFormatRaw)
+		}
+
+		if _, err := os.Stat(cfg.BaseImagePath); err != nil {
+			return nil, fmt.Errorf("base image does not exist: %v", err)
+		}
+	}
+
+	if cfg.Output == nil && !cfg.Resume && cfg.OnlyDiff == "" && !cfg.Discard {
+		// Apply the existing file policy to the restore target
+		resolve := resolveOutputPath
+		if cfg.MaxOutputFileSize > 0 {
+			resolve = resolvePartsPath
+		}
+
+		fullPath, err := resolve(fmt.Sprintf("%s/%s", cfg.OutputDirectory, cfg.OutputFileName), cfg.OnExisting)
+		if err != nil {
+			return nil, err
+		}
+		cfg.OutputFileName = filepath.Base(fullPath)
+	}
+
+	concurrency, err := resolveConcurrency(cfg.Concurrency, fmt.Sprintf("%s/%s", cfg.OutputDirectory, cfg.OutputFileName))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Concurrency = concurrency
+
 	// Resolve the backup record
 	backup, err := cfg.Store.findBackup(cfg.SourceBackupID)
 	if err != nil {
 		return nil, fmt.Errorf("error resolving backup record with id %d: %v", cfg.SourceBackupID, err)
 	}
 
+	if backup.HashSample {
+		fmt.Fprintf(os.Stderr, "WARNING: backup %d was taken with hash sampling and may not match its source exactly\n", backup.ID)
+	}
+
 	restore := &Restore{
 		store:  cfg.Store,
 		backup: backup,
 		config: cfg,
 	}
 
-	if backup.BackupType == backupTypeDifferential {
-		// Ensure the full backup exists
-		lfb, err := cfg.Store.findLastFullBackupRecord(backup.VolumeID)
+	if cfg.LimitPositions < 0 {
+		return nil, fmt.Errorf("position limit must not be negative, got %d", cfg.LimitPositions)
+	}
+
+	if cfg.OnlyDiff != "" && backup.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("updating an existing image is not supported with %q chunking", backup.Chunking)
+	}
+
+	if cfg.LimitPositions > 0 && backup.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("limiting positions is not supported with %q chunking", backup.Chunking)
+	}
+
+	if checkpointing && backup.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("restore checkpoints are not supported with %q chunking", backup.Chunking)
+	}
+
+	if cfg.Resume {
+		cp, err := cfg.Store.findRestoreCheckpoint(backup.ID, restore.FullRestorePath())
 		if err != nil {
-			return nil, fmt.Errorf("error resolving last full backup record: %v", err)
+			return nil, fmt.Errorf("error resolving restore checkpoint: %v", err)
 		}
+		restore.checkpoint = cp
+	}
+
+	chain, err := cfg.Store.RestoreChain(backup.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving restore chain: %v", err)
+	}
+	restore.chain = chain
 
-		restore.lastFullBackup = lfb
+	if err := restore.checkChainDepth(); err != nil {
+		return nil, err
+	}
+
+	if cfg.BaseImagePath != "" {
+		if err := restore.checkBaseImage(); err != nil {
+			return nil, err
+		}
 	}
 
 	return restore, nil
 }
 
+// ChainDepthError is returned when restoring a backup would apply more backups than allowed.
+type ChainDepthError struct {
+	BackupID int
+	Depth    int
+	Max      int
+}
+
+func (e *ChainDepthError) Error() string {
+	return fmt.Sprintf("restoring backup %d requires a chain of %d backups, exceeding the maximum of %d: take a new full backup of the volume to shorten the chain", e.BackupID, e.Depth, e.Max)
+}
+
+// chainDepth returns the number of backups applied to restore the backup.
+func (r *Restore) chainDepth() int {
+	// Content-defined backups record their complete layout.
+	if r.backup.Chunking == ChunkingContentDefined {
+		return 1
+	}
+
+	return len(r.chain)
+}
+
+// checkChainDepth refuses restores that apply more backups than MaxRestoreChainDepth,
+// falling back to the store's policy when it isn't set.
+func (r *Restore) checkChainDepth() error {
+	limit := r.config.MaxRestoreChainDepth
+	if limit == 0 {
+		var err error
+		limit, err = r.store.MaxRestoreChainDepth()
+		if err != nil {
+			return fmt.Errorf("error resolving maximum restore chain depth: %v", err)
+		}
+	}
+
+	if depth := r.chainDepth(); limit > 0 && depth > limit {
+		return &ChainDepthError{BackupID: r.backup.ID, Depth: depth, Max: limit}
+	}
+
+	return nil
+}
+
 func (r *Restore) FullRestorePath() string {
 	return fmt.Sprintf("%s/%s", r.config.OutputDirectory, r.config.OutputFileName)
 }
 
 func (r *Restore) Run() error {
-	restoreTarget, err := os.OpenFile(r.FullRestorePath(), os.O_CREATE|os.O_WRONLY, 0644)
+	if r.config.OnlyDiff != "" {
+		return r.runOnlyDiff()
+	}
+
+	if r.config.Discard {
+		return r.runDiscard()
+	}
+
+	if r.config.Output != nil {
+		return r.runToOutput()
+	}
+
+	if r.config.MaxOutputFileSize > 0 {
+		return r.runToParts()
+	}
+
+	return r.runToFile(r.FullRestorePath(), r.config.OnExisting)
+}
+
+// runToOutput assembles the restore in a temporary file, then streams it to the configured Output.
+// Blocks are restored out of order, so the output can't be written to directly.
+func (r *Restore) runToOutput() error {
+	dir := r.config.OutputDirectory
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	tmp, err := os.CreateTemp(dir, "restore-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary restore file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	if err := r.runToFile(tmpPath, ExistingFileOverwrite); err != nil {
+		return err
+	}
+
+	restored, err := os.Open(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error opening temporary restore file: %v", err)
+	}
+	defer func() { _ = restored.Close() }()
+
+	if _, err := io.Copy(r.config.Output, restored); err != nil {
+		return fmt.Errorf("error writing restore to output: %v", err)
+	}
+
+	return nil
+}
+
+func (r *Restore) runToFile(path string, onExisting ExistingFilePolicy) error {
+	openTarget := openOutputFile
+	if r.config.Resume {
+		// Keep the blocks restored before the interruption.
+		openTarget = openResumeFile
+	}
+
+	restoreTarget, err := openTarget(path, onExisting)
 	if err != nil {
 		return fmt.Errorf("error opening restore file: %v", err)
 	}
 	defer func() { _ = restoreTarget.Close() }()
 
-	switch r.backup.BackupType {
-	case backupTypeFull:
-		return r.restoreFromBackup(restoreTarget, r.backup)
-	case backupTypeDifferential:
-		// Restore from the full backup first
-		if err := r.restoreFromBackup(restoreTarget, r.lastFullBackup); err != nil {
-			return fmt.Errorf("error restoring from full backup: %w", err)
+	if err := r.setupProgress(); err != nil {
+		return err
+	}
+
+	if r.config.BaseImagePath != "" {
+		if err := r.copyBaseImage(restoreTarget); err != nil {
+			return err
 		}
+	}
 
-		// Layer the differential backup on top
-		return r.restoreFromBackup(restoreTarget, r.backup)
+	if err := r.restoreTo(restoreTarget); err != nil {
+		return err
+	}
 
+	if err := r.extendSparseImage(restoreTarget); err != nil {
+		return err
+	}
+
+	if err := r.truncateToSize(restoreTarget); err != nil {
+		return err
+	}
+
+	r.progress.finish()
+
+	if r.config.CheckpointInterval > 0 || r.config.Resume {
+		if err := r.store.deleteRestoreCheckpoint(r.backup.ID, path); err != nil {
+			return fmt.Errorf("error removing restore checkpoint: %v", err)
+		}
+	}
+
+	// Close the restore target so the validation pass reads what was written.
+	if err := restoreTarget.Close(); err != nil {
+		return fmt.Errorf("error closing restore file: %v", err)
+	}
+
+	if r.config.Validate {
+		if err := r.validateFile(path); err != nil {
+			return err
+		}
+	}
+
+	if r.config.CompareTo != "" {
+		return r.compareFile(path)
+	}
+
+	return nil
+}
+
+// restoreTo restores the backup onto the target.
+func (r *Restore) restoreTo(target restoreTarget) error {
+	switch {
+	case r.config.Stream != nil:
+		return r.restoreStream(target)
+	case r.backup.Chunking == ChunkingContentDefined:
+		return r.restoreContentDefined(target)
+	case r.backup.BackupType == backupTypeFull:
+		return r.restoreFull(target)
+	case r.backup.BackupType == backupTypeDifferential:
+		return r.restoreChain(target)
 	default:
 		return fmt.Errorf("backup type %s is not supported", r.backup.BackupType)
 	}
 }
 
-func (r *Restore) restoreFromBackup(target *os.File, backup BackupRecord) error {
-	source, err := os.Open(backup.FullPath)
+// restoreChain layers each backup of the restore chain onto the target in order, skipping the
+// layers an interrupted restore already moved past.
+func (r *Restore) restoreChain(target restoreTarget) error {
+	start := 0
+	if r.config.BaseImagePath != "" {
+		// The base image stands in for the full backup.
+		start = 1
+	}
+	for i, layer := range r.chain {
+		if r.checkpoint != nil && r.checkpoint.layerBackupID == layer.ID {
+			start = i
+		}
+	}
+
+	for _, layer := range r.chain[start:] {
+		if err := r.restoreFromBackup(target, layer); err != nil {
+			if layer.ID == r.backup.ID {
+				return err
+			}
+			return fmt.Errorf("error restoring from %s backup: %w", layer.BackupType, err)
+		}
+	}
+
+	return nil
+}
+
+// setupProgress sizes the progress tracker using the number of positions that will be written.
+func (r *Restore) setupProgress() error {
+	if r.config.Progress == nil && r.config.ProgressReport == nil {
+		return nil
+	}
+
+	// Content-defined backups record their complete layout.
+	layers := r.chain
+	if r.backup.Chunking == ChunkingContentDefined {
+		layers = []BackupRecord{r.backup}
+	}
+	if r.config.BaseImagePath != "" {
+		layers = r.chain[1:]
+	}
+
+	total := 0
+	for _, layer := range layers {
+		var count int
+		row := r.store.QueryRow("SELECT COALESCE(SUM(run_length), 0) FROM block_positions WHERE backup_id = ?", layer.ID)
+		if err := row.Scan(&count); err != nil {
+			return fmt.Errorf("error counting block positions: %w", err)
+		}
+		total += count
+	}
+
+	r.progress = newProgressTracker(r.reportProgress(), total)
+
+	return nil
+}
+
+// reportProgress returns the callback the progress tracker reports to, passing each update to
+// Progress and, with the throughput and estimated time remaining, to ProgressReport.
+func (r *Restore) reportProgress() ProgressFunc {
+	if r.config.ProgressReport == nil {
+		return r.config.Progress
+	}
+
+	eta := newETAEstimator()
+	return func(completed, total int) {
+		if r.config.Progress != nil {
+			r.config.Progress(completed, total)
+		}
+
+		bytes := int64(completed) * int64(r.backup.BlockSize)
+		perSecond, remaining, ok := eta.observe(time.Now(), bytes, int64(total)*int64(r.backup.BlockSize))
+		r.config.ProgressReport(RestoreProgress{
+			Completed:      completed,
+			Total:          total,
+			BytesRestored:  bytes,
+			BytesPerSecond: perSecond,
+			Remaining:      remaining,
+			Estimating:     !ok,
+		})
+	}
+}
+
+func (r *Restore) restoreFromBackup(target restoreTarget, backup BackupRecord) error {
+	if r.backupFileMissing(backup) {
+		return r.restoreFromOtherFiles(target, backup)
+	}
+
+	source, closeSource, err := r.openBackupData(backup)
 	if err != nil {
 		return fmt.Errorf("error opening restore source file: %v", err)
 	}
-	defer func() { _ = source.Close() }()
+	defer closeSource()
+
+	return r.restoreFromReader(target, source, backup.FullPath, backup)
+}
 
-	// Count the total number of unique blocks in the backup
+// openBackupData opens the backup's data for sequential reading, preferring the data supplied in
+// Sources, then the configured Storage for backups cataloged as remote.
+func (r *Restore) openBackupData(backup BackupRecord) (io.Reader, func(), error) {
+	if source, ok := r.config.Sources[backup.ID]; ok {
+		return io.NewSectionReader(source, 0, math.MaxInt64), func() {}, nil
+	}
+
+	if backup.RemoteKey != "" {
+		if r.config.Storage == nil {
+			return nil, nil, fmt.Errorf("backup %d is stored remotely as %s, but no storage is configured", backup.ID, backup.RemoteKey)
+		}
+
+		source, err := r.config.Storage.Open(backup.RemoteKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return source, func() { _ = source.Close() }, nil
+	}
+
+	source, closer, err := openForRead(backup.FullPath, r.config.DirectIO)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return io.NewSectionReader(source, 0, math.MaxInt64), func() { _ = closer.Close() }, nil
+}
+
+// restoreFromReader restores the backup's blocks from its sequential backup stream.
+// The name identifies the stream in errors.
+func (r *Restore) restoreFromReader(target restoreTarget, source io.Reader, name string, backup BackupRecord) error {
+	// Reverse the backup's filter if one is configured.
+	reader := source
+	if len(r.config.FilterCommand) > 0 {
+		filter, err := newFilterReader(r.config.FilterCommand, source)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = filter.Close() }()
+		reader = filter
+	}
+
+	// Count the total number of unique blocks stored in the backup file
 	var totalUniqueBlocks int
-	row := r.store.QueryRow("SELECT COUNT(DISTINCT block_id) FROM block_positions WHERE backup_id = ?", backup.ID)
+	row := r.store.QueryRow("SELECT COUNT(DISTINCT b.id) FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND b.hash NOT LIKE 'fill:%'", backup.ID)
 	if err := row.Scan(&totalUniqueBlocks); err != nil {
 		return fmt.Errorf("error counting unique blocks: %w", err)
 	}
 
-	for blockNum := 0; blockNum < totalUniqueBlocks; blockNum++ {
-		// Read block data from the source file
-		// TODO - Rework this to use readblocks.
-		blockData, err := readBlock(source, totalUniqueBlocks, backup.BlockSize, blockNum)
-		if err != nil {
-			return fmt.Errorf("error reading block at position %d: %w", blockNum, err)
+	// Skip the blocks an interrupted restore already restored from this layer.
+	start := 0
+	if r.checkpoint != nil && r.checkpoint.layerBackupID == backup.ID {
+		start = min(r.checkpoint.blocksRestored, totalUniqueBlocks)
+		if err := skipBytes(reader, start*backup.BlockSize); err != nil {
+			return fmt.Errorf("error skipping restored blocks: %w", err)
 		}
+	}
 
-		// Calculate the hash
-		hash := calculateBlockHash(blockData)
+	finalLength, err := r.finalBlockLength(backup)
+	if err != nil {
+		return err
+	}
 
-		// Query the database for the block positions tied to the hash
-		rows, err := r.store.Query("SELECT position from block_positions bp JOIN blocks b ON bp.block_id = b.id where bp.backup_id = ? AND b.hash = ?", backup.ID, hash)
-		if err != nil {
-			return fmt.Errorf("error quering block positions for hash %s: %w", hash, err)
+	index := newBlockPositionIndex(r.store, backup.ID)
+	if r.positionWindow > 0 {
+		index.window = r.positionWindow
+	}
+	read := func(blockNum int) restoredBlock {
+		length := backup.BlockSize
+		if blockNum == totalUniqueBlocks-1 {
+			length = finalLength
 		}
+		return r.readRestoredBlock(reader, index, name, backup, blockNum, totalUniqueBlocks, length)
+	}
 
-		// Iterate over each block position and write the block data to the restore file
-		for rows.Next() {
-			if rows.Err() != nil {
-				return fmt.Errorf("error reading block positions: %w", rows.Err())
-			}
-			var pos int
-			if err := rows.Scan(&pos); err != nil {
-				return fmt.Errorf("failed to scan position: %w", err)
+	if r.config.Pipeline {
+		if err := r.restorePipelined(target, backup, start, totalUniqueBlocks, read); err != nil {
+			return err
+		}
+	} else {
+		for blockNum := start; blockNum < totalUniqueBlocks; blockNum++ {
+			block := read(blockNum)
+			if block.err != nil {
+				return block.err
 			}
 
-			_, err = target.WriteAt(blockData, int64(pos*backup.BlockSize))
-			if err != nil {
-				return fmt.Errorf("error writing to restore file: %v", err)
+			if err := r.writeRestoredBlock(target, backup, block); err != nil {
+				return err
 			}
 		}
-		rows.Close()
+	}
+
+	if filter, ok := reader.(*filterReader); ok {
+		if err := filter.Close(); err != nil {
+			return err
+		}
+	}
+
+	return r.restoreFillBlocks(target, backup)
+}
+
+// finalBlockLength returns the length of the last block stored in the backup's file. It's short
+// when it holds the end of a source that isn't a multiple of the block size, and is read at its
+// exact length so the footer following the blocks isn't mistaken for block data.
+func (r *Restore) finalBlockLength(backup BackupRecord) (int, error) {
+	partial := backup.SizeInBytes % backup.BlockSize
+	if partial == 0 || backup.Chunking == ChunkingContentDefined {
+		return backup.BlockSize, nil
+	}
+
+	// Blocks are stored in position order, so the partial block is stored last when the backup
+	// records the final position.
+	var count int
+	row := r.store.QueryRow("SELECT COUNT(*) FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND "+blockPosition+" = ? AND b.hash NOT LIKE 'fill:%'", backup.ID, backup.TotalBlocks-1)
+	if err := row.Scan(&count); err != nil {
+		return 0, fmt.Errorf("error finding final block: %w", err)
+	}
+
+	if count == 0 {
+		return backup.BlockSize, nil
+	}
+
+	return partial, nil
+}
+
+// beyondLimit reports whether the position is past the configured LimitPositions.
+func (r *Restore) beyondLimit(pos int) bool {
+	return r.config.LimitPositions > 0 && pos >= r.config.LimitPositions
+}
+
+// restoredSize returns the length of the restored output, which is truncated to the positions
+// restored when LimitPositions is set.
+func (r *Restore) restoredSize() int64 {
+	size := int64(r.backup.SizeInBytes)
+	if r.config.LimitPositions > 0 {
+		size = min(size, int64(r.config.LimitPositions)*int64(r.backup.BlockSize))
+	}
+
+	return size
+}
+
+// truncateToSize sizes the restored file to the backup's recorded size. Anything written past it
+// is dropped, such as the full's positions beyond the end of a differential taken after the volume
+// shrank, or what an existing restore target held past the positions restored with LimitPositions.
+// A shorter file means positions weren't restored, and is reported as an error.
+func (r *Restore) truncateToSize(target *os.File) error {
+	info, err := target.Stat()
+	if err != nil {
+		return fmt.Errorf("error inspecting restore file: %v", err)
+	}
+
+	size := r.restoredSize()
+	switch {
+	case info.Size() < size:
+		return fmt.Errorf("restored file is %d bytes, but backup %d is %d bytes", info.Size(), r.backup.ID, size)
+	case info.Size() > size:
+		if err := target.Truncate(size); err != nil {
+			return fmt.Errorf("error truncating restore file: %v", err)
+		}
 	}
 
 	return nil
 }
 
-// Deprecated - instead.
-func readBlock(disk *os.File, totalBlocks, blockSize, blockNum int) ([]byte, error) {
-	buffer := make([]byte, blockSize)
-	offset := int64(blockSize * blockNum)
+// restorePipelineDepth is the number of blocks the pipelined restore reads ahead of its writes.
+const restorePipelineDepth = 8
+
+// restoredBlock is a block read from a backup stream, along with the positions it's restored to.
+type restoredBlock struct {
+	blockNum  int
+	data      []byte
+	positions []int
+	err       error
+}
+
+// readRestoredBlock reads the next block of length bytes from the backup stream and looks up the
+// positions it's restored to in the index. The block is the blockNum'th of the total stored in
+// the stream.
+func (r *Restore) readRestoredBlock(reader io.Reader, index *blockPositionIndex, name string, backup BackupRecord, blockNum, total, length int) restoredBlock {
+	// Read the next block from the backup stream
+	blockData, err := readNextBlock(reader, length)
+	switch {
+	case err == io.EOF:
+		return restoredBlock{err: &TruncatedBackupError{Path: name, Expected: total, Actual: blockNum}}
+	case err != nil:
+		return restoredBlock{err: fmt.Errorf("error reading block at position %d: %w", blockNum, err)}
+	case len(blockData) < length:
+		return restoredBlock{err: &TruncatedBackupError{Path: name, Expected: total, Actual: blockNum}}
+	}
+
+	// Calculate the hash
+	hash := backup.HashAlgorithm.sum(blockData)
+	if backup.HashSample {
+		hash = sampleBlockHash(blockData)
+	}
+
+	// Look up the block positions tied to the hash
+	positions, err := index.lookup(blockNum, hash)
+	if err != nil {
+		return restoredBlock{err: err}
+	}
 
-	endRange := blockSize*blockNum + blockSize
-	endOfFile := blockSize * totalBlocks
-	if endRange > endOfFile {
-		endRange = endOfFile
-		trimmedBlockSize := endRange - blockSize*blockNum
-		if trimmedBlockSize <= 0 {
-			return nil, io.EOF
+	return restoredBlock{blockNum: blockNum, data: blockData, positions: positions}
+}
+
+// writeRestoredBlock writes the block to each of its positions in the target, checkpointing the
+// restore every CheckpointInterval blocks.
+func (r *Restore) writeRestoredBlock(target restoreTarget, backup BackupRecord, block restoredBlock) error {
+	if r.crashAfter > 0 && r.blocksRestored == r.crashAfter {
+		return errSimulatedCrash
+	}
+
+	for _, pos := range block.positions {
+		if r.beyondLimit(pos) {
+			continue
+		}
+
+		if err := r.writeAt(target, block.data, int64(pos*backup.BlockSize)); err != nil {
+			return err
 		}
-		buffer = make([]byte, trimmedBlockSize)
+
+		r.progress.add(1)
 	}
 
-	_, err := disk.Seek(offset, 0)
+	r.blocksRestored++
+	if interval := r.config.CheckpointInterval; interval > 0 && (block.blockNum+1)%interval == 0 {
+		if err := r.saveCheckpoint(target, backup, block.blockNum+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restorePipelined restores blocks start through total-1 using a reader goroutine that fetches
+// blocks and their positions while the calling goroutine writes them, overlapping the I/O.
+func (r *Restore) restorePipelined(target restoreTarget, backup BackupRecord, start, total int, read func(int) restoredBlock) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	depth := restorePipelineDepth
+	if r.config.Concurrency > 0 {
+		depth = r.config.Concurrency
+	}
+	blocks := make(chan restoredBlock, depth)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(blocks)
+		for blockNum := start; blockNum < total; blockNum++ {
+			block := read(blockNum)
+			select {
+			case blocks <- block:
+			case <-done:
+				return
+			}
+
+			// Read errors are sent as the final block.
+			if block.err != nil {
+				return
+			}
+		}
+	}()
+
+	for block := range blocks {
+		if block.err != nil {
+			return block.err
+		}
+
+		if err := r.writeRestoredBlock(target, backup, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreFull restores a full backup, copying the backup file straight to the target when
+// its blocks are stored in position order.
+func (r *Restore) restoreFull(target restoreTarget) error {
+	sequential, err := r.isSequential(r.backup)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// Checkpoints track blocks restored through the general path.
+	checkpointing := r.config.CheckpointInterval > 0 || r.config.Resume
+	// Copying the file would allocate its zeroed blocks.
+	sparse := r.config.OutputImageFormat == ImageFormatRawSparse
+	if !sequential || r.disableFastPath || checkpointing || sparse || r.backupFileMissing(r.backup) {
+		return r.restoreFromBackup(target, r.backup)
 	}
-	_, err = disk.Read(buffer)
+
+	source, closeSource, err := r.openBackupData(r.backup)
 	if err != nil {
+		return fmt.Errorf("error opening restore source file: %v", err)
+	}
+	defer closeSource()
+
+	n, err := io.CopyN(io.NewOffsetWriter(target, 0), source, r.restoredSize())
+	switch {
+	case err == io.EOF:
+		return &TruncatedBackupError{Path: r.backup.FullPath, Expected: r.backup.TotalBlocks, Actual: int(n) / r.backup.BlockSize}
+	case err != nil:
+		return fmt.Errorf("error writing to restore file: %v", err)
+	}
+
+	r.progress.add(r.backup.TotalBlocks)
+
+	return nil
+}
+
+// isSequential reports whether the backup file holds every block of the backup exactly once
+// in position order, so it's byte-for-byte the restored output.
+func (r *Restore) isSequential(backup BackupRecord) (bool, error) {
+	// Filtered backup files don't hold the blocks as-is.
+	if len(r.config.FilterCommand) > 0 || backup.TotalBlocks == 0 {
+		return false, nil
+	}
+
+	var positions, distinctPositions, distinctBlocks, fills int
+	var minPos, maxPos sql.NullInt64
+	row := r.store.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT `+blockPosition+`), COUNT(DISTINCT b.id), MIN(`+blockPosition+`), MAX(`+blockPosition+`),
+		COALESCE(SUM(CASE WHEN b.hash LIKE 'fill:%' THEN 1 ELSE 0 END), 0)
+		FROM block_positions bp JOIN blocks b ON `+positionRange+` WHERE bp.backup_id = ?`, backup.ID)
+	if err := row.Scan(&positions, &distinctPositions, &distinctBlocks, &minPos, &maxPos, &fills); err != nil {
+		return false, fmt.Errorf("error inspecting block positions: %w", err)
+	}
+
+	// Each position holds its own block, with no holes or descriptors.
+	total := backup.TotalBlocks
+	if positions != total || distinctPositions != total || distinctBlocks != total || fills != 0 ||
+		minPos.Int64 != 0 || maxPos.Int64 != int64(total-1) {
+		return false, nil
+	}
+
+	// Blocks already stored by an earlier backup aren't written again, which would leave the file
+	// short, with its footer read as block data.
+	var stored int
+	row = r.store.QueryRow(`SELECT COUNT(DISTINCT b.id) FROM block_positions bp JOIN blocks b ON `+positionRange+` WHERE bp.backup_id = ?
+		AND NOT EXISTS (SELECT 1 FROM block_positions op WHERE op.backup_id < ? AND b.id BETWEEN op.block_id AND op.block_id + op.run_length - 1)`, backup.ID, backup.ID)
+	if err := row.Scan(&stored); err != nil {
+		return false, fmt.Errorf("error counting stored blocks: %w", err)
+	}
+
+	return stored == total, nil
+}
+
+// TruncatedBackupError is returned when a backup file holds fewer blocks than its catalog records.
+type TruncatedBackupError struct {
+	Path     string
+	Expected int
+	Actual   int
+}
+
+func (e *TruncatedBackupError) Error() string {
+	return fmt.Sprintf("backup file %s truncated: expected %d unique blocks, file holds %d (%d missing)", e.Path, e.Expected, e.Actual, e.Expected-e.Actual)
+}
+
+// readNextBlock reads the next block from the sequential backup stream.
+// The final block of a stream may be shorter than the block size.
+func readNextBlock(reader io.Reader, blockSize int) ([]byte, error) {
+	buffer := make([]byte, blockSize)
+	n, err := io.ReadFull(reader, buffer)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		return buffer[:n], nil
+	case err != nil:
 		return nil, err
 	}
 
@@ -1,10 +1,15 @@
 package block
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -187,3 +192,885 @@ func fileChecksum(filePath string) (string, error) {
 
 	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
+
+func TestRestoreTruncatedBackup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a partial copy that cut off midway through the 19th block.
+	if err := os.Truncate(b.FullPath(), 18*1048576+100); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     b.Record.FileName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore.Run()
+	if err == nil {
+		t.Fatal("expected restore of a truncated backup to fail")
+	}
+
+	var truncated *TruncatedBackupError
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected a truncated backup error, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "expected 37 unique blocks, file holds 18") {
+		t.Fatalf("unexpected error message: %v", err)
+	}
+}
+
+func TestRestoreValidate(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     b.Record.FileName,
+		Validate:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A good restore passes validation.
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a bad write landing in the middle of position 7.
+	target, err := os.OpenFile(restore.FullRestorePath(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.WriteAt([]byte("corrupted"), 7*1048576+512); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore.Validate()
+	if err == nil {
+		t.Fatal("expected validation to catch the corrupted block")
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	if len(validationErr.Positions) != 1 || validationErr.Positions[0] != 7 {
+		t.Fatalf("expected position 7 to be reported, got %v", validationErr.Positions)
+	}
+}
+
+func TestRestoreToOutput(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pipe the restore into a hasher, as with `bd backup restore --to-stdout | sha256sum`.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashed := make(chan string)
+	go func() {
+		hasher := sha256.New()
+		_, _ = io.Copy(hasher, pr)
+		hashed <- fmt.Sprintf("%x", hasher.Sum(nil))
+	}()
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		Output:             pw,
+		Validate:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_ = pw.Close()
+
+	if checksum := <-hashed; checksum != fullBackupChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", fullBackupChecksum, checksum)
+	}
+
+	// The temporary restore file is removed once streamed.
+	entries, err := os.ReadDir("restores/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("expected no files left in the restore directory, got %d", len(entries))
+	}
+}
+
+// backupRandomSource backs up a source of random data, so every block is unique.
+func backupRandomSource(tb testing.TB, store *Store, size int) (*Backup, string) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		tb.Fatal(err)
+	}
+
+	sourcePath := filepath.Join(tb.TempDir(), "random.img")
+	if err := os.WriteFile(sourcePath, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      sourcePath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       65536,
+		BlockBufferSize: 16,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return b, fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func TestRestoreFastPath(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, checksum := backupRandomSource(t, store, 8*1048576)
+
+	// pg.ext4 holds duplicate blocks, so it must take the general path.
+	dup, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dup.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		backup     *Backup
+		checksum   string
+		sequential bool
+	}{
+		{backup: b, checksum: checksum, sequential: true},
+		{backup: dup, checksum: fullBackupChecksum, sequential: false},
+	}
+
+	for _, test := range tests {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     test.backup.Record.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     test.backup.Record.FileName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sequential, err := restore.isSequential(restore.backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sequential != test.sequential {
+			t.Fatalf("expected backup %d sequential to be %t, got %t", test.backup.Record.ID, test.sequential, sequential)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		targetChecksum, err := fileChecksum(restore.FullRestorePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if targetChecksum != test.checksum {
+			t.Fatalf("expected checksums to match, got %s and %s", test.checksum, targetChecksum)
+		}
+	}
+
+	// A full of a copy of the source stores none of its blocks, as they're all in b's file.
+	data, err := os.ReadFile(b.Config.DevicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyPath := filepath.Join(t.TempDir(), "copy.img")
+	if err := os.WriteFile(copyPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deduped, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      copyPath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       65536,
+		BlockBufferSize: 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deduped.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     deduped.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     deduped.Record.FileName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequential, err := restore.isSequential(restore.backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sequential {
+		t.Fatal("expected a backup whose blocks are stored in another file not to be sequential")
+	}
+}
+
+func BenchmarkRestoreFull(b *testing.B) {
+	store, err := NewStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(b)
+
+	backup, _ := backupRandomSource(b, store, 32*1048576)
+
+	for _, fastPath := range []bool{true, false} {
+		name := "general"
+		if fastPath {
+			name = "fast"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(backup.Record.SizeInBytes))
+			for i := 0; i < b.N; i++ {
+				restore, err := NewRestore(RestoreConfig{
+					Store:              store,
+					RestoreInputFormat: RestoreInputFormatFile,
+					SourceBackupID:     backup.Record.ID,
+					OutputDirectory:    "restores/",
+					OutputFileName:     "bench",
+					OnExisting:         ExistingFileOverwrite,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				restore.disableFastPath = !fastPath
+
+				if err := restore.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreFromMemory(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Load the backups into memory and remove their files, so only the buffers can be read.
+	sources := map[int]io.ReaderAt{}
+	for _, b := range []*Backup{fb, db} {
+		data, err := os.ReadFile(b.FullPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(b.FullPath()); err != nil {
+			t.Fatal(err)
+		}
+
+		sources[b.Record.ID] = bytes.NewReader(data)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     db.Record.FileName,
+		Sources:            sources,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	targetChecksum, err := fileChecksum(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffWithChangesChecksum != targetChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", diffWithChangesChecksum, targetChecksum)
+	}
+}
+
+func TestRestoreMaxChainDepth(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	newRestore := func(backupID, maxDepth int) error {
+		_, err := NewRestore(RestoreConfig{
+			Store:                store,
+			RestoreInputFormat:   RestoreInputFormatFile,
+			SourceBackupID:       backupID,
+			OutputDirectory:      "restores/",
+			OutputFileName:       "chain",
+			MaxRestoreChainDepth: maxDepth,
+		})
+		return err
+	}
+
+	// The differential's chain holds the full and the differential.
+	var depthErr *ChainDepthError
+	if err := newRestore(db.Record.ID, 1); !errors.As(err, &depthErr) {
+		t.Fatalf("expected a chain depth error, got %v", err)
+	}
+
+	if depthErr.Depth != 2 || depthErr.Max != 1 || !strings.Contains(depthErr.Error(), "take a new full backup") {
+		t.Fatalf("expected a depth of 2 exceeding 1 with guidance, got %q", depthErr)
+	}
+
+	if err := newRestore(fb.Record.ID, 1); err != nil {
+		t.Fatalf("expected the full backup to be within the limit, got %v", err)
+	}
+
+	// The store's policy applies when the restore doesn't set a limit.
+	if err := store.SetMaxRestoreChainDepth(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newRestore(db.Record.ID, 0); !errors.As(err, &depthErr) {
+		t.Fatalf("expected the store policy to refuse the restore, got %v", err)
+	}
+
+	if err := newRestore(db.Record.ID, 2); err != nil {
+		t.Fatalf("expected the restore's limit to override the store policy, got %v", err)
+	}
+
+	if err := newRestore(db.Record.ID, -1); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Fatalf("expected a negative limit to be rejected, got %v", err)
+	}
+}
+
+func TestPipelinedRestore(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		backup   *Backup
+		checksum string
+	}{
+		{backup: b, checksum: fullBackupChecksum},
+		{backup: db, checksum: diffWithChangesChecksum},
+	}
+
+	for _, test := range tests {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     test.backup.Record.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     test.backup.Record.FileName,
+			Pipeline:           true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), test.checksum)
+	}
+
+	// Read errors surface through the pipeline.
+	if err := os.Truncate(b.FullPath(), int64(5*b.Record.BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "truncated",
+		Pipeline:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var truncated *TruncatedBackupError
+	if err := restore.Run(); !errors.As(err, &truncated) {
+		t.Fatalf("expected truncated backup error, got %v", err)
+	}
+
+	if truncated.Actual != 5 {
+		t.Errorf("expected 5 blocks to be read, got %d", truncated.Actual)
+	}
+}
+
+func BenchmarkRestorePipeline(b *testing.B) {
+	store, err := NewStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(b)
+
+	backup, _ := backupRandomSource(b, store, 32*1048576)
+
+	for _, pipeline := range []bool{false, true} {
+		name := "serial"
+		if pipeline {
+			name = "pipelined"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(backup.Record.SizeInBytes))
+			for i := 0; i < b.N; i++ {
+				restore, err := NewRestore(RestoreConfig{
+					Store:              store,
+					RestoreInputFormat: RestoreInputFormatFile,
+					SourceBackupID:     backup.Record.ID,
+					OutputDirectory:    "restores/",
+					OutputFileName:     "bench",
+					OnExisting:         ExistingFileOverwrite,
+					Pipeline:           pipeline,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				restore.disableFastPath = true
+
+				if err := restore.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreLimitPositions(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	const limit = 5
+	cases := []struct {
+		name     string
+		backupID int
+		source   string
+		pipeline bool
+	}{
+		{"full", fb.Record.ID, "assets/pg.ext4", false},
+		{"differential", db.Record.ID, "assets/pg_altered.ext4", false},
+		{"pipelined", db.Record.ID, "assets/pg_altered.ext4", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			restore, err := NewRestore(RestoreConfig{
+				Store:              store,
+				RestoreInputFormat: RestoreInputFormatFile,
+				SourceBackupID:     tc.backupID,
+				OutputDirectory:    "restores/",
+				OutputFileName:     "limited-" + tc.name,
+				LimitPositions:     limit,
+				Pipeline:           tc.pipeline,
+				Validate:           true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := restore.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			restored, err := os.ReadFile(restore.FullRestorePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			source, err := os.ReadFile(tc.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(restored) != limit*cfg.BlockSize {
+				t.Fatalf("expected %d bytes, got %d", limit*cfg.BlockSize, len(restored))
+			}
+
+			if !bytes.Equal(restored, source[:limit*cfg.BlockSize]) {
+				t.Fatalf("expected the output to hold the first %d blocks of %s", limit, tc.source)
+			}
+		})
+	}
+}
+
+func TestRestoreSizeChangingDifferential(t *testing.T) {
+	original, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	altered, err := os.ReadFile("assets/pg_altered.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := make([]byte, 2*1048576+4096)
+	if _, err := rand.Read(extra); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, source := range map[string][]byte{
+		"shrunk": altered[:30*1048576+12345],
+		"grown":  append(append([]byte{}, original...), extra...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenStore(filepath.Join(dir, "backups.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			if err := store.SetupDB(); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &BackupConfig{
+				Store:           store,
+				DevicePath:      "assets/pg.ext4",
+				OutputFormat:    BackupOutputFormatFile,
+				OutputDirectory: dir,
+				BlockSize:       1048576,
+				BlockBufferSize: 5,
+			}
+
+			fb, err := NewBackup(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fb.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Take the differential of the same volume after it changed size.
+			cfg.Source = bytes.NewReader(source)
+			db, err := NewBackup(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			restore, err := NewRestore(RestoreConfig{
+				Store:              store,
+				RestoreInputFormat: RestoreInputFormatFile,
+				SourceBackupID:     db.Record.ID,
+				OutputDirectory:    dir,
+				OutputFileName:     "restored",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := restore.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			restored, err := os.ReadFile(restore.FullRestorePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(restored) != len(source) {
+				t.Fatalf("expected the restored file to be %d bytes, got %d", len(source), len(restored))
+			}
+
+			if !bytes.Equal(restored, source) {
+				t.Fatal("expected the restored file to match the resized source")
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package block
+
+import "fmt"
+
+// BackupResult summarizes a completed backup.
+type BackupResult struct {
+	BackupID          int    `json:"backup_id"`
+	FilePath          string `json:"file_path"`
+	BackupSizeInBytes int    `json:"backup_size_bytes"`
+	SourceSizeInBytes int    `json:"source_size_bytes"`
+	SpaceSavedInBytes int    `json:"space_saved_bytes"`
+	BlocksEvaluated   int    `json:"blocks_evaluated"`
+	BlocksWritten     int    `json:"blocks_written"`
+	DurationMs        int64  `json:"duration_ms"`
+	// BlockBufferSize is the number of blocks buffered at once, which is the size an adaptive
+	// buffer settled on when BlockBufferSizeAuto was used.
+	BlockBufferSize int `json:"block_buffer_size"`
+	// Approximate is set when the backup used hash sampling. Sampling only hashes part of each
+	// block, which is faster on large blocks, but a block changed outside the sampled regions is
+	// treated as unchanged and its old contents are restored.
+	Approximate bool `json:"approximate"`
+}
+
+// Result returns the summary of the backup. It must be called after Run.
+func (b *Backup) Result() (BackupResult, error) {
+	blocksWritten, err := b.store.UniqueBlocksInBackup(b.Record.ID)
+	if err != nil {
+		return BackupResult{}, fmt.Errorf("error getting unique blocks: %v", err)
+	}
+
+	sourceSize, err := sourceSizeInBytes(b.Config)
+	if err != nil {
+		return BackupResult{}, fmt.Errorf("error getting device size: %v", err)
+	}
+
+	bufferSize := b.Config.BlockBufferSize
+	if b.bufferBlocks > 0 {
+		bufferSize = b.bufferBlocks
+	}
+
+	return BackupResult{
+		BackupID:          b.Record.ID,
+		FilePath:          b.FullPath(),
+		BackupSizeInBytes: b.Record.SizeInBytes,
+		SourceSizeInBytes: sourceSize,
+		SpaceSavedInBytes: sourceSize - b.Record.SizeInBytes,
+		BlocksEvaluated:   b.TotalBlocks(),
+		BlocksWritten:     blocksWritten,
+		DurationMs:        b.Record.Duration.Milliseconds(),
+		BlockBufferSize:   bufferSize,
+		Approximate:       b.Record.HashSample,
+	}, nil
+}
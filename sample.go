@@ -0,0 +1,37 @@
+package block
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cespare/xxhash"
+)
+
+// sampledBlockPrefix identifies hashes computed over a sample of the block rather than all of it.
+// Keeping them distinct from full hashes prevents sampled and fully hashed blocks from being
+// deduplicated against each other.
+const sampledBlockPrefix = "sample:"
+
+// hashSampleSize is the number of bytes hashed from each sampled region of a block.
+const hashSampleSize = 1024
+
+// sampleBlockHash hashes the first, middle and last hashSampleSize bytes of the block along with
+// its length. Blocks no larger than three samples are hashed in full.
+func sampleBlockHash(data []byte) string {
+	d := xxhash.New()
+	if len(data) <= 3*hashSampleSize {
+		_, _ = d.Write(data)
+	} else {
+		mid := (len(data) - hashSampleSize) / 2
+		_, _ = d.Write(data[:hashSampleSize])
+		_, _ = d.Write(data[mid : mid+hashSampleSize])
+		_, _ = d.Write(data[len(data)-hashSampleSize:])
+	}
+	_, _ = fmt.Fprintf(d, ":%d", len(data))
+
+	return sampledBlockPrefix + formatSum64(d.Sum64())
+}
+
+func isSampledBlock(hash string) bool {
+	return strings.HasPrefix(hash, sampledBlockPrefix)
+}
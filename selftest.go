@@ -0,0 +1,84 @@
+package block
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SelfTestResult is the outcome of a self-test run.
+type SelfTestResult struct {
+	// SourceChecksum is the sha256 checksum of the source device.
+	SourceChecksum string
+	// RestoreChecksum is the sha256 checksum of the restored output.
+	RestoreChecksum string
+	// Passed reports whether the checksums match.
+	Passed bool
+}
+
+// SelfTest performs a full backup of the device, restores it to a temporary location and
+// compares the checksums end to end. The backup is recorded in a temporary store, so the
+// catalog is left untouched, and all temporary files are removed on return.
+func SelfTest(devicePath string, blockSize, blockBufferSize int) (SelfTestResult, error) {
+	tmpDir, err := os.MkdirTemp("", "bd-selftest-")
+	if err != nil {
+		return SelfTestResult{}, err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	store, err := OpenStore(filepath.Join(tmpDir, "selftest.db"))
+	if err != nil {
+		return SelfTestResult{}, fmt.Errorf("error creating store: %v", err)
+	}
+	defer func() { _ = store.Close() }()
+
+	if err := store.SetupDB(); err != nil {
+		return SelfTestResult{}, fmt.Errorf("error setting up database: %v", err)
+	}
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      devicePath,
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: tmpDir,
+		BlockSize:       blockSize,
+		BlockBufferSize: blockBufferSize,
+	})
+	if err != nil {
+		return SelfTestResult{}, fmt.Errorf("error creating backup: %v", err)
+	}
+
+	if err := b.Run(); err != nil {
+		return SelfTestResult{}, fmt.Errorf("error performing backup: %v", err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     b.Record.ID,
+		OutputDirectory:    tmpDir,
+		OutputFileName:     "restored",
+	})
+	if err != nil {
+		return SelfTestResult{}, fmt.Errorf("error creating restore: %v", err)
+	}
+
+	if err := restore.Run(); err != nil {
+		return SelfTestResult{}, fmt.Errorf("error performing restore: %v", err)
+	}
+
+	var result SelfTestResult
+	result.SourceChecksum, err = fileSHA256(devicePath)
+	if err != nil {
+		return SelfTestResult{}, fmt.Errorf("error calculating source checksum: %v", err)
+	}
+
+	result.RestoreChecksum, err = fileSHA256(restore.FullRestorePath())
+	if err != nil {
+		return SelfTestResult{}, fmt.Errorf("error calculating restore checksum: %v", err)
+	}
+
+	result.Passed = result.SourceChecksum == result.RestoreChecksum
+
+	return result, nil
+}
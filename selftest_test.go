@@ -0,0 +1,20 @@
+package block
+
+import (
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	result, err := SelfTest("assets/pg.ext4", 1048576, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Passed {
+		t.Fatalf("expected self-test to pass, got source %s and restore %s", result.SourceChecksum, result.RestoreChecksum)
+	}
+
+	if result.SourceChecksum != fullBackupChecksum {
+		t.Fatalf("expected source checksum to be %s, got %s", fullBackupChecksum, result.SourceChecksum)
+	}
+}
@@ -0,0 +1,135 @@
+package block
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// settingMaxRestoreChainDepth is the settings key of the store's maximum restore chain depth.
+const settingMaxRestoreChainDepth = "max_restore_chain_depth"
+
+func (s Store) setting(key string) (string, bool, error) {
+	var value string
+	err := s.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", false, nil
+	case err != nil:
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+func (s Store) setSetting(key, value string) error {
+	_, err := s.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+// MaxRestoreChainDepth returns the maximum number of backups a restore may apply, or zero if unlimited.
+func (s Store) MaxRestoreChainDepth() (int, error) {
+	value, ok, err := s.setting(settingMaxRestoreChainDepth)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	depth, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s setting %q: %v", settingMaxRestoreChainDepth, value, err)
+	}
+
+	return depth, nil
+}
+
+// SetMaxRestoreChainDepth sets the maximum number of backups a restore may apply when the
+// restore doesn't specify its own limit. Zero removes the limit.
+func (s Store) SetMaxRestoreChainDepth(depth int) error {
+	if depth < 0 {
+		return fmt.Errorf("maximum restore chain depth must not be negative, got %d", depth)
+	}
+
+	return s.setSetting(settingMaxRestoreChainDepth, strconv.Itoa(depth))
+}
+
+// VolumeDefaults are the settings used by the backups of a volume when their BackupConfig leaves
+// the corresponding field unset, so repeated backups don't need to respecify them and risk a
+// mismatch that breaks the chain. Zero values have no default.
+type VolumeDefaults struct {
+	BlockSize     int
+	Chunking      Chunking
+	FilterCommand []string
+}
+
+// GetVolumeDefaults returns the default backup settings of the volume. A volume without
+// defaults returns zero VolumeDefaults.
+func (s Store) GetVolumeDefaults(volumeID int) (VolumeDefaults, error) {
+	var defaults VolumeDefaults
+	var filterCommand string
+	err := s.QueryRow("SELECT block_size, chunking, filter_command FROM volume_settings WHERE volume_id = ?", volumeID).
+		Scan(&defaults.BlockSize, &defaults.Chunking, &filterCommand)
+	switch {
+	case err == sql.ErrNoRows:
+		return VolumeDefaults{}, nil
+	case err != nil:
+		return VolumeDefaults{}, err
+	}
+
+	if err := json.Unmarshal([]byte(filterCommand), &defaults.FilterCommand); err != nil {
+		return VolumeDefaults{}, fmt.Errorf("invalid filter command default %q: %v", filterCommand, err)
+	}
+
+	return defaults, nil
+}
+
+// SetVolumeDefaults replaces the default backup settings of the volume. Zero VolumeDefaults
+// remove them.
+func (s Store) SetVolumeDefaults(volumeID int, defaults VolumeDefaults) error {
+	if defaults.BlockSize < 0 {
+		return fmt.Errorf("default block size must not be negative, got %d", defaults.BlockSize)
+	}
+
+	switch defaults.Chunking {
+	case "", ChunkingFixed, ChunkingContentDefined:
+	default:
+		return fmt.Errorf("chunking %q is not supported", defaults.Chunking)
+	}
+
+	var exists bool
+	if err := s.QueryRow("SELECT EXISTS (SELECT 1 FROM volumes WHERE id = ?)", volumeID).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("volume with id %d does not exist", volumeID)
+	}
+
+	filterCommand, err := json.Marshal(defaults.FilterCommand)
+	if err != nil {
+		return err
+	}
+	if defaults.FilterCommand == nil {
+		filterCommand = []byte("[]")
+	}
+
+	_, err = s.Exec(`INSERT INTO volume_settings (volume_id, block_size, chunking, filter_command) VALUES (?, ?, ?, ?)
+		ON CONFLICT(volume_id) DO UPDATE SET block_size = excluded.block_size, chunking = excluded.chunking, filter_command = excluded.filter_command`,
+		volumeID, defaults.BlockSize, defaults.Chunking, string(filterCommand))
+	return err
+}
+
+// apply fills the fields of cfg that are unset with the volume's defaults.
+func (d VolumeDefaults) apply(cfg *BackupConfig) {
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = d.BlockSize
+	}
+
+	if cfg.Chunking == "" {
+		cfg.Chunking = d.Chunking
+	}
+
+	if len(cfg.FilterCommand) == 0 {
+		cfg.FilterCommand = d.FilterCommand
+	}
+}
@@ -0,0 +1,149 @@
+package block
+
+import (
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+// BlockSignature is the rsync style signature of the block at a position of a backup. A remote
+// holding an older version of the volume compares signatures to find the blocks it lacks.
+type BlockSignature struct {
+	Position int
+	// Weak is the Adler-32 checksum of the block, which is cheap to compare before Strong.
+	Weak uint32
+	// Strong is the block's hash.
+	Strong string
+}
+
+// Signature returns the signature of every position of the backup's volume at the time of the
+// backup, in position order. The blocks of a differential are layered on its full backup. The
+// blocks are read from the files of the backup's restore chain.
+func (b *Backup) Signature() ([]BlockSignature, error) {
+	return b.store.backupSignature(*b.Record)
+}
+
+func (s Store) backupSignature(backup BackupRecord) ([]BlockSignature, error) {
+	if backup.Chunking == ChunkingContentDefined {
+		return nil, fmt.Errorf("signatures are not supported with %q chunking", backup.Chunking)
+	}
+
+	chain, err := s.RestoreChain(backup.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving restore chain: %v", err)
+	}
+
+	// The weak checksum of each block stored across the chain's files, keyed by its hash.
+	r := &Restore{store: &s, backup: backup, chain: chain}
+	weak := map[string]uint32{}
+	for _, layer := range chain {
+		if err := r.readWeakChecksums(layer, weak); err != nil {
+			return nil, err
+		}
+	}
+
+	hashes, err := s.positionHashes(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := make([]BlockSignature, 0, len(hashes))
+	for pos, hash := range hashes {
+		sum, ok := weak[hash]
+		if !ok && isFillBlock(hash) {
+			data, valid := parseFillDescriptor(hash)
+			if !valid {
+				return nil, fmt.Errorf("invalid fill block descriptor %q", hash)
+			}
+			sum, ok = adler32.Checksum(data), true
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("block %s at position %d is not stored in the files of backup %d's chain", hash, pos, backup.ID)
+		}
+
+		signatures = append(signatures, BlockSignature{Position: pos, Weak: sum, Strong: hash})
+	}
+
+	return signatures, nil
+}
+
+// readWeakChecksums reads the blocks stored in the layer's backup file, recording the weak
+// checksum of each by its hash.
+func (r *Restore) readWeakChecksums(layer BackupRecord, weak map[string]uint32) error {
+	return r.readStoredBlocks(layer, func(hash string, data []byte) error {
+		weak[hash] = adler32.Checksum(data)
+		return nil
+	})
+}
+
+// readStoredBlocks reads each block stored in the layer's backup file in order, passing it to fn
+// along with its hash.
+func (r *Restore) readStoredBlocks(layer BackupRecord, fn func(hash string, data []byte) error) error {
+	source, closeSource, err := r.openBackupData(layer)
+	if err != nil {
+		return fmt.Errorf("error opening backup file: %v", err)
+	}
+	defer closeSource()
+
+	var stored int
+	row := r.store.QueryRow("SELECT COUNT(DISTINCT b.id) FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ? AND b.hash NOT LIKE 'fill:%'", layer.ID)
+	if err := row.Scan(&stored); err != nil {
+		return fmt.Errorf("error counting unique blocks: %w", err)
+	}
+
+	finalLength, err := r.finalBlockLength(layer)
+	if err != nil {
+		return err
+	}
+
+	for blockNum := 0; blockNum < stored; blockNum++ {
+		length := layer.BlockSize
+		if blockNum == stored-1 {
+			length = finalLength
+		}
+
+		data, err := readNextBlock(source, length)
+		switch {
+		case err == io.EOF || (err == nil && len(data) < length):
+			return &TruncatedBackupError{Path: layer.FullPath, Expected: stored, Actual: blockNum}
+		case err != nil:
+			return fmt.Errorf("error reading block %d of %s: %w", blockNum, layer.FullPath, err)
+		}
+
+		hash := layer.HashAlgorithm.sum(data)
+		if layer.HashSample {
+			hash = sampleBlockHash(data)
+		}
+
+		if err := fn(hash, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MissingBlocks returns the signatures of want whose blocks aren't held by a volume with the
+// signatures have, regardless of their positions. These are the blocks a remote holding have
+// must be sent to reconstruct want.
+func MissingBlocks(have, want []BlockSignature) []BlockSignature {
+	held := map[uint32]map[string]bool{}
+	for _, sig := range have {
+		if held[sig.Weak] == nil {
+			held[sig.Weak] = map[string]bool{}
+		}
+		held[sig.Weak][sig.Strong] = true
+	}
+
+	var missing []BlockSignature
+	for _, sig := range want {
+		// Weak checksums rarely collide, so the strong hash is only compared on a match.
+		if strong, ok := held[sig.Weak]; ok && strong[sig.Strong] {
+			continue
+		}
+		missing = append(missing, sig)
+	}
+
+	return missing
+}
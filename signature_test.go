@@ -0,0 +1,79 @@
+package block
+
+import "testing"
+
+func TestBackupSignature(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	full, err := fb.Signature()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := db.Signature()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(full) != 50 || len(diff) != 50 {
+		t.Fatalf("expected a signature for each of the 50 positions, got %d and %d", len(full), len(diff))
+	}
+
+	// The signatures describe the sources the backups were taken from.
+	for _, sig := range diff {
+		data := readSourceBlock(t, "assets/pg_altered.ext4", sig.Position, cfg.BlockSize)
+		if sig.Strong != calculateBlockHash(data) {
+			t.Fatalf("expected position %d to have the hash of the source block", sig.Position)
+		}
+	}
+
+	// Only the block changed by the differential is missing from a remote holding the full.
+	missing := MissingBlocks(full, diff)
+	if len(missing) != 1 || missing[0].Position != 0 {
+		t.Fatalf("expected only position 0 to be missing, got %+v", missing)
+	}
+
+	if missing := MissingBlocks(diff, diff); len(missing) != 0 {
+		t.Fatalf("expected no blocks to be missing from an identical signature, got %+v", missing)
+	}
+
+	// A remote with nothing needs every position.
+	if missing := MissingBlocks(nil, full); len(missing) != len(full) {
+		t.Fatalf("expected every position to be missing, got %d", len(missing))
+	}
+}
@@ -0,0 +1,82 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// sourceChangeSampleBlocks is the number of blocks at the start of the source that are rehashed to
+// detect changes made during the backup.
+const sourceChangeSampleBlocks = 8
+
+// sourceSnapshot captures the state of the source used to detect changes made during the backup.
+type sourceSnapshot struct {
+	size    int
+	modTime time.Time
+	// sample is the hash of the first sourceChangeSampleBlocks blocks.
+	sample string
+}
+
+// snapshotSource captures the source's size, modification time and the hash of its first blocks.
+// The modification time is only known when the source is opened from DevicePath.
+func (b *Backup) snapshotSource(source io.ReaderAt) (sourceSnapshot, error) {
+	var snapshot sourceSnapshot
+
+	size, err := sourceSizeInBytes(&BackupConfig{DevicePath: b.vol.DevicePath, Source: b.Config.Source})
+	if err != nil {
+		return snapshot, fmt.Errorf("error getting source size: %v", err)
+	}
+	snapshot.size = size
+
+	if b.Config.Source == nil {
+		fi, err := os.Stat(b.vol.DevicePath)
+		if err != nil {
+			return snapshot, fmt.Errorf("error getting source modification time: %v", err)
+		}
+		snapshot.modTime = fi.ModTime()
+	}
+
+	sampleSize := sourceChangeSampleBlocks * b.Config.BlockSize
+	if sampleSize > size {
+		sampleSize = size
+	}
+
+	sample := make([]byte, sampleSize)
+	if _, err := source.ReadAt(sample, 0); err != nil && err != io.EOF {
+		return snapshot, fmt.Errorf("error reading source sample: %v", err)
+	}
+	snapshot.sample = calculateBlockHash(sample)
+
+	return snapshot, nil
+}
+
+// checkSourceChange compares the source against the snapshot taken when the backup started, and
+// handles a change according to OnSourceChange.
+func (b *Backup) checkSourceChange(source io.ReaderAt, before sourceSnapshot) error {
+	after, err := b.snapshotSource(source)
+	if err != nil {
+		return err
+	}
+
+	var change string
+	switch {
+	case after.size != before.size:
+		change = fmt.Sprintf("its size changed from %d to %d bytes", before.size, after.size)
+	case !after.modTime.Equal(before.modTime):
+		change = fmt.Sprintf("it was modified at %s", after.modTime.Format(time.RFC3339))
+	case after.sample != before.sample:
+		change = fmt.Sprintf("its first %d blocks changed", sourceChangeSampleBlocks)
+	default:
+		return nil
+	}
+
+	if b.Config.OnSourceChange == SourceChangeWarn {
+		fmt.Fprintf(os.Stderr, "WARNING: source %s changed during the backup (%s). The backup may be inconsistent!\n", b.vol.DevicePath, change)
+		b.SourceChanged = true
+		return nil
+	}
+
+	return fmt.Errorf("source %s changed during the backup, so the backup may be inconsistent: %s", b.vol.DevicePath, change)
+}
@@ -0,0 +1,124 @@
+package block
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// mutatingReaderAt flips the first byte of its data once a read reaches mutateAt, simulating a
+// write to a live source while it's being backed up.
+type mutatingReaderAt struct {
+	data     []byte
+	mutateAt int64
+	mutated  bool
+}
+
+func (m *mutatingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if m.mutateAt > 0 && off >= m.mutateAt && !m.mutated {
+		m.data[0] ^= 0xFF
+		m.mutated = true
+	}
+
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mutatingReaderAt) Size() int64 {
+	return int64(len(m.data))
+}
+
+func TestDetectChangeDuringBackup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	tests := []struct {
+		name     string
+		mutateAt int64
+		policy   SourceChangePolicy
+		changed  bool
+	}{
+		{name: "unchanged", policy: SourceChangeFail},
+		{name: "fail", mutateAt: 512 * 1024, policy: SourceChangeFail, changed: true},
+		{name: "warn", mutateAt: 512 * 1024, policy: SourceChangeWarn, changed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile("assets/tiny.ext4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := &mutatingReaderAt{data: data, mutateAt: tt.mutateAt}
+
+			b, err := NewBackup(&BackupConfig{
+				Store:                    store,
+				DevicePath:               "assets/tiny.ext4",
+				Source:                   source,
+				OutputFormat:             BackupOutputFormatFile,
+				OutputDirectory:          "backups/",
+				BlockSize:                4096,
+				BlockBufferSize:          5,
+				DetectChangeDuringBackup: true,
+				OnSourceChange:           tt.policy,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = b.Run()
+			if source.mutated != tt.changed {
+				t.Fatalf("expected the source to be mutated: %t", tt.changed)
+			}
+
+			switch {
+			case tt.changed && tt.policy == SourceChangeFail:
+				if err == nil || !strings.Contains(err.Error(), "changed during the backup") {
+					t.Fatalf("expected the backup to fail with a source change, got %v", err)
+				}
+				if b.Record.Status == backupStatusCompleted {
+					t.Fatal("expected the backup not to be completed")
+				}
+			case err != nil:
+				t.Fatal(err)
+			case b.SourceChanged != tt.changed:
+				t.Fatalf("expected SourceChanged %t, got %t", tt.changed, b.SourceChanged)
+			}
+		})
+	}
+}
+
+func TestDetectChangeDuringBackupPolicy(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	_, err = NewBackup(&BackupConfig{
+		Store:                    store,
+		DevicePath:               "assets/tiny.ext4",
+		OutputFormat:             BackupOutputFormatFile,
+		OutputDirectory:          "backups/",
+		BlockSize:                4096,
+		BlockBufferSize:          5,
+		DetectChangeDuringBackup: true,
+		OnSourceChange:           "ignore",
+	})
+	if err == nil {
+		t.Fatal("expected an unsupported source change policy to be rejected")
+	}
+}
@@ -0,0 +1,64 @@
+package block
+
+import (
+	"fmt"
+	"os"
+)
+
+// isZeroBlock reports whether every byte of data is zero.
+func isZeroBlock(data []byte) bool {
+	for _, c := range data {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeAt writes data to the restore target at offset. Sparse images don't allocate zeroed
+// blocks, so their range is deallocated instead of written, dropping any data an earlier layer
+// of the chain wrote there.
+func (r *Restore) writeAt(target restoreTarget, data []byte, offset int64) error {
+	if f, ok := target.(*os.File); ok && r.config.OutputImageFormat == ImageFormatRawSparse && isZeroBlock(data) {
+		if err := punchHole(f, offset, int64(len(data))); err != nil {
+			return fmt.Errorf("error deallocating restore file range: %v", err)
+		}
+		return nil
+	}
+
+	if _, err := target.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("error writing to restore file: %v", err)
+	}
+
+	return nil
+}
+
+// extendSparseImage grows a sparse image to the size of the restored backup, since trailing
+// zeroed blocks aren't written.
+func (r *Restore) extendSparseImage(target *os.File) error {
+	if r.config.OutputImageFormat != ImageFormatRawSparse {
+		return nil
+	}
+
+	info, err := target.Stat()
+	if err != nil {
+		return fmt.Errorf("error inspecting restore file: %v", err)
+	}
+
+	if info.Size() >= r.restoredSize() {
+		return nil
+	}
+
+	if err := target.Truncate(r.restoredSize()); err != nil {
+		return fmt.Errorf("error extending restore file: %v", err)
+	}
+
+	return nil
+}
+
+// writeZeros writes length zeroed bytes to f at offset.
+func writeZeros(f *os.File, offset, length int64) error {
+	_, err := f.WriteAt(make([]byte, length), offset)
+	return err
+}
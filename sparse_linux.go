@@ -0,0 +1,25 @@
+//go:build linux
+
+package block
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// punchHole deallocates length bytes of f at offset, leaving a hole that reads as zeros.
+// Zeros are written when the filesystem doesn't support punching holes.
+func punchHole(f *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return writeZeros(f, offset, length)
+	}
+
+	return err
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package block
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// allocatedBlocks returns the blockSize blocks of f that hold data rather than a hole.
+func allocatedBlocks(t *testing.T, f *os.File, blockSize int64) map[int64]bool {
+	t.Helper()
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := map[int64]bool{}
+	for offset := int64(0); offset < info.Size(); {
+		start, err := f.Seek(offset, seekData)
+		if err != nil {
+			// ENXIO: there's no data past offset.
+			break
+		}
+
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for pos := start / blockSize; pos*blockSize < end; pos++ {
+			blocks[pos] = true
+		}
+		offset = end
+	}
+
+	return blocks
+}
+
+// requireHoles skips the test unless dir's filesystem reports holes.
+func requireHoles(t *testing.T, dir string) {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(1048576); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(allocatedBlocks(t, f, 4096)) != 0 {
+		t.Skip("filesystem does not report holes")
+	}
+}
+
+func TestRestoreRawSparse(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	outputDir := t.TempDir()
+	requireHoles(t, outputDir)
+
+	const blockSize = 65536
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       blockSize,
+		BlockBufferSize: 100,
+	}
+
+	full, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := full.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := diff.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     diff.Record.ID,
+		OutputDirectory:    outputDir,
+		OutputFileName:     "sparse.img",
+		OutputImageFormat:  ImageFormatRawSparse,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := os.ReadFile("assets/pg_altered.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	restored, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored, expected) {
+		t.Fatalf("sparse image does not match the source")
+	}
+
+	// Only the source's non-zero blocks are allocated.
+	allocated := allocatedBlocks(t, f, blockSize)
+	written := 0
+	for pos := int64(0); pos*blockSize < int64(len(expected)); pos++ {
+		block := expected[pos*blockSize : min((pos+1)*blockSize, int64(len(expected)))]
+		if isZeroBlock(block) {
+			if allocated[pos] {
+				t.Fatalf("expected zeroed block %d to be a hole", pos)
+			}
+			continue
+		}
+
+		if !allocated[pos] {
+			t.Fatalf("expected block %d to be allocated", pos)
+		}
+		written++
+	}
+
+	if len(allocated) != written {
+		t.Fatalf("expected %d allocated blocks, got %d", written, len(allocated))
+	}
+
+	if written == len(expected)/blockSize {
+		t.Fatalf("expected the source to hold zeroed blocks")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package block
+
+import "os"
+
+// punchHole writes zeros in place of a hole, since deallocating a range of a file is only
+// supported on Linux.
+func punchHole(f *os.File, offset, length int64) error {
+	return writeZeros(f, offset, length)
+}
@@ -0,0 +1,101 @@
+package block
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackupStats is a snapshot of a running backup.
+type BackupStats struct {
+	// Elapsed is the time since the backup started.
+	Elapsed time.Duration
+	// BlocksProcessed is the number of blocks hashed so far, out of TotalBlocks.
+	BlocksProcessed int
+	TotalBlocks     int
+	// BlocksWritten is the number of blocks written to the backup file so far.
+	BlocksWritten int
+	// BytesRead and BytesWritten count the bytes read from the source and written to the backup file.
+	BytesRead    int64
+	BytesWritten int64
+	// Throughput is the average rate the source has been read at, in MB/s.
+	Throughput float64
+	// DedupRatio is the fraction of the processed blocks that didn't need to be written.
+	DedupRatio float64
+}
+
+// StatsFunc receives periodic snapshots of a running backup.
+type StatsFunc func(BackupStats)
+
+// defaultStatsInterval is how often stats are emitted when StatsInterval isn't set.
+const defaultStatsInterval = 5 * time.Second
+
+// liveStats accumulates the counters reported in BackupStats. It is safe for concurrent use.
+type liveStats struct {
+	bytesRead     atomic.Int64
+	blocksWritten atomic.Int64
+	bytesWritten  atomic.Int64
+}
+
+// snapshot returns the current stats of the backup.
+func (b *Backup) snapshot(startTime time.Time) BackupStats {
+	stats := BackupStats{
+		Elapsed:       time.Since(startTime),
+		TotalBlocks:   b.TotalBlocks(),
+		BlocksWritten: int(b.stats.blocksWritten.Load()),
+		BytesRead:     b.stats.bytesRead.Load(),
+		BytesWritten:  b.stats.bytesWritten.Load(),
+	}
+
+	if b.progress != nil {
+		stats.BlocksProcessed = int(b.progress.completed.Load())
+	}
+
+	if seconds := stats.Elapsed.Seconds(); seconds > 0 {
+		stats.Throughput = float64(stats.BytesRead) / 1e6 / seconds
+	}
+
+	if stats.BlocksProcessed > 0 {
+		stats.DedupRatio = 1 - float64(stats.BlocksWritten)/float64(stats.BlocksProcessed)
+	}
+
+	return stats
+}
+
+// startStats emits a stats snapshot every StatsInterval until the returned function is called,
+// which emits a final snapshot.
+func (b *Backup) startStats(startTime time.Time) func() {
+	if b.Config.Stats == nil {
+		return func() {}
+	}
+
+	interval := b.Config.StatsInterval
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				b.Config.Stats(b.snapshot(startTime))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		b.Config.Stats(b.snapshot(startTime))
+	}
+}
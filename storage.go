@@ -0,0 +1,42 @@
+package block
+
+import (
+	"fmt"
+	"io"
+)
+
+// Storage is a backend holding backup files outside the local filesystem, such as object storage.
+// Backups cataloged with CatalogRemoteBackups are restored by streaming their files from it.
+type Storage interface {
+	// List returns the keys of the backup files held by the backend.
+	List() ([]string, error)
+	// Open returns a reader for the backup file stored under key.
+	// The reader is only read sequentially, so it doesn't need to support seeking.
+	Open(key string) (io.ReadCloser, error)
+}
+
+// CatalogRemoteBackups records which backups have their files held by storage, matching each key
+// to the backup with the same file name. Cataloged backups are read from storage on restore,
+// so their files no longer need to exist locally. It returns the number of backups cataloged.
+func (s Store) CatalogRemoteBackups(storage Storage) (int, error) {
+	keys, err := storage.List()
+	if err != nil {
+		return 0, fmt.Errorf("error listing remote storage: %v", err)
+	}
+
+	cataloged := 0
+	for _, key := range keys {
+		res, err := s.Exec("UPDATE backups SET remote_key = ? WHERE file_name = ?", key, key)
+		if err != nil {
+			return cataloged, fmt.Errorf("error cataloging remote backup %s: %w", key, err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return cataloged, err
+		}
+		cataloged += int(n)
+	}
+
+	return cataloged, nil
+}
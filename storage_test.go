@@ -0,0 +1,133 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// mockStorage holds backup files in memory and only hands out sequential readers.
+type mockStorage struct {
+	files map[string][]byte
+}
+
+func (m *mockStorage) List() ([]string, error) {
+	keys := []string{}
+	for key := range m.files {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (m *mockStorage) Open(key string) (io.ReadCloser, error) {
+	data, ok := m.files[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+
+	// Hide the underlying reader's Seek and ReadAt methods.
+	return io.NopCloser(struct{ io.Reader }{bytes.NewReader(data)}), nil
+}
+
+func TestRestoreFromRemoteStorage(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the backup files to remote storage.
+	storage := &mockStorage{files: map[string][]byte{}}
+	for _, b := range []*Backup{fb, db} {
+		data, err := os.ReadFile(b.FullPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(b.FullPath()); err != nil {
+			t.Fatal(err)
+		}
+
+		storage.files[b.FileName()] = data
+	}
+
+	cataloged, err := store.CatalogRemoteBackups(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cataloged != 2 {
+		t.Fatalf("expected 2 backups to be cataloged, got %d", cataloged)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range backups {
+		if b.RemoteKey != b.FileName {
+			t.Fatalf("expected backup %d to be listed with remote key %s, got %q", b.ID, b.FileName, b.RemoteKey)
+		}
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     db.Record.FileName,
+		Storage:            storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	targetChecksum, err := fileChecksum(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffWithChangesChecksum != targetChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", diffWithChangesChecksum, targetChecksum)
+	}
+}
@@ -1,14 +1,25 @@
 package block
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
 	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 type Volume struct {
 	ID         int
 	Name       string
 	DevicePath string
+	// LastBackupAt is when the volume's last successful backup completed, or zero if it has none.
+	LastBackupAt time.Time
+	// UUID is the filesystem UUID the volume is identified by when backed up with
+	// BackupConfig.IdentifyByUUID, or empty if it's only identified by name.
+	UUID string
 }
 
 type BackupRecord struct {
@@ -21,9 +32,55 @@ type BackupRecord struct {
 	SizeInBytes  int
 	TotalBlocks  int
 	BlockSize    int
-	CreatedAt    time.Time
+	Chunking     Chunking
+	Duration     time.Duration
+	// SourcePath is the absolute path of the source at the time of the backup.
+	SourcePath string
+	// SourceInode is the inode of the source at the time of the backup, or 0 if unknown.
+	SourceInode uint64
+	// Status is backupStatusRunning until the backup completes, or backupStatusFailed if it
+	// returned an error.
+	Status string
+	// ErrorMessage is the error a failed backup returned, or empty if it didn't fail.
+	ErrorMessage string
+	// HashSample is set when blocks were identified by hashing a sample of their contents,
+	// so the backup may be approximate.
+	HashSample bool
+	// HashAlgorithm is the digest the backup's blocks were hashed with.
+	HashAlgorithm HashAlgorithm
+	// RemoteKey is the key of the backup file on remote storage, or empty if the file is local.
+	RemoteKey string
+	// AppVersion optionally identifies the application version that created the backup.
+	AppVersion string
+	// MerkleRoot is the hex encoded root of the Merkle tree over the backup's blocks, or empty
+	// if the backup wasn't taken with BackupConfig.MerkleTree.
+	MerkleRoot string
+	// Notes are free-form annotations attached to the backup after the fact (see SetBackupNotes).
+	Notes string
+	// LogicalSizeInBytes is the size of the backup stream before FilterCommand, and
+	// PhysicalSizeInBytes the size of the backup file it produced. Both are 0 until the backup
+	// completes.
+	LogicalSizeInBytes  int
+	PhysicalSizeInBytes int
+	CreatedAt           time.Time
 }
 
+// CompressionRatio returns the ratio of the backup's logical size to its physical size, or 0 if
+// the sizes weren't recorded. Backups that aren't filtered through a compressor report 1.
+func (b BackupRecord) CompressionRatio() float64 {
+	if b.PhysicalSizeInBytes == 0 {
+		return 0
+	}
+
+	return float64(b.LogicalSizeInBytes) / float64(b.PhysicalSizeInBytes)
+}
+
+const (
+	backupStatusRunning   = "running"
+	backupStatusCompleted = "completed"
+	backupStatusFailed    = "failed"
+)
+
 type Block struct {
 	hash string
 }
@@ -37,6 +94,22 @@ type BlockPosition struct {
 
 type Store struct {
 	*sql.DB
+	// blocksSchema is the name of the attached database holding the block data.
+	// Empty when the block data lives alongside the catalog.
+	blocksSchema string
+}
+
+// blocksSchemaName is the schema name the block data database is attached under.
+const blocksSchemaName = "blockdata"
+
+// blocksTable qualifies the block data table name with the attached schema, if any.
+// Queries can continue to use unqualified names, as SQLite resolves them across attached databases.
+func (s Store) blocksTable(name string) string {
+	if s.blocksSchema == "" {
+		return name
+	}
+
+	return s.blocksSchema + "." + name
 }
 
 func (s Store) SetupDB() error {
@@ -69,7 +142,7 @@ func (s Store) SetupDB() error {
 		return err
 	}
 
-	createBlocksTableSQL := `CREATE TABLE IF NOT EXISTS blocks (
+	createBlocksTableSQL := `CREATE TABLE IF NOT EXISTS ` + s.blocksTable("blocks") + ` (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		hash TEXT NOT NULL,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -80,13 +153,13 @@ func (s Store) SetupDB() error {
 		return err
 	}
 
-	createBlocksIndexSQL := `CREATE INDEX IF NOT EXISTS idx_blocks_hash ON blocks(hash)`
+	createBlocksIndexSQL := `CREATE INDEX IF NOT EXISTS ` + s.blocksTable("idx_blocks_hash") + ` ON blocks(hash)`
 	_, err = s.Exec(createBlocksIndexSQL)
 	if err != nil {
 		return err
 	}
 
-	createBlockPositionsSQL := `CREATE TABLE IF NOT EXISTS block_positions (
+	createBlockPositionsSQL := `CREATE TABLE IF NOT EXISTS ` + s.blocksTable("block_positions") + ` (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		backup_id INTEGER NOT NULL,
 		block_id INTEGER NOT NULL,
@@ -101,32 +174,379 @@ func (s Store) SetupDB() error {
 		return err
 	}
 
-	createBlockPositionsIndexSQL := `CREATE INDEX IF NOT EXISTS idx_block_positions_backup_id ON block_positions(backup_id);`
+	createBlockPositionsIndexSQL := `CREATE INDEX IF NOT EXISTS ` + s.blocksTable("idx_block_positions_backup_id") + ` ON block_positions(backup_id);`
 	_, err = s.Exec(createBlockPositionsIndexSQL)
 	if err != nil {
 		return err
 	}
+
+	return s.migrate()
+}
+
+// migration applies a single schema or data change within a transaction.
+type migration func(tx *sql.Tx) error
+
+// sqlMigration returns a migration that executes stmt.
+func sqlMigration(stmt string) migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// noopMigration takes the place of a migration moved to the end of the list, so the
+// user_version of stores that applied it there still counts the same migrations.
+func noopMigration(*sql.Tx) error {
 	return nil
 }
 
+// addColumnMigration returns a migration that adds column to table with the given definition,
+// unless the table already has it because the store applied the migration before it was moved.
+func addColumnMigration(table, column, definition string) migration {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			return nil
+		}
+
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+		return err
+	}
+}
+
+// migrations are applied in order on top of the base schema. The index of the last
+// applied migration is tracked using SQLite's user_version pragma, so migrations are only
+// ever appended to the list.
+var migrations = []migration{
+	sqlMigration(`ALTER TABLE backups ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN chunking TEXT NOT NULL DEFAULT 'fixed';`),
+	sqlMigration(`ALTER TABLE block_positions ADD COLUMN offset INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE block_positions ADD COLUMN length INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE block_positions ADD COLUMN stored INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN source_path TEXT NOT NULL DEFAULT '';`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN source_inode INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN status TEXT NOT NULL DEFAULT 'completed';`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN hash_sample INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN remote_key TEXT NOT NULL DEFAULT '';`),
+	sqlMigration(`ALTER TABLE block_positions ADD COLUMN run_length INTEGER NOT NULL DEFAULT 1;`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN app_version TEXT NOT NULL DEFAULT '';`),
+	sqlMigration(`CREATE TABLE IF NOT EXISTS restore_checkpoints (
+		backup_id INTEGER NOT NULL,
+		output_path TEXT NOT NULL,
+		layer_backup_id INTEGER NOT NULL,
+		blocks_restored INTEGER NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(backup_id, output_path)
+	);`),
+	sqlMigration(`CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`),
+	sqlMigration(`ALTER TABLE volumes ADD COLUMN last_backup_at TIMESTAMP;`),
+	encodeHashesAsHex,
+	sqlMigration(`ALTER TABLE backups ADD COLUMN merkle_root TEXT NOT NULL DEFAULT '';`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN notes TEXT NOT NULL DEFAULT '';`),
+	noopMigration, // backups.error_message, moved to the end
+	noopMigration, // hash_cache, moved to the end
+	sqlMigration(`CREATE TABLE IF NOT EXISTS volume_settings (
+		volume_id INTEGER PRIMARY KEY,
+		block_size INTEGER NOT NULL DEFAULT 0,
+		chunking TEXT NOT NULL DEFAULT '',
+		filter_command TEXT NOT NULL DEFAULT '[]',
+		FOREIGN KEY(volume_id) REFERENCES volumes(id)
+	);`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN hash_algorithm TEXT NOT NULL DEFAULT 'xxhash64';`),
+	addBlockAlgorithms,
+	sqlMigration(`ALTER TABLE backups ADD COLUMN logical_size INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE backups ADD COLUMN physical_size INTEGER NOT NULL DEFAULT 0;`),
+	sqlMigration(`ALTER TABLE volumes ADD COLUMN uuid TEXT NOT NULL DEFAULT '';`),
+	addColumnMigration("backups", "error_message", "TEXT NOT NULL DEFAULT ''"),
+	sqlMigration(`CREATE TABLE IF NOT EXISTS hash_cache (
+		volume_id INTEGER PRIMARY KEY,
+		backup_id INTEGER NOT NULL,
+		block_size INTEGER NOT NULL,
+		hashes TEXT NOT NULL,
+		FOREIGN KEY(volume_id) REFERENCES volumes(id)
+	);`),
+}
+
+// LatestSchemaVersion is the schema version of a fully migrated data store.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the number of migrations applied to the data store.
+func (s Store) SchemaVersion() (int, error) {
+	var version int
+	row := s.QueryRow("PRAGMA user_version;")
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// SQLiteVersion returns the version of the SQLite library backing the data store.
+func (s Store) SQLiteVersion() (string, error) {
+	var version string
+	row := s.QueryRow("SELECT sqlite_version();")
+	if err := row.Scan(&version); err != nil {
+		return "", err
+	}
+
+	return version, nil
+}
+
+func (s Store) migrate() error {
+	var version int
+	row := s.QueryRow("PRAGMA user_version;")
+	if err := row.Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := migrations[i](tx); err != nil {
+			handleRollback(tx)
+			return fmt.Errorf("error applying migration %d: %w", i+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", i+1)); err != nil {
+			handleRollback(tx)
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// synchronousConn reserves a connection with SQLite's synchronous setting for block positions
+// changed to mode, as the setting is scoped to a connection. restore reinstates the previous
+// setting and returns the connection to the pool.
+func (s Store) synchronousConn(mode SynchronousMode) (conn *sql.Conn, restore func() error, err error) {
+	ctx := context.Background()
+	conn, err = s.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pragma := "PRAGMA synchronous"
+	if s.blocksSchema != "" {
+		pragma = "PRAGMA " + s.blocksSchema + ".synchronous"
+	}
+
+	var previous int
+	if err := conn.QueryRowContext(ctx, pragma+";").Scan(&previous); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("%s = %s;", pragma, mode)); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	restore = func() error {
+		defer func() { _ = conn.Close() }()
+		_, err := conn.ExecContext(ctx, fmt.Sprintf("%s = %d;", pragma, previous))
+		return err
+	}
+
+	return conn, restore, nil
+}
+
 func NewStore() (*Store, error) {
-	s, err := sql.Open("sqlite3", "backups.db?_busy_timeout=5000&_journal_mode=WAL")
+	return OpenStore("backups.db")
+}
+
+// storeDSN returns the connection string used for the sqlite data store at the specified path.
+// Transactions take the write lock immediately, so reads performed within a transaction
+// can't be invalidated by a concurrent writer before the transaction writes.
+func storeDSN(path string) string {
+	return path + "?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+}
+
+// OpenStore opens the sqlite data store at the specified path.
+func OpenStore(path string) (*Store, error) {
+	s, err := sql.Open("sqlite3", storeDSN(path))
 	if err != nil {
 		return nil, err
 	}
 
-	return &Store{s}, nil
+	return &Store{DB: s}, nil
+}
+
+// NewReadOnlyStore opens the default data store read-only.
+func NewReadOnlyStore() (*Store, error) {
+	return OpenReadOnlyStore("backups.db")
+}
+
+// OpenReadOnlyStore opens the sqlite data store at the specified path without write access, for
+// reporting that can safely run alongside an active backup. Reads never take the write lock, and
+// any attempted write fails. The store must already exist and can't be set up or migrated.
+func OpenReadOnlyStore(path string) (*Store, error) {
+	s, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{DB: s}, nil
+}
+
+// OpenSplitStore opens a sqlite data store that keeps the volume and backup catalog at catalogPath
+// and the blocks and block_positions tables in a separate database at blocksPath.
+// This keeps the catalog small and portable while the block data can live on other storage.
+// Note that writes spanning both files are not atomic across them.
+func OpenSplitStore(catalogPath, blocksPath string) (*Store, error) {
+	// ATTACH is scoped to a connection, so every connection in the pool attaches the block data.
+	d := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if _, err := conn.Exec("ATTACH DATABASE ? AS "+blocksSchemaName+";", []driver.Value{blocksPath}); err != nil {
+				return fmt.Errorf("error attaching blocks database %s: %w", blocksPath, err)
+			}
+
+			if _, err := conn.Exec("PRAGMA "+blocksSchemaName+".journal_mode = WAL;", nil); err != nil {
+				return fmt.Errorf("error setting journal mode on blocks database: %w", err)
+			}
+
+			return nil
+		},
+	}
+
+	s := sql.OpenDB(attachConnector{dsn: storeDSN(catalogPath), driver: d})
+
+	return &Store{DB: s, blocksSchema: blocksSchemaName}, nil
+}
+
+// attachConnector opens connections using a driver configured with a connect hook.
+type attachConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c attachConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c attachConnector) Driver() driver.Driver {
+	return c.driver
 }
 
 func (s Store) FindVolume(name string) (Volume, error) {
 	var id int
 	var devicePath string
-	row := s.QueryRow("SELECT id, devicePath FROM volumes WHERE name = ?", name)
-	if err := row.Scan(&id, &devicePath); err != nil {
+	var lastBackupAt sql.NullTime
+	var uuid string
+	row := s.QueryRow("SELECT id, devicePath, last_backup_at, uuid FROM volumes WHERE name = ?", name)
+	if err := row.Scan(&id, &devicePath, &lastBackupAt, &uuid); err != nil {
+		return Volume{}, err
+	}
+
+	return Volume{ID: id, Name: name, DevicePath: devicePath, LastBackupAt: lastBackupAt.Time.UTC(), UUID: uuid}, nil
+}
+
+// findVolumeByUUID returns the volume identified by the filesystem UUID.
+// It returns sql.ErrNoRows if no volume has the UUID.
+func (s Store) findVolumeByUUID(uuid string) (Volume, error) {
+	var name string
+	row := s.QueryRow("SELECT name FROM volumes WHERE uuid = ? ORDER BY id ASC LIMIT 1", uuid)
+	if err := row.Scan(&name); err != nil {
 		return Volume{}, err
 	}
 
-	return Volume{ID: id, Name: name, DevicePath: devicePath}, nil
+	return s.FindVolume(name)
+}
+
+// setVolumeUUID records the filesystem UUID the volume is identified by.
+func (s Store) setVolumeUUID(volumeID int, uuid string) error {
+	_, err := s.Exec("UPDATE volumes SET uuid = ? WHERE id = ?", uuid, volumeID)
+	return err
+}
+
+// ListVolumes returns every volume, ordered by name.
+func (s Store) ListVolumes() ([]Volume, error) {
+	rows, err := s.Query("SELECT id, name, devicePath, last_backup_at, uuid FROM volumes ORDER BY name ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var volumes []Volume
+	for rows.Next() {
+		var id int
+		var name, devicePath, uuid string
+		var lastBackupAt sql.NullTime
+		if err := rows.Scan(&id, &name, &devicePath, &lastBackupAt, &uuid); err != nil {
+			return volumes, err
+		}
+
+		volumes = append(volumes, Volume{
+			ID:           id,
+			Name:         name,
+			DevicePath:   devicePath,
+			LastBackupAt: lastBackupAt.Time.UTC(),
+			UUID:         uuid,
+		})
+	}
+
+	return volumes, rows.Err()
+}
+
+// storeTime normalizes t to UTC, the zone the store persists and reads timestamps in, so a record
+// built in memory matches the one read back.
+func storeTime(t time.Time) time.Time {
+	return t.UTC()
+}
+
+// TouchVolume records that the volume was successfully backed up now.
+func (s Store) TouchVolume(volumeID int) error {
+	res, err := s.Exec("UPDATE volumes SET last_backup_at = ? WHERE id = ?", storeTime(time.Now()), volumeID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("volume %d not found", volumeID)
+	}
+
+	return nil
+}
+
+// StaleVolumes returns the volumes that haven't been successfully backed up within olderThan,
+// including volumes that have never been backed up.
+func (s Store) StaleVolumes(olderThan time.Duration) ([]Volume, error) {
+	volumes, err := s.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+
+	var stale []Volume
+	for _, vol := range volumes {
+		if vol.LastBackupAt.Before(cutoff) {
+			stale = append(stale, vol)
+		}
+	}
+
+	return stale, nil
 }
 
 func (s Store) InsertVolume(name, devicePath string) (Volume, error) {
@@ -149,10 +569,164 @@ func (s Store) InsertVolume(name, devicePath string) (Volume, error) {
 	return Volume{ID: int(volumeID), Name: name, DevicePath: devicePath}, nil
 }
 
-func (s Store) insertBackupRecord(volumeID int, fileName string, fullPath string, outputFormat string, backupType string, totalBlocks, blockSize, sizeInBytes int) (BackupRecord, error) {
+// RenameVolume renames a volume, keeping its backups attached.
+// Volumes are resolved by the basename of their device path, so renaming a volume to match
+// a new device path keeps the differential chain intact.
+func (s Store) RenameVolume(oldName, newName string) error {
+	if _, err := s.FindVolume(newName); err == nil {
+		return fmt.Errorf("volume %s already exists", newName)
+	}
+
+	res, err := s.Exec("UPDATE volumes SET name = ? WHERE name = ?", newName, oldName)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("volume %s does not exist", oldName)
+	}
+
+	return nil
+}
+
+// UpdateVolumeDevicePath updates the device path recorded for a volume.
+func (s Store) UpdateVolumeDevicePath(volumeID int, path string) error {
+	res, err := s.Exec("UPDATE volumes SET devicePath = ? WHERE id = ?", path, volumeID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("volume with id %d does not exist", volumeID)
+	}
+
+	return nil
+}
+
+// DeleteVolume deletes the volume along with its backups, their block positions and the blocks
+// no other volume references, then removes the volume's local backup files. Files on remote
+// storage are left in place. It refuses to delete a volume whose stored blocks are shared with
+// other volumes, since their backups may read them from the volume's backup files.
+func (s Store) DeleteVolume(volumeID int) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM volumes WHERE id = ?)", volumeID).Scan(&exists); err != nil {
+		handleRollback(tx)
+		return err
+	}
+
+	if !exists {
+		handleRollback(tx)
+		return fmt.Errorf("volume with id %d does not exist", volumeID)
+	}
+
+	rows, err := tx.Query("SELECT full_path FROM backups WHERE volume_id = ? AND output_format = ? AND remote_key = ''", volumeID, string(BackupOutputFormatFile))
+	if err != nil {
+		handleRollback(tx)
+		return err
+	}
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			handleRollback(tx)
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+
+	// The volume's blocks that another volume's positions reference.
+	const volumeBlocks = "SELECT b.id FROM block_positions bp JOIN blocks b ON " + positionRange + " JOIN backups k ON k.id = bp.backup_id WHERE k.volume_id = ?"
+	const referencedElsewhere = "EXISTS (SELECT 1 FROM block_positions op JOIN backups ok ON ok.id = op.backup_id WHERE ok.volume_id != ? AND blocks.id BETWEEN op.block_id AND op.block_id + op.run_length - 1)"
+
+	var shared int
+	row := tx.QueryRow("SELECT COUNT(*) FROM blocks WHERE id IN ("+volumeBlocks+") AND hash NOT LIKE 'fill:%' AND "+referencedElsewhere, volumeID, volumeID)
+	if err := row.Scan(&shared); err != nil {
+		handleRollback(tx)
+		return fmt.Errorf("error checking for shared blocks: %w", err)
+	}
+
+	if shared > 0 {
+		handleRollback(tx)
+		return fmt.Errorf("volume with id %d shares %d stored blocks with other volumes, whose backups may read them from its backup files", volumeID, shared)
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM blocks WHERE id IN (" + volumeBlocks + ") AND NOT " + referencedElsewhere, []interface{}{volumeID, volumeID}},
+		{"DELETE FROM block_positions WHERE backup_id IN (SELECT id FROM backups WHERE volume_id = ?)", []interface{}{volumeID}},
+		{"DELETE FROM restore_checkpoints WHERE backup_id IN (SELECT id FROM backups WHERE volume_id = ?)", []interface{}{volumeID}},
+		{"DELETE FROM backups WHERE volume_id = ?", []interface{}{volumeID}},
+		{"DELETE FROM hash_cache WHERE volume_id = ?", []interface{}{volumeID}},
+		{"DELETE FROM volume_settings WHERE volume_id = ?", []interface{}{volumeID}},
+		{"DELETE FROM volumes WHERE id = ?", []interface{}{volumeID}},
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			handleRollback(tx)
+			return fmt.Errorf("error deleting volume %d: %w", volumeID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Files can't be removed transactionally, so they go once the records are gone.
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("volume %d was deleted, but its backup file couldn't be removed: %v", volumeID, err)
+		}
+	}
+
+	return nil
+}
+
+// SetBackupNotes replaces the notes attached to a backup, e.g. to record that its restore was
+// verified. Empty notes clear them.
+func (s Store) SetBackupNotes(backupID int, notes string) error {
+	res, err := s.Exec("UPDATE backups SET notes = ? WHERE id = ?", notes, backupID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("backup with id %d does not exist", backupID)
+	}
+
+	return nil
+}
+
+func (s Store) insertBackupRecord(volumeID int, fileName string, fullPath string, outputFormat string, backupType string, totalBlocks, blockSize, sizeInBytes int, chunking Chunking) (BackupRecord, error) {
 	// Write the backup record to the database
-	insertSQL := `INSERT INTO backups (volume_id, file_name, full_path, output_format, backup_type, total_blocks, block_size, size_in_bytes) VALUES (?,?,?,?,?,?,?,?);`
-	res, err := s.Exec(insertSQL, volumeID, fileName, fullPath, outputFormat, backupType, totalBlocks, blockSize, sizeInBytes)
+	createdAt := storeTime(time.Now())
+	insertSQL := `INSERT INTO backups (volume_id, file_name, full_path, output_format, backup_type, total_blocks, block_size, size_in_bytes, chunking, status, created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?);`
+	res, err := s.Exec(insertSQL, volumeID, fileName, fullPath, outputFormat, backupType, totalBlocks, blockSize, sizeInBytes, chunking, backupStatusRunning, createdAt)
 	if err != nil {
 		return BackupRecord{}, err
 	}
@@ -172,13 +746,15 @@ func (s Store) insertBackupRecord(volumeID int, fileName string, fullPath string
 		TotalBlocks:  totalBlocks,
 		BlockSize:    blockSize,
 		SizeInBytes:  sizeInBytes,
-		CreatedAt:    time.Now(),
+		Chunking:     chunking,
+		Status:       backupStatusRunning,
+		CreatedAt:    createdAt,
 	}, nil
 }
 
 func (s Store) ListBackups() ([]BackupRecord, error) {
 	var backups []BackupRecord
-	rows, err := s.Query("SELECT id, volume_id, file_name, full_path, output_format, backup_type, total_blocks, block_size, size_in_bytes, created_at FROM backups ORDER BY id ASC")
+	rows, err := s.Query("SELECT id, volume_id, file_name, full_path, output_format, backup_type, total_blocks, block_size, size_in_bytes, chunking, duration_ms, source_path, source_inode, status, hash_sample, hash_algorithm, remote_key, app_version, merkle_root, notes, error_message, logical_size, physical_size, created_at FROM backups ORDER BY id ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -193,33 +769,181 @@ func (s Store) ListBackups() ([]BackupRecord, error) {
 		var totalBlocks int
 		var blockSize int
 		var sizeInBytes int
+		var chunking Chunking
+		var durationMs int64
+		var sourcePath string
+		var sourceInode int64
+		var status string
+		var hashSample bool
+		var hashAlgorithm HashAlgorithm
+		var remoteKey string
+		var appVersion string
+		var merkleRoot string
+		var notes string
+		var errorMessage string
+		var logicalSize int
+		var physicalSize int
 		var createdAt time.Time
-		if err := rows.Scan(&id, &volumeID, &fileName, &fullPath, &outputFormat, &backupType, &totalBlocks, &blockSize, &sizeInBytes, &createdAt); err != nil {
+		if err := rows.Scan(&id, &volumeID, &fileName, &fullPath, &outputFormat, &backupType, &totalBlocks, &blockSize, &sizeInBytes, &chunking, &durationMs, &sourcePath, &sourceInode, &status, &hashSample, &hashAlgorithm, &remoteKey, &appVersion, &merkleRoot, &notes, &errorMessage, &logicalSize, &physicalSize, &createdAt); err != nil {
 			return backups, err
 		}
 
 		backups = append(backups, BackupRecord{
-			ID:           id,
-			FileName:     fileName,
-			FullPath:     fullPath,
-			OutputFormat: outputFormat,
-			VolumeID:     volumeID,
-			BackupType:   backupType,
-			TotalBlocks:  totalBlocks,
-			BlockSize:    blockSize,
-			SizeInBytes:  sizeInBytes,
-			CreatedAt:    createdAt,
+			ID:                  id,
+			FileName:            fileName,
+			FullPath:            fullPath,
+			OutputFormat:        outputFormat,
+			VolumeID:            volumeID,
+			BackupType:          backupType,
+			TotalBlocks:         totalBlocks,
+			BlockSize:           blockSize,
+			SizeInBytes:         sizeInBytes,
+			Chunking:            chunking,
+			Duration:            time.Duration(durationMs) * time.Millisecond,
+			SourcePath:          sourcePath,
+			SourceInode:         uint64(sourceInode),
+			Status:              status,
+			HashSample:          hashSample,
+			HashAlgorithm:       hashAlgorithm,
+			RemoteKey:           remoteKey,
+			AppVersion:          appVersion,
+			MerkleRoot:          merkleRoot,
+			Notes:               notes,
+			ErrorMessage:        errorMessage,
+			LogicalSizeInBytes:  logicalSize,
+			PhysicalSizeInBytes: physicalSize,
+			CreatedAt:           createdAt.UTC(),
 		})
 	}
 
 	return backups, nil
 }
 
+// CountBackups returns the total number of backups without loading their records.
+func (s Store) CountBackups() (int, error) {
+	var count int
+	row := s.QueryRow("SELECT COUNT(*) FROM backups")
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// CountBackupsByVolume returns the number of backups taken of the specified volume.
+func (s Store) CountBackupsByVolume(volumeID int) (int, error) {
+	var count int
+	row := s.QueryRow("SELECT COUNT(*) FROM backups WHERE volume_id = ?", volumeID)
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
 func (s Store) updateBackupSize(backupID int, sizeInBytes int) error {
 	_, err := s.Exec("UPDATE backups SET size_in_bytes = ? WHERE id = ?", sizeInBytes, backupID)
 	return err
 }
 
+// updateBackupSizes records the backup's logical and physical sizes.
+func (s Store) updateBackupSizes(backupID int, logicalSize, physicalSize int) error {
+	_, err := s.Exec("UPDATE backups SET logical_size = ?, physical_size = ? WHERE id = ?", logicalSize, physicalSize, backupID)
+	return err
+}
+
+func (s Store) updateBackupTotalBlocks(backupID int, totalBlocks int) error {
+	_, err := s.Exec("UPDATE backups SET total_blocks = ? WHERE id = ?", totalBlocks, backupID)
+	return err
+}
+
+func (s Store) updateBackupDuration(backupID int, duration time.Duration) error {
+	_, err := s.Exec("UPDATE backups SET duration_ms = ? WHERE id = ?", duration.Milliseconds(), backupID)
+	return err
+}
+
+func (s Store) updateBackupStatus(backupID int, status string) error {
+	_, err := s.Exec("UPDATE backups SET status = ? WHERE id = ?", status, backupID)
+	return err
+}
+
+// markBackupFailed records that the backup failed with err.
+func (s Store) markBackupFailed(backupID int, err error) error {
+	_, execErr := s.Exec("UPDATE backups SET status = ?, error_message = ? WHERE id = ?", backupStatusFailed, err.Error(), backupID)
+	return execErr
+}
+
+// LastError returns the most recent failed backup, whose ErrorMessage holds the error it failed
+// with. It returns sql.ErrNoRows if no backup has failed.
+func (s Store) LastError() (BackupRecord, error) {
+	var id int
+	row := s.QueryRow("SELECT id FROM backups WHERE status = ? ORDER BY id DESC LIMIT 1", backupStatusFailed)
+	if err := row.Scan(&id); err != nil {
+		return BackupRecord{}, err
+	}
+
+	return s.findBackup(id)
+}
+
+func (s Store) updateBackupAppVersion(backupID int, appVersion string) error {
+	_, err := s.Exec("UPDATE backups SET app_version = ? WHERE id = ?", appVersion, backupID)
+	return err
+}
+
+// mismatchedBlockSizes returns the distinct block sizes, other than the backup's, of the store's
+// completed fixed chunking backups hashed with the same algorithm.
+func (s Store) mismatchedBlockSizes(backup BackupRecord) ([]int, error) {
+	rows, err := s.Query("SELECT DISTINCT block_size FROM backups WHERE id != ? AND status = ? AND chunking = ? AND hash_algorithm = ? AND block_size != ? ORDER BY block_size ASC",
+		backup.ID, backupStatusCompleted, ChunkingFixed, backup.HashAlgorithm, backup.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sizes []int
+	for rows.Next() {
+		var size int
+		if err := rows.Scan(&size); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, rows.Err()
+}
+
+func (s Store) updateBackupHashSample(backupID int, hashSample bool) error {
+	_, err := s.Exec("UPDATE backups SET hash_sample = ? WHERE id = ?", hashSample, backupID)
+	return err
+}
+
+func (s Store) updateBackupHashAlgorithm(backupID int, algorithm HashAlgorithm) error {
+	_, err := s.Exec("UPDATE backups SET hash_algorithm = ? WHERE id = ?", algorithm, backupID)
+	return err
+}
+
+func (s Store) updateBackupSource(backupID int, sourcePath string, sourceInode uint64) error {
+	_, err := s.Exec("UPDATE backups SET source_path = ?, source_inode = ? WHERE id = ?", sourcePath, int64(sourceInode), backupID)
+	return err
+}
+
+// VolumeThroughput returns the average number of bytes read per second across the
+// volume's historical backups, along with the number of backups sampled.
+func (s Store) VolumeThroughput(volumeID int) (float64, int, error) {
+	var samples int
+	var totalBytes, totalMs sql.NullInt64
+	row := s.QueryRow("SELECT COUNT(*), SUM(total_blocks * block_size), SUM(duration_ms) FROM backups WHERE volume_id = ? AND duration_ms > 0", volumeID)
+	if err := row.Scan(&samples, &totalBytes, &totalMs); err != nil {
+		return 0, 0, err
+	}
+
+	if samples == 0 || totalMs.Int64 == 0 {
+		return 0, 0, nil
+	}
+
+	return float64(totalBytes.Int64) / (float64(totalMs.Int64) / 1000), samples, nil
+}
+
 func (s Store) TotalBlocks() (int, error) {
 	var count int
 	row := s.QueryRow("SELECT count(*) FROM blocks;")
@@ -230,6 +954,69 @@ func (s Store) TotalBlocks() (int, error) {
 	return count, nil
 }
 
+// Stats summarizes the contents of a store.
+type Stats struct {
+	Volumes             int
+	Backups             int
+	FullBackups         int
+	DifferentialBackups int
+	// UniqueBlocks is the number of distinct blocks stored across every backup, and Positions
+	// the number of block positions referencing them.
+	UniqueBlocks int
+	Positions    int
+	// LogicalSizeInBytes and PhysicalSizeInBytes total the sizes of the completed backups (see
+	// BackupRecord.LogicalSizeInBytes).
+	LogicalSizeInBytes  int
+	PhysicalSizeInBytes int
+}
+
+// Stats gathers the store's totals in a single query.
+func (s Store) Stats() (Stats, error) {
+	var stats Stats
+	row := s.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM volumes),
+		(SELECT COUNT(*) FROM backups),
+		(SELECT COUNT(*) FROM backups WHERE backup_type = ?),
+		(SELECT COUNT(*) FROM backups WHERE backup_type = ?),
+		(SELECT COUNT(*) FROM blocks),
+		(SELECT COALESCE(SUM(run_length), 0) FROM block_positions),
+		(SELECT COALESCE(SUM(logical_size), 0) FROM backups),
+		(SELECT COALESCE(SUM(physical_size), 0) FROM backups)`, backupTypeFull, backupTypeDifferential)
+	if err := row.Scan(&stats.Volumes, &stats.Backups, &stats.FullBackups, &stats.DifferentialBackups, &stats.UniqueBlocks, &stats.Positions, &stats.LogicalSizeInBytes, &stats.PhysicalSizeInBytes); err != nil {
+		return Stats{}, fmt.Errorf("error gathering store stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// RestoreChain returns the backups needed to restore the backup, in the order they're applied:
+// a full backup first, followed by the backup itself when it's a differential. A differential is
+// layered on the completed full backup of its volume that preceded it, even if newer fulls exist.
+func (s Store) RestoreChain(backupID int) ([]BackupRecord, error) {
+	backup, err := s.findBackup(backupID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving backup record with id %d: %w", backupID, err)
+	}
+
+	if backup.BackupType != backupTypeDifferential {
+		return []BackupRecord{backup}, nil
+	}
+
+	var fullID int
+	row := s.QueryRow("SELECT id FROM backups WHERE volume_id = ? AND backup_type = 'full' AND status = ? AND id < ? ORDER BY id DESC LIMIT 1", backup.VolumeID, backupStatusCompleted, backup.ID)
+	if err := row.Scan(&fullID); err != nil {
+		return nil, fmt.Errorf("error resolving full backup of differential %d: %w", backup.ID, err)
+	}
+
+	full, err := s.findBackup(fullID)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving backup record with id %d: %w", fullID, err)
+	}
+
+	return []BackupRecord{full, backup}, nil
+}
+
+// findLastFullBackupRecord returns the volume's most recent completed full backup.
 func (s Store) findLastFullBackupRecord(volumeID int) (BackupRecord, error) {
 	var id int
 	var totalBlocks int
@@ -238,22 +1025,34 @@ func (s Store) findLastFullBackupRecord(volumeID int) (BackupRecord, error) {
 	var fullPath string
 	var outputFormat string
 	var backupType string
+	var chunking Chunking
+	var status string
+	var hashSample bool
+	var hashAlgorithm HashAlgorithm
+	var remoteKey string
+	var appVersion string
 	var createdAt time.Time
-	row := s.QueryRow("SELECT id, file_name, full_path, output_format, backup_type, total_blocks, block_size, created_at FROM backups WHERE volume_id = ? AND backup_type = 'full' ORDER BY id DESC LIMIT 1", volumeID)
-	if err := row.Scan(&id, &fileName, &fullPath, &outputFormat, &backupType, &totalBlocks, &blockSize, &createdAt); err != nil {
+	row := s.QueryRow("SELECT id, file_name, full_path, output_format, backup_type, total_blocks, block_size, chunking, status, hash_sample, hash_algorithm, remote_key, app_version, created_at FROM backups WHERE volume_id = ? AND backup_type = 'full' AND status = ? ORDER BY id DESC LIMIT 1", volumeID, backupStatusCompleted)
+	if err := row.Scan(&id, &fileName, &fullPath, &outputFormat, &backupType, &totalBlocks, &blockSize, &chunking, &status, &hashSample, &hashAlgorithm, &remoteKey, &appVersion, &createdAt); err != nil {
 		return BackupRecord{}, err
 	}
 
 	return BackupRecord{
-		ID:           id,
-		FileName:     fileName,
-		FullPath:     fullPath,
-		OutputFormat: outputFormat,
-		VolumeID:     volumeID,
-		BackupType:   backupType,
-		TotalBlocks:  totalBlocks,
-		BlockSize:    blockSize,
-		CreatedAt:    createdAt,
+		ID:            id,
+		FileName:      fileName,
+		FullPath:      fullPath,
+		OutputFormat:  outputFormat,
+		VolumeID:      volumeID,
+		BackupType:    backupType,
+		TotalBlocks:   totalBlocks,
+		BlockSize:     blockSize,
+		Chunking:      chunking,
+		Status:        status,
+		HashSample:    hashSample,
+		HashAlgorithm: hashAlgorithm,
+		RemoteKey:     remoteKey,
+		AppVersion:    appVersion,
+		CreatedAt:     createdAt.UTC(),
 	}, nil
 }
 
@@ -265,28 +1064,74 @@ func (s Store) findBackup(id int) (BackupRecord, error) {
 	var volumeID int
 	var blockSize int
 	var backupType string
+	var sizeInBytes int
+	var chunking Chunking
+	var durationMs int64
+	var sourcePath string
+	var sourceInode int64
+	var status string
+	var hashSample bool
+	var hashAlgorithm HashAlgorithm
+	var remoteKey string
+	var appVersion string
+	var merkleRoot string
+	var notes string
+	var errorMessage string
+	var logicalSize int
+	var physicalSize int
 	var createdAt time.Time
-	row := s.QueryRow("SELECT file_name, full_path, output_format, volume_id, backup_type, total_blocks, block_size, created_at FROM backups WHERE id = ? ORDER BY id DESC LIMIT 1", id)
-	if err := row.Scan(&fileName, &fullPath, &outputFormat, &volumeID, &backupType, &totalBlocks, &blockSize, &createdAt); err != nil {
+	row := s.QueryRow("SELECT file_name, full_path, output_format, volume_id, backup_type, total_blocks, block_size, size_in_bytes, chunking, duration_ms, source_path, source_inode, status, hash_sample, hash_algorithm, remote_key, app_version, merkle_root, notes, error_message, logical_size, physical_size, created_at FROM backups WHERE id = ? ORDER BY id DESC LIMIT 1", id)
+	if err := row.Scan(&fileName, &fullPath, &outputFormat, &volumeID, &backupType, &totalBlocks, &blockSize, &sizeInBytes, &chunking, &durationMs, &sourcePath, &sourceInode, &status, &hashSample, &hashAlgorithm, &remoteKey, &appVersion, &merkleRoot, &notes, &errorMessage, &logicalSize, &physicalSize, &createdAt); err != nil {
 		return BackupRecord{}, err
 	}
 
 	return BackupRecord{
-		ID:           id,
-		FileName:     fileName,
-		FullPath:     fullPath,
-		OutputFormat: outputFormat,
-		VolumeID:     volumeID,
-		BackupType:   backupType,
-		TotalBlocks:  totalBlocks,
-		BlockSize:    blockSize,
-		CreatedAt:    createdAt,
+		ID:                  id,
+		FileName:            fileName,
+		FullPath:            fullPath,
+		OutputFormat:        outputFormat,
+		VolumeID:            volumeID,
+		BackupType:          backupType,
+		TotalBlocks:         totalBlocks,
+		BlockSize:           blockSize,
+		SizeInBytes:         sizeInBytes,
+		Chunking:            chunking,
+		Duration:            time.Duration(durationMs) * time.Millisecond,
+		SourcePath:          sourcePath,
+		SourceInode:         uint64(sourceInode),
+		Status:              status,
+		HashSample:          hashSample,
+		HashAlgorithm:       hashAlgorithm,
+		RemoteKey:           remoteKey,
+		AppVersion:          appVersion,
+		MerkleRoot:          merkleRoot,
+		Notes:               notes,
+		ErrorMessage:        errorMessage,
+		LogicalSizeInBytes:  logicalSize,
+		PhysicalSizeInBytes: physicalSize,
+		CreatedAt:           createdAt.UTC(),
 	}, nil
 }
 
+// LatestBackup returns the most recent backup of the volume, regardless of its type.
+func (s Store) LatestBackup(volumeID int) (BackupRecord, error) {
+	var id int
+	row := s.QueryRow("SELECT id FROM backups WHERE volume_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", volumeID)
+	if err := row.Scan(&id); err != nil {
+		return BackupRecord{}, err
+	}
+
+	return s.findBackup(id)
+}
+
+// FindBackup returns the backup record with the specified id.
+func (s Store) FindBackup(id int) (BackupRecord, error) {
+	return s.findBackup(id)
+}
+
 func (s Store) findBlockPositionsByBackup(backupID int) ([]BlockPosition, error) {
 	var positions []BlockPosition
-	rows, err := s.Query("SELECT id, position, block_id FROM block_positions WHERE backup_id = ? ORDER BY position ASC;", backupID)
+	rows, err := s.Query("SELECT id, position, block_id, run_length FROM block_positions WHERE backup_id = ? ORDER BY position ASC;", backupID)
 	if err != nil {
 		return nil, err
 	}
@@ -295,16 +1140,19 @@ func (s Store) findBlockPositionsByBackup(backupID int) ([]BlockPosition, error)
 		var id int
 		var position int
 		var blockID int
-		if err := rows.Scan(&id, &position, &blockID); err != nil {
+		var runLength int
+		if err := rows.Scan(&id, &position, &blockID, &runLength); err != nil {
 			return positions, err
 		}
 
-		positions = append(positions, BlockPosition{
-			id:       id,
-			backupID: backupID,
-			blockID:  blockID,
-			position: position,
-		})
+		for i := 0; i < runLength; i++ {
+			positions = append(positions, BlockPosition{
+				id:       id,
+				backupID: backupID,
+				blockID:  blockID + i,
+				position: position + i,
+			})
+		}
 	}
 
 	return positions, nil
@@ -312,7 +1160,7 @@ func (s Store) findBlockPositionsByBackup(backupID int) ([]BlockPosition, error)
 
 func (s Store) UniqueBlocksInBackup(backupID int) (int, error) {
 	var count int
-	row := s.QueryRow("SELECT COUNT(DISTINCT block_id) FROM block_positions WHERE backup_id = ?", backupID)
+	row := s.QueryRow("SELECT COUNT(DISTINCT b.id) FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ?", backupID)
 	if err := row.Scan(&count); err != nil {
 		return -1, err
 	}
@@ -320,9 +1168,20 @@ func (s Store) UniqueBlocksInBackup(backupID int) (int, error) {
 	return count, nil
 }
 
+// countPositions returns the number of distinct positions recorded for the backup.
+func (s Store) countPositions(backupID int) (int, error) {
+	var count int
+	row := s.QueryRow("SELECT COUNT(DISTINCT "+blockPosition+") FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ?", backupID)
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
 func (s Store) findBlockAtPosition(backupID int, pos int) (*Block, error) {
 	var hash string
-	row := s.QueryRow("SELECT hash FROM blocks b JOIN block_positions bp ON bp.block_id = b.id WHERE bp.backup_id = ? AND bp.position = ?", backupID, pos)
+	row := s.QueryRow("SELECT hash FROM block_positions bp JOIN blocks b ON b.id = bp.block_id + ? - bp.position WHERE bp.backup_id = ? AND bp.position <= ? AND bp.position + bp.run_length > ?", pos, backupID, pos, pos)
 	err := row.Scan(&hash)
 	switch {
 	case err == sql.ErrNoRows:
@@ -333,3 +1192,180 @@ func (s Store) findBlockAtPosition(backupID int, pos int) (*Block, error) {
 
 	return &Block{hash: hash}, nil
 }
+
+func (s Store) findHashesByBackup(backupID int) (map[int]string, error) {
+	rows, err := s.Query("SELECT "+blockPosition+", b.hash FROM block_positions bp JOIN blocks b ON "+positionRange+" WHERE bp.backup_id = ?", backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := make(map[int]string)
+	for rows.Next() {
+		var position int
+		var hash string
+		if err := rows.Scan(&position, &hash); err != nil {
+			return nil, err
+		}
+		hashes[position] = hash
+	}
+
+	return hashes, rows.Err()
+}
+
+// MissingPositions returns the positions within a full backup's range that have no
+// recorded block position, which would leave a hole in the restored output.
+// Differential backups are sparse by design, so no positions are reported for them.
+func (s Store) MissingPositions(backupID int) ([]int, error) {
+	backup, err := s.findBackup(backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if backup.BackupType != backupTypeFull {
+		return nil, nil
+	}
+
+	rows, err := s.Query("SELECT position, run_length FROM block_positions WHERE backup_id = ? ORDER BY position ASC", backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var missing []int
+	expected := 0
+	for rows.Next() {
+		var position, runLength int
+		if err := rows.Scan(&position, &runLength); err != nil {
+			return nil, err
+		}
+
+		for ; expected < position && expected < backup.TotalBlocks; expected++ {
+			missing = append(missing, expected)
+		}
+		if end := position + runLength; end > expected {
+			expected = end
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for ; expected < backup.TotalBlocks; expected++ {
+		missing = append(missing, expected)
+	}
+
+	return missing, nil
+}
+
+// BlockReference identifies a position within a backup that references a block.
+type BlockReference struct {
+	BackupID   int
+	VolumeID   int
+	BackupType string
+	FileName   string
+	Position   int
+}
+
+// BackupsReferencingHash returns every backup position that references the block with the specified hash.
+func (s Store) BackupsReferencingHash(hash string) ([]BlockReference, error) {
+	rows, err := s.Query(`SELECT bk.id, bk.volume_id, bk.backup_type, bk.file_name, `+blockPosition+` AS pos
+		FROM blocks b
+		JOIN block_positions bp ON `+positionRange+`
+		JOIN backups bk ON bk.id = bp.backup_id
+		WHERE b.hash = ?
+		ORDER BY bk.id ASC, pos ASC`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []BlockReference
+	for rows.Next() {
+		var ref BlockReference
+		if err := rows.Scan(&ref.BackupID, &ref.VolumeID, &ref.BackupType, &ref.FileName, &ref.Position); err != nil {
+			return refs, err
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+// HistogramBucket counts the unique blocks of a backup that are referenced by the same number of
+// positions.
+type HistogramBucket struct {
+	References int
+	Blocks     int
+}
+
+// BlockHistogram returns how many of the backup's unique blocks are referenced by each number of
+// positions, fewest references first. Highly repeated blocks, such as zeroed ones, show up as a
+// bucket with many references. A differential only covers the positions it recorded.
+func (s Store) BlockHistogram(backupID int) ([]HistogramBucket, error) {
+	if _, err := s.findBackup(backupID); err != nil {
+		return nil, fmt.Errorf("error resolving backup record with id %d: %w", backupID, err)
+	}
+
+	rows, err := s.Query(`SELECT refs, COUNT(*) FROM (
+			SELECT b.id, COUNT(DISTINCT `+blockPosition+`) AS refs
+			FROM block_positions bp
+			JOIN blocks b ON `+positionRange+`
+			WHERE bp.backup_id = ?
+			GROUP BY b.id
+		)
+		GROUP BY refs
+		ORDER BY refs ASC`, backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []HistogramBucket
+	for rows.Next() {
+		var bucket HistogramBucket
+		if err := rows.Scan(&bucket.References, &bucket.Blocks); err != nil {
+			return buckets, err
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// SharedBlockStat describes a block referenced by the backups of more than one volume.
+type SharedBlockStat struct {
+	BlockID int
+	Hash    string
+	// Volumes is the number of distinct volumes referencing the block.
+	Volumes int
+	// References is the number of positions referencing the block across all backups.
+	References int
+}
+
+// CrossVolumeSharedBlocks returns the blocks referenced by more than one volume, most shared first.
+func (s Store) CrossVolumeSharedBlocks() ([]SharedBlockStat, error) {
+	rows, err := s.Query(`SELECT b.id, b.hash, COUNT(DISTINCT bk.volume_id) AS volumes, COUNT(*) AS refs
+		FROM blocks b
+		JOIN block_positions bp ON ` + positionRange + `
+		JOIN backups bk ON bk.id = bp.backup_id
+		GROUP BY b.id
+		HAVING volumes > 1
+		ORDER BY volumes DESC, refs DESC, b.id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []SharedBlockStat
+	for rows.Next() {
+		var stat SharedBlockStat
+		if err := rows.Scan(&stat.BlockID, &stat.Hash, &stat.Volumes, &stat.References); err != nil {
+			return stats, err
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, rows.Err()
+}
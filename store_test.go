@@ -0,0 +1,1489 @@
+package block
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMissingPositions(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	b, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := store.MissingPositions(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing positions, got %v", missing)
+	}
+
+	var blockID int
+	row := store.QueryRow("SELECT block_id FROM block_positions WHERE backup_id = ? AND position = ?", b.Record.ID, 17)
+	if err := row.Scan(&blockID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Exec("DELETE FROM block_positions WHERE backup_id = ? AND position = ?", b.Record.ID, 17); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err = store.MissingPositions(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) != 1 || missing[0] != 17 {
+		t.Fatalf("expected position 17 to be missing, got %v", missing)
+	}
+
+	// Restore the position, as differentials refuse to build on an incomplete full.
+	if _, err := store.Exec("INSERT INTO block_positions (backup_id, block_id, position) VALUES (?, ?, ?)", b.Record.ID, blockID, 17); err != nil {
+		t.Fatal(err)
+	}
+
+	// Differentials are sparse, so gaps are not reported.
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err = store.MissingPositions(db.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing positions for a differential, got %v", missing)
+	}
+}
+
+func TestBackupsReferencingHash(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	var backupIDs []int
+	for _, devicePath := range []string{"assets/pg.ext4", "assets/pg_altered.ext4"} {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+		backupIDs = append(backupIDs, b.Record.ID)
+	}
+
+	// Position 1 is unchanged between the two assets, so its block is shared.
+	block, err := store.findBlockAtPosition(backupIDs[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := store.BackupsReferencingHash(block.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[int]bool{}
+	for _, ref := range refs {
+		if ref.Position == 1 {
+			found[ref.BackupID] = true
+		}
+	}
+
+	for _, id := range backupIDs {
+		if !found[id] {
+			t.Fatalf("expected backup %d to reference the shared block at position 1, got %+v", id, refs)
+		}
+	}
+
+	refs, err = store.BackupsReferencingHash("does-not-exist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 0 {
+		t.Fatalf("expected no references for an unknown hash, got %d", len(refs))
+	}
+}
+
+func TestSplitStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenSplitStore(filepath.Join(dir, "catalog.db"), filepath.Join(dir, "blocks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// The block tables live in the attached database only.
+	var count int
+	row := store.QueryRow("SELECT COUNT(*) FROM main.sqlite_master WHERE name IN ('blocks', 'block_positions')")
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected the catalog to hold no block tables, got %d", count)
+	}
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Differentials resolve the volume's full through the attached block data.
+	if db.Record.BackupType != backupTypeDifferential {
+		t.Fatalf("expected a differential backup, got %s", db.Record.BackupType)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	positions, err := store.findBlockPositionsByBackup(db.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 1 {
+		t.Fatalf("expected 1 block position, got %d", len(positions))
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores",
+		OutputFileName:     db.Record.FileName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	targetChecksum, err := fileChecksum(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffWithChangesChecksum != targetChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", diffWithChangesChecksum, targetChecksum)
+	}
+
+	// The block data was written to the attached database.
+	blocks, err := OpenStore(filepath.Join(dir, "blocks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocks.Close()
+
+	row = blocks.QueryRow("SELECT COUNT(*) FROM block_positions")
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 51 {
+		t.Fatalf("expected 51 block positions in the blocks database, got %d", count)
+	}
+}
+
+func TestRenameVolume(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	dir := t.TempDir()
+	data, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sdb"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      filepath.Join(dir, "sdb"),
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device comes back under a new path with a changed block.
+	altered, err := os.ReadFile("assets/pg_altered.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPath := filepath.Join(dir, "sdc")
+	if err := os.WriteFile(newPath, altered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RenameVolume("sdb", "sdc"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateVolumeDevicePath(fb.vol.ID, newPath); err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err := store.FindVolume("sdc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.ID != fb.vol.ID || vol.DevicePath != newPath {
+		t.Fatalf("expected volume %d at %s, got volume %d at %s", fb.vol.ID, newPath, vol.ID, vol.DevicePath)
+	}
+
+	cfg.DevicePath = newPath
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Record.BackupType != backupTypeDifferential || db.Record.VolumeID != fb.vol.ID {
+		t.Fatalf("expected a differential of volume %d, got a %s of volume %d", fb.vol.ID, db.Record.BackupType, db.Record.VolumeID)
+	}
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	positions, err := store.findBlockPositionsByBackup(db.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(positions) != 1 {
+		t.Fatalf("expected 1 block position, got %d", len(positions))
+	}
+
+	// Renaming onto an existing volume is refused.
+	if _, err := store.InsertVolume("sdd", "/dev/sdd"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RenameVolume("sdc", "sdd"); err == nil {
+		t.Fatal("expected renaming onto an existing volume to fail")
+	}
+}
+
+func TestCountBackups(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	count, err := store.CountBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Fatalf("expected no backups, got %d", count)
+	}
+
+	var volumeID int
+	for _, devicePath := range []string{"assets/pg.ext4", "assets/pg.ext4", "assets/tiny.ext4"} {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		if devicePath == "assets/pg.ext4" {
+			volumeID = b.vol.ID
+		}
+	}
+
+	count, err = store.CountBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 3 {
+		t.Fatalf("expected 3 backups, got %d", count)
+	}
+
+	count, err = store.CountBackupsByVolume(volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("expected 2 backups of the volume, got %d", count)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats != (Stats{}) {
+		t.Fatalf("expected an empty store to have no stats, got %+v", stats)
+	}
+
+	cfg := &BackupConfig{
+		Store:                store,
+		DevicePath:           "assets/pg.ext4",
+		OutputFormat:         BackupOutputFormatFile,
+		OutputDirectory:      "backups/",
+		BlockSize:            1048576,
+		BlockBufferSize:      5,
+		EncodePositionRanges: true,
+	}
+
+	// A full and differential of one volume, then a full of another.
+	for _, source := range []struct{ volume, device string }{
+		{"assets/pg.ext4", "assets/pg.ext4"},
+		{"assets/pg.ext4", "assets/pg_altered.ext4"},
+		{"assets/tiny.ext4", "assets/tiny.ext4"},
+	} {
+		cfg.DevicePath = source.volume
+		b, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Hack the device path to simulate a change
+		b.vol.DevicePath = source.device
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err = store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compute each total individually.
+	volumes, err := store.ListVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uniqueBlocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Stats{Volumes: len(volumes), Backups: len(backups), UniqueBlocks: uniqueBlocks}
+	for _, b := range backups {
+		switch b.BackupType {
+		case backupTypeFull:
+			expected.FullBackups++
+		case backupTypeDifferential:
+			expected.DifferentialBackups++
+		}
+
+		positions, err := store.countPositions(b.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected.Positions += positions
+		expected.LogicalSizeInBytes += b.LogicalSizeInBytes
+		expected.PhysicalSizeInBytes += b.PhysicalSizeInBytes
+	}
+
+	if stats != expected {
+		t.Fatalf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	if stats.Volumes != 2 || stats.FullBackups != 2 || stats.DifferentialBackups != 1 {
+		t.Fatalf("expected 2 volumes with 2 fulls and a differential, got %+v", stats)
+	}
+}
+
+func TestLatestBackup(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := store.LatestBackup(fb.vol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if latest.ID != fb.Record.ID {
+		t.Fatalf("expected the full backup %d, got %d", fb.Record.ID, latest.ID)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err = store.LatestBackup(fb.vol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if latest.ID != db.Record.ID || latest.BackupType != backupTypeDifferential {
+		t.Fatalf("expected the differential backup %d, got %s backup %d", db.Record.ID, latest.BackupType, latest.ID)
+	}
+}
+
+func TestCrossVolumeSharedBlocks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// The two files are separate volumes that differ only in their first block.
+	var backupIDs []int
+	for _, devicePath := range []string{"assets/pg.ext4", "assets/pg_altered.ext4"} {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		backupIDs = append(backupIDs, b.Record.ID)
+	}
+
+	// Count the references to each hash within each volume's backup.
+	counts := make([]map[string]int, len(backupIDs))
+	for i, id := range backupIDs {
+		hashes, err := store.findHashesByBackup(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counts[i] = map[string]int{}
+		for _, hash := range hashes {
+			counts[i][hash]++
+		}
+	}
+
+	expected := map[string]int{}
+	for hash, n := range counts[0] {
+		if m, ok := counts[1][hash]; ok {
+			expected[hash] = n + m
+		}
+	}
+
+	shared, err := store.CrossVolumeSharedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shared) == 0 || len(shared) != len(expected) {
+		t.Fatalf("expected %d shared blocks, got %d", len(expected), len(shared))
+	}
+
+	for _, stat := range shared {
+		if stat.Volumes != 2 {
+			t.Fatalf("expected block %d to be shared by 2 volumes, got %d", stat.BlockID, stat.Volumes)
+		}
+
+		if stat.References != expected[stat.Hash] {
+			t.Fatalf("expected block %d to have %d references, got %d", stat.BlockID, expected[stat.Hash], stat.References)
+		}
+	}
+}
+
+func TestValidateReferentialIntegrity(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err := store.ValidateReferentialIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no integrity errors, got %v", errs)
+	}
+
+	// Point a position at a block that doesn't exist, as if the blocks were renumbered.
+	var positionID int
+	if err := store.QueryRow("SELECT id FROM block_positions WHERE backup_id = ? AND position = 0", b.Record.ID).Scan(&positionID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Exec("UPDATE block_positions SET block_id = 999999 WHERE id = ?", positionID); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err = store.ValidateReferentialIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := IntegrityError{
+		Table:           "block_positions",
+		RowID:           positionID,
+		Column:          "block_id",
+		Reference:       999999,
+		ReferencedTable: "blocks",
+	}
+	if len(errs) != 1 || errs[0] != expected {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+}
+
+func TestBackupAppVersion(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+		AppVersion:      "v1.4.2-3-g9c1e2f7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.AppVersion != "v1.4.2-3-g9c1e2f7" {
+		t.Fatalf("expected app version v1.4.2-3-g9c1e2f7, got %q", record.AppVersion)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 1 || backups[0].AppVersion != record.AppVersion {
+		t.Fatalf("expected the listed backup to have app version %q, got %v", record.AppVersion, backups)
+	}
+}
+
+func TestStaleVolumes(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	before := time.Now()
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err := store.FindVolume("tiny.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.LastBackupAt.Before(before) || vol.LastBackupAt.After(time.Now()) {
+		t.Fatalf("expected the last backup time to be updated by the backup, got %v", vol.LastBackupAt)
+	}
+
+	never, err := store.InsertVolume("never", "/dev/never")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleNames := func(olderThan time.Duration) []string {
+		stale, err := store.StaleVolumes(olderThan)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, v := range stale {
+			names = append(names, v.Name)
+		}
+		return names
+	}
+
+	if names := staleNames(time.Hour); len(names) != 1 || names[0] != never.Name {
+		t.Fatalf("expected only the volume that was never backed up to be stale, got %v", names)
+	}
+
+	// Age the backup past the threshold.
+	if _, err := store.Exec("UPDATE volumes SET last_backup_at = ? WHERE id = ?", time.Now().Add(-48*time.Hour), vol.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := staleNames(24 * time.Hour); len(names) != 2 {
+		t.Fatalf("expected both volumes to be stale, got %v", names)
+	}
+
+	if names := staleNames(72 * time.Hour); len(names) != 1 || names[0] != never.Name {
+		t.Fatalf("expected only the volume that was never backed up to be stale, got %v", names)
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := NewReadOnlyStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	backups, err := ro.ListBackups()
+	if err != nil {
+		t.Fatalf("expected read-only store to query backups: %v", err)
+	}
+
+	if len(backups) != 1 || backups[0].ID != b.Record.ID {
+		t.Fatalf("expected backup %d to be listed, got %+v", b.Record.ID, backups)
+	}
+
+	_, err = ro.InsertVolume("readonly", "/dev/null")
+	if err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Fatalf("expected write to a read-only store to fail, got %v", err)
+	}
+}
+
+func TestRestoreChain(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	// A full, followed by a differential of the altered source and one of the original.
+	var backups []*Backup
+	for _, source := range []string{"assets/pg.ext4", "assets/pg_altered.ext4", "assets/pg.ext4"} {
+		b, err := NewBackup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.vol.DevicePath = source
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, b)
+	}
+
+	full := backups[0].Record.ID
+	expected := map[int][]int{
+		full:                 {full},
+		backups[1].Record.ID: {full, backups[1].Record.ID},
+		backups[2].Record.ID: {full, backups[2].Record.ID},
+	}
+
+	for backupID, ids := range expected {
+		chain, err := store.RestoreChain(backupID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(chain) != len(ids) {
+			t.Fatalf("expected backup %d to have a chain of %d backups, got %+v", backupID, len(ids), chain)
+		}
+
+		for i, backup := range chain {
+			if backup.ID != ids[i] {
+				t.Fatalf("expected backup %d to be layer %d of the chain of backup %d, got %d", ids[i], i, backupID, backup.ID)
+			}
+		}
+	}
+
+	// Each differential is restored on top of the full, not the differentials before it.
+	for i, checksum := range map[int]string{1: diffWithChangesChecksum, 2: fullBackupChecksum} {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     backups[i].Record.ID,
+			OutputDirectory:    "restores/",
+			OutputFileName:     backups[i].Record.FileName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), checksum)
+	}
+
+	if _, err := store.RestoreChain(999); err == nil {
+		t.Fatal("expected an error for a missing backup")
+	}
+}
+
+func TestBackupCreatedAtUTC(t *testing.T) {
+	// Run in a non-UTC zone so a local timestamp would be caught.
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	vol, err := store.InsertVolume("vol", "assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.insertBackupRecord(vol.ID, "vol_full", "backups/vol_full", string(BackupOutputFormatFile), backupTypeFull, 50, 1048576, 52428800, ChunkingFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record.CreatedAt.Location() != time.UTC {
+		t.Fatalf("expected the returned record's CreatedAt in UTC, got %s", record.CreatedAt.Location())
+	}
+
+	found, err := store.findBackup(record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !found.CreatedAt.Equal(record.CreatedAt) || found.CreatedAt.Location() != time.UTC {
+		t.Fatalf("expected CreatedAt %s, got %s", record.CreatedAt, found.CreatedAt)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 1 || backups[0].CreatedAt.String() != record.CreatedAt.String() {
+		t.Fatalf("expected the listed CreatedAt to match %s, got %v", record.CreatedAt, backups)
+	}
+}
+
+func TestBlockHistogram(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := store.findHashesByBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := map[string]int{}
+	for _, hash := range hashes {
+		refs[hash]++
+	}
+
+	expected := map[int]int{}
+	for _, n := range refs {
+		expected[n]++
+	}
+
+	histogram, err := store.BlockHistogram(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(histogram) != len(expected) {
+		t.Fatalf("expected %d buckets, got %v", len(expected), histogram)
+	}
+
+	// The sample volume has 50 positions referencing 37 unique blocks.
+	var blocks, positions int
+	for i, bucket := range histogram {
+		if i > 0 && bucket.References <= histogram[i-1].References {
+			t.Fatalf("expected buckets ordered by references, got %v", histogram)
+		}
+
+		if bucket.Blocks != expected[bucket.References] {
+			t.Fatalf("expected %d blocks referenced %d times, got %d", expected[bucket.References], bucket.References, bucket.Blocks)
+		}
+		blocks += bucket.Blocks
+		positions += bucket.Blocks * bucket.References
+	}
+
+	if blocks != 37 || positions != 50 {
+		t.Fatalf("expected 37 unique blocks across 50 positions, got %d across %d", blocks, positions)
+	}
+
+	if histogram[len(histogram)-1].References < 2 {
+		t.Fatalf("expected a block referenced more than once, got %v", histogram)
+	}
+
+	if _, err := store.BlockHistogram(b.Record.ID + 1); err == nil {
+		t.Fatal("expected an error for an unknown backup")
+	}
+}
+
+func TestSetBackupNotes(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/tiny.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Record.Notes != "" {
+		t.Fatalf("expected a new backup to have no notes, got %q", b.Record.Notes)
+	}
+
+	const notes = "pre-upgrade snapshot, verified restore on 2024-01-02"
+	if err := store.SetBackupNotes(b.Record.ID, notes); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.Notes != notes {
+		t.Fatalf("expected notes %q, got %q", notes, found.Notes)
+	}
+
+	backups, err := store.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 1 || backups[0].Notes != notes {
+		t.Fatalf("expected the listed backup to have notes %q, got %v", notes, backups)
+	}
+
+	if err := store.SetBackupNotes(b.Record.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = store.FindBackup(b.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.Notes != "" {
+		t.Fatalf("expected the notes to be cleared, got %q", found.Notes)
+	}
+
+	if err := store.SetBackupNotes(b.Record.ID+1, notes); err == nil {
+		t.Fatal("expected an error setting the notes of an unknown backup")
+	}
+}
+
+func TestVolumeDefaults(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	vol, err := store.InsertVolume("pg.ext4", "assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults, err := store.GetVolumeDefaults(vol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if defaults.BlockSize != 0 || defaults.Chunking != "" || len(defaults.FilterCommand) != 0 {
+		t.Fatalf("expected a volume without defaults to return zero defaults, got %+v", defaults)
+	}
+
+	want := VolumeDefaults{BlockSize: 65536, Chunking: ChunkingFixed}
+	if err := store.SetVolumeDefaults(vol.ID, want); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults, err = store.GetVolumeDefaults(vol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if defaults.BlockSize != want.BlockSize || defaults.Chunking != want.Chunking {
+		t.Fatalf("expected defaults %+v, got %+v", want, defaults)
+	}
+
+	// An explicit setting wins over the volume's default.
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       4096,
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Config.BlockSize != 4096 {
+		t.Fatalf("expected an explicit block size to override the default, got %d", b.Config.BlockSize)
+	}
+
+	b, err = NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockBufferSize: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Record.BlockSize != want.BlockSize {
+		t.Fatalf("expected the backup to inherit block size %d, got %d", want.BlockSize, b.Record.BlockSize)
+	}
+
+	if b.Record.Chunking != want.Chunking {
+		t.Fatalf("expected the backup to inherit chunking %q, got %q", want.Chunking, b.Record.Chunking)
+	}
+
+	if err := store.SetVolumeDefaults(vol.ID+1, want); err == nil {
+		t.Fatal("expected setting the defaults of an unknown volume to fail")
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:                 store,
+		DevicePath:            "assets/pg.ext4",
+		OutputFormat:          BackupOutputFormatFile,
+		OutputDirectory:       "backups/",
+		BlockSize:             1048576,
+		BlockBufferSize:       5,
+		CompactConstantBlocks: true,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another volume's backup must survive the deletion.
+	other, err := NewBackup(&BackupConfig{
+		Store:                 store,
+		DevicePath:            "assets/tiny.ext4",
+		OutputFormat:          BackupOutputFormatFile,
+		OutputDirectory:       "backups/",
+		BlockSize:             1048576,
+		BlockBufferSize:       5,
+		CompactConstantBlocks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	otherBlocks, err := store.UniqueBlocksInBackup(other.Record.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteVolume(fb.vol.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.FindVolume(fb.vol.Name); err != sql.ErrNoRows {
+		t.Fatalf("expected the volume to be deleted, got %v", err)
+	}
+
+	for _, b := range []*Backup{fb, db} {
+		if _, err := store.FindBackup(b.Record.ID); err == nil {
+			t.Fatalf("expected backup %d to be deleted", b.Record.ID)
+		}
+
+		if _, err := os.Stat(b.FullPath()); !os.IsNotExist(err) {
+			t.Fatalf("expected backup file %s to be removed, got %v", b.FullPath(), err)
+		}
+	}
+
+	var positions int
+	if err := store.QueryRow("SELECT COUNT(*) FROM block_positions WHERE backup_id IN (?, ?)", fb.Record.ID, db.Record.ID).Scan(&positions); err != nil {
+		t.Fatal(err)
+	}
+
+	if positions != 0 {
+		t.Fatalf("expected the volume's block positions to be deleted, got %d", positions)
+	}
+
+	// Only the other volume's blocks remain.
+	blocks, err := store.TotalBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if blocks != otherBlocks {
+		t.Fatalf("expected %d blocks to remain, got %d", otherBlocks, blocks)
+	}
+
+	if _, err := store.FindBackup(other.Record.ID); err != nil {
+		t.Fatalf("expected the other volume's backup to remain, got %v", err)
+	}
+
+	if _, err := os.Stat(other.FullPath()); err != nil {
+		t.Fatalf("expected the other volume's backup file to remain, got %v", err)
+	}
+
+	if err := store.DeleteVolume(fb.vol.ID); err == nil {
+		t.Fatal("expected deleting a deleted volume to fail")
+	}
+}
+
+func TestDeleteVolumeSharedBlocks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	data, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of the volume deduplicates against its blocks.
+	copyPath := filepath.Join(t.TempDir(), "pg_copy.ext4")
+	if err := os.WriteFile(copyPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var volumes []*Backup
+	for _, path := range []string{"assets/pg.ext4", copyPath} {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      path,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+		volumes = append(volumes, b)
+	}
+
+	if err := store.DeleteVolume(volumes[0].vol.ID); err == nil || !strings.Contains(err.Error(), "shares") {
+		t.Fatalf("expected deleting a volume with shared blocks to fail, got %v", err)
+	}
+
+	if _, err := os.Stat(volumes[0].FullPath()); err != nil {
+		t.Fatalf("expected the refused deletion to keep the backup file, got %v", err)
+	}
+}
+
+func TestMigrateMovedMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewind  []string
+		version int
+	}{
+		// Once volume_settings was added, before the error_message migration was inserted ahead of it.
+		{name: "volume settings", rewind: []string{"ALTER TABLE backups DROP COLUMN error_message;", "DROP TABLE hash_cache;"}, version: 19},
+		// Once error_message was added, before the hash_cache migration was inserted ahead of volume_settings.
+		{name: "error message", rewind: []string{"DROP TABLE hash_cache;"}, version: 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := NewStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			setup(store)
+			defer cleanup(t)
+
+			// Drop what the migrations after the rewound version added too.
+			stmts := append(test.rewind,
+				"ALTER TABLE backups DROP COLUMN hash_algorithm;",
+				"ALTER TABLE backups DROP COLUMN logical_size;",
+				"ALTER TABLE backups DROP COLUMN physical_size;",
+				"ALTER TABLE volumes DROP COLUMN uuid;",
+				fmt.Sprintf("PRAGMA user_version = %d;", test.version),
+			)
+			for _, stmt := range stmts {
+				if _, err := store.Exec(stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := store.SetupDB(); err != nil {
+				t.Fatal(err)
+			}
+
+			version, err := store.SchemaVersion()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version != LatestSchemaVersion() {
+				t.Fatalf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+			}
+
+			b, err := NewBackup(&BackupConfig{
+				Store:           store,
+				DevicePath:      "assets/tiny.ext4",
+				OutputFormat:    BackupOutputFormatFile,
+				OutputDirectory: "backups/",
+				BlockSize:       1048576,
+				BlockBufferSize: 5,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.markBackupFailed(b.Record.ID, errors.New("simulated failure")); err != nil {
+				t.Fatal(err)
+			}
+
+			backups, err := store.ListBackups()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(backups) != 1 || backups[0].ErrorMessage != "simulated failure" {
+				t.Fatalf("expected the failure to be recorded, got %+v", backups)
+			}
+
+			// Deleting the volume clears its hash cache.
+			if err := store.DeleteVolume(b.Record.VolumeID); err != nil {
+				t.Fatal(err)
+			}
+
+			// Migrating again is a no-op.
+			if err := store.SetupDB(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// streamMagic marks the start of each frame in a backup stream.
+var streamMagic = [8]byte{'B', 'D', 'S', 'T', 'R', 'E', 'A', 'M'}
+
+// streamHeader precedes each backup's data in a backup stream. Frames can be concatenated,
+// so a full backup's frame followed by a differential's frame restores the differential.
+type streamHeader struct {
+	Magic [8]byte
+	// BackupID is the backup the frame's data belongs to.
+	BackupID int64
+	// ParentID is the full backup a differential is layered on top of, or 0 for a full backup.
+	ParentID int64
+	// BlockSize is the block size of the backup.
+	BlockSize int64
+	// Length is the number of bytes of backup data following the header.
+	Length int64
+}
+
+// WriteBackupStream writes the backup as a self-delimiting frame to w. The frames of a full
+// backup and its differential can be concatenated and restored using RestoreConfig.Stream.
+func (s Store) WriteBackupStream(w io.Writer, backupID int) error {
+	backup, err := s.findBackup(backupID)
+	if err != nil {
+		return fmt.Errorf("error resolving backup record with id %d: %v", backupID, err)
+	}
+
+	if backup.Chunking == ChunkingContentDefined {
+		return fmt.Errorf("backup %d uses content-defined chunking, which can't be streamed", backup.ID)
+	}
+
+	header := streamHeader{
+		Magic:     streamMagic,
+		BackupID:  int64(backup.ID),
+		BlockSize: int64(backup.BlockSize),
+	}
+
+	if backup.BackupType == backupTypeDifferential {
+		chain, err := s.RestoreChain(backup.ID)
+		if err != nil {
+			return fmt.Errorf("error resolving restore chain: %v", err)
+		}
+		header.ParentID = int64(chain[0].ID)
+	}
+
+	f, err := os.Open(backup.FullPath)
+	if err != nil {
+		return fmt.Errorf("error opening backup file: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting backup size: %v", err)
+	}
+	header.Length = fi.Size()
+
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return fmt.Errorf("error writing stream header: %w", err)
+	}
+
+	if _, err := io.CopyN(w, f, header.Length); err != nil {
+		return fmt.Errorf("error writing backup data to stream: %w", err)
+	}
+
+	return nil
+}
+
+// restoreStream applies each frame of the configured stream in order.
+// Every frame must belong to the restore's chain, and differentials must follow their full backup.
+func (r *Restore) restoreStream(target restoreTarget) error {
+	applied := map[int]bool{}
+	for {
+		var header streamHeader
+		err := binary.Read(r.config.Stream, binary.BigEndian, &header)
+		switch {
+		case err == io.EOF:
+			if !applied[r.backup.ID] {
+				return fmt.Errorf("stream ended before backup %d was restored", r.backup.ID)
+			}
+			return nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return fmt.Errorf("stream truncated within a frame header")
+		case err != nil:
+			return fmt.Errorf("error reading stream header: %w", err)
+		}
+
+		if header.Magic != streamMagic {
+			return fmt.Errorf("invalid stream frame: bad magic %q", header.Magic[:])
+		}
+
+		backupID := int(header.BackupID)
+		if !r.inChain(backupID) {
+			return fmt.Errorf("stream frame for backup %d is not part of the restore chain of backup %d", backupID, r.backup.ID)
+		}
+
+		backup, err := r.store.findBackup(backupID)
+		if err != nil {
+			return fmt.Errorf("error resolving backup record with id %d: %v", backupID, err)
+		}
+
+		if int64(backup.BlockSize) != header.BlockSize {
+			return fmt.Errorf("stream frame for backup %d has block size %d, expected %d", backupID, header.BlockSize, backup.BlockSize)
+		}
+
+		if backup.BackupType == backupTypeDifferential && !applied[int(header.ParentID)] {
+			return fmt.Errorf("stream frame for differential backup %d precedes its full backup %d", backupID, header.ParentID)
+		}
+
+		frame := io.LimitReader(r.config.Stream, header.Length)
+		if err := r.restoreFromReader(target, frame, fmt.Sprintf("stream frame for backup %d", backupID), backup); err != nil {
+			return err
+		}
+
+		// Skip anything left in the frame so the next header is read from the right place.
+		if _, err := io.Copy(io.Discard, frame); err != nil {
+			return fmt.Errorf("error reading stream: %w", err)
+		}
+
+		applied[backupID] = true
+	}
+}
+
+// inChain reports whether the backup is part of the restore chain.
+func (r *Restore) inChain(backupID int) bool {
+	for _, layer := range r.chain {
+		if layer.ID == backupID {
+			return true
+		}
+	}
+
+	return false
+}
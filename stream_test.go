@@ -0,0 +1,104 @@
+package block
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRestoreConcatenatedStream(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var full, diff bytes.Buffer
+	if err := store.WriteBackupStream(&full, fb.Record.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteBackupStream(&diff, db.Record.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A differential's frame can't be applied before its full.
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "out-of-order",
+		Stream:             bytes.NewReader(append(append([]byte{}, diff.Bytes()...), full.Bytes()...)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore.Run()
+	if err == nil || !strings.Contains(err.Error(), "precedes its full backup") {
+		t.Fatalf("expected an out of order frame error, got %v", err)
+	}
+
+	// Concatenate the full and differential streams into a single stream.
+	var combined bytes.Buffer
+	combined.Write(full.Bytes())
+	combined.Write(diff.Bytes())
+
+	restore, err = NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     db.Record.FileName,
+		Stream:             &combined,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	targetChecksum, err := fileChecksum(restore.FullRestorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffWithChangesChecksum != targetChecksum {
+		t.Fatalf("expected checksums to match, got %s and %s", diffWithChangesChecksum, targetChecksum)
+	}
+}
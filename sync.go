@@ -0,0 +1,338 @@
+package block
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SyncRemote is the receiving end of Store.Sync, such as the store of another host.
+type SyncRemote interface {
+	// MissingBlocks returns the hashes of the blocks hashed with algorithm the remote doesn't hold.
+	MissingBlocks(algorithm HashAlgorithm, hashes []string) ([]string, error)
+	// Receive reconstructs the backup described by manifest, reading the data of the manifest's
+	// Sent blocks from blocks in order. Every other block is one the remote already holds.
+	Receive(manifest SyncManifest, blocks io.Reader) error
+}
+
+// SyncManifest describes a backup transferred by Store.Sync.
+type SyncManifest struct {
+	Volume      string
+	DevicePath  string
+	BlockSize   int
+	SizeInBytes int
+	HashSample  bool
+	// HashAlgorithm is the digest Hashes were computed with.
+	HashAlgorithm HashAlgorithm
+	AppVersion    string
+	// Hashes holds the hash of the block at each position of the volume, in position order.
+	Hashes []string
+	// Sent holds the blocks the remote reported missing, in the order their data is streamed.
+	Sent []SyncBlock
+}
+
+// SyncBlock is a block whose data is streamed to the remote.
+type SyncBlock struct {
+	Hash   string
+	Length int
+}
+
+// SyncResult summarizes a sync.
+type SyncResult struct {
+	// BlocksSent is the number of blocks the remote lacked, and BytesSent the size of their data.
+	BlocksSent int
+	BytesSent  int64
+	// BlocksHeld is the number of the backup's blocks the remote already held.
+	BlocksHeld int
+}
+
+// Sync transfers the backup to remote, sending only the blocks the remote doesn't already hold.
+// The remote reconstructs the volume as it was at the time of the backup, so a differential is
+// received as a full backup. Not supported with ChunkingContentDefined.
+func (s Store) Sync(backupID int, remote SyncRemote) (SyncResult, error) {
+	backup, err := s.findBackup(backupID)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("error resolving backup record with id %d: %w", backupID, err)
+	}
+
+	if backup.Chunking == ChunkingContentDefined {
+		return SyncResult{}, fmt.Errorf("syncing is not supported with %q chunking", backup.Chunking)
+	}
+
+	if backup.Status != backupStatusCompleted {
+		return SyncResult{}, fmt.Errorf("backup %d has not completed", backup.ID)
+	}
+
+	manifest := SyncManifest{
+		BlockSize:     backup.BlockSize,
+		SizeInBytes:   backup.SizeInBytes,
+		HashSample:    backup.HashSample,
+		HashAlgorithm: backup.HashAlgorithm,
+		AppVersion:    backup.AppVersion,
+	}
+
+	row := s.QueryRow("SELECT name, devicePath FROM volumes WHERE id = ?", backup.VolumeID)
+	if err := row.Scan(&manifest.Volume, &manifest.DevicePath); err != nil {
+		return SyncResult{}, fmt.Errorf("error resolving volume %d: %w", backup.VolumeID, err)
+	}
+
+	manifest.Hashes, err = s.positionHashes(backup)
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	// Constant blocks are reconstructed from their descriptor, so they're never sent.
+	var unique []string
+	seen := map[string]bool{}
+	for _, hash := range manifest.Hashes {
+		if !seen[hash] && !isFillBlock(hash) {
+			unique = append(unique, hash)
+		}
+		seen[hash] = true
+	}
+
+	missing, err := remote.MissingBlocks(backup.HashAlgorithm, unique)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("error checking the blocks held by the remote: %w", err)
+	}
+
+	wanted := map[string]bool{}
+	for _, hash := range missing {
+		wanted[hash] = true
+	}
+
+	// Spool the missing blocks, so the manifest lists them before their data is streamed.
+	spool, err := os.CreateTemp("", "sync-*")
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("error creating sync spool file: %v", err)
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+
+	chain, err := s.RestoreChain(backup.ID)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("error resolving restore chain: %v", err)
+	}
+
+	result := SyncResult{BlocksHeld: len(unique) - len(wanted)}
+	r := &Restore{store: &s, backup: backup, chain: chain}
+	spooler := bufio.NewWriter(spool)
+	for _, layer := range chain {
+		err := r.readStoredBlocks(layer, func(hash string, data []byte) error {
+			if !wanted[hash] {
+				return nil
+			}
+			delete(wanted, hash)
+
+			if _, err := spooler.Write(data); err != nil {
+				return fmt.Errorf("error spooling block %s: %v", hash, err)
+			}
+			manifest.Sent = append(manifest.Sent, SyncBlock{Hash: hash, Length: len(data)})
+			result.BytesSent += int64(len(data))
+
+			return nil
+		})
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+
+	for hash := range wanted {
+		return SyncResult{}, fmt.Errorf("block %s is not stored in the files of backup %d's chain", hash, backup.ID)
+	}
+
+	if err := spooler.Flush(); err != nil {
+		return SyncResult{}, fmt.Errorf("error spooling blocks: %v", err)
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return SyncResult{}, err
+	}
+
+	if err := remote.Receive(manifest, bufio.NewReader(spool)); err != nil {
+		return SyncResult{}, fmt.Errorf("error transferring backup %d: %w", backup.ID, err)
+	}
+	result.BlocksSent = len(manifest.Sent)
+
+	return result, nil
+}
+
+// StoreRemote receives synced backups into a store, such as one shared by another host. The
+// backup files it reconstructs are written to OutputDirectory.
+type StoreRemote struct {
+	Store           *Store
+	OutputDirectory string
+}
+
+// MissingBlocks returns the hashes the store has no block hashed with algorithm for.
+func (sr StoreRemote) MissingBlocks(algorithm HashAlgorithm, hashes []string) ([]string, error) {
+	var missing []string
+	for _, hash := range hashes {
+		var count int
+		if err := sr.Store.QueryRow("SELECT COUNT(*) FROM blocks WHERE algorithm = ? AND hash = ?", algorithm, hash).Scan(&count); err != nil {
+			return nil, err
+		}
+
+		if count == 0 {
+			missing = append(missing, hash)
+		}
+	}
+
+	return missing, nil
+}
+
+// spooledBlock locates a block's data within a spool file.
+type spooledBlock struct {
+	offset int64
+	length int
+}
+
+// Receive writes a full backup file holding the manifest's blocks, reading those that weren't
+// sent from the store's existing backup files, and catalogs it (see RecoverFromFile).
+func (sr StoreRemote) Receive(manifest SyncManifest, blocks io.Reader) error {
+	spool, err := os.CreateTemp(sr.OutputDirectory, "sync-*")
+	if err != nil {
+		return fmt.Errorf("error creating sync spool file: %v", err)
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+
+	spooled := map[string]spooledBlock{}
+	var offset int64
+	for _, block := range manifest.Sent {
+		if _, err := io.CopyN(spool, blocks, int64(block.Length)); err != nil {
+			return fmt.Errorf("error receiving block %s: %w", block.Hash, err)
+		}
+		spooled[block.Hash] = spooledBlock{offset: offset, length: block.Length}
+		offset += int64(block.Length)
+	}
+
+	needed := map[string]bool{}
+	for _, hash := range manifest.Hashes {
+		if _, ok := spooled[hash]; !ok && !isFillBlock(hash) {
+			needed[hash] = true
+		}
+	}
+
+	if err := sr.spoolHeldBlocks(manifest.HashAlgorithm, needed, spool, spooled, offset); err != nil {
+		return err
+	}
+
+	path := filepath.Join(sr.OutputDirectory, fmt.Sprintf("%s_%s_%d", manifest.Volume, backupTypeFull, time.Now().UnixMilli()))
+	out, err := openOutputFile(path, ExistingFileFail)
+	if err != nil {
+		return fmt.Errorf("error opening backup file: %v", err)
+	}
+	defer func() { _ = out.Close() }()
+
+	// Blocks are written once each, in the order of their first position, as a backup writes them.
+	w := bufio.NewWriter(out)
+	written := map[string]bool{}
+	positions := make([]footerPosition, 0, len(manifest.Hashes))
+	var dataLength int64
+	for pos, hash := range manifest.Hashes {
+		positions = append(positions, footerPosition{position: pos, hash: hash})
+		if written[hash] || isFillBlock(hash) {
+			continue
+		}
+		written[hash] = true
+
+		block := spooled[hash]
+		data := make([]byte, block.length)
+		if _, err := spool.ReadAt(data, block.offset); err != nil {
+			return fmt.Errorf("error reading spooled block %s: %v", hash, err)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error writing backup file: %v", err)
+		}
+		dataLength += int64(len(data))
+	}
+
+	meta := footerMetadata{
+		Version:       footerVersion,
+		Volume:        manifest.Volume,
+		DevicePath:    manifest.DevicePath,
+		BackupType:    backupTypeFull,
+		Chunking:      ChunkingFixed,
+		BlockSize:     manifest.BlockSize,
+		TotalBlocks:   len(manifest.Hashes),
+		SizeInBytes:   manifest.SizeInBytes,
+		HashAlgorithm: manifest.HashAlgorithm,
+		HashSample:    manifest.HashSample,
+		AppVersion:    manifest.AppVersion,
+		DataLength:    dataLength,
+	}
+
+	if err := encodeFooter(w, meta, positions); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing backup file: %v", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing backup file: %v", err)
+	}
+
+	if _, err := RecoverFromFile(path, sr.Store); err != nil {
+		return fmt.Errorf("error cataloging backup file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// spoolHeldBlocks appends the needed blocks to the spool from the files of the store's backups
+// hashed with algorithm, starting at offset. Backups whose files can't be read, e.g. because
+// they're filtered or remote, are skipped.
+func (sr StoreRemote) spoolHeldBlocks(algorithm HashAlgorithm, needed map[string]bool, spool *os.File, spooled map[string]spooledBlock, offset int64) error {
+	if len(needed) == 0 {
+		return nil
+	}
+
+	backups, err := sr.Store.ListBackups()
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		if len(needed) == 0 {
+			break
+		}
+
+		if backup.Status != backupStatusCompleted || backup.Chunking == ChunkingContentDefined || backup.HashAlgorithm != algorithm ||
+			backup.OutputFormat != string(BackupOutputFormatFile) || backup.RemoteKey != "" {
+			continue
+		}
+
+		r := &Restore{store: sr.Store, backup: backup}
+		_ = r.readStoredBlocks(backup, func(hash string, data []byte) error {
+			if !needed[hash] {
+				return nil
+			}
+
+			if _, err := spool.WriteAt(data, offset); err != nil {
+				return err
+			}
+			spooled[hash] = spooledBlock{offset: offset, length: len(data)}
+			offset += int64(len(data))
+			delete(needed, hash)
+
+			return nil
+		})
+	}
+
+	for hash := range needed {
+		return fmt.Errorf("block %s is held by the store but couldn't be read from its backup files", hash)
+	}
+
+	return nil
+}
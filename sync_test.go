@@ -0,0 +1,206 @@
+package block
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// mockRemote holds a fixed set of blocks and records what it's sent.
+type mockRemote struct {
+	held     map[string]bool
+	manifest SyncManifest
+	received int64
+}
+
+func (m *mockRemote) MissingBlocks(algorithm HashAlgorithm, hashes []string) ([]string, error) {
+	var missing []string
+	for _, hash := range hashes {
+		if !m.held[hash] {
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+func (m *mockRemote) Receive(manifest SyncManifest, blocks io.Reader) error {
+	m.manifest = manifest
+	n, err := io.Copy(io.Discard, blocks)
+	m.received = n
+	return err
+}
+
+func TestSyncSendsMissingBlocks(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	b, err := NewBackup(&BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := b.Signature()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote already holds the blocks of the first 20 positions.
+	remote := &mockRemote{held: map[string]bool{}}
+	for _, sig := range signature[:20] {
+		remote.held[sig.Strong] = true
+	}
+
+	result, err := store.Sync(b.Record.ID, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	seen := map[string]bool{}
+	for _, sig := range signature {
+		if !seen[sig.Strong] && !remote.held[sig.Strong] {
+			expected = append(expected, sig.Strong)
+		}
+		seen[sig.Strong] = true
+	}
+
+	if len(remote.manifest.Sent) != len(expected) || result.BlocksSent != len(expected) {
+		t.Fatalf("expected %d blocks to be sent, got %d", len(expected), len(remote.manifest.Sent))
+	}
+
+	var bytesSent int64
+	for _, block := range remote.manifest.Sent {
+		if remote.held[block.Hash] {
+			t.Fatalf("expected block %s held by the remote not to be sent", block.Hash)
+		}
+		bytesSent += int64(block.Length)
+	}
+
+	if remote.received != bytesSent || result.BytesSent != bytesSent {
+		t.Fatalf("expected %d bytes to be streamed, got %d", bytesSent, remote.received)
+	}
+
+	if result.BlocksHeld != len(seen)-len(expected) {
+		t.Fatalf("expected %d blocks to be held by the remote, got %d", len(seen)-len(expected), result.BlocksHeld)
+	}
+
+	if len(remote.manifest.Hashes) != 50 {
+		t.Fatalf("expected the manifest to describe 50 positions, got %d", len(remote.manifest.Hashes))
+	}
+}
+
+func TestSyncToStore(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 10,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteDir := t.TempDir()
+	remoteStore, err := OpenStore(filepath.Join(remoteDir, "remote.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteStore.Close()
+
+	if err := remoteStore.SetupDB(); err != nil {
+		t.Fatal(err)
+	}
+	remote := StoreRemote{Store: remoteStore, OutputDirectory: remoteDir}
+
+	result, err := store.Sync(fb.Record.ID, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.BlocksSent != 37 || result.BlocksHeld != 0 {
+		t.Fatalf("expected every one of the 37 blocks to be sent to an empty remote, got %+v", result)
+	}
+
+	// Only the block changed by the differential is sent once the remote holds the full.
+	result, err = store.Sync(db.Record.ID, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.BlocksSent != 1 || result.BytesSent != int64(cfg.BlockSize) {
+		t.Fatalf("expected only the changed block to be sent, got %+v", result)
+	}
+
+	backups, err := remoteStore.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backups) != 2 {
+		t.Fatalf("expected the remote to catalog 2 backups, got %d", len(backups))
+	}
+
+	for i, checksum := range []string{fullBackupChecksum, diffWithChangesChecksum} {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              remoteStore,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     backups[i].ID,
+			OutputDirectory:    remoteDir,
+			OutputFileName:     backups[i].FileName + ".restored",
+			Validate:           true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		compareChecksum(t, restore.FullRestorePath(), checksum)
+	}
+}
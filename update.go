@@ -0,0 +1,149 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// BlocksUpdated returns the number of blocks an OnlyDiff restore wrote to its target.
+// It must be called after Run.
+func (r *Restore) BlocksUpdated() int {
+	return r.blocksUpdated
+}
+
+// runOnlyDiff updates the existing OnlyDiff image in place, writing only the positions whose
+// contents differ from the backup.
+func (r *Restore) runOnlyDiff() error {
+	path := r.config.OnlyDiff
+	target, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error opening restore target: %v", err)
+	}
+	defer func() { _ = target.Close() }()
+
+	differing, err := r.differingPositions(target)
+	if err != nil {
+		return err
+	}
+
+	if err := r.updateDifferingBlocks(target, differing); err != nil {
+		return err
+	}
+
+	// Drop anything the target held past the end of the backup.
+	info, err := target.Stat()
+	if err != nil {
+		return fmt.Errorf("error inspecting restore target: %v", err)
+	}
+
+	if info.Size() != int64(r.backup.SizeInBytes) {
+		if err := target.Truncate(int64(r.backup.SizeInBytes)); err != nil {
+			return fmt.Errorf("error resizing restore target: %v", err)
+		}
+	}
+
+	if err := target.Sync(); err != nil {
+		return fmt.Errorf("error syncing restore target: %v", err)
+	}
+
+	if err := target.Close(); err != nil {
+		return fmt.Errorf("error closing restore target: %v", err)
+	}
+
+	if r.config.Validate {
+		if err := r.validateFile(path); err != nil {
+			return err
+		}
+	}
+
+	if r.config.CompareTo != "" {
+		return r.compareFile(path)
+	}
+
+	return nil
+}
+
+// differingPositions reads the target block by block, returning the positions whose contents
+// don't match the backup, keyed by the hash of the block they should hold.
+func (r *Restore) differingPositions(target io.ReaderAt) (map[string][]int, error) {
+	hashes, err := r.store.positionHashes(r.backup)
+	if err != nil {
+		return nil, err
+	}
+
+	differing := map[string][]int{}
+	buf := make([]byte, r.backup.BlockSize)
+	for pos, hash := range hashes {
+		offset := int64(pos) * int64(r.backup.BlockSize)
+		length := int(min(int64(r.backup.BlockSize), int64(r.backup.SizeInBytes)-offset))
+
+		n, err := target.ReadAt(buf[:length], offset)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading restore target at offset %d: %v", offset, err)
+		}
+
+		if n == length && blockMatchesHash(buf[:length], hash, r.backup.HashAlgorithm) {
+			continue
+		}
+		differing[hash] = append(differing[hash], pos)
+	}
+
+	return differing, nil
+}
+
+// updateDifferingBlocks writes the block each differing position should hold, reading the blocks
+// from the files of the backup's restore chain.
+func (r *Restore) updateDifferingBlocks(target io.WriterAt, differing map[string][]int) error {
+	write := func(data []byte, positions []int) error {
+		for _, pos := range positions {
+			if _, err := target.WriteAt(data, int64(pos)*int64(r.backup.BlockSize)); err != nil {
+				return fmt.Errorf("error writing to restore target: %v", err)
+			}
+			r.blocksUpdated++
+		}
+		return nil
+	}
+
+	// Constant blocks are reconstructed from their descriptor.
+	for hash, positions := range differing {
+		if !isFillBlock(hash) {
+			continue
+		}
+
+		data, ok := parseFillDescriptor(hash)
+		if !ok {
+			return fmt.Errorf("invalid fill block descriptor %q", hash)
+		}
+
+		if err := write(data, positions); err != nil {
+			return err
+		}
+		delete(differing, hash)
+	}
+
+	for _, layer := range r.chain {
+		if len(differing) == 0 {
+			break
+		}
+
+		err := r.readStoredBlocks(layer, func(hash string, data []byte) error {
+			positions, ok := differing[hash]
+			if !ok {
+				return nil
+			}
+			delete(differing, hash)
+
+			return write(data, positions)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for hash := range differing {
+		return fmt.Errorf("block %s is not stored in the files of backup %d's chain", hash, r.backup.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package block
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreOnlyDiff(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	cfg := &BackupConfig{
+		Store:           store,
+		DevicePath:      "assets/pg.ext4",
+		OutputFormat:    BackupOutputFormatFile,
+		OutputDirectory: "backups/",
+		BlockSize:       1048576,
+		BlockBufferSize: 5,
+	}
+
+	fb, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fb.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBackup(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hack the device path to simulate a change
+	db.vol.DevicePath = "assets/pg_altered.ext4"
+
+	if err := db.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The altered image differs from the original in a single block.
+	source, err := os.ReadFile("assets/pg.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetPath := filepath.Join(t.TempDir(), "staging.img")
+	if err := os.WriteFile(targetPath, source, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(backupID int) int {
+		restore, err := NewRestore(RestoreConfig{
+			Store:              store,
+			RestoreInputFormat: RestoreInputFormatFile,
+			SourceBackupID:     backupID,
+			OnlyDiff:           targetPath,
+			Validate:           true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restore.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		return restore.BlocksUpdated()
+	}
+
+	if updated := update(db.Record.ID); updated != 1 {
+		t.Fatalf("expected 1 block to be updated, got %d", updated)
+	}
+	compareChecksum(t, targetPath, diffWithChangesChecksum)
+
+	// An up to date target is left alone.
+	if updated := update(db.Record.ID); updated != 0 {
+		t.Fatalf("expected no blocks to be updated, got %d", updated)
+	}
+
+	// Rolling back to the full rewrites the block again, and drops anything past its end.
+	f, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("trailing")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if updated := update(fb.Record.ID); updated != 1 {
+		t.Fatalf("expected 1 block to be updated, got %d", updated)
+	}
+	compareChecksum(t, targetPath, fullBackupChecksum)
+
+	if _, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OnlyDiff:           filepath.Join(t.TempDir(), "missing.img"),
+	}); err == nil {
+		t.Fatal("expected a missing restore target to be rejected")
+	}
+}
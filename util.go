@@ -1,7 +1,11 @@
 package block
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strconv"
@@ -20,18 +24,105 @@ func GetTargetSizeInBytes(devicePath string) (int, error) {
 	if mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0 {
 		totalSizeInBytes, err = getBlockDeviceSize(devicePath)
 		if err != nil {
-			return 0, fmt.Errorf("error getting block device size: %v", err)
+			return 0, fmt.Errorf("error getting block device size: %w", err)
 		}
 	}
 	return int(totalSizeInBytes), nil
 }
 
+// resolveOutputPath applies the existing file policy to path and returns the path that should be written to.
+func resolveOutputPath(path string, policy ExistingFilePolicy) (string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, nil
+	}
+
+	switch policy {
+	case ExistingFileFail, "":
+		return "", fmt.Errorf("output file %s already exists", path)
+	case ExistingFileOverwrite:
+		return path, nil
+	case ExistingFileRename:
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s.%d", path, i)
+			if _, err := os.Stat(candidate); os.IsNotExist(err) {
+				return candidate, nil
+			}
+		}
+	default:
+		return "", fmt.Errorf("existing file policy %q is not supported", policy)
+	}
+}
+
+// openOutputFile opens path for writing. Files are truncated when overwriting, otherwise
+// the file must not already exist.
+func openOutputFile(path string, policy ExistingFilePolicy) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	if policy == ExistingFileOverwrite {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+
+	return os.OpenFile(path, flags, 0644)
+}
+
+// fileSHA256 returns the hex encoded sha256 checksum of the file at path.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// ErrNotBlockDevice is returned when a device path can't be sized as a block device.
+var ErrNotBlockDevice = errors.New("not a block device")
+
+// blockdevCommand is the command used to size block devices.
+var blockdevCommand = "blockdev"
+
+// getBlockDeviceSize returns the size of the block device at devicePath using the BLKGETSIZE64
+// ioctl, falling back to blockdev where the ioctl isn't available (e.g. on other platforms).
+// blockdev's output also describes why a device can't be sized.
 func getBlockDeviceSize(devicePath string) (int64, error) {
-	cmd := exec.Command("blockdev", "--getsize64", devicePath)
+	if size, err := ioctlBlockDeviceSize(devicePath); err == nil {
+		return size, nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(blockdevCommand, "--getsize64", devicePath)
+	cmd.Stderr = &stderr
+
 	result, err := cmd.Output()
 	if err != nil {
-		return 0, err
+		return 0, blockdevError(devicePath, err, strings.TrimSpace(stderr.String()))
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(result)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output from %s for %s: %q", blockdevCommand, devicePath, result)
 	}
 
-	return strconv.ParseInt(strings.TrimSpace(string(result)), 10, 64)
+	return size, nil
+}
+
+// blockdevError describes why blockdev failed to size devicePath using the message it wrote to stderr.
+func blockdevError(devicePath string, err error, stderr string) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return fmt.Errorf("unable to size %s, %s is not installed: %w", devicePath, blockdevCommand, err)
+	case strings.Contains(stderr, "Permission denied"):
+		return fmt.Errorf("permission denied sizing %s, try running as root (%s): %w", devicePath, stderr, os.ErrPermission)
+	case strings.Contains(stderr, "Inappropriate ioctl"), strings.Contains(stderr, "No such device"):
+		return fmt.Errorf("%s is %w (%s)", devicePath, ErrNotBlockDevice, stderr)
+	case stderr != "":
+		return fmt.Errorf("%s failed to size %s: %s: %w", blockdevCommand, devicePath, stderr, err)
+	default:
+		return fmt.Errorf("%s failed to size %s: %w", blockdevCommand, devicePath, err)
+	}
 }
@@ -0,0 +1,64 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeBlockdev replaces blockdev with a script that writes stderr and fails.
+func fakeBlockdev(t *testing.T, stderr string) {
+	t.Helper()
+
+	script := filepath.Join(t.TempDir(), "blockdev")
+	contents := "#!/bin/sh\necho '" + stderr + "' >&2\nexit 1\n"
+	if err := os.WriteFile(script, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	original := blockdevCommand
+	blockdevCommand = script
+	t.Cleanup(func() { blockdevCommand = original })
+}
+
+func TestBlockDeviceSizeErrors(t *testing.T) {
+	t.Run("not a block device", func(t *testing.T) {
+		if _, err := exec.LookPath(blockdevCommand); err != nil {
+			t.Skip("blockdev is not installed")
+		}
+
+		_, err := getBlockDeviceSize("assets/tiny.ext4")
+		if !errors.Is(err, ErrNotBlockDevice) {
+			t.Fatalf("expected not a block device error, got %v", err)
+		}
+
+		if !strings.Contains(err.Error(), "assets/tiny.ext4") || !strings.Contains(err.Error(), "Inappropriate ioctl") {
+			t.Errorf("expected error to name the path and include blockdev's message, got %v", err)
+		}
+	})
+
+	t.Run("permission denied", func(t *testing.T) {
+		fakeBlockdev(t, "blockdev: cannot open /dev/sdz: Permission denied")
+
+		_, err := getBlockDeviceSize("/dev/sdz")
+		if !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("expected permission error, got %v", err)
+		}
+
+		if errors.Is(err, ErrNotBlockDevice) {
+			t.Errorf("expected permission error not to be reported as not a block device")
+		}
+	})
+
+	t.Run("other failures include stderr", func(t *testing.T) {
+		fakeBlockdev(t, "blockdev: cannot open /dev/sdz: No such file or directory")
+
+		_, err := getBlockDeviceSize("/dev/sdz")
+		if err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+			t.Fatalf("expected error to include blockdev's message, got %v", err)
+		}
+	})
+}
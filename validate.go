@@ -0,0 +1,127 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ValidationError is returned when restored blocks don't match the hashes recorded for their positions.
+type ValidationError struct {
+	// Positions holds every position whose restored contents didn't match.
+	Positions []int
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("restore validation failed: %d position(s) do not match their recorded hash, first mismatch at position %d", len(e.Positions), e.Positions[0])
+}
+
+// Validate reads back the restored output and confirms that every position matches the
+// hash recorded for that position's block.
+func (r *Restore) Validate() error {
+	if r.config.MaxOutputFileSize > 0 {
+		return r.validateParts(r.FullRestorePath())
+	}
+
+	return r.validateFile(r.FullRestorePath())
+}
+
+func (r *Restore) validateFile(path string) error {
+	output, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening restored file: %v", err)
+	}
+	defer func() { _ = output.Close() }()
+
+	return r.validateOutput(output)
+}
+
+// validateParts validates the parts of a multi-part restore as a single output.
+func (r *Restore) validateParts(path string) error {
+	parts := newPartFiles(path, r.config.MaxOutputFileSize, os.Open)
+	defer func() { _ = parts.Close() }()
+
+	return r.validateOutput(parts)
+}
+
+func (r *Restore) validateOutput(output io.ReaderAt) error {
+	extents, err := r.store.restoredExtents(r.backup)
+	if err != nil {
+		return err
+	}
+
+	var mismatched []int
+	for _, extent := range extents {
+		if r.beyondLimit(extent.position) {
+			continue
+		}
+
+		buf := make([]byte, extent.length)
+		n, err := output.ReadAt(buf, extent.offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading restored block at position %d: %w", extent.position, err)
+		}
+
+		if !blockMatchesHash(buf[:n], extent.hash, r.backup.HashAlgorithm) {
+			mismatched = append(mismatched, extent.position)
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return &ValidationError{Positions: mismatched}
+	}
+
+	return nil
+}
+
+// blockExtent describes where a block lives within the restored output.
+type blockExtent struct {
+	position int
+	offset   int64
+	length   int
+	hash     string
+}
+
+// restoredExtents returns the extents that make up the restored output of the backup.
+func (s Store) restoredExtents(backup BackupRecord) ([]blockExtent, error) {
+	if backup.Chunking == ChunkingContentDefined {
+		rows, err := s.Query("SELECT bp.position, bp.offset, bp.length, b.hash FROM block_positions bp JOIN blocks b ON bp.block_id = b.id WHERE bp.backup_id = ? ORDER BY bp.position ASC", backup.ID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var extents []blockExtent
+		for rows.Next() {
+			var extent blockExtent
+			if err := rows.Scan(&extent.position, &extent.offset, &extent.length, &extent.hash); err != nil {
+				return nil, err
+			}
+			extents = append(extents, extent)
+		}
+
+		return extents, rows.Err()
+	}
+
+	hashes, err := s.resolveBackupHashes(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	extents := make([]blockExtent, 0, len(hashes))
+	for pos := 0; pos < backup.TotalBlocks; pos++ {
+		hash, ok := hashes[pos]
+		if !ok {
+			continue
+		}
+
+		extents = append(extents, blockExtent{
+			position: pos,
+			offset:   int64(pos * backup.BlockSize),
+			length:   backup.BlockSize,
+			hash:     hash,
+		})
+	}
+
+	return extents, nil
+}
@@ -0,0 +1,114 @@
+package block
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The ext2/3/4 superblock starts 1024 bytes into the filesystem, with its magic number at 0x38
+// and the filesystem UUID at 0x68.
+const (
+	ext4SuperblockOffset = 1024
+	ext4MagicOffset      = 0x38
+	ext4UUIDOffset       = 0x68
+	ext4Magic            = 0xEF53
+)
+
+// filesystemUUID returns the UUID of the ext2/3/4 filesystem on the source, or an empty string if
+// the source doesn't hold one.
+func filesystemUUID(source io.ReaderAt) (string, error) {
+	superblock := make([]byte, ext4UUIDOffset+16)
+	n, err := source.ReadAt(superblock, ext4SuperblockOffset)
+	if n < len(superblock) {
+		if err == nil || err == io.EOF {
+			return "", nil
+		}
+		return "", fmt.Errorf("error reading superblock: %w", err)
+	}
+
+	if binary.LittleEndian.Uint16(superblock[ext4MagicOffset:]) != ext4Magic {
+		return "", nil
+	}
+
+	uuid := superblock[ext4UUIDOffset:]
+	if bytes.Equal(uuid, make([]byte, len(uuid))) {
+		return "", nil
+	}
+
+	encoded := hex.EncodeToString(uuid)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", encoded[:8], encoded[8:12], encoded[12:16], encoded[16:20], encoded[20:]), nil
+}
+
+// sourceUUID returns the filesystem UUID of the backup's source when IdentifyByUUID is set, or an
+// empty string if it isn't set or the source holds no filesystem UUID.
+func sourceUUID(cfg *BackupConfig) (string, error) {
+	if !cfg.IdentifyByUUID {
+		return "", nil
+	}
+
+	if cfg.Source != nil {
+		return filesystemUUID(cfg.Source)
+	}
+
+	f, err := os.Open(cfg.DevicePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	return filesystemUUID(f)
+}
+
+// resolveVolumeByUUID returns the volume identified by the filesystem UUID, regardless of the
+// device path it's reached through. A filesystem backed up for the first time joins the volume
+// named after its device path, unless that volume belongs to another filesystem, in which case
+// it starts a volume of its own.
+func resolveVolumeByUUID(store *Store, devicePath, uuid string) (*Volume, error) {
+	vol, err := store.findVolumeByUUID(uuid)
+	switch {
+	case err == nil:
+		// The volume is read through the path it was reached by this time.
+		if vol.DevicePath != devicePath {
+			if err := store.UpdateVolumeDevicePath(vol.ID, devicePath); err != nil {
+				return nil, err
+			}
+			vol.DevicePath = devicePath
+		}
+		return &vol, nil
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	named, err := resolveVolume(store, devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if named.UUID != "" {
+		// The device path now holds a different filesystem, such as after a reformat.
+		named, err = resolveVolume(store, fmt.Sprintf("%s-%s", volumeName(devicePath), uuid[:8]))
+		if err != nil {
+			return nil, err
+		}
+		if named.UUID != "" {
+			return nil, fmt.Errorf("volume %s already belongs to the filesystem %s", named.Name, named.UUID)
+		}
+
+		if err := store.UpdateVolumeDevicePath(named.ID, devicePath); err != nil {
+			return nil, err
+		}
+		named.DevicePath = devicePath
+	}
+
+	if err := store.setVolumeUUID(named.ID, uuid); err != nil {
+		return nil, fmt.Errorf("error recording the UUID of volume %s: %w", named.Name, err)
+	}
+	named.UUID = uuid
+
+	return named, nil
+}
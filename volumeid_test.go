@@ -0,0 +1,103 @@
+package block
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyAsset copies the asset to path.
+func copyAsset(t *testing.T, asset, path string) {
+	data, err := os.ReadFile(asset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdentifyVolumeByUUID(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	setup(store)
+	defer cleanup(t)
+
+	// The altered image holds the same filesystem as the original, reached through another path.
+	dir := t.TempDir()
+	firstPath := filepath.Join(dir, "by-uuid-disk")
+	secondPath := filepath.Join(dir, "sdb")
+	copyAsset(t, "assets/pg.ext4", firstPath)
+	copyAsset(t, "assets/pg_altered.ext4", secondPath)
+
+	backup := func(devicePath string) *Backup {
+		b, err := NewBackup(&BackupConfig{
+			Store:           store,
+			DevicePath:      devicePath,
+			OutputFormat:    BackupOutputFormatFile,
+			OutputDirectory: "backups/",
+			BlockSize:       1048576,
+			BlockBufferSize: 5,
+			IdentifyByUUID:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		return b
+	}
+
+	fb := backup(firstPath)
+	if fb.vol.UUID != "2dd0737d-6f3c-4728-8229-dce03fef5935" {
+		t.Fatalf("expected the volume to be identified by the filesystem UUID, got %q", fb.vol.UUID)
+	}
+
+	db := backup(secondPath)
+	if db.vol.ID != fb.vol.ID || db.BackupType() != backupTypeDifferential {
+		t.Fatalf("expected a differential of volume %d, got a %s of volume %d", fb.vol.ID, db.BackupType(), db.vol.ID)
+	}
+
+	restore, err := NewRestore(RestoreConfig{
+		Store:              store,
+		RestoreInputFormat: RestoreInputFormatFile,
+		SourceBackupID:     db.Record.ID,
+		OutputDirectory:    "restores/",
+		OutputFileName:     "sdb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore.Run(); err != nil {
+		t.Fatal(err)
+	}
+	compareChecksum(t, restore.FullRestorePath(), diffWithChangesChecksum)
+
+	// Another filesystem at the first path starts a volume of its own.
+	copyAsset(t, "assets/tiny.ext4", firstPath)
+	reformatted := backup(firstPath)
+	if reformatted.vol.ID == fb.vol.ID || reformatted.vol.Name != "by-uuid-disk-9905d1c3" || reformatted.BackupType() != backupTypeFull {
+		t.Fatalf("expected a full of a new volume, got a %s of volume %s", reformatted.BackupType(), reformatted.vol.Name)
+	}
+
+	// Sources without a filesystem fall back to the basename.
+	rawPath := filepath.Join(dir, "raw.img")
+	if err := os.WriteFile(rawPath, bytes.Repeat([]byte{0xab}, 1048576), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := backup(rawPath)
+	if raw.vol.Name != "raw.img" || raw.vol.UUID != "" {
+		t.Fatalf("expected the raw source to be identified by name, got %s with UUID %q", raw.vol.Name, raw.vol.UUID)
+	}
+}